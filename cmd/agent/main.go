@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/luckyseadog/go-dev/internal/agent"
 	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/spool"
 )
 
 var (
@@ -40,6 +42,17 @@ func main() {
 	var configFlag string
 	var cFlag string
 	var gRPCFlag string
+	var agentIDFlag string       // agentIDFlag is the identifier of the agent, the host name by default.
+	var labelsFlag string        // labelsFlag holds the labels attached to every metric as "name1=value1,name2=value2".
+	var spoolDirFlag string      // spoolDirFlag is the directory of the spool of unsent batches, empty means no spool.
+	var spoolMaxSizeFlag string  // spoolMaxSizeFlag is the maximum size of the spool in bytes.
+	var spoolMaxAgeFlag string   // spoolMaxAgeFlag is the maximum age of the oldest batch of the spool.
+	var retryAttemptsFlag string // retryAttemptsFlag is the maximum number of attempts to send a report.
+	var retryBackoffFlag string  // retryBackoffFlag is the delay before the first retry.
+	var retryMaxDelayFlag string // retryMaxDelayFlag is the maximum delay between retries.
+	var retryJitterFlag string   // retryJitterFlag is the fraction of the delay it is randomly changed by.
+	var collectorsFlag string    // collectorsFlag holds the names of the enabled collectors as "name1,name2".
+	var pushAddressFlag string   // pushAddressFlag is the local address the applications push metrics to.
 
 	// Parse command-line flags and set corresponding variables.
 	flag.StringVar(&addressFlag, "a", "127.0.0.1:8080", "address of server")
@@ -52,6 +65,17 @@ func main() {
 	flag.StringVar(&configFlag, "config", "", "path to config")
 	flag.StringVar(&cFlag, "c", "", "path to config")
 	flag.StringVar(&gRPCFlag, "grpc", "false", "whether to use gRPC")
+	flag.StringVar(&agentIDFlag, "id", "", "identifier of the agent, host name by default")
+	flag.StringVar(&labelsFlag, "labels", "", "labels of metrics as name1=value1,name2=value2")
+	flag.StringVar(&spoolDirFlag, "spool", "", "directory to keep unsent metrics in")
+	flag.StringVar(&spoolMaxSizeFlag, "spool-max-size", "", "maximum size of unsent metrics in bytes (64MB by default)")
+	flag.StringVar(&spoolMaxAgeFlag, "spool-max-age", "", "maximum age of unsent metrics (24h by default)")
+	flag.StringVar(&retryAttemptsFlag, "retry-attempts", "", "maximum number of attempts to send metrics (3 by default)")
+	flag.StringVar(&retryBackoffFlag, "retry-backoff", "", "delay before the first retry (1s by default)")
+	flag.StringVar(&retryMaxDelayFlag, "retry-max-backoff", "", "maximum delay between retries (5s by default)")
+	flag.StringVar(&retryJitterFlag, "retry-jitter", "", "fraction of the retry delay it is randomly changed by (0.2 by default)")
+	flag.StringVar(&collectorsFlag, "collectors", "", "enabled collectors as name1,name2 (runtime,memory,cpu by default)")
+	flag.StringVar(&pushAddressFlag, "push", "", "local address to accept metrics of applications on, e.g. 127.0.0.1:9091 or unix:/run/agent.sock")
 
 	// Parse the command-line flags.
 	flag.Parse()
@@ -101,6 +125,39 @@ func main() {
 	if gRPCFlag == "" {
 		gRPCFlag = Config.GRPC
 	}
+	if agentIDFlag == "" {
+		agentIDFlag = Config.AgentID
+	}
+	if labelsFlag == "" {
+		labelsFlag = Config.Labels
+	}
+	if spoolDirFlag == "" {
+		spoolDirFlag = Config.SpoolDir
+	}
+	if spoolMaxSizeFlag == "" {
+		spoolMaxSizeFlag = Config.SpoolMaxSize
+	}
+	if spoolMaxAgeFlag == "" {
+		spoolMaxAgeFlag = Config.SpoolMaxAge
+	}
+	if retryAttemptsFlag == "" {
+		retryAttemptsFlag = Config.RetryAttempts
+	}
+	if retryBackoffFlag == "" {
+		retryBackoffFlag = Config.RetryBackoff
+	}
+	if retryMaxDelayFlag == "" {
+		retryMaxDelayFlag = Config.RetryMaxDelay
+	}
+	if retryJitterFlag == "" {
+		retryJitterFlag = Config.RetryJitter
+	}
+	if collectorsFlag == "" {
+		collectorsFlag = Config.Collectors
+	}
+	if pushAddressFlag == "" {
+		pushAddressFlag = Config.PushAddress
+	}
 
 	// Initialize logging if the "logging" flag is set.
 	if logging {
@@ -208,13 +265,180 @@ func main() {
 		}
 	}
 
+	// Retrieve the identifier of the agent.
+	// If "AGENT_ID" environment variable is set, use its value.
+	// Otherwise, use the value provided by the command-line flag "-id" or the host name.
+	agentID := os.Getenv("AGENT_ID")
+	if agentID == "" {
+		agentID = agentIDFlag
+	}
+	if agentID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			agent.MyLog.Fatal(err)
+		}
+		agentID = hostname
+	}
+
+	// Retrieve the labels attached to every metric.
+	// If "LABELS" environment variable is set, use its value.
+	// Otherwise, use the value provided by the command-line flag "-labels".
+	labelsStr := os.Getenv("LABELS")
+	if labelsStr == "" {
+		labelsStr = labelsFlag
+	}
+	labels, err := metrics.ParseLabels(labelsStr)
+	if err != nil {
+		agent.MyLog.Fatal(err)
+	}
+
+	// Open the spool of unsent batches.
+	// If "SPOOL_DIR", "SPOOL_MAX_SIZE" and "SPOOL_MAX_AGE" environment variables are set, use their values.
+	// Otherwise, use the values provided by the command-line flags "-spool", "-spool-max-size" and "-spool-max-age".
+	var sp *spool.Spool
+	spoolDir := os.Getenv("SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = spoolDirFlag
+	}
+	if spoolDir != "" {
+		spoolMaxSizeStr := os.Getenv("SPOOL_MAX_SIZE")
+		if spoolMaxSizeStr == "" {
+			spoolMaxSizeStr = spoolMaxSizeFlag
+		}
+		spoolMaxSize := int64(64 << 20)
+		if spoolMaxSizeStr != "" {
+			spoolMaxSize, err = strconv.ParseInt(spoolMaxSizeStr, 10, 64)
+			if err != nil || spoolMaxSize < 0 {
+				agent.MyLog.Fatal("Invalid spool max size")
+			}
+		}
+
+		spoolMaxAgeStr := os.Getenv("SPOOL_MAX_AGE")
+		if spoolMaxAgeStr == "" {
+			spoolMaxAgeStr = spoolMaxAgeFlag
+		}
+		spoolMaxAge := 24 * time.Hour
+		if spoolMaxAgeStr != "" {
+			spoolMaxAge, err = time.ParseDuration(spoolMaxAgeStr)
+			if err != nil || spoolMaxAge < 0 {
+				agent.MyLog.Fatal("Invalid spool max age")
+			}
+		}
+
+		sp, err = spool.Open(spoolDir, spoolMaxSize, spoolMaxAge)
+		if err != nil {
+			agent.MyLog.Fatal(err)
+		}
+		if n := sp.Len(); n > 0 {
+			agent.MyLog.Printf("spool: %d unsent batches are left from the previous run", n)
+		}
+	}
+
+	// Retrieve the policy of retrying failed reports.
+	// If "RETRY_MAX_ATTEMPTS", "RETRY_INITIAL_BACKOFF", "RETRY_MAX_BACKOFF" and "RETRY_JITTER" environment variables are set,
+	// use their values. Otherwise, use the values provided by the command-line flags "-retry-attempts", "-retry-backoff",
+	// "-retry-max-backoff" and "-retry-jitter".
+	retry := agent.DefaultRetryPolicy()
+	retryAttemptsStr := os.Getenv("RETRY_MAX_ATTEMPTS")
+	if retryAttemptsStr == "" {
+		retryAttemptsStr = retryAttemptsFlag
+	}
+	if retryAttemptsStr != "" {
+		retry.MaxAttempts, err = strconv.Atoi(retryAttemptsStr)
+		if err != nil {
+			agent.MyLog.Fatal("Invalid retry max attempts")
+		}
+	}
+	retryBackoffStr := os.Getenv("RETRY_INITIAL_BACKOFF")
+	if retryBackoffStr == "" {
+		retryBackoffStr = retryBackoffFlag
+	}
+	if retryBackoffStr != "" {
+		retry.InitialBackoff, err = time.ParseDuration(retryBackoffStr)
+		if err != nil {
+			agent.MyLog.Fatal("Invalid retry initial backoff")
+		}
+	}
+	retryMaxDelayStr := os.Getenv("RETRY_MAX_BACKOFF")
+	if retryMaxDelayStr == "" {
+		retryMaxDelayStr = retryMaxDelayFlag
+	}
+	if retryMaxDelayStr != "" {
+		retry.MaxBackoff, err = time.ParseDuration(retryMaxDelayStr)
+		if err != nil {
+			agent.MyLog.Fatal("Invalid retry max backoff")
+		}
+	}
+	retryJitterStr := os.Getenv("RETRY_JITTER")
+	if retryJitterStr == "" {
+		retryJitterStr = retryJitterFlag
+	}
+	if retryJitterStr != "" {
+		retry.Jitter, err = strconv.ParseFloat(retryJitterStr, 64)
+		if err != nil {
+			agent.MyLog.Fatal("Invalid retry jitter")
+		}
+	}
+	if err := retry.Validate(); err != nil {
+		agent.MyLog.Fatal(err)
+	}
+
+	// Create the enabled collectors.
+	// If "COLLECTORS" environment variable is set, use its value.
+	// Otherwise, use the value provided by the command-line flag "-collectors".
+	collectorsStr := os.Getenv("COLLECTORS")
+	if collectorsStr == "" {
+		collectorsStr = collectorsFlag
+	}
+	registry, err := agent.NewRegistry(agent.ParseCollectorNames(collectorsStr), Config.CollectorOptions)
+	if err != nil {
+		agent.MyLog.Fatal(err)
+	}
+
+	// Scrape the exporters in Prometheus format set in the config.
+	if len(Config.ScrapeTargets) > 0 {
+		scrapeCollector, err := agent.NewScrapeCollector(Config.ScrapeTargets)
+		if err != nil {
+			agent.MyLog.Fatal(err)
+		}
+		registry.Add("scrape", scrapeCollector)
+	}
+
+	// Start the listener for the metrics of local applications.
+	// If "PUSH_ADDRESS" environment variable is set, use its value.
+	// Otherwise, use the value provided by the command-line flag "-push".
+	pushAddress := os.Getenv("PUSH_ADDRESS")
+	if pushAddress == "" {
+		pushAddress = pushAddressFlag
+	}
+	if pushAddress != "" {
+		pushServer, err := agent.NewPushServer(pushAddress)
+		if err != nil {
+			agent.MyLog.Fatal(err)
+		}
+		registry.Add("push", pushServer)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := pushServer.Serve(ctx); err != nil {
+				agent.MyLog.Println(err)
+			}
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
 	if gRPC {
 		address := os.Getenv("ADDRESS")
 		if address == "" {
 			address = addressFlag
 		}
 
-		agt, err := agent.NewAgentGRPC(address, contentType, pollInterval, reportInterval, []byte(secretKeyStr), rateLimit, cryptoKeyDir)
+		agt, err := agent.NewAgentGRPC(address, contentType, pollInterval, reportInterval, []byte(secretKeyStr), rateLimit, cryptoKeyDir, agentID, labels, sp, retry, registry)
 		if err != nil {
 			agent.MyLog.Fatal(err)
 		}
@@ -242,7 +466,7 @@ func main() {
 		// It uses the specified content type for requests, pollInterval for metric collection,
 		// reportInterval for sending metrics, secretKey for digital signature,
 		// and rateLimit for controlling the number of concurrent requests.
-		agt, err := agent.NewAgent(address, contentType, pollInterval, reportInterval, []byte(secretKeyStr), rateLimit, cryptoKeyDir)
+		agt, err := agent.NewAgent(address, contentType, pollInterval, reportInterval, []byte(secretKeyStr), rateLimit, cryptoKeyDir, agentID, labels, sp, retry, registry)
 		if err != nil {
 			agent.MyLog.Fatal(err)
 		}
@@ -3,9 +3,9 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,10 +17,13 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	_ "github.com/jackc/pgx/v5/stdlib"
 
+	"github.com/luckyseadog/go-dev/internal/alerting"
 	"github.com/luckyseadog/go-dev/internal/handlers"
 	"github.com/luckyseadog/go-dev/internal/middlewares"
 	"github.com/luckyseadog/go-dev/internal/server"
+	"github.com/luckyseadog/go-dev/internal/statsd"
 	"github.com/luckyseadog/go-dev/internal/storage"
+	"github.com/luckyseadog/go-dev/internal/webhooks"
 	pb "github.com/luckyseadog/go-dev/protobuf"
 )
 
@@ -37,6 +40,13 @@ func init() {
 }
 
 func main() {
+	// The subcommand migrate applies or lists the migrations of SQLStorage instead of running the server.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		migrate()
+		return
+	}
+
 	// SetUp initializes environment variables for the application based on command-line flags and environment variables.
 	// It returns an EnvVariables struct with the configured values.
 	// If any configuration error occurs, it returns an error.
@@ -61,28 +71,43 @@ func main() {
 	// The initialization of Storage
 	var s storage.Storage
 
-	// If envVariables.DataSourceName is set, SQLStorage will be used, MyStorage otherwise.
+	// If envVariables.DataSourceName is set, SQLStorage will be used. Otherwise, if envVariables.WALDir is set,
+	// WALStorage will be used, MyStorage otherwise.
 	if envVariables.DataSourceName != "" {
-		// Open a database connection based on the provided data source name.
-		var err error
-		db, err := sql.Open("pgx", envVariables.DataSourceName)
+		// Create a new storage of type SQLStorage that will be used for storing metrics.
+		ss, err := openSQLStorage(envVariables.DataSourceName)
 		if err != nil {
 			server.MyLog.Fatal(err)
 		}
-		defer db.Close()
+		defer ss.DB.Close()
+		ss.SetRollupWindows(envVariables.RollupWindows)
+		s = ss
 
-		// Create a new storage of type SQLStorage that will be used for storing metrics.
-		s = storage.NewSQLStorage(db)
-
-		// Perform table creation for SQL storage, if applicable.
-		if ss, ok := s.(*storage.SQLStorage); ok {
-			err = ss.CreateTables()
-			if err != nil {
-				server.MyLog.Fatal(err)
-			}
-		} else {
-			server.MyLog.Fatal(storage.ErrNotSQLStorage)
+		// Bring the schema up to date, the replicas of the server wait for the one applying the migrations.
+		applied, err := ss.Migrate(context.Background())
+		if err != nil {
+			server.MyLog.Fatal(err)
+		}
+		for _, migration := range applied {
+			server.MyLog.Printf("applied migration %d %s", migration.Version, migration.Name)
 		}
+	} else if envVariables.WALDir != "" {
+		// Open the storage of type WALStorage, its data is recovered from the snapshot and the log of the directory.
+		// Closing it writes a snapshot, so the log is short on the next start.
+		ws, err := storage.OpenWALStorage(envVariables.WALDir, storage.WALOptions{
+			Fsync:            envVariables.WALFsync,
+			SnapshotInterval: envVariables.WALSnapshot,
+			RollupWindows:    envVariables.RollupWindows,
+		})
+		if err != nil {
+			server.MyLog.Fatal(err)
+		}
+		defer func() {
+			if err := ws.Close(); err != nil {
+				server.MyLog.Println(err)
+			}
+		}()
+		s = ws
 	} else {
 		// Create a new storage of type MyStorage that will be used for storing metrics.
 		// MyStorage uses chanel for storing metrics to file.
@@ -90,7 +115,9 @@ func main() {
 		cancel := make(chan struct{})
 		defer close(cancel)
 
-		s = storage.NewStorage(storageChan, envVariables.StoreInterval)
+		ms := storage.NewStorage(storageChan, envVariables.StoreInterval)
+		ms.SetRollupWindows(envVariables.RollupWindows)
+		s = ms
 
 		// Start a goroutine that saves metrics from MyStorage to file.
 		server.PassSignal(cancel, storageChan, envVariables, s)
@@ -110,11 +137,53 @@ func main() {
 		}
 	}
 
+	// If a file with alerting rules is set, start the engine that periodically evaluates them against the storage.
+	var alertingEngine *alerting.Engine
+	if envVariables.RulesFile != "" {
+		alerting.MyLog = server.MyLog
+		alertingEngine, err = alerting.NewEngine(s, envVariables.RulesFile, envVariables.RulesInterval)
+		if err != nil {
+			server.MyLog.Fatal(err)
+		}
+		ctx, cancelAlerting := context.WithCancel(context.Background())
+		defer cancelAlerting()
+		go alertingEngine.Run(ctx)
+	}
+
+	// Start the dispatcher that sends the stored values to webhook subscriptions.
+	webhooks.MyLog = server.MyLog
+	dispatcher := webhooks.NewDispatcher(webhooks.Config{BatchInterval: envVariables.WebhookBatch, AllowPrivate: envVariables.WebhookPrivate})
+	s.Subscribe(dispatcher)
+	ctxWebhooks, cancelWebhooks := context.WithCancel(context.Background())
+	defer cancelWebhooks()
+	go dispatcher.Run(ctxWebhooks)
+
+	// If the StatsD address is set, start the UDP listener. It is stopped with the final flush
+	// after the HTTP or gRPC server is shut down.
+	if envVariables.StatsdAddress != "" {
+		statsd.MyLog = server.MyLog
+		statsdServer := statsd.NewServer(envVariables.StatsdAddress, s, envVariables.StatsdFlush, envVariables.StatsdPercents)
+		err = statsdServer.Listen()
+		if err != nil {
+			server.MyLog.Fatal(err)
+		}
+		ctxStatsd, cancelStatsd := context.WithCancel(context.Background())
+		statsdDone := make(chan struct{})
+		go func() {
+			statsdServer.Serve(ctxStatsd)
+			close(statsdDone)
+		}()
+		defer func() {
+			cancelStatsd()
+			<-statsdDone
+		}()
+	}
+
 	// Create a new server instance with the provided address and router.
 	var srv server.ServerInterface
 	if envVariables.GRPC {
 		// srv := server.NewServerGRPC(envVariables.Address)
-		// pb.RegisterMetricsCollectServer(srv, &server.MetricsCollectServer{Storage: s})
+		// pb.RegisterMetricsCollectServer(srv, &server.MetricsCollectServer{Storage: s, Key: envVariables.SecretKey})
 
 		// if envVariables.CryptoKeyDir != "" {
 		// grpcServer := grpc.NewServer(
@@ -143,13 +212,23 @@ func main() {
 				Certificates: []tls.Certificate{serverTLSCert},
 			}
 
-			srv := server.NewServerGRPC(envVariables.Address, tlsConfig, middlewares.GzipInterceptor, middlewares.SubnetInterceptor(envVariables.TrustedSubnet))
-			pb.RegisterMetricsCollectServer(srv, &server.MetricsCollectServer{Storage: s})
+			srv := server.NewServerGRPC(envVariables.Address, tlsConfig, middlewares.GzipInterceptor, middlewares.SubnetInterceptor(envVariables.TrustedSubnet),
+				middlewares.SubnetStreamInterceptor(envVariables.TrustedSubnet))
+			pb.RegisterMetricsCollectServer(srv, &server.MetricsCollectServer{Storage: s, Key: envVariables.SecretKey})
+			pb.RegisterMetricsQueryServer(srv, server.NewMetricsQueryServer(s))
+			if alertingEngine != nil {
+				pb.RegisterAlertsServer(srv, &server.AlertsServer{Engine: alertingEngine})
+			}
 			// defer srv.Close()
 			srv.Run()
 		} else {
-			srv := server.NewServerGRPC(envVariables.Address, nil, middlewares.GzipInterceptor, middlewares.SubnetInterceptor(envVariables.TrustedSubnet))
-			pb.RegisterMetricsCollectServer(srv, &server.MetricsCollectServer{Storage: s})
+			srv := server.NewServerGRPC(envVariables.Address, nil, middlewares.GzipInterceptor, middlewares.SubnetInterceptor(envVariables.TrustedSubnet),
+				middlewares.SubnetStreamInterceptor(envVariables.TrustedSubnet))
+			pb.RegisterMetricsCollectServer(srv, &server.MetricsCollectServer{Storage: s, Key: envVariables.SecretKey})
+			pb.RegisterMetricsQueryServer(srv, server.NewMetricsQueryServer(s))
+			if alertingEngine != nil {
+				pb.RegisterAlertsServer(srv, &server.AlertsServer{Engine: alertingEngine})
+			}
 			// defer srv.Close()
 			srv.Run()
 		}
@@ -173,9 +252,51 @@ func main() {
 		r.Get("/value/{^+}/*", func(w http.ResponseWriter, r *http.Request) {
 			handlers.HandlerGet(w, r, s)
 		})
+		r.Get("/history/{^+}/*", func(w http.ResponseWriter, r *http.Request) {
+			handlers.HandlerHistory(w, r, s)
+		})
+		r.Get("/rate/{^+}/*", func(w http.ResponseWriter, r *http.Request) {
+			handlers.HandlerRate(w, r, s)
+		})
+		r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			handlers.HandlerMetrics(w, r, s)
+		})
 		r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
 			handlers.HandlerPing(w, r, s)
 		})
+		if alertingEngine != nil {
+			r.Get("/alerts", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerAlerts(w, r, alertingEngine)
+			})
+		}
+		r.Post("/api/v1/write", func(w http.ResponseWriter, r *http.Request) {
+			handlers.HandlerRemoteWrite(w, r, s, envVariables.SecretKey)
+		})
+		r.Route("/metadata", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerMetadata(w, r, s, envVariables.SecretKey)
+			})
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerMetadata(w, r, s, envVariables.SecretKey)
+			})
+			r.Delete("/{_}", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerMetadata(w, r, s, envVariables.SecretKey)
+			})
+		})
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerWebhooks(w, r, dispatcher)
+			})
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerWebhooks(w, r, dispatcher)
+			})
+			r.Delete("/{_}", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerWebhooks(w, r, dispatcher)
+			})
+			r.Get("/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+				handlers.HandlerDeadLetters(w, r, dispatcher)
+			})
+		})
 		r.Route("/value", func(r chi.Router) {
 			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
 				handlers.HandlerValueJSON(w, r, s, envVariables.SecretKey)
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/server"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// migrate runs the subcommand "server migrate [flags] [up|status]". The database is set as for the server:
+// by flag -d, the config or DATABASE_DSN. Action up applies the pending migrations and is the default one,
+// action status lists the migrations with the moments they were applied.
+func migrate() {
+	envVariables, err := server.SetUp()
+	if err != nil {
+		server.MyLog.Fatal(err)
+	}
+	if envVariables.DataSourceName == "" {
+		server.MyLog.Fatal("migrate: the database is not set")
+	}
+
+	ss, err := openSQLStorage(envVariables.DataSourceName)
+	if err != nil {
+		server.MyLog.Fatal(err)
+	}
+	defer ss.DB.Close()
+
+	switch action := flag.Arg(0); action {
+	case "", "up":
+		applied, err := ss.Migrate(context.Background())
+		for _, migration := range applied {
+			fmt.Fprintf(os.Stdout, "applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			server.MyLog.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(os.Stdout, "the schema is up to date")
+		}
+	case "status":
+		statuses, err := ss.MigrationStatus(context.Background())
+		if err != nil {
+			server.MyLog.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied != nil {
+				applied = status.Applied.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		w.Flush()
+	default:
+		server.MyLog.Fatalf("migrate: unknown action %q, expected up or status", action)
+	}
+}
+
+// openSQLStorage opens the database of the data source name and returns the storage on it.
+// A name with scheme sqlite:// is the path of a SQLite database file, PostgreSQL is used otherwise.
+// The SQLite driver is registered by sqlite.go.
+func openSQLStorage(dataSourceName string) (*storage.SQLStorage, error) {
+	if sqlitePath, ok := storage.SQLitePath(dataSourceName); ok {
+		db, err := sql.Open("sqlite", sqlitePath)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewSQLiteStorage(db), nil
+	}
+
+	db, err := sql.Open("pgx", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewSQLStorage(db), nil
+}
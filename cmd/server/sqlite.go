@@ -0,0 +1,6 @@
+// This file registers the pure-Go SQLite driver, so the server accepts data source names like sqlite:///path.
+package main
+
+import (
+	_ "modernc.org/sqlite"
+)
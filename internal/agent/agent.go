@@ -3,25 +3,33 @@
 package agent
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"runtime"
 	"sync"
 	"time"
 
-	"github.com/shirou/gopsutil/v3/mem"
-
 	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/spool"
 )
 
 // UPDATE defines the API endpoint for sending updates to the server.
 const UPDATE = "updates/"
 
+// METADATA defines the API endpoint for registering the metadata of the metrics of the agent.
+const METADATA = "metadata/"
+
+// IdempotencyKeyHeader is the header with the idempotency key of the batch sent to UPDATE.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // MyLog is the logger used for agent logs. It is initialized with log.Default() by default.
 var MyLog = log.Default()
 
@@ -29,13 +37,13 @@ type AgentInterface interface {
 	Run()
 	Stop()
 	PostStats(wg *sync.WaitGroup)
-	GetExtendedStats(wg *sync.WaitGroup)
 	GetStats(wg *sync.WaitGroup)
 }
 
 // InteractionRules holds configuration parameters for the agent's behavior.
 // It specifies the address of the server, content type for requests, poll and report intervals,
-// secret key for digital signature, and a rate limit channel.
+// secret key for digital signature, a rate limit channel, the identity of the agent
+// with the labels attached to every metric it sends and the policy of retrying failed reports.
 type InteractionRules struct {
 	address        string
 	contentType    string
@@ -43,24 +51,20 @@ type InteractionRules struct {
 	reportInterval time.Duration
 	secretKey      []byte
 	rateLimitChan  chan struct{}
-}
-
-// Metrics struct holds various metric data collected by the agent.
-type Metrics struct {
-	MemStats       runtime.MemStats      // Memory statistics collected from the runtime.
-	VirtualMemory  mem.VirtualMemoryStat // Virtual memory statistics.
-	CPUUtilization []metrics.Gauge       // Slice of CPU utilization.
-	PollCount      metrics.Counter       // Counter for tracking polling operations.
-	RandomValue    metrics.Gauge         // Gauge for tracking a random value.
+	agentID        string
+	labels         map[string]string
+	retry          RetryPolicy
 }
 
 // Agent struct represents the monitoring agent responsible for collecting and reporting metrics.
 type Agent struct {
-	client  *http.Client     // HTTP client responsible for sending metric updates.
-	metrics Metrics          // Metrics collected by the agent.
-	mu      sync.RWMutex     // Mutex for safe concurrent access to metrics.
-	cancel  chan struct{}    // Channel for signaling agent cancellation.
-	ruler   InteractionRules // Configuration rules for agent behavior.
+	client   *http.Client     // HTTP client responsible for sending metric updates.
+	registry *Registry        // Collectors of the agent and the metrics collected since the last report.
+	cancel   chan struct{}    // Channel for signaling agent cancellation.
+	ruler    InteractionRules // Configuration rules for agent behavior.
+	spool    *spool.Spool     // On-disk queue of unsent batches, nil if the agent does not keep them.
+
+	described bool // Whether the metadata of the collectors is registered, it is used only by PostStats.
 }
 
 // NewAgent creates and initializes a new instance of the Agent with the provided parameters.
@@ -74,10 +78,17 @@ type Agent struct {
 //   - reportInterval: The time interval for sending metrics to the server.
 //   - secretKey: The secret key used for digital signature.
 //   - rateLimit: The maximum number of concurrent requests the agent can handle.
+//   - cryptoKeyDir: The directory with certificates for TLS, empty string means plain HTTP.
+//   - agentID: The identifier of the agent the server keeps metrics of different agents apart by.
+//   - labels: The labels attached to every metric sent by the agent.
+//   - sp: The spool keeping the batches until they are sent, nil means the batches which failed to send are lost.
+//   - retry: The policy of retrying the reports failed with transient errors.
+//   - registry: The collectors polled by the agent.
 //
 // Returns:
 //   - A pointer to a newly created and initialized Agent instance.
-func NewAgent(address string, contentType string, pollInterval time.Duration, reportInterval time.Duration, secretKey []byte, rateLimit int, cryptoKeyDir string) (*Agent, error) {
+func NewAgent(address string, contentType string, pollInterval time.Duration, reportInterval time.Duration, secretKey []byte, rateLimit int, cryptoKeyDir string,
+	agentID string, labels map[string]string, sp *spool.Spool, retry RetryPolicy, registry *Registry) (*Agent, error) {
 	rateLimitChan := make(chan struct{}, rateLimit)
 	for i := 0; i < rateLimit; i++ {
 		rateLimitChan <- struct{}{}
@@ -89,6 +100,9 @@ func NewAgent(address string, contentType string, pollInterval time.Duration, re
 		reportInterval: reportInterval,
 		secretKey:      secretKey,
 		rateLimitChan:  rateLimitChan,
+		agentID:        agentID,
+		labels:         labels,
+		retry:          retry,
 	}
 	cancel := make(chan struct{})
 
@@ -121,5 +135,85 @@ func NewAgent(address string, contentType string, pollInterval time.Duration, re
 	} else {
 		client = &http.Client{}
 	}
-	return &Agent{client: client, ruler: interactionRules, cancel: cancel}, nil
+	return &Agent{client: client, registry: registry, ruler: interactionRules, cancel: cancel, spool: sp}, nil
+}
+
+// sign calculates and attaches a hash to each metric of the batch if the agent has a secret key.
+// The batches are signed right before sending, so the batches folded by the spool are signed correctly.
+func sign(batch []metrics.Metrics, secretKey []byte) {
+	if len(secretKey) == 0 {
+		return
+	}
+	for i, metric := range batch {
+		switch {
+		case metric.Value != nil:
+			batch[i].Hash = security.Hash(fmt.Sprintf("%s:gauge:%f", metric.Key(), *metric.Value), secretKey)
+		case metric.Delta != nil:
+			batch[i].Hash = security.Hash(fmt.Sprintf("%s:counter:%d", metric.Key(), *metric.Delta), secretKey)
+		case metric.Histogram != nil:
+			batch[i].Hash = security.Hash(fmt.Sprintf("%s:histogram:%s", metric.Key(), metric.Histogram.HashString()), secretKey)
+		}
+	}
+}
+
+// newBatchKey returns a random idempotency key for a batch.
+func newBatchKey() string {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		// The batch is sent without a key then, the server applies it as a batch of the older agents.
+		MyLog.Println(err)
+		return ""
+	}
+	return hex.EncodeToString(key)
+}
+
+// report sends the batch. If the agent has a spool, the batch is appended to it first and then
+// all the batches of the spool are sent in order, so the batches failed to send are kept until the server is back.
+// Every batch gets an idempotency key which is kept with it in the spool, so the server applies the batch once
+// however many times it is retried. A batch sent once is not folded into a newer batch by the spool, so its values
+// are never sent under another key.
+func report(sp *spool.Spool, batch []metrics.Metrics, send func(key string, batch []metrics.Metrics) error) error {
+	key := newBatchKey()
+	if sp == nil {
+		return send(key, batch)
+	}
+
+	err := sp.Append(key, batch)
+	if err != nil {
+		MyLog.Println("spool:", err)
+		return send(key, batch)
+	}
+	sent, err := sp.Replay(send)
+	if sent > 1 {
+		MyLog.Printf("spool: %d batches are sent", sent)
+	}
+
+	return err
+}
+
+// keep appends the batch to the spool on shutdown, so the metrics collected since the last report
+// are sent after the restart of the agent.
+func keep(sp *spool.Spool, batch []metrics.Metrics) {
+	if sp == nil {
+		return
+	}
+	err := sp.Append(newBatchKey(), batch)
+	if err != nil {
+		MyLog.Println("spool:", err)
+	}
+}
+
+// describe registers the metadata of the collectors by send and reports whether the registration is over.
+// A transient error is logged and the registration is tried again on the next report. A rejection, e.g. by a server
+// which does not know the metadata or has a metric declared with another type, is logged and not tried again.
+func describe(metadata []metrics.Metadata, send func(metadata []metrics.Metadata) error) bool {
+	if len(metadata) == 0 {
+		return true
+	}
+	err := send(metadata)
+	if err != nil {
+		MyLog.Println("metadata:", err)
+	}
+	return err == nil || errors.Is(err, spool.ErrRejected)
 }
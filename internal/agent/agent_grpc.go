@@ -1,30 +1,45 @@
 package agent
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"os"
 	"path"
-	"sync"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"github.com/luckyseadog/go-dev/internal/spool"
+
 	pb "github.com/luckyseadog/go-dev/protobuf"
 )
 
+// agentIDMetadata is the metadata key with which the agent identifies itself when it opens the StreamMetrics stream.
+const agentIDMetadata = "x-agent-id"
+
 type AgentGRPC struct {
-	client  pb.MetricsCollectClient
-	ruler   InteractionRules
-	metrics Metrics
-	mu      sync.RWMutex
-	cancel  chan struct{}
+	client   pb.MetricsCollectClient
+	ruler    InteractionRules
+	registry *Registry
+	cancel   chan struct{}
+	spool    *spool.Spool
+
+	// stream is the open StreamMetrics stream, it is used only by PostStats.
+	stream       pb.MetricsCollect_StreamMetricsClient
+	streamCancel context.CancelFunc
+	seq          uint64
+	// unary is set if the server does not support StreamMetrics, the batches are sent by AddMetrics then.
+	unary bool
+	// described is set once the metadata of the collectors is registered, it is used only by PostStats.
+	described bool
 }
 
-func NewAgentGRPC(address string, contentType string, pollInterval time.Duration, reportInterval time.Duration, secretKey []byte, rateLimit int, cryptoKeyDir string) (*AgentGRPC, error) {
+func NewAgentGRPC(address string, contentType string, pollInterval time.Duration, reportInterval time.Duration, secretKey []byte, rateLimit int, cryptoKeyDir string,
+	agentID string, labels map[string]string, sp *spool.Spool, retry RetryPolicy, registry *Registry) (*AgentGRPC, error) {
 	rateLimitChan := make(chan struct{}, rateLimit)
 	for i := 0; i < rateLimit; i++ {
 		rateLimitChan <- struct{}{}
@@ -36,6 +51,9 @@ func NewAgentGRPC(address string, contentType string, pollInterval time.Duration
 		reportInterval: reportInterval,
 		secretKey:      secretKey,
 		rateLimitChan:  rateLimitChan,
+		agentID:        agentID,
+		labels:         labels,
+		retry:          retry,
 	}
 	cancel := make(chan struct{})
 
@@ -67,7 +85,7 @@ func NewAgentGRPC(address string, contentType string, pollInterval time.Duration
 		if err != nil {
 			return nil, err
 		}
-		return &AgentGRPC{client: pb.NewMetricsCollectClient(c), ruler: interactionRules, cancel: cancel}, nil
+		return &AgentGRPC{client: pb.NewMetricsCollectClient(c), ruler: interactionRules, registry: registry, cancel: cancel, spool: sp}, nil
 	} else {
 		c, err := grpc.Dial(
 			address,
@@ -76,6 +94,6 @@ func NewAgentGRPC(address string, contentType string, pollInterval time.Duration
 		if err != nil {
 			return nil, err
 		}
-		return &AgentGRPC{client: pb.NewMetricsCollectClient(c), ruler: interactionRules, cancel: cancel}, nil
+		return &AgentGRPC{client: pb.NewMetricsCollectClient(c), ruler: interactionRules, registry: registry, cancel: cancel, spool: sp}, nil
 	}
 }
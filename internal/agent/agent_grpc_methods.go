@@ -2,33 +2,30 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"os"
 	"os/signal"
-	"runtime"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
-
 	"github.com/luckyseadog/go-dev/internal/metrics"
 	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/spool"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/luckyseadog/go-dev/protobuf"
 )
 
-// GetStats retrieves metrics into metrics filed of struct Agent
-
-// GetStats periodically collects and updates basic metric statistics.
+// GetStats periodically polls the collectors of the agent.
 // This method runs in the background as a goroutine.
 //
-// It reads memory statistics using runtime.ReadMemStats, generates a random value for testing purposes,
-// and increments the poll count metric. The collected metrics are updated in the agent's Metrics field.
-// The method respects rate limiting to control the frequency of metric collection.
+// The collectors are run concurrently, at most rate limit of them at once, see Registry.Poll.
+// The collected metrics are kept in the registry until the next report.
 //
 // The method continues running until the agent's cancel signal is received.
 func (a *AgentGRPC) GetStats(wg *sync.WaitGroup) {
@@ -41,160 +38,101 @@ func (a *AgentGRPC) GetStats(wg *sync.WaitGroup) {
 			wg.Done()
 			return
 		case <-ticker.C:
-			<-a.ruler.rateLimitChan
-			a.mu.RLock()
-			runtime.ReadMemStats(&a.metrics.MemStats)
-			a.metrics.RandomValue = metrics.Gauge(rand.Float64())
-			a.metrics.PollCount += 1
-			a.mu.RUnlock()
-			a.ruler.rateLimitChan <- struct{}{}
+			a.registry.Poll(a.ruler.rateLimitChan)
 		}
 	}
 }
 
-// GetExtendedStats periodically collects and updates extended metric statistics.
+// PostStats periodically sends collected metrics to server using gRPC client.
 // This method runs in the background as a goroutine.
 //
-// It reads VirtualMemory statistics using mem.VirtualMemory function and
-// CPU utilization statistics using cpu.Percent function.
+// It sends the collected metrics over the StreamMetrics stream, see send.
+// The metadata of the collectors is registered by RegisterMetadata before the first report, see describe.
+// The method calculates and attaches a hash to each metric for data integrity verification.
+// If the agent has a spool, the batches which failed to send are kept in it and sent on the next reports.
 //
 // The method continues running until the agent's cancel signal is received.
-func (a *AgentGRPC) GetExtendedStats(wg *sync.WaitGroup) {
-	ticker := time.NewTicker(a.ruler.pollInterval)
+// The metrics collected since the last report are kept in the spool then.
+func (a *AgentGRPC) PostStats(wg *sync.WaitGroup) {
+	ticker := time.NewTicker(a.ruler.reportInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-a.cancel:
+			batch := a.registry.Drain(a.ruler.agentID, a.ruler.labels)
+			keep(a.spool, batch)
 			wg.Done()
 			return
 		case <-ticker.C:
-			<-a.ruler.rateLimitChan
-			a.mu.RLock()
-			v, err := mem.VirtualMemory()
-			if err != nil {
-				MyLog.Println(err)
+			if !a.described {
+				a.described = describe(a.registry.Metadata(), a.sendMetadata)
 			}
-			a.metrics.VirtualMemory = *v
+			batch := a.registry.Drain(a.ruler.agentID, a.ruler.labels)
 
-			CPUUtilizationFloat, err := cpu.Percent(0, true)
+			err := report(a.spool, batch, a.ruler.retry.Wrap(a.sendBatch, a.cancel))
 			if err != nil {
 				MyLog.Println(err)
+				continue
 			}
-			CPUUtilization := make([]metrics.Gauge, 0, len(CPUUtilizationFloat))
-			for _, el := range CPUUtilizationFloat {
-				CPUUtilization = append(CPUUtilization, metrics.Gauge(el))
-			}
-			a.metrics.CPUUtilization = CPUUtilization
-			a.mu.RUnlock()
-			a.ruler.rateLimitChan <- struct{}{}
 		}
 	}
 }
 
-// PostStats periodically sends collected metrics to server using HTTP client.
-// This method runs in the background as a goroutine.
-//
-// It sends collected metrics as two maps:
-// - metricsGauge
-// - metricsCounter
-//
-// It assembles the collected metrics into JSON format and sends them to the server's update endpoint.
-// The method calculates and attaches a hash to each metric for data integrity verification.
-//
-// The method continues running until the agent's cancel signal is received.
-func (a *AgentGRPC) PostStats(wg *sync.WaitGroup) {
-	ticker := time.NewTicker(a.ruler.reportInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-a.cancel:
-			wg.Done()
-			return
-		case <-ticker.C:
-			a.mu.Lock()
-			metricsGauge := metrics.GetMetrics(a.metrics.MemStats)
-			metricsGauge[metrics.RandomValue] = a.metrics.RandomValue
-			metricsGauge[metrics.TotalMemory] = metrics.Gauge(a.metrics.VirtualMemory.Total)
-			metricsGauge[metrics.FreeMemory] = metrics.Gauge(a.metrics.VirtualMemory.Available)
-			for i, cpuMetric := range a.metrics.CPUUtilization {
-				metricsGauge[metrics.Metric(fmt.Sprintf("CPUutilization%d", i+1))] = cpuMetric
-			}
-			metricsCounter := map[metrics.Metric]metrics.Counter{
-				metrics.PollCount: a.metrics.PollCount,
-			}
-			a.metrics.PollCount = 0
-			a.mu.Unlock()
-			metricsCurrent := make([]metrics.Metrics, 0)
-
-			for key, value := range metricsGauge {
-				valueFloat64 := float64(value)
-
-				var metricHash string
-				if len(a.ruler.secretKey) > 0 {
-					metricHash = security.Hash(fmt.Sprintf("%s:gauge:%f", string(key), valueFloat64), a.ruler.secretKey)
-				}
-				metricsCurrent = append(
-					metricsCurrent,
-					metrics.Metrics{ID: string(key), MType: "gauge", Value: &valueFloat64, Hash: metricHash},
-				)
-			}
-			for key, value := range metricsCounter {
-				valueInt64 := int64(value)
-
-				var metricHash string
-				if len(a.ruler.secretKey) > 0 {
-					metricHash = security.Hash(fmt.Sprintf("%s:counter:%d", string(key), valueInt64), a.ruler.secretKey)
-				}
-				metricsCurrent = append(
-					metricsCurrent,
-					metrics.Metrics{ID: string(key), MType: "counter", Delta: &valueInt64, Hash: metricHash},
-				)
-			}
+// sendBatch converts the batch with its idempotency key to the protobuf request and sends it.
+func (a *AgentGRPC) sendBatch(key string, batch []metrics.Metrics) error {
+	sign(batch, a.ruler.secretKey)
+
+	request := pb.AddMetricsRequest{IdempotencyKey: key}
+	for _, metric := range batch {
+		pbMetric := &pb.Metric{
+			Id:     metric.ID,
+			MType:  metric.MType,
+			Hash:   metric.Hash,
+			Agent:  metric.Agent,
+			Labels: metric.Labels,
+		}
+		switch {
+		case metric.Value != nil:
+			pbMetric.Value = *metric.Value
+		case metric.Delta != nil:
+			pbMetric.Delta = *metric.Delta
+		case metric.Histogram != nil:
+			pbMetric.Histogram = &pb.Histogram{Bounds: metric.Histogram.Bounds, Counts: metric.Histogram.Counts,
+				Sum: metric.Histogram.Sum, Count: metric.Histogram.Count}
+		}
+		request.Metrics = append(request.Metrics, pbMetric)
+	}
 
-			var request pb.AddMetricsRequest
-
-			for _, metric := range metricsCurrent {
-				if metric.Delta == nil {
-					request.Metrics = append(request.Metrics, &pb.Metric{
-						Id:    metric.ID,
-						MType: metric.MType,
-						Value: *metric.Value,
-						Hash:  metric.Hash,
-					})
-				}
-
-				if metric.Value == nil {
-					request.Metrics = append(request.Metrics, &pb.Metric{
-						Id:    metric.ID,
-						MType: metric.MType,
-						Delta: *metric.Delta,
-						Hash:  metric.Hash,
-					})
-				}
-			}
+	return a.send(&request)
+}
 
-			md := metadata.New(map[string]string{
-				"X-Real-IP": "127.0.0.1",
-			}) // should insert in config
-			ctx := metadata.NewOutgoingContext(context.Background(), md)
+// sendMetadata registers the metadata by RegisterMetadata. The statuses InvalidArgument and FailedPrecondition
+// mean the server will not accept the metadata, Unimplemented means the server does not know it,
+// the error wraps spool.ErrRejected then.
+func (a *AgentGRPC) sendMetadata(metadata []metrics.Metadata) error {
+	request := pb.RegisterMetadataRequest{}
+	for _, m := range metadata {
+		request.Metadata = append(request.Metadata, &pb.MetricDescriptor{Name: m.Name, MType: m.MType, Unit: m.Unit, Help: m.Help})
+	}
+	if len(a.ruler.secretKey) > 0 {
+		request.Hash = security.Hash(metrics.MetadataHashString(metadata), a.ruler.secretKey)
+	}
 
-			_, err := a.client.AddMetrics(ctx, &request)
-			if err != nil {
-				MyLog.Println(err)
-				continue
-			}
-		}
+	_, err := a.client.RegisterMetadata(a.outgoingContext(context.Background()), &request)
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.Unauthenticated, codes.Unimplemented:
+		return fmt.Errorf("%w: %s", spool.ErrRejected, status.Convert(err).Message())
+	default:
+		return err
 	}
 }
 
 func (a *AgentGRPC) Run() {
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(2)
 
 	go a.GetStats(&wg)
-	go a.GetExtendedStats(&wg)
 	go a.PostStats(&wg)
 
 	stop := make(chan os.Signal, 1)
@@ -205,6 +143,107 @@ func (a *AgentGRPC) Run() {
 	}(stop)
 
 	wg.Wait()
+	a.closeStream()
+}
+
+// send sends the batch over the StreamMetrics stream and waits for its ack. The stream is opened
+// on the first report and after a failure, so a broken stream is reopened on the next report.
+// If the server does not support StreamMetrics, the agent falls back to AddMetrics.
+func (a *AgentGRPC) send(request *pb.AddMetricsRequest) error {
+	if a.unary {
+		_, err := a.client.AddMetrics(a.outgoingContext(context.Background()), request)
+		if err != nil && rejectedCode(status.Code(err)) {
+			return fmt.Errorf("%w: %s", spool.ErrRejected, status.Convert(err).Message())
+		}
+		return err
+	}
+
+	if a.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := a.client.StreamMetrics(a.outgoingContext(ctx))
+		if err != nil {
+			cancel()
+			return err
+		}
+		a.stream, a.streamCancel = stream, cancel
+	}
+
+	a.seq++
+	request.Seq = a.seq
+	err := a.stream.Send(request)
+	// The error of a broken stream is returned by Recv, Send returns io.EOF then.
+	if err == nil || errors.Is(err, io.EOF) {
+		var ack *pb.StreamMetricsAck
+		ack, err = a.stream.Recv()
+		if err == nil {
+			if ack.Seq != request.Seq {
+				a.closeStream()
+				return fmt.Errorf("unexpected ack %d for batch %d", ack.Seq, request.Seq)
+			}
+			if ack.Error != "" {
+				return ackError(ack)
+			}
+			return nil
+		}
+	}
+
+	a.closeStream()
+	if status.Code(err) == codes.Unimplemented {
+		MyLog.Println("server does not support StreamMetrics, using AddMetrics")
+		a.unary = true
+		return a.send(request)
+	}
+	return err
+}
+
+// ackError returns the error of a batch acknowledged with an error. If the status of the ack is rejectedCode,
+// the error wraps spool.ErrRejected; the batches failed with the other statuses, e.g. Unavailable, are kept
+// for a retry. An ack of an older server has no status, its error is taken as Unknown and kept for a retry too,
+// as such a server reported the failures of the storage without a status.
+func ackError(ack *pb.StreamMetricsAck) error {
+	code := codes.Code(ack.Code)
+	if code == codes.OK {
+		return status.Error(codes.Unknown, ack.Error)
+	}
+	if rejectedCode(code) {
+		return fmt.Errorf("%w: %s", spool.ErrRejected, ack.Error)
+	}
+	return status.Error(code, ack.Error)
+}
+
+// rejectedCode reports whether the status of a failed batch means that sending the batch again fails the same way,
+// so the batch must not block the newer ones in the spool: InvalidArgument for an invalid batch, FailedPrecondition
+// for values of another type than the declared one, the other values of the batch are stored then,
+// and Unknown or DataLoss for an unexpected failure of the server on the batch.
+func rejectedCode(code codes.Code) bool {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.Unknown, codes.DataLoss:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeStream closes the StreamMetrics stream if it is open.
+func (a *AgentGRPC) closeStream() {
+	if a.stream == nil {
+		return
+	}
+	err := a.stream.CloseSend()
+	if err != nil {
+		MyLog.Println(err)
+	}
+	a.streamCancel()
+	a.stream, a.streamCancel = nil, nil
+}
+
+// outgoingContext attaches the metadata of the agent to ctx.
+func (a *AgentGRPC) outgoingContext(ctx context.Context) context.Context {
+	md := metadata.New(map[string]string{
+		"X-Real-IP":     "127.0.0.1", // should insert in config
+		agentIDMetadata: a.ruler.agentID,
+	})
+	return metadata.NewOutgoingContext(ctx, md)
 }
 
 func (a *AgentGRPC) Stop() {
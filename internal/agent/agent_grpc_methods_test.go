@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luckyseadog/go-dev/internal/spool"
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+func TestAckError(t *testing.T) {
+	tests := []struct {
+		name      string
+		ack       *pb.StreamMetricsAck
+		rejected  bool
+		retryable bool
+	}{
+		{name: "invalid batch", ack: &pb.StreamMetricsAck{Error: "histogram is empty", Code: uint32(codes.InvalidArgument)}, rejected: true},
+		{name: "type conflict", ack: &pb.StreamMetricsAck{Error: "conflict", Code: uint32(codes.FailedPrecondition)}, rejected: true},
+		{name: "unexpected failure", ack: &pb.StreamMetricsAck{Error: "panic", Code: uint32(codes.Unknown)}, rejected: true},
+		{name: "storage is down", ack: &pb.StreamMetricsAck{Error: "connection refused", Code: uint32(codes.Unavailable)}, retryable: true},
+		{name: "older server", ack: &pb.StreamMetricsAck{Error: "connection refused"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ackError(tt.ack)
+			require.Error(t, err)
+			require.Equal(t, tt.rejected, errors.Is(err, spool.ErrRejected))
+			require.Equal(t, tt.retryable, retryable(err))
+			if !tt.rejected {
+				require.Equal(t, tt.ack.Error, status.Convert(err).Message())
+			}
+		})
+	}
+}
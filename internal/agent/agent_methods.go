@@ -6,31 +6,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"runtime"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
-
 	"github.com/luckyseadog/go-dev/internal/metrics"
 	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/spool"
 )
 
-// GetStats retrieves metrics into metrics filed of struct Agent
-
-// GetStats periodically collects and updates basic metric statistics.
+// GetStats periodically polls the collectors of the agent.
 // This method runs in the background as a goroutine.
 //
-// It reads memory statistics using runtime.ReadMemStats, generates a random value for testing purposes,
-// and increments the poll count metric. The collected metrics are updated in the agent's Metrics field.
-// The method respects rate limiting to control the frequency of metric collection.
+// The collectors are run concurrently, at most rate limit of them at once, see Registry.Poll.
+// The collected metrics are kept in the registry until the next report.
 //
 // The method continues running until the agent's cancel signal is received.
 func (a *Agent) GetStats(wg *sync.WaitGroup) {
@@ -43,53 +36,7 @@ func (a *Agent) GetStats(wg *sync.WaitGroup) {
 			wg.Done()
 			return
 		case <-ticker.C:
-			<-a.ruler.rateLimitChan
-			a.mu.RLock()
-			runtime.ReadMemStats(&a.metrics.MemStats)
-			a.metrics.RandomValue = metrics.Gauge(rand.Float64())
-			a.metrics.PollCount += 1
-			a.mu.RUnlock()
-			a.ruler.rateLimitChan <- struct{}{}
-		}
-	}
-}
-
-// GetExtendedStats periodically collects and updates extended metric statistics.
-// This method runs in the background as a goroutine.
-//
-// It reads VirtualMemory statistics using mem.VirtualMemory function and
-// CPU utilization statistics using cpu.Percent function.
-//
-// The method continues running until the agent's cancel signal is received.
-func (a *Agent) GetExtendedStats(wg *sync.WaitGroup) {
-	ticker := time.NewTicker(a.ruler.pollInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-a.cancel:
-			wg.Done()
-			return
-		case <-ticker.C:
-			<-a.ruler.rateLimitChan
-			a.mu.RLock()
-			v, err := mem.VirtualMemory()
-			if err != nil {
-				MyLog.Println(err)
-			}
-			a.metrics.VirtualMemory = *v
-
-			CPUUtilizationFloat, err := cpu.Percent(0, true)
-			if err != nil {
-				MyLog.Println(err)
-			}
-			CPUUtilization := make([]metrics.Gauge, 0, len(CPUUtilizationFloat))
-			for _, el := range CPUUtilizationFloat {
-				CPUUtilization = append(CPUUtilization, metrics.Gauge(el))
-			}
-			a.metrics.CPUUtilization = CPUUtilization
-			a.mu.RUnlock()
-			a.ruler.rateLimitChan <- struct{}{}
+			a.registry.Poll(a.ruler.rateLimitChan)
 		}
 	}
 }
@@ -97,14 +44,13 @@ func (a *Agent) GetExtendedStats(wg *sync.WaitGroup) {
 // PostStats periodically sends collected metrics to server using HTTP client.
 // This method runs in the background as a goroutine.
 //
-// It sends collected metrics as two maps:
-// - metricsGauge
-// - metricsCounter
-//
 // It assembles the collected metrics into JSON format and sends them to the server's update endpoint.
+// The metadata of the collectors is registered before the first report, see describe.
 // The method calculates and attaches a hash to each metric for data integrity verification.
+// If the agent has a spool, the batches which failed to send are kept in it and sent on the next reports.
 //
 // The method continues running until the agent's cancel signal is received.
+// The metrics collected since the last report are kept in the spool then.
 func (a *Agent) PostStats(wg *sync.WaitGroup) {
 	ticker := time.NewTicker(a.ruler.reportInterval)
 	defer ticker.Stop()
@@ -112,83 +58,112 @@ func (a *Agent) PostStats(wg *sync.WaitGroup) {
 	for {
 		select {
 		case <-a.cancel:
+			batch := a.registry.Drain(a.ruler.agentID, a.ruler.labels)
+			keep(a.spool, batch)
 			wg.Done()
 			return
 		case <-ticker.C:
-			a.mu.Lock()
-			metricsGauge := metrics.GetMetrics(a.metrics.MemStats)
-			metricsGauge[metrics.RandomValue] = a.metrics.RandomValue
-			metricsGauge[metrics.TotalMemory] = metrics.Gauge(a.metrics.VirtualMemory.Total)
-			metricsGauge[metrics.FreeMemory] = metrics.Gauge(a.metrics.VirtualMemory.Available)
-			for i, cpuMetric := range a.metrics.CPUUtilization {
-				metricsGauge[metrics.Metric(fmt.Sprintf("CPUutilization%d", i+1))] = cpuMetric
-			}
-			metricsCounter := map[metrics.Metric]metrics.Counter{
-				metrics.PollCount: a.metrics.PollCount,
-			}
-			a.metrics.PollCount = 0
-			a.mu.Unlock()
-			metricsCurrent := make([]metrics.Metrics, 0)
-
-			for key, value := range metricsGauge {
-				valueFloat64 := float64(value)
-
-				var metricHash string
-				if len(a.ruler.secretKey) > 0 {
-					metricHash = security.Hash(fmt.Sprintf("%s:gauge:%f", string(key), valueFloat64), a.ruler.secretKey)
-				}
-				metricsCurrent = append(
-					metricsCurrent,
-					metrics.Metrics{ID: string(key), MType: "gauge", Value: &valueFloat64, Hash: metricHash},
-				)
-			}
-			for key, value := range metricsCounter {
-				valueInt64 := int64(value)
-
-				var metricHash string
-				if len(a.ruler.secretKey) > 0 {
-					metricHash = security.Hash(fmt.Sprintf("%s:counter:%d", string(key), valueInt64), a.ruler.secretKey)
-				}
-				metricsCurrent = append(
-					metricsCurrent,
-					metrics.Metrics{ID: string(key), MType: "counter", Delta: &valueInt64, Hash: metricHash},
-				)
+			if !a.described {
+				a.described = describe(a.registry.Metadata(), a.sendMetadata)
 			}
+			batch := a.registry.Drain(a.ruler.agentID, a.ruler.labels)
 
-			data, err := json.Marshal(metricsCurrent)
+			err := report(a.spool, batch, a.ruler.retry.Wrap(a.send, a.cancel))
 			if err != nil {
 				MyLog.Println(err)
 				continue
 			}
+		}
+	}
+}
 
-			address, err := url.Parse(a.ruler.address)
-			if err != nil {
-				MyLog.Println(err)
-			}
-			address.Path = address.Path + UPDATE
+// send sends the batch to the server's update endpoint with its idempotency key. A response with status 4xx
+// other than 429 means the server will not accept the batch, the error wraps spool.ErrRejected then.
+func (a *Agent) send(key string, batch []metrics.Metrics) error {
+	sign(batch, a.ruler.secretKey)
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
 
-			ctx := context.Background()
-			fmt.Println(string(data))
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, address.String(), bytes.NewBuffer(data))
-			if err != nil {
-				MyLog.Println(err)
-				continue
-			}
-			req.Header.Set("X-Real-IP", "127.0.0.1") // localhost for now
-			req.Header.Set("Content-Type", a.ruler.contentType)
-			req.Header.Add("Accept", "application/json")
-			response, err := a.client.Do(req)
-			if err != nil {
-				MyLog.Println(err)
-				continue
-			}
-			defer response.Body.Close()
-			_, err = io.Copy(io.Discard, response.Body)
-			if err != nil {
-				MyLog.Println(err)
-				continue
-			}
-		}
+	address, err := url.Parse(a.ruler.address)
+	if err != nil {
+		return err
+	}
+	address.Path = address.Path + UPDATE
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address.String(), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Real-IP", "127.0.0.1") // localhost for now
+	req.Header.Set("Content-Type", a.ruler.contentType)
+	req.Header.Add("Accept", "application/json")
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	response, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(io.Discard, response.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 400 && response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status %d", spool.ErrRejected, response.StatusCode)
+	default:
+		return newStatusError(response)
+	}
+}
+
+// sendMetadata sends the metadata to the server's metadata endpoint, signed with the secret key of the agent.
+// A response with status 4xx other than 429 means the server will not accept the metadata,
+// the error wraps spool.ErrRejected then.
+func (a *Agent) sendMetadata(metadata []metrics.Metadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	address, err := url.Parse(a.ruler.address)
+	if err != nil {
+		return err
+	}
+	address.Path = address.Path + METADATA
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, address.String(), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Real-IP", "127.0.0.1") // localhost for now
+	req.Header.Set("Content-Type", "application/json")
+	if len(a.ruler.secretKey) > 0 {
+		req.Header.Set("HashSHA256", security.Hash(string(data), a.ruler.secretKey))
+	}
+	response, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 400 && response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status %d: %s", spool.ErrRejected, response.StatusCode, bytes.TrimSpace(body))
+	default:
+		return newStatusError(response)
 	}
 }
 
@@ -198,10 +173,9 @@ func (a *Agent) PostStats(wg *sync.WaitGroup) {
 // It could be used simultaneously with Stop command.
 func (a *Agent) Run() {
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(2)
 
 	go a.GetStats(&wg)
-	go a.GetExtendedStats(&wg)
 	go a.PostStats(&wg)
 
 	stop := make(chan os.Signal, 1)
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/spool"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// flakyServer applies the batches to the storage like the server and fails the requests on demand:
+// before the batch is applied, as if the server is down, or after it, as if the response is lost.
+type flakyServer struct {
+	storage *storage.MyStorage
+	down    bool
+	lost    bool
+}
+
+func (fs *flakyServer) send(key string, batch []metrics.Metrics) error {
+	if fs.down {
+		return errors.New("connection refused")
+	}
+	values := make([]storage.MetricValue, 0, len(batch))
+	for _, metric := range batch {
+		values = append(values, storage.MetricValue{Metric: metric.Key(), Value: metrics.Counter(*metric.Delta)})
+	}
+	_, _, err := fs.storage.StoreBatchContext(context.Background(), key, values)
+	if err != nil {
+		return err
+	}
+	if fs.lost {
+		return errors.New("context deadline exceeded")
+	}
+	return nil
+}
+
+func TestReport_OnceThroughSpool(t *testing.T) {
+	// Every batch exceeds the size limit, so the unsent batches are folded.
+	sp, err := spool.Open(t.TempDir(), 1, 0)
+	require.NoError(t, err)
+	server := &flakyServer{storage: storage.NewStorage(nil, time.Second)}
+	poll := func(delta int64) []metrics.Metrics {
+		return []metrics.Metrics{NewCounter("PollCount", delta, nil)}
+	}
+
+	// The server applies the first batch, but the agent does not get the response.
+	server.lost = true
+	require.Error(t, report(sp, poll(1), server.send))
+	// The server is down, the batches are kept and folded, the applied one is not.
+	server.lost, server.down = false, true
+	require.Error(t, report(sp, poll(2), server.send))
+	require.Error(t, report(sp, poll(3), server.send))
+	require.Equal(t, 2, sp.Len())
+
+	// The server is back: the applied batch is acknowledged without being applied again.
+	server.down = false
+	require.NoError(t, report(sp, poll(4), server.send))
+	require.Equal(t, 0, sp.Len())
+	require.Equal(t, metrics.Counter(10), server.storage.DataCounter["PollCount"])
+}
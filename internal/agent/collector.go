@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// DefaultCollectors are the collectors enabled when the configuration does not name them.
+var DefaultCollectors = []string{"runtime", "memory", "cpu"}
+
+// Collector gathers a set of metrics on every poll of the agent.
+//
+// Gauges returned by Collect replace the values returned by the previous call, so a gauge which is not returned
+// anymore is not reported anymore. Counters are deltas since the previous call, the agent sums them up until the report.
+// The agent and its labels are added to the metrics by the agent, a collector sets only the labels of its own,
+// e.g. the mount point of a filesystem.
+type Collector interface {
+	Collect() ([]metrics.Metrics, error)
+}
+
+// Describer is implemented by the collectors which know the metrics they report. The agent registers
+// the metadata with the server before the first report, so the server knows the units of the metrics
+// and rejects the values of another type sent under their names.
+type Describer interface {
+	Describe() []metrics.Metadata
+}
+
+// CollectorFactory creates a collector from its options, the raw JSON value set for the collector
+// in "collector_options" of the configuration, nil if it is not set.
+type CollectorFactory func(options json.RawMessage) (Collector, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]CollectorFactory{}
+)
+
+// RegisterCollector makes the collector available by the name to enable in the configuration.
+// It is meant to be called from init functions and panics if the name is already registered.
+func RegisterCollector(name string, factory CollectorFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("agent: collector " + name + " is registered twice")
+	}
+	factories[name] = factory
+}
+
+// CollectorNames returns the sorted names of the registered collectors.
+func CollectorNames() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewGauge returns the gauge with the given name, value and labels for Collector implementations.
+func NewGauge(name string, value float64, labels map[string]string) metrics.Metrics {
+	return metrics.Metrics{ID: name, MType: "gauge", Value: &value, Labels: labels}
+}
+
+// NewCounter returns the counter with the given name, delta and labels for Collector implementations.
+func NewCounter(name string, delta int64, labels map[string]string) metrics.Metrics {
+	return metrics.Metrics{ID: name, MType: "counter", Delta: &delta, Labels: labels}
+}
+
+// Registry holds the enabled collectors and the metrics they collected since the last report.
+type Registry struct {
+	names      []string
+	collectors []Collector
+
+	mu       sync.Mutex
+	gauges   [][]metrics.Metrics
+	counters map[metrics.Metric]metrics.Metrics
+}
+
+// NewRegistry creates the collectors with the given names.
+//
+// Parameters:
+//   - names: The names of the collectors to enable.
+//   - options: The options of the collectors by name, the collectors without options get nil.
+//
+// Returns:
+//   - A pointer to the Registry and an error if a name is unknown or a collector can not be created.
+func NewRegistry(names []string, options map[string]json.RawMessage) (*Registry, error) {
+	r := &Registry{counters: map[metrics.Metric]metrics.Metrics{}}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		factoriesMu.RLock()
+		factory, ok := factories[name]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q, available: %s", name, strings.Join(CollectorNames(), ", "))
+		}
+		collector, err := factory(options[name])
+		if err != nil {
+			return nil, fmt.Errorf("collector %q: %w", name, err)
+		}
+		r.names = append(r.names, name)
+		r.collectors = append(r.collectors, collector)
+	}
+	r.gauges = make([][]metrics.Metrics, len(r.collectors))
+
+	return r, nil
+}
+
+// Add enables the collector created by the caller, e.g. PushServer. It should be called before the agent is run.
+func (r *Registry) Add(name string, collector Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, name)
+	r.collectors = append(r.collectors, collector)
+	r.gauges = append(r.gauges, nil)
+}
+
+// ParseCollectorNames parses the names of collectors written as "name1,name2".
+// An empty string means DefaultCollectors.
+func ParseCollectorNames(str string) []string {
+	if strings.TrimSpace(str) == "" {
+		return DefaultCollectors
+	}
+	var names []string
+	for _, name := range strings.Split(str, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Names returns the names of the enabled collectors.
+func (r *Registry) Names() []string {
+	return append([]string(nil), r.names...)
+}
+
+// Metadata returns the metadata of the metrics of the collectors implementing Describer.
+// A name described by several collectors gets the metadata of the first of them.
+func (r *Registry) Metadata() []metrics.Metadata {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	var metadata []metrics.Metadata
+	seen := map[string]bool{}
+	for _, collector := range collectors {
+		describer, ok := collector.(Describer)
+		if !ok {
+			continue
+		}
+		for _, m := range describer.Describe() {
+			if !seen[m.Name] {
+				seen[m.Name] = true
+				metadata = append(metadata, m)
+			}
+		}
+	}
+	return metadata
+}
+
+// Poll runs all the collectors, at most limit of them at once, and keeps their metrics until Drain.
+// An error of a collector is logged and the metrics it collected before keep being reported.
+func (r *Registry) Poll(limit chan struct{}) {
+	var wg sync.WaitGroup
+	for i := range r.collectors {
+		<-limit
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				limit <- struct{}{}
+				wg.Done()
+			}()
+
+			collected, err := r.collectors[i].Collect()
+			if err != nil {
+				MyLog.Printf("collector %s: %v", r.names[i], err)
+				return
+			}
+			r.add(i, collected)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// add keeps the metrics collected by the i-th collector.
+func (r *Registry) add(i int, collected []metrics.Metrics) {
+	gauges := make([]metrics.Metrics, 0, len(collected))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, metric := range collected {
+		switch {
+		case metric.MType == "gauge" && metric.Value != nil:
+			gauges = append(gauges, metric)
+		case metric.MType == "counter" && metric.Delta != nil:
+			key := metric.Key()
+			if stored, ok := r.counters[key]; ok {
+				delta := *stored.Delta + *metric.Delta
+				metric.Delta = &delta
+			}
+			r.counters[key] = metric
+		case metric.MType == "histogram" && metric.Histogram != nil:
+			key := metrics.Metric("histogram:") + metric.Key()
+			if stored, ok := r.counters[key]; ok {
+				if !stored.Histogram.SameBounds(*metric.Histogram) {
+					MyLog.Printf("collector %s: buckets of histogram %s changed, its observations since the last report are dropped", r.names[i], metric.ID)
+				}
+				histogram := stored.Histogram.Merge(*metric.Histogram)
+				metric.Histogram = &histogram
+			}
+			r.counters[key] = metric
+		default:
+			MyLog.Printf("collector %s: invalid metric %s", r.names[i], metric.ID)
+		}
+	}
+	r.gauges[i] = gauges
+}
+
+// Drain returns the last gauges of all the collectors and the counters accumulated since the previous Drain,
+// which are reset. The agent and its labels are added to every metric.
+func (r *Registry) Drain(agentID string, labels map[string]string) []metrics.Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	batch := make([]metrics.Metrics, 0, len(r.counters))
+	for _, gauges := range r.gauges {
+		for _, gauge := range gauges {
+			value := *gauge.Value
+			gauge.Value = &value
+			batch = append(batch, withAgent(gauge, agentID, labels))
+		}
+	}
+	for _, counter := range r.counters {
+		batch = append(batch, withAgent(counter, agentID, labels))
+	}
+	r.counters = map[metrics.Metric]metrics.Metrics{}
+
+	return batch
+}
+
+// withAgent sets the agent of the metric and adds the labels of the agent to the labels of the metric.
+// The labels set by the collector take precedence.
+func withAgent(metric metrics.Metrics, agentID string, labels map[string]string) metrics.Metrics {
+	metric.Agent = agentID
+	if len(metric.Labels) == 0 {
+		metric.Labels = labels
+		return metric
+	}
+
+	merged := make(map[string]string, len(labels)+len(metric.Labels))
+	for label, value := range labels {
+		merged[label] = value
+	}
+	for label, value := range metric.Labels {
+		merged[label] = value
+	}
+	metric.Labels = merged
+
+	return metric
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// collectorFunc is a Collector calling the function.
+type collectorFunc func() ([]metrics.Metrics, error)
+
+func (f collectorFunc) Collect() ([]metrics.Metrics, error) {
+	return f()
+}
+
+// newLimit returns the rate limit channel of Poll with n tokens.
+func newLimit(n int) chan struct{} {
+	limit := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		limit <- struct{}{}
+	}
+	return limit
+}
+
+// drained drains the registry and returns the metrics by their type and name.
+func drained(r *Registry) map[string]metrics.Metrics {
+	byName := map[string]metrics.Metrics{}
+	for _, metric := range r.Drain("host1", map[string]string{"env": "prod"}) {
+		byName[metric.MType+":"+metric.ID] = metric
+	}
+	return byName
+}
+
+func TestRegistry_PollDrain(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	require.NoError(t, err)
+	polls := 0
+	r.Add("test", collectorFunc(func() ([]metrics.Metrics, error) {
+		polls++
+		histogram := metrics.NewHistogram([]float64{1})
+		histogram.Observe(0.5)
+		return []metrics.Metrics{
+			NewGauge("Temperature", float64(polls), map[string]string{"env": "test"}),
+			NewCounter("Requests", 2, nil),
+			{ID: "Latency", MType: "histogram", Histogram: &histogram},
+		}, nil
+	}))
+	limit := newLimit(1)
+
+	// The counters are summed up and the gauges are replaced until Drain.
+	r.Poll(limit)
+	r.Poll(limit)
+	got := drained(r)
+	require.Len(t, got, 3)
+	require.Equal(t, 2.0, *got["gauge:Temperature"].Value)
+	require.Equal(t, int64(4), *got["counter:Requests"].Delta)
+	require.Equal(t, uint64(2), got["histogram:Latency"].Histogram.Count)
+	for _, metric := range got {
+		require.Equal(t, "host1", metric.Agent)
+	}
+	// The labels of the collector take precedence over the labels of the agent.
+	require.Equal(t, map[string]string{"env": "test"}, got["gauge:Temperature"].Labels)
+	require.Equal(t, map[string]string{"env": "prod"}, got["counter:Requests"].Labels)
+
+	// The counters are reset by Drain, the gauges are reported until they are collected again.
+	got = drained(r)
+	require.Len(t, got, 1)
+	require.Contains(t, got, "gauge:Temperature")
+	require.Len(t, limit, 1)
+}
+
+func TestRegistry_PollLimit(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	require.NoError(t, err)
+	var running, maxRunning int32
+	for i := 0; i < 6; i++ {
+		r.Add("test", collectorFunc(func() ([]metrics.Metrics, error) {
+			current := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				prev := atomic.LoadInt32(&maxRunning)
+				if current <= prev || atomic.CompareAndSwapInt32(&maxRunning, prev, current) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return nil, nil
+		}))
+	}
+
+	limit := newLimit(2)
+	r.Poll(limit)
+	require.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(2))
+	require.Len(t, limit, 2)
+}
+
+func TestRegistry_PollError(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	require.NoError(t, err)
+	var mu sync.Mutex
+	fail := false
+	r.Add("failing", collectorFunc(func() ([]metrics.Metrics, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return []metrics.Metrics{NewGauge("Temperature", 2, nil)}, errors.New("sensor is not available")
+		}
+		return []metrics.Metrics{NewGauge("Temperature", 1, nil)}, nil
+	}))
+	r.Add("invalid", collectorFunc(func() ([]metrics.Metrics, error) {
+		return []metrics.Metrics{{ID: "NoValue", MType: "gauge"}, NewGauge("Valid", 1, nil)}, nil
+	}))
+	limit := newLimit(2)
+
+	r.Poll(limit)
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	r.Poll(limit)
+
+	// The failing collector keeps its last metrics, the invalid metrics are dropped.
+	got := drained(r)
+	require.Equal(t, 1.0, *got["gauge:Temperature"].Value)
+	require.Contains(t, got, "gauge:Valid")
+	require.NotContains(t, got, "gauge:NoValue")
+}
+
+func TestNewRegistry(t *testing.T) {
+	created := 0
+	RegisterCollector("test_registry", func(options json.RawMessage) (Collector, error) {
+		created++
+		if options != nil {
+			return nil, errors.New("no options expected")
+		}
+		return collectorFunc(func() ([]metrics.Metrics, error) { return nil, nil }), nil
+	})
+	require.Contains(t, CollectorNames(), "test_registry")
+	require.Panics(t, func() {
+		RegisterCollector("test_registry", func(options json.RawMessage) (Collector, error) { return nil, nil })
+	})
+
+	// A name enabled twice creates one collector.
+	r, err := NewRegistry([]string{"test_registry", "test_registry"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"test_registry"}, r.Names())
+	require.Equal(t, 1, created)
+
+	_, err = NewRegistry([]string{"test_registry", "unknown"}, nil)
+	require.ErrorContains(t, err, `unknown collector "unknown"`)
+	_, err = NewRegistry([]string{"test_registry"}, map[string]json.RawMessage{"test_registry": json.RawMessage(`{}`)})
+	require.ErrorContains(t, err, `collector "test_registry"`)
+}
+
+func TestParseCollectorNames(t *testing.T) {
+	require.Equal(t, DefaultCollectors, ParseCollectorNames(" "))
+	require.Equal(t, []string{"cpu", "disk"}, ParseCollectorNames("cpu, ,disk,"))
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"runtime"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+func init() {
+	RegisterCollector("runtime", func(json.RawMessage) (Collector, error) { return runtimeCollector{}, nil })
+	RegisterCollector("memory", func(json.RawMessage) (Collector, error) { return memoryCollector{}, nil })
+	RegisterCollector("cpu", func(json.RawMessage) (Collector, error) { return cpuCollector{}, nil })
+}
+
+// runtimeMetadata describes the fields of runtime.MemStats reported by runtimeCollector, see metrics.GetMetrics.
+var runtimeMetadata = []metrics.Metadata{
+	{Name: string(metrics.Alloc), MType: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects."},
+	{Name: string(metrics.BuckHashSys), MType: "gauge", Unit: "bytes", Help: "Bytes of memory in profiling bucket hash tables."},
+	{Name: string(metrics.Frees), MType: "gauge", Unit: "objects", Help: "Cumulative count of heap objects freed."},
+	{Name: string(metrics.GCCPUFraction), MType: "gauge", Unit: "ratio", Help: "Fraction of the available CPU time used by the GC since the program started."},
+	{Name: string(metrics.GCSys), MType: "gauge", Unit: "bytes", Help: "Bytes of memory in garbage collection metadata."},
+	{Name: string(metrics.HeapAlloc), MType: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects."},
+	{Name: string(metrics.HeapIdle), MType: "gauge", Unit: "bytes", Help: "Bytes in idle heap spans."},
+	{Name: string(metrics.HeapInuse), MType: "gauge", Unit: "bytes", Help: "Bytes in in-use heap spans."},
+	{Name: string(metrics.HeapObjects), MType: "gauge", Unit: "objects", Help: "Number of allocated heap objects."},
+	{Name: string(metrics.HeapReleased), MType: "gauge", Unit: "bytes", Help: "Bytes of physical memory returned to the OS."},
+	{Name: string(metrics.HeapSys), MType: "gauge", Unit: "bytes", Help: "Bytes of heap memory obtained from the OS."},
+	{Name: string(metrics.LastGC), MType: "gauge", Unit: "nanoseconds", Help: "Time the last garbage collection finished, since the Unix epoch."},
+	{Name: string(metrics.Lookups), MType: "gauge", Unit: "lookups", Help: "Number of pointer lookups performed by the runtime."},
+	{Name: string(metrics.MCacheInuse), MType: "gauge", Unit: "bytes", Help: "Bytes of allocated mcache structures."},
+	{Name: string(metrics.MCacheSys), MType: "gauge", Unit: "bytes", Help: "Bytes of memory obtained from the OS for mcache structures."},
+	{Name: string(metrics.MSpanInuse), MType: "gauge", Unit: "bytes", Help: "Bytes of allocated mspan structures."},
+	{Name: string(metrics.MSpanSys), MType: "gauge", Unit: "bytes", Help: "Bytes of memory obtained from the OS for mspan structures."},
+	{Name: string(metrics.Mallocs), MType: "gauge", Unit: "objects", Help: "Cumulative count of heap objects allocated."},
+	{Name: string(metrics.NextGC), MType: "gauge", Unit: "bytes", Help: "Target heap size of the next GC cycle."},
+	{Name: string(metrics.NumForcedGC), MType: "gauge", Unit: "cycles", Help: "Number of GC cycles forced by the application."},
+	{Name: string(metrics.NumGC), MType: "gauge", Unit: "cycles", Help: "Number of completed GC cycles."},
+	{Name: string(metrics.OtherSys), MType: "gauge", Unit: "bytes", Help: "Bytes of memory in miscellaneous off-heap runtime allocations."},
+	{Name: string(metrics.PauseTotalNs), MType: "gauge", Unit: "nanoseconds", Help: "Cumulative time spent in GC stop-the-world pauses."},
+	{Name: string(metrics.StackInuse), MType: "gauge", Unit: "bytes", Help: "Bytes in stack spans."},
+	{Name: string(metrics.StackSys), MType: "gauge", Unit: "bytes", Help: "Bytes of stack memory obtained from the OS."},
+	{Name: string(metrics.Sys), MType: "gauge", Unit: "bytes", Help: "Total bytes of memory obtained from the OS."},
+	{Name: string(metrics.TotalAlloc), MType: "gauge", Unit: "bytes", Help: "Cumulative bytes allocated for heap objects."},
+	{Name: string(metrics.RandomValue), MType: "gauge", Help: "Random value from 0 to 1 for testing purposes."},
+	{Name: string(metrics.PollCount), MType: "counter", Unit: "polls", Help: "Number of polls of the agent."},
+}
+
+// runtimeCollector reports runtime.MemStats of the agent, a random value for testing purposes
+// and the PollCount counter incremented on every poll.
+type runtimeCollector struct{}
+
+func (runtimeCollector) Collect() ([]metrics.Metrics, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	metricsGauge := metrics.GetMetrics(memStats)
+	collected := make([]metrics.Metrics, 0, len(metricsGauge)+2)
+	for key, value := range metricsGauge {
+		collected = append(collected, NewGauge(string(key), float64(value), nil))
+	}
+	collected = append(collected,
+		NewGauge(string(metrics.RandomValue), rand.Float64(), nil),
+		NewCounter(string(metrics.PollCount), 1, nil),
+	)
+
+	return collected, nil
+}
+
+func (runtimeCollector) Describe() []metrics.Metadata {
+	return runtimeMetadata
+}
+
+// memoryCollector reports the total and the available virtual memory of the host.
+type memoryCollector struct{}
+
+func (memoryCollector) Collect() ([]metrics.Metrics, error) {
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	return []metrics.Metrics{
+		NewGauge(string(metrics.TotalMemory), float64(v.Total), nil),
+		NewGauge(string(metrics.FreeMemory), float64(v.Available), nil),
+	}, nil
+}
+
+func (memoryCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: string(metrics.TotalMemory), MType: "gauge", Unit: "bytes", Help: "Total virtual memory of the host."},
+		{Name: string(metrics.FreeMemory), MType: "gauge", Unit: "bytes", Help: "Virtual memory of the host available for new processes."},
+	}
+}
+
+// cpuCollector reports the utilization of every CPU since the previous poll as CPUutilization1, CPUutilization2 and so on.
+type cpuCollector struct{}
+
+func (cpuCollector) Collect() ([]metrics.Metrics, error) {
+	utilization, err := cpu.Percent(0, true)
+	if err != nil {
+		return nil, err
+	}
+
+	collected := make([]metrics.Metrics, 0, len(utilization))
+	for i, value := range utilization {
+		collected = append(collected, NewGauge(fmt.Sprintf("CPUutilization%d", i+1), value, nil))
+	}
+
+	return collected, nil
+}
+
+func (cpuCollector) Describe() []metrics.Metadata {
+	count, err := cpu.Counts(true)
+	if err != nil {
+		count = runtime.NumCPU()
+	}
+
+	metadata := make([]metrics.Metadata, 0, count)
+	for i := 1; i <= count; i++ {
+		metadata = append(metadata, metrics.Metadata{Name: fmt.Sprintf("CPUutilization%d", i), MType: "gauge", Unit: "percent",
+			Help: fmt.Sprintf("Utilization of CPU %d since the previous poll.", i)})
+	}
+	return metadata
+}
@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/net"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+func init() {
+	RegisterCollector("filesystem", newFilesystemCollector)
+	RegisterCollector("diskio", newDiskIOCollector)
+	RegisterCollector("network", newNetworkCollector)
+	RegisterCollector("load", func(json.RawMessage) (Collector, error) { return loadCollector{avg: load.Avg}, nil })
+	RegisterCollector("uptime", func(json.RawMessage) (Collector, error) {
+		return uptimeCollector{uptime: host.Uptime, bootTime: host.BootTime}, nil
+	})
+}
+
+// decodeOptions decodes the options of a collector into v, unknown fields are an error.
+// Nil options leave v unchanged.
+func decodeOptions(options json.RawMessage, v any) error {
+	if len(options) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+// selected reports whether the name is in the list, an empty list selects every name.
+func selected(list []string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, el := range list {
+		if el == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cumulative converts the cumulative counters of the system to the deltas reported by collectors.
+// The first value of a counter gives no delta, a value lower than the previous one means the counter
+// was reset (e.g. a network interface was recreated) and the value itself is the delta.
+type cumulative struct {
+	mu   sync.Mutex
+	last map[metrics.Metric]uint64
+}
+
+func newCumulative() *cumulative {
+	return &cumulative{last: map[metrics.Metric]uint64{}}
+}
+
+// counter returns the counter with the delta of the value since the previous call for the same name and labels.
+// The second value is false if there is no previous value.
+func (c *cumulative) counter(name string, value uint64, labels map[string]string) (metrics.Metrics, bool) {
+	key := metrics.SeriesKey(name, "", labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[key]
+	c.last[key] = value
+	if !ok {
+		return metrics.Metrics{}, false
+	}
+
+	delta := value
+	if value >= last {
+		delta = value - last
+	}
+	return NewCounter(name, int64(delta), labels), true
+}
+
+// filesystemOptions are the options of the filesystem collector.
+type filesystemOptions struct {
+	Mountpoints []string `json:"mountpoints"` // The mount points to report, all the physical ones by default.
+	All         bool     `json:"all"`         // Whether to report virtual filesystems too, e.g. tmpfs.
+}
+
+// filesystemCollector reports the usage of every mounted filesystem with the labels mountpoint, device and fstype.
+// The collectors of the host read the system with the functions of gopsutil set by their constructors.
+type filesystemCollector struct {
+	options    filesystemOptions
+	partitions func(all bool) ([]disk.PartitionStat, error)
+	usage      func(path string) (*disk.UsageStat, error)
+}
+
+func newFilesystemCollector(options json.RawMessage) (Collector, error) {
+	c := filesystemCollector{partitions: disk.Partitions, usage: disk.Usage}
+	return c, decodeOptions(options, &c.options)
+}
+
+func (c filesystemCollector) Collect() ([]metrics.Metrics, error) {
+	partitions, err := c.partitions(c.options.All)
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []metrics.Metrics
+	for _, partition := range partitions {
+		if !selected(c.options.Mountpoints, partition.Mountpoint) {
+			continue
+		}
+		usage, err := c.usage(partition.Mountpoint)
+		if err != nil {
+			MyLog.Printf("filesystem %s: %v", partition.Mountpoint, err)
+			continue
+		}
+
+		labels := map[string]string{"mountpoint": partition.Mountpoint, "device": partition.Device, "fstype": partition.Fstype}
+		collected = append(collected,
+			NewGauge("FilesystemTotalBytes", float64(usage.Total), labels),
+			NewGauge("FilesystemUsedBytes", float64(usage.Used), labels),
+			NewGauge("FilesystemFreeBytes", float64(usage.Free), labels),
+			NewGauge("FilesystemUsedPercent", usage.UsedPercent, labels),
+			NewGauge("FilesystemInodesUsedPercent", usage.InodesUsedPercent, labels),
+		)
+	}
+
+	return collected, nil
+}
+
+func (filesystemCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: "FilesystemTotalBytes", MType: "gauge", Unit: "bytes", Help: "Size of the filesystem."},
+		{Name: "FilesystemUsedBytes", MType: "gauge", Unit: "bytes", Help: "Used space of the filesystem."},
+		{Name: "FilesystemFreeBytes", MType: "gauge", Unit: "bytes", Help: "Free space of the filesystem."},
+		{Name: "FilesystemUsedPercent", MType: "gauge", Unit: "percent", Help: "Used space of the filesystem."},
+		{Name: "FilesystemInodesUsedPercent", MType: "gauge", Unit: "percent", Help: "Used inodes of the filesystem."},
+	}
+}
+
+// diskIOOptions are the options of the diskio collector.
+type diskIOOptions struct {
+	Devices []string `json:"devices"` // The devices to report, e.g. "sda", all of them by default.
+}
+
+// diskIOCollector reports the I/O counters of every block device with the label device.
+type diskIOCollector struct {
+	options    diskIOOptions
+	cumulative *cumulative
+	ioCounters func(names ...string) (map[string]disk.IOCountersStat, error)
+}
+
+func newDiskIOCollector(options json.RawMessage) (Collector, error) {
+	c := diskIOCollector{cumulative: newCumulative(), ioCounters: disk.IOCounters}
+	return c, decodeOptions(options, &c.options)
+}
+
+func (c diskIOCollector) Collect() ([]metrics.Metrics, error) {
+	counters, err := c.ioCounters(c.options.Devices...)
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []metrics.Metrics
+	for device, stat := range counters {
+		labels := map[string]string{"device": device}
+		for _, counter := range []struct {
+			name  string
+			value uint64
+		}{
+			{"DiskReadBytes", stat.ReadBytes},
+			{"DiskWriteBytes", stat.WriteBytes},
+			{"DiskReads", stat.ReadCount},
+			{"DiskWrites", stat.WriteCount},
+			{"DiskIOTimeMs", stat.IoTime},
+		} {
+			if metric, ok := c.cumulative.counter(counter.name, counter.value, labels); ok {
+				collected = append(collected, metric)
+			}
+		}
+		collected = append(collected, NewGauge("DiskIOInProgress", float64(stat.IopsInProgress), labels))
+	}
+
+	return collected, nil
+}
+
+func (diskIOCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: "DiskReadBytes", MType: "counter", Unit: "bytes", Help: "Bytes read from the device."},
+		{Name: "DiskWriteBytes", MType: "counter", Unit: "bytes", Help: "Bytes written to the device."},
+		{Name: "DiskReads", MType: "counter", Unit: "operations", Help: "Completed reads of the device."},
+		{Name: "DiskWrites", MType: "counter", Unit: "operations", Help: "Completed writes of the device."},
+		{Name: "DiskIOTimeMs", MType: "counter", Unit: "milliseconds", Help: "Time the device spent doing I/O."},
+		{Name: "DiskIOInProgress", MType: "gauge", Unit: "operations", Help: "I/O operations of the device in progress."},
+	}
+}
+
+// networkOptions are the options of the network collector.
+type networkOptions struct {
+	Interfaces []string `json:"interfaces"` // The interfaces to report, e.g. "eth0", all of them by default.
+}
+
+// networkCollector reports the traffic and the errors of every network interface with the label interface.
+type networkCollector struct {
+	options    networkOptions
+	cumulative *cumulative
+	ioCounters func(pernic bool) ([]net.IOCountersStat, error)
+}
+
+func newNetworkCollector(options json.RawMessage) (Collector, error) {
+	c := networkCollector{cumulative: newCumulative(), ioCounters: net.IOCounters}
+	return c, decodeOptions(options, &c.options)
+}
+
+func (c networkCollector) Collect() ([]metrics.Metrics, error) {
+	counters, err := c.ioCounters(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []metrics.Metrics
+	for _, stat := range counters {
+		if !selected(c.options.Interfaces, stat.Name) {
+			continue
+		}
+		labels := map[string]string{"interface": stat.Name}
+		for _, counter := range []struct {
+			name  string
+			value uint64
+		}{
+			{"NetBytesSent", stat.BytesSent},
+			{"NetBytesRecv", stat.BytesRecv},
+			{"NetPacketsSent", stat.PacketsSent},
+			{"NetPacketsRecv", stat.PacketsRecv},
+			{"NetErrorsIn", stat.Errin},
+			{"NetErrorsOut", stat.Errout},
+			{"NetDropsIn", stat.Dropin},
+			{"NetDropsOut", stat.Dropout},
+		} {
+			if metric, ok := c.cumulative.counter(counter.name, counter.value, labels); ok {
+				collected = append(collected, metric)
+			}
+		}
+	}
+
+	return collected, nil
+}
+
+func (networkCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: "NetBytesSent", MType: "counter", Unit: "bytes", Help: "Bytes sent by the interface."},
+		{Name: "NetBytesRecv", MType: "counter", Unit: "bytes", Help: "Bytes received by the interface."},
+		{Name: "NetPacketsSent", MType: "counter", Unit: "packets", Help: "Packets sent by the interface."},
+		{Name: "NetPacketsRecv", MType: "counter", Unit: "packets", Help: "Packets received by the interface."},
+		{Name: "NetErrorsIn", MType: "counter", Unit: "errors", Help: "Errors while receiving."},
+		{Name: "NetErrorsOut", MType: "counter", Unit: "errors", Help: "Errors while sending."},
+		{Name: "NetDropsIn", MType: "counter", Unit: "packets", Help: "Incoming packets dropped."},
+		{Name: "NetDropsOut", MType: "counter", Unit: "packets", Help: "Outgoing packets dropped."},
+	}
+}
+
+// loadCollector reports the load average of the host over 1, 5 and 15 minutes.
+type loadCollector struct {
+	avg func() (*load.AvgStat, error)
+}
+
+func (c loadCollector) Collect() ([]metrics.Metrics, error) {
+	avg, err := c.avg()
+	if err != nil {
+		return nil, err
+	}
+
+	return []metrics.Metrics{
+		NewGauge("Load1", avg.Load1, nil),
+		NewGauge("Load5", avg.Load5, nil),
+		NewGauge("Load15", avg.Load15, nil),
+	}, nil
+}
+
+func (loadCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: "Load1", MType: "gauge", Help: "Load average of the host over 1 minute."},
+		{Name: "Load5", MType: "gauge", Help: "Load average of the host over 5 minutes."},
+		{Name: "Load15", MType: "gauge", Help: "Load average of the host over 15 minutes."},
+	}
+}
+
+// uptimeCollector reports the uptime of the host and the time it was booted at, both in seconds.
+type uptimeCollector struct {
+	uptime   func() (uint64, error)
+	bootTime func() (uint64, error)
+}
+
+func (c uptimeCollector) Collect() ([]metrics.Metrics, error) {
+	uptime, err := c.uptime()
+	if err != nil {
+		return nil, err
+	}
+	bootTime, err := c.bootTime()
+	if err != nil {
+		return nil, err
+	}
+
+	return []metrics.Metrics{
+		NewGauge("UptimeSeconds", float64(uptime), nil),
+		NewGauge("BootTimeSeconds", float64(bootTime), nil),
+	}, nil
+}
+
+func (uptimeCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: "UptimeSeconds", MType: "gauge", Unit: "seconds", Help: "Time since the host was booted."},
+		{Name: "BootTimeSeconds", MType: "gauge", Unit: "seconds", Help: "Time the host was booted at, since the Unix epoch."},
+	}
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// byKey returns the metrics by their type, name and labels.
+func byKey(collected []metrics.Metrics) map[string]metrics.Metrics {
+	byKey := map[string]metrics.Metrics{}
+	for _, metric := range collected {
+		byKey[metric.MType+":"+string(metric.Key())] = metric
+	}
+	return byKey
+}
+
+func TestCumulative(t *testing.T) {
+	c := newCumulative()
+	eth0 := map[string]string{"interface": "eth0"}
+	eth1 := map[string]string{"interface": "eth1"}
+
+	// The first value of a series gives no delta.
+	_, ok := c.counter("NetBytesSent", 100, eth0)
+	require.False(t, ok)
+	_, ok = c.counter("NetBytesSent", 500, eth1)
+	require.False(t, ok)
+
+	metric, ok := c.counter("NetBytesSent", 150, eth0)
+	require.True(t, ok)
+	require.Equal(t, int64(50), *metric.Delta)
+	require.Equal(t, eth0, metric.Labels)
+
+	// A lower value is a reset of the counter, the value itself is the increase.
+	metric, ok = c.counter("NetBytesSent", 30, eth0)
+	require.True(t, ok)
+	require.Equal(t, int64(30), *metric.Delta)
+	metric, ok = c.counter("NetBytesSent", 40, eth0)
+	require.True(t, ok)
+	require.Equal(t, int64(10), *metric.Delta)
+
+	metric, ok = c.counter("NetBytesSent", 500, eth1)
+	require.True(t, ok)
+	require.Equal(t, int64(0), *metric.Delta)
+}
+
+func TestNetworkCollector(t *testing.T) {
+	collector, err := newNetworkCollector(json.RawMessage(`{"interfaces": ["eth0"]}`))
+	require.NoError(t, err)
+	c := collector.(networkCollector)
+	var stats []net.IOCountersStat
+	c.ioCounters = func(pernic bool) ([]net.IOCountersStat, error) {
+		require.True(t, pernic)
+		return stats, nil
+	}
+	key := func(name string) string {
+		return "counter:" + string(metrics.SeriesKey(name, "", map[string]string{"interface": "eth0"}))
+	}
+
+	stats = []net.IOCountersStat{{Name: "eth0", BytesSent: 100, Errin: 1}, {Name: "lo", BytesSent: 1000}}
+	collected, err := c.Collect()
+	require.NoError(t, err)
+	require.Empty(t, collected)
+
+	stats = []net.IOCountersStat{{Name: "eth0", BytesSent: 250, Errin: 1}, {Name: "lo", BytesSent: 2000}}
+	got := byKey(mustCollect(t, c))
+	require.Len(t, got, 8)
+	require.Equal(t, int64(150), *got[key("NetBytesSent")].Delta)
+	require.Equal(t, int64(0), *got[key("NetErrorsIn")].Delta)
+
+	// The interface is recreated and its counters start from zero.
+	stats = []net.IOCountersStat{{Name: "eth0", BytesSent: 20}}
+	got = byKey(mustCollect(t, c))
+	require.Equal(t, int64(20), *got[key("NetBytesSent")].Delta)
+
+	c.ioCounters = func(bool) ([]net.IOCountersStat, error) { return nil, errors.New("no /proc") }
+	_, err = c.Collect()
+	require.Error(t, err)
+}
+
+func TestDiskIOCollector(t *testing.T) {
+	collector, err := newDiskIOCollector(json.RawMessage(`{"devices": ["sda"]}`))
+	require.NoError(t, err)
+	c := collector.(diskIOCollector)
+	reads := uint64(10)
+	c.ioCounters = func(names ...string) (map[string]disk.IOCountersStat, error) {
+		require.Equal(t, []string{"sda"}, names)
+		return map[string]disk.IOCountersStat{"sda": {ReadCount: reads, IopsInProgress: 2}}, nil
+	}
+	labels := map[string]string{"device": "sda"}
+
+	got := byKey(mustCollect(t, c))
+	require.Len(t, got, 1)
+	require.Equal(t, 2.0, *got["gauge:"+string(metrics.SeriesKey("DiskIOInProgress", "", labels))].Value)
+
+	reads = 15
+	got = byKey(mustCollect(t, c))
+	require.Len(t, got, 6)
+	require.Equal(t, int64(5), *got["counter:"+string(metrics.SeriesKey("DiskReads", "", labels))].Delta)
+}
+
+func TestFilesystemCollector(t *testing.T) {
+	collector, err := newFilesystemCollector(json.RawMessage(`{"mountpoints": ["/", "/data"], "all": true}`))
+	require.NoError(t, err)
+	c := collector.(filesystemCollector)
+	c.partitions = func(all bool) ([]disk.PartitionStat, error) {
+		require.True(t, all)
+		return []disk.PartitionStat{
+			{Mountpoint: "/", Device: "/dev/sda1", Fstype: "ext4"},
+			{Mountpoint: "/data", Device: "/dev/sdb1", Fstype: "xfs"},
+			{Mountpoint: "/boot", Device: "/dev/sda2", Fstype: "ext4"},
+		}, nil
+	}
+	c.usage = func(path string) (*disk.UsageStat, error) {
+		if path == "/data" {
+			return nil, errors.New("permission denied")
+		}
+		return &disk.UsageStat{Total: 100, Used: 25, Free: 75, UsedPercent: 25}, nil
+	}
+
+	// A filesystem which can not be read is skipped.
+	got := byKey(mustCollect(t, c))
+	require.Len(t, got, 5)
+	labels := map[string]string{"mountpoint": "/", "device": "/dev/sda1", "fstype": "ext4"}
+	require.Equal(t, 25.0, *got["gauge:"+string(metrics.SeriesKey("FilesystemUsedBytes", "", labels))].Value)
+}
+
+func TestLoadUptimeCollectors(t *testing.T) {
+	got := byKey(mustCollect(t, loadCollector{avg: func() (*load.AvgStat, error) {
+		return &load.AvgStat{Load1: 1, Load5: 0.5, Load15: 0.25}, nil
+	}}))
+	require.Equal(t, 0.25, *got["gauge:Load15"].Value)
+
+	got = byKey(mustCollect(t, uptimeCollector{
+		uptime:   func() (uint64, error) { return 60, nil },
+		bootTime: func() (uint64, error) { return 1700000000, nil },
+	}))
+	require.Equal(t, 60.0, *got["gauge:UptimeSeconds"].Value)
+	require.Equal(t, 1700000000.0, *got["gauge:BootTimeSeconds"].Value)
+}
+
+func TestHostCollectorOptions(t *testing.T) {
+	for name, factory := range map[string]CollectorFactory{
+		"filesystem": newFilesystemCollector,
+		"diskio":     newDiskIOCollector,
+		"network":    newNetworkCollector,
+	} {
+		_, err := factory(nil)
+		require.NoError(t, err, name)
+		_, err = factory(json.RawMessage(`{"unknown": true}`))
+		require.Error(t, err, name)
+		_, err = factory(json.RawMessage(`[]`))
+		require.Error(t, err, name)
+	}
+	_, err := newNetworkCollector(json.RawMessage(`{"interfaces": "eth0"}`))
+	require.Error(t, err)
+	_, err = newFilesystemCollector(json.RawMessage(`{"all": "yes"}`))
+	require.Error(t, err)
+}
+
+// mustCollect collects the metrics of the collector and fails the test on error.
+func mustCollect(t *testing.T, c Collector) []metrics.Metrics {
+	t.Helper()
+	collected, err := c.Collect()
+	require.NoError(t, err)
+	return collected
+}
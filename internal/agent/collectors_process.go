@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/process"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+func init() {
+	RegisterCollector("process", newProcessCollector)
+}
+
+// ProcessSelector selects the process to monitor by exactly one of PIDFile, Exe or Cmdline.
+// If several processes match Exe or Cmdline, the oldest of them, usually the parent, is the monitored one.
+type ProcessSelector struct {
+	Name    string `json:"name"`     // The value of the label process of the metrics.
+	PIDFile string `json:"pid_file"` // The path to the file with the PID of the process.
+	Exe     string `json:"exe"`      // The name of the executable, e.g. "nginx".
+	Cmdline string `json:"cmdline"`  // The regular expression matched against the command line.
+
+	cmdline *regexp.Regexp
+}
+
+// processOptions are the options of the process collector.
+//
+// They look like:
+//
+//	"collector_options": {"process": {"processes": [
+//	  {"name": "nginx", "pid_file": "/run/nginx.pid"},
+//	  {"name": "postgres", "exe": "postgres"},
+//	  {"name": "worker", "cmdline": "python .*worker\\.py"}
+//	]}}
+type processOptions struct {
+	Processes []ProcessSelector `json:"processes"`
+}
+
+// monitored is the state of a selected process kept between polls.
+type monitored struct {
+	process    *process.Process // kept while the process lives, CPU percent is measured since the previous poll.
+	createTime int64
+}
+
+// processCollector reports the metrics of the selected processes with the label process:
+// CPU percent, RSS, open file descriptors and threads of the process, the number of the matching processes,
+// whether the process is running and the number of its restarts detected by the change of the PID.
+type processCollector struct {
+	selectors []ProcessSelector
+	state     map[string]*monitored
+}
+
+func newProcessCollector(options json.RawMessage) (Collector, error) {
+	var opts processOptions
+	err := decodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Processes) == 0 {
+		return nil, errors.New("no processes are selected")
+	}
+
+	names := map[string]bool{}
+	for i := range opts.Processes {
+		selector := &opts.Processes[i]
+		if selector.Name == "" {
+			return nil, errors.New("process name is required")
+		}
+		if names[selector.Name] {
+			return nil, fmt.Errorf("duplicate process name %q", selector.Name)
+		}
+		names[selector.Name] = true
+
+		set := 0
+		for _, field := range []string{selector.PIDFile, selector.Exe, selector.Cmdline} {
+			if field != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("process %q: exactly one of pid_file, exe and cmdline should be set", selector.Name)
+		}
+		if selector.Cmdline != "" {
+			selector.cmdline, err = regexp.Compile(selector.Cmdline)
+			if err != nil {
+				return nil, fmt.Errorf("process %q: %w", selector.Name, err)
+			}
+		}
+	}
+
+	return &processCollector{selectors: opts.Processes, state: map[string]*monitored{}}, nil
+}
+
+func (c *processCollector) Collect() ([]metrics.Metrics, error) {
+	var all []*process.Process
+	for _, selector := range c.selectors {
+		if selector.PIDFile == "" {
+			var err error
+			all, err = process.Processes()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	var collected []metrics.Metrics
+	for _, selector := range c.selectors {
+		labels := map[string]string{"process": selector.Name}
+		matched, err := selector.find(all)
+		if err != nil {
+			MyLog.Printf("process %s: %v", selector.Name, err)
+		}
+		collected = append(collected, NewGauge("ProcessCount", float64(len(matched)), labels))
+		if len(matched) == 0 {
+			collected = append(collected, NewGauge("ProcessUp", 0, labels))
+			continue
+		}
+		collected = append(collected, NewGauge("ProcessUp", 1, labels))
+
+		main, createTime := oldest(matched)
+		state, ok := c.state[selector.Name]
+		switch {
+		case !ok:
+			state = &monitored{process: main, createTime: createTime}
+			c.state[selector.Name] = state
+		case state.process.Pid != main.Pid || state.createTime != createTime:
+			MyLog.Printf("process %s is restarted, PID %d -> %d", selector.Name, state.process.Pid, main.Pid)
+			state.process, state.createTime = main, createTime
+			collected = append(collected, NewCounter("ProcessRestarts", 1, labels))
+		}
+		collected = append(collected, state.collect(labels)...)
+	}
+
+	return collected, nil
+}
+
+func (c *processCollector) Describe() []metrics.Metadata {
+	return []metrics.Metadata{
+		{Name: "ProcessCount", MType: "gauge", Unit: "processes", Help: "Number of the processes matching the selector."},
+		{Name: "ProcessUp", MType: "gauge", Help: "1 if a matching process is running, 0 otherwise."},
+		{Name: "ProcessRestarts", MType: "counter", Unit: "restarts", Help: "Restarts of the process detected by the change of its PID."},
+		{Name: "ProcessCPUPercent", MType: "gauge", Unit: "percent", Help: "CPU utilization of the process since the previous poll."},
+		{Name: "ProcessRSSBytes", MType: "gauge", Unit: "bytes", Help: "Resident set size of the process."},
+		{Name: "ProcessOpenFDs", MType: "gauge", Unit: "descriptors", Help: "Open file descriptors of the process."},
+		{Name: "ProcessThreads", MType: "gauge", Unit: "threads", Help: "Threads of the process."},
+	}
+}
+
+// find returns the processes matching the selector. all is the list of running processes,
+// it is not used for the selection by the PID file.
+func (s ProcessSelector) find(all []*process.Process) ([]*process.Process, error) {
+	if s.PIDFile != "" {
+		data, err := os.ReadFile(s.PIDFile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PID file: %w", err)
+		}
+		p, err := process.NewProcess(int32(pid))
+		if err != nil {
+			// The process is not running, the PID file is stale.
+			return nil, nil
+		}
+		return []*process.Process{p}, nil
+	}
+
+	var matched []*process.Process
+	for _, p := range all {
+		if s.Exe != "" {
+			name, _ := p.Name()
+			exe, _ := p.Exe()
+			if name == s.Exe || (exe != "" && filepath.Base(exe) == s.Exe) {
+				matched = append(matched, p)
+			}
+			continue
+		}
+		cmdline, err := p.Cmdline()
+		if err == nil && cmdline != "" && s.cmdline.MatchString(cmdline) {
+			matched = append(matched, p)
+		}
+	}
+
+	return matched, nil
+}
+
+// oldest returns the process started first and its create time.
+func oldest(processes []*process.Process) (*process.Process, int64) {
+	var main *process.Process
+	var mainCreateTime int64
+	for _, p := range processes {
+		createTime, err := p.CreateTime()
+		if err != nil {
+			continue
+		}
+		if main == nil || createTime < mainCreateTime || (createTime == mainCreateTime && p.Pid < main.Pid) {
+			main, mainCreateTime = p, createTime
+		}
+	}
+	if main == nil {
+		return processes[0], 0
+	}
+	return main, mainCreateTime
+}
+
+// collect returns the resource usage of the monitored process. The metrics which can not be read,
+// e.g. the file descriptors of a process of another user, are skipped.
+func (m *monitored) collect(labels map[string]string) []metrics.Metrics {
+	var collected []metrics.Metrics
+	if percent, err := m.process.Percent(0); err == nil {
+		collected = append(collected, NewGauge("ProcessCPUPercent", percent, labels))
+	}
+	if memInfo, err := m.process.MemoryInfo(); err == nil {
+		collected = append(collected, NewGauge("ProcessRSSBytes", float64(memInfo.RSS), labels))
+	}
+	if fds, err := m.process.NumFDs(); err == nil {
+		collected = append(collected, NewGauge("ProcessOpenFDs", float64(fds), labels))
+	}
+	if threads, err := m.process.NumThreads(); err == nil {
+		collected = append(collected, NewGauge("ProcessThreads", float64(threads), labels))
+	}
+	return collected
+}
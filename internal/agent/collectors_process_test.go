@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+func TestNewProcessCollector_Invalid(t *testing.T) {
+	for _, options := range []string{
+		``,
+		`{}`,
+		`{"processes": []}`,
+		`{"processes": [{"exe": "nginx"}]}`,
+		`{"processes": [{"name": "nginx"}]}`,
+		`{"processes": [{"name": "nginx", "exe": "nginx", "pid_file": "/run/nginx.pid"}]}`,
+		`{"processes": [{"name": "nginx", "exe": "nginx"}, {"name": "nginx", "pid_file": "/run/nginx.pid"}]}`,
+		`{"processes": [{"name": "worker", "cmdline": "python (worker"}]}`,
+		`{"processes": [{"name": "nginx", "exe": "nginx", "user": "www"}]}`,
+	} {
+		_, err := newProcessCollector(json.RawMessage(options))
+		require.Error(t, err, options)
+	}
+
+	_, err := newProcessCollector(json.RawMessage(`{"processes": [
+	  {"name": "nginx", "pid_file": "/run/nginx.pid"},
+	  {"name": "postgres", "exe": "postgres"},
+	  {"name": "worker", "cmdline": "python .*worker\\.py"}
+	]}`))
+	require.NoError(t, err)
+}
+
+// startSleep starts a process which lives until the end of the test and writes its PID to the file.
+func startSleep(t *testing.T, pidFile string) *exec.Cmd {
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o600))
+	return cmd
+}
+
+func TestProcessCollector(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+	pidFile := filepath.Join(t.TempDir(), "sleep.pid")
+	first := startSleep(t, pidFile)
+
+	collector, err := newProcessCollector(json.RawMessage(`{"processes": [
+	  {"name": "pidfile", "pid_file": "` + pidFile + `"},
+	  {"name": "exe", "exe": "sleep"},
+	  {"name": "cmdline", "cmdline": "^sleep 60$"},
+	  {"name": "missing", "exe": "no-such-process-name"}
+	]}`))
+	require.NoError(t, err)
+	c := collector.(*processCollector)
+	value := func(got map[string]metrics.Metrics, name, process string) *float64 {
+		return got["gauge:"+string(metrics.SeriesKey(name, "", map[string]string{"process": process}))].Value
+	}
+	restarts := func(got map[string]metrics.Metrics, process string) (metrics.Metrics, bool) {
+		metric, ok := got["counter:"+string(metrics.SeriesKey("ProcessRestarts", "", map[string]string{"process": process}))]
+		return metric, ok
+	}
+
+	got := byKey(mustCollect(t, c))
+	for _, process := range []string{"pidfile", "exe", "cmdline"} {
+		require.Equal(t, 1.0, *value(got, "ProcessUp", process), process)
+		require.GreaterOrEqual(t, *value(got, "ProcessCount", process), 1.0, process)
+	}
+	require.Equal(t, 0.0, *value(got, "ProcessUp", "missing"))
+	require.Equal(t, 0.0, *value(got, "ProcessCount", "missing"))
+	require.Equal(t, int32(first.Process.Pid), c.state["pidfile"].process.Pid)
+	_, ok := restarts(got, "pidfile")
+	require.False(t, ok)
+
+	// The process is restarted with another PID.
+	require.NoError(t, first.Process.Kill())
+	_ = first.Wait()
+	second := startSleep(t, pidFile)
+	got = byKey(mustCollect(t, c))
+	metric, ok := restarts(got, "pidfile")
+	require.True(t, ok)
+	require.Equal(t, int64(1), *metric.Delta)
+	require.Equal(t, int32(second.Process.Pid), c.state["pidfile"].process.Pid)
+
+	got = byKey(mustCollect(t, c))
+	_, ok = restarts(got, "pidfile")
+	require.False(t, ok)
+
+	// A new process with the same PID is told by its create time.
+	c.state["pidfile"].createTime--
+	got = byKey(mustCollect(t, c))
+	_, ok = restarts(got, "pidfile")
+	require.True(t, ok)
+
+	// The process is down while the PID file is stale.
+	require.NoError(t, second.Process.Kill())
+	_ = second.Wait()
+	got = byKey(mustCollect(t, c))
+	require.Equal(t, 0.0, *value(got, "ProcessUp", "pidfile"))
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// pushGaugeTTL is how long a pushed gauge is reported without being pushed again.
+const pushGaugeTTL = 10 * time.Minute
+
+// maxPushBody is the maximum size of a push request.
+const maxPushBody = 4 << 20
+
+// PushServer is the local listener the applications of the host push their metrics to.
+// It accepts the same JSON as the server: a single metrics.Metrics on /update/ and an array of them on /updates/.
+// The pushed metrics are reported by the agent with its own metrics, so the applications reuse its TLS,
+// signing, retries and spool. The hashes of the pushed metrics are ignored, the agent signs them with its key.
+//
+// PushServer is a Collector: gauges are reported until they are not pushed for pushGaugeTTL,
+// counters are summed up until the next report.
+type PushServer struct {
+	listener net.Listener
+	server   *http.Server
+
+	mu       sync.Mutex
+	gauges   map[metrics.Metric]pushedGauge
+	counters map[metrics.Metric]metrics.Metrics
+}
+
+type pushedGauge struct {
+	metric   metrics.Metrics
+	pushedAt time.Time
+}
+
+var (
+	errPushNotLoopback = errors.New("push address should be a loopback one, e.g. 127.0.0.1:9091")
+	errPushNotSocket   = errors.New("push path exists and is not a socket")
+)
+
+// NewPushServer listens on the address. An address starting with "unix:" is the path to a Unix socket,
+// otherwise it is a TCP address with a loopback host, e.g. "127.0.0.1:9091" or "localhost:9091":
+// the pushed metrics are not authenticated, so they are accepted from the host only.
+func NewPushServer(address string) (*PushServer, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", strings.TrimPrefix(path, "//")
+		// A socket left by the previous run prevents listening, any other file is not removed.
+		info, err := os.Lstat(address)
+		switch {
+		case err == nil && info.Mode()&os.ModeSocket == 0:
+			return nil, fmt.Errorf("%w: %s", errPushNotSocket, address)
+		case err == nil:
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, err
+		}
+	} else if err := checkLoopback(address); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &PushServer{
+		listener: listener,
+		gauges:   map[metrics.Metric]pushedGauge{},
+		counters: map[metrics.Metric]metrics.Metrics{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update/", ps.handleUpdate)
+	mux.HandleFunc("/updates/", ps.handleUpdates)
+	ps.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	return ps, nil
+}
+
+// checkLoopback returns an error unless the host of the TCP address is localhost or a loopback IP.
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errPushNotLoopback, address)
+}
+
+// Addr returns the address the server listens on.
+func (ps *PushServer) Addr() net.Addr {
+	return ps.listener.Addr()
+}
+
+// Serve accepts the pushes until ctx is done.
+func (ps *PushServer) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = ps.server.Shutdown(shutdownCtx)
+	}()
+
+	err := ps.server.Serve(ps.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Collect implements Collector.
+func (ps *PushServer) Collect() ([]metrics.Metrics, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	collected := make([]metrics.Metrics, 0, len(ps.gauges)+len(ps.counters))
+	for key, gauge := range ps.gauges {
+		if time.Since(gauge.pushedAt) > pushGaugeTTL {
+			delete(ps.gauges, key)
+			continue
+		}
+		collected = append(collected, gauge.metric)
+	}
+	for _, counter := range ps.counters {
+		collected = append(collected, counter)
+	}
+	ps.counters = map[metrics.Metric]metrics.Metrics{}
+
+	return collected, nil
+}
+
+func (ps *PushServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	var metric metrics.Metrics
+	if !decodePush(w, r, &metric) {
+		return
+	}
+	ps.push(w, []metrics.Metrics{metric})
+}
+
+func (ps *PushServer) handleUpdates(w http.ResponseWriter, r *http.Request) {
+	var batch []metrics.Metrics
+	if !decodePush(w, r, &batch) {
+		return
+	}
+	ps.push(w, batch)
+}
+
+// decodePush decodes the body of the POST request into v, it writes the error response and returns false on failure.
+func decodePush(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are allowed!", http.StatusMethodNotAllowed)
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPushBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if len(body) > maxPushBody {
+		http.Error(w, "request is too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// push validates the whole batch and then keeps it until the next Collect.
+func (ps *PushServer) push(w http.ResponseWriter, batch []metrics.Metrics) {
+	for _, metric := range batch {
+		if err := validatePushed(metric); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	ps.mu.Lock()
+	for _, metric := range batch {
+		metric.Hash, metric.Agent = "", ""
+		key := metric.Key()
+		switch metric.MType {
+		case "gauge":
+			ps.gauges[key] = pushedGauge{metric: metric, pushedAt: now}
+		case "counter":
+			if stored, ok := ps.counters[key]; ok {
+				delta := *stored.Delta + *metric.Delta
+				metric.Delta = &delta
+			}
+			ps.counters[key] = metric
+		case "histogram":
+			key = "histogram:" + key
+			if stored, ok := ps.counters[key]; ok {
+				if !stored.Histogram.SameBounds(*metric.Histogram) {
+					MyLog.Printf("push: buckets of histogram %s changed, its observations since the last report are dropped", metric.ID)
+				}
+				histogram := stored.Histogram.Merge(*metric.Histogram)
+				metric.Histogram = &histogram
+			}
+			ps.counters[key] = metric
+		}
+	}
+	ps.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validatePushed checks the pushed metric as the server does.
+func validatePushed(metric metrics.Metrics) error {
+	if err := metric.Validate(); err != nil {
+		return err
+	}
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil || metric.Delta != nil {
+			return fmt.Errorf("gauge %s should have only value", metric.ID)
+		}
+	case "counter":
+		if metric.Delta == nil || metric.Value != nil {
+			return fmt.Errorf("counter %s should have only delta", metric.ID)
+		}
+	case "histogram":
+		if metric.Histogram == nil {
+			return fmt.Errorf("histogram %s should have histogram", metric.ID)
+		}
+		return metric.Histogram.Validate()
+	default:
+		return fmt.Errorf("not allowed type %q", metric.MType)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// newTestPushServer serves a PushServer on a loopback port until the end of the test and returns it with its URL.
+func newTestPushServer(t *testing.T) (*PushServer, string) {
+	ps, err := NewPushServer("127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = ps.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ps, "http://" + ps.Addr().String()
+}
+
+// post sends the body to the push server and returns the status code.
+func post(t *testing.T, url, body string) int {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+// collectedByKey collects the metrics of the push server by their type and series key.
+func collectedByKey(t *testing.T, ps *PushServer) map[string]metrics.Metrics {
+	t.Helper()
+	collected, err := ps.Collect()
+	require.NoError(t, err)
+	byKey := map[string]metrics.Metrics{}
+	for _, metric := range collected {
+		byKey[metric.MType+":"+string(metric.Key())] = metric
+	}
+	return byKey
+}
+
+func TestPushServer_Counters(t *testing.T) {
+	ps, url := newTestPushServer(t)
+
+	require.Equal(t, http.StatusAccepted, post(t, url+"/update/", `{"id":"requests","type":"counter","delta":2}`))
+	require.Equal(t, http.StatusAccepted, post(t, url+"/updates/", `[{"id":"requests","type":"counter","delta":3},{"id":"temperature","type":"gauge","value":21.5}]`))
+
+	got := collectedByKey(t, ps)
+	require.Equal(t, int64(5), *got["counter:requests"].Delta)
+	require.Equal(t, 21.5, *got["gauge:temperature"].Value)
+
+	// The counters are reported once, the gauges until they expire.
+	got = collectedByKey(t, ps)
+	require.NotContains(t, got, "counter:requests")
+	require.Contains(t, got, "gauge:temperature")
+}
+
+func TestPushServer_GaugeTTL(t *testing.T) {
+	ps, url := newTestPushServer(t)
+
+	require.Equal(t, http.StatusAccepted, post(t, url+"/updates/", `[{"id":"fresh","type":"gauge","value":1},{"id":"stale","type":"gauge","value":2}]`))
+	ps.mu.Lock()
+	stale := ps.gauges["stale"]
+	stale.pushedAt = time.Now().Add(-pushGaugeTTL - time.Second)
+	ps.gauges["stale"] = stale
+	ps.mu.Unlock()
+
+	got := collectedByKey(t, ps)
+	require.Contains(t, got, "gauge:fresh")
+	require.NotContains(t, got, "gauge:stale")
+	ps.mu.Lock()
+	require.NotContains(t, ps.gauges, metrics.Metric("stale"))
+	ps.mu.Unlock()
+}
+
+func TestPushServer_Invalid(t *testing.T) {
+	ps, url := newTestPushServer(t)
+
+	for _, body := range []string{
+		`[{"id":"requests{","type":"counter","delta":1}]`,
+		`[{"id":"requests","type":"counter","value":1}]`,
+		`[{"id":"temperature","type":"gauge","delta":1}]`,
+		`[{"id":"temperature","type":"gauge","value":1,"delta":1}]`,
+		`[{"id":"latency","type":"histogram"}]`,
+		`[{"id":"latency","type":"summary","value":1}]`,
+		// A valid metric is not kept if another one of the batch is invalid.
+		`[{"id":"requests","type":"counter","delta":1},{"id":"temperature","type":"gauge"}]`,
+		`not json`,
+	} {
+		require.Equal(t, http.StatusBadRequest, post(t, url+"/updates/", body), body)
+	}
+	resp, err := http.Get(url + "/updates/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	require.Empty(t, collectedByKey(t, ps))
+}
+
+func TestNewPushServer_Address(t *testing.T) {
+	for _, address := range []string{":9091", "0.0.0.0:9091", "192.0.2.1:9091", "example.com:9091", "127.0.0.1"} {
+		_, err := NewPushServer(address)
+		require.Error(t, err, address)
+	}
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0", "localhost:0"} {
+		ps, err := NewPushServer(address)
+		if err != nil {
+			var opErr *net.OpError
+			// The host may have no IPv6 loopback.
+			require.ErrorAs(t, err, &opErr, address)
+			continue
+		}
+		require.NoError(t, ps.listener.Close())
+	}
+}
+
+func TestNewPushServer_Socket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A regular file at the path is not removed.
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0o600))
+	_, err := NewPushServer("unix:" + file)
+	require.ErrorIs(t, err, errPushNotSocket)
+	_, err = os.Stat(file)
+	require.NoError(t, err)
+
+	// A socket left by the previous run is replaced.
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+	require.NoError(t, listener.Close())
+	ps, err := NewPushServer("unix:" + socket)
+	require.NoError(t, err)
+	require.NoError(t, ps.listener.Close())
+}
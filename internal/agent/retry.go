@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// Default values of RetryPolicy.
+const (
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = time.Second
+	DefaultRetryMaxBackoff     = 5 * time.Second
+	DefaultRetryJitter         = 0.2
+)
+
+// RetryPolicy describes how the agent retries sending a batch which failed with a transient error.
+// The delay before the n-th retry is InitialBackoff*2^(n-1) capped by MaxBackoff, randomly changed by up to Jitter of it,
+// so the agents restarted together do not retry in lockstep.
+//
+// Transient errors are network errors, HTTP 5xx and 429 responses and gRPC Unavailable and ResourceExhausted statuses.
+type RetryPolicy struct {
+	MaxAttempts    int           // The maximum number of attempts including the first one, 1 means no retries.
+	InitialBackoff time.Duration // The delay before the first retry.
+	MaxBackoff     time.Duration // The maximum delay between attempts.
+	Jitter         float64       // The fraction of the delay it is randomly changed by, from 0 to 1.
+}
+
+// DefaultRetryPolicy returns the policy used when the configuration does not set it.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		Jitter:         DefaultRetryJitter,
+	}
+}
+
+// Validate checks the values of the policy.
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("retry max attempts should be positive")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("retry backoff should not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry jitter should be from 0 to 1")
+	}
+	return nil
+}
+
+// Wrap returns send which retries the batch according to the policy until it succeeds, fails with
+// an error which is not transient or the attempts are over. Waiting for a retry is interrupted by closing cancel,
+// the last error is returned then.
+func (p RetryPolicy) Wrap(send func(key string, batch []metrics.Metrics) error, cancel <-chan struct{}) func(key string, batch []metrics.Metrics) error {
+	return func(key string, batch []metrics.Metrics) error {
+		var err error
+		for attempt := 1; ; attempt++ {
+			err = send(key, batch)
+			if err == nil || !retryable(err) || attempt >= p.MaxAttempts {
+				return err
+			}
+
+			delay := p.backoff(attempt)
+			var se *statusError
+			if errors.As(err, &se) && se.retryAfter > delay {
+				delay = se.retryAfter
+			}
+			MyLog.Printf("attempt %d failed, retrying in %s: %v", attempt, delay.Round(time.Millisecond), err)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-cancel:
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// backoff returns the delay before the retry following the attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	delay += delay * p.Jitter * (2*rand.Float64() - 1)
+
+	return time.Duration(delay)
+}
+
+// statusError is the error of an HTTP response with an unsuccessful status.
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+// newStatusError creates the error of the response, taking the delay from its Retry-After header in seconds.
+func newStatusError(response *http.Response) *statusError {
+	se := &statusError{code: response.StatusCode}
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		se.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return se
+}
+
+func (se *statusError) Error() string {
+	return fmt.Sprintf("server responded with status %d", se.code)
+}
+
+// retryable reports whether the error of sending is transient.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.Unavailable || s.Code() == codes.ResourceExhausted
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.2}
+	for attempt, base := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		base *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			delay := p.backoff(attempt + 1)
+			require.GreaterOrEqual(t, delay, base*8/10, attempt+1)
+			require.LessOrEqual(t, delay, base*12/10, attempt+1)
+		}
+	}
+
+	p.Jitter = 0
+	require.Equal(t, 400*time.Millisecond, p.backoff(3))
+	p.MaxBackoff = 0
+	require.Equal(t, 3200*time.Millisecond, p.backoff(6))
+}
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	require.NoError(t, DefaultRetryPolicy().Validate())
+	for _, p := range []RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 1, InitialBackoff: -time.Second},
+		{MaxAttempts: 1, MaxBackoff: -time.Second},
+		{MaxAttempts: 1, Jitter: -0.1},
+		{MaxAttempts: 1, Jitter: 1.5},
+	} {
+		require.Error(t, p.Validate(), p)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&statusError{code: http.StatusInternalServerError}, true},
+		{&statusError{code: http.StatusServiceUnavailable}, true},
+		{&statusError{code: http.StatusTooManyRequests}, true},
+		{&statusError{code: http.StatusBadRequest}, false},
+		{&statusError{code: http.StatusUnauthorized}, false},
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.ResourceExhausted, "exhausted"), true},
+		{status.Error(codes.InvalidArgument, "invalid"), false},
+		{status.Error(codes.Unknown, "unknown"), false},
+		{&url.Error{Op: "Post", URL: "http://localhost", Err: errors.New("connection refused")}, true},
+		{errors.New("invalid batch"), false},
+	} {
+		require.Equal(t, tt.retryable, retryable(tt.err), tt.err)
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	for header, retryAfter := range map[string]time.Duration{"": 0, "3": 3 * time.Second, "-1": 0, "Wed, 21 Oct 2015 07:28:00 GMT": 0} {
+		recorder := httptest.NewRecorder()
+		if header != "" {
+			recorder.Header().Set("Retry-After", header)
+		}
+		recorder.WriteHeader(http.StatusTooManyRequests)
+		se := newStatusError(recorder.Result())
+		require.Equal(t, http.StatusTooManyRequests, se.code)
+		require.Equal(t, retryAfter, se.retryAfter, header)
+	}
+}
+
+// sender fails with the errors in order and then succeeds, it counts the attempts.
+type sender struct {
+	errs     []error
+	attempts int
+}
+
+func (s *sender) send(key string, batch []metrics.Metrics) error {
+	s.attempts++
+	if s.attempts <= len(s.errs) {
+		return s.errs[s.attempts-1]
+	}
+	return nil
+}
+
+func TestRetryPolicy_Wrap(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	unavailable := &statusError{code: http.StatusServiceUnavailable}
+
+	s := &sender{errs: []error{unavailable}}
+	require.NoError(t, p.Wrap(s.send, nil)("key", nil))
+	require.Equal(t, 2, s.attempts)
+
+	s = &sender{errs: []error{unavailable, unavailable, unavailable, unavailable}}
+	require.ErrorIs(t, p.Wrap(s.send, nil)("key", nil), unavailable)
+	require.Equal(t, 3, s.attempts)
+
+	rejected := &statusError{code: http.StatusBadRequest}
+	s = &sender{errs: []error{rejected}}
+	require.ErrorIs(t, p.Wrap(s.send, nil)("key", nil), rejected)
+	require.Equal(t, 1, s.attempts)
+}
+
+func TestRetryPolicy_WrapRetryAfter(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	// Retry-After longer than the backoff delays the retry.
+	s := &sender{errs: []error{&statusError{code: http.StatusTooManyRequests, retryAfter: 200 * time.Millisecond}}}
+	start := time.Now()
+	require.NoError(t, p.Wrap(s.send, nil)("key", nil))
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Equal(t, 2, s.attempts)
+}
+
+func TestRetryPolicy_WrapCancel(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	unavailable := &statusError{code: http.StatusServiceUnavailable}
+	s := &sender{errs: []error{unavailable}}
+
+	cancel := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(cancel) })
+	start := time.Now()
+	require.ErrorIs(t, p.Wrap(s.send, cancel)("key", nil), unavailable)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, 1, s.attempts)
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/promtext"
+)
+
+// defaultScrapeTimeout is the timeout of a scrape if the target does not set it.
+const defaultScrapeTimeout = 5 * time.Second
+
+// maxScrapeBody is the maximum size of the exposition of a target.
+const maxScrapeBody = 16 << 20
+
+// scrapeTarget is a validated metrics.ScrapeTarget.
+type scrapeTarget struct {
+	metrics.ScrapeTarget
+	instance string
+	timeout  time.Duration
+}
+
+// ScrapeCollector scrapes the exporters in Prometheus format on every poll of the agent.
+//
+// Gauges and untyped metrics are reported as gauges, so are the quantiles of summaries. Counters, the buckets
+// and the counts of histograms and summaries are cumulative, the deltas between scrapes are reported as counters,
+// a value lower than the previous one is a restart of the exporter. The fractional part of the deltas is carried to the next scrape.
+// The sums of histograms and summaries are fractional, e.g. seconds, so they are reported as gauges with the cumulative value.
+//
+// Every metric gets the labels of its target and the labels job (the name of the target) and instance (the host and the port
+// of the target), the labels of the exporter with these names and with the name agent are renamed with the prefix exported_.
+// The gauge up{job,instance} is 1 if the last scrape of the target succeeded and 0 otherwise,
+// the failures are logged when the target goes down.
+type ScrapeCollector struct {
+	targets []scrapeTarget
+	client  *http.Client
+
+	mu   sync.Mutex
+	last map[metrics.Metric]float64
+	down map[string]bool
+}
+
+// NewScrapeCollector validates the targets and creates the collector scraping them.
+func NewScrapeCollector(targets []metrics.ScrapeTarget) (*ScrapeCollector, error) {
+	c := &ScrapeCollector{client: &http.Client{}, last: map[metrics.Metric]float64{}, down: map[string]bool{}}
+	names := map[string]bool{}
+	for _, target := range targets {
+		if target.Name == "" {
+			return nil, errors.New("scrape target name is required")
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("duplicate scrape target %q", target.Name)
+		}
+		names[target.Name] = true
+
+		address, err := url.Parse(target.URL)
+		if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+			return nil, fmt.Errorf("scrape target %q: invalid url %q", target.Name, target.URL)
+		}
+		if err := metrics.ValidateLabels(target.Labels); err != nil {
+			return nil, fmt.Errorf("scrape target %q: %w", target.Name, err)
+		}
+		timeout := defaultScrapeTimeout
+		if target.Timeout != "" {
+			timeout, err = time.ParseDuration(target.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("scrape target %q: invalid timeout", target.Name)
+			}
+		}
+
+		c.targets = append(c.targets, scrapeTarget{ScrapeTarget: target, instance: address.Host, timeout: timeout})
+	}
+
+	return c, nil
+}
+
+// Collect implements Collector. The targets are scraped concurrently, a failed target is logged and reported by up.
+func (c *ScrapeCollector) Collect() ([]metrics.Metrics, error) {
+	results := make([][]metrics.Metrics, len(c.targets))
+	var wg sync.WaitGroup
+	for i := range c.targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := c.targets[i]
+			up := map[string]string{"job": target.Name, "instance": target.instance}
+
+			collected, err := c.scrape(target)
+			c.setDown(target.Name, err)
+			if err != nil {
+				results[i] = []metrics.Metrics{NewGauge("up", 0, up)}
+				return
+			}
+			results[i] = append(collected, NewGauge("up", 1, up))
+		}(i)
+	}
+	wg.Wait()
+
+	var collected []metrics.Metrics
+	for _, result := range results {
+		collected = append(collected, result...)
+	}
+	return collected, nil
+}
+
+// setDown logs the failures of the target when it goes down and when it is back.
+func (c *ScrapeCollector) setDown(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err != nil && !c.down[name]:
+		MyLog.Printf("scrape %s: %v", name, err)
+	case err == nil && c.down[name]:
+		MyLog.Printf("scrape %s: target is up", name)
+	}
+	c.down[name] = err != nil
+}
+
+// scrape fetches and converts the metrics of the target.
+func (c *ScrapeCollector) scrape(target scrapeTarget) ([]metrics.Metrics, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), target.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	response, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	samples, err := promtext.Parse(http.MaxBytesReader(nil, response.Body, maxScrapeBody))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var collected []metrics.Metrics
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		labels := target.labels(sample.Labels)
+		if (metrics.Metrics{ID: sample.Name, Labels: labels}).Validate() != nil {
+			// The server rejects the whole batch with such a metric.
+			continue
+		}
+
+		switch {
+		case sample.Name == sample.Family+"_created":
+			// The creation time of OpenMetrics counters is not a value.
+		case sample.Name == sample.Family+"_sum" && (sample.Type == promtext.TypeHistogram || sample.Type == promtext.TypeSummary):
+			collected = append(collected, NewGauge(sample.Name, sample.Value, labels))
+		case sample.Type == promtext.TypeCounter,
+			sample.Type == promtext.TypeHistogram,
+			sample.Type == promtext.TypeSummary && sample.Name != sample.Family:
+			if metric, ok := c.delta(sample.Name, sample.Value, labels); ok {
+				collected = append(collected, metric)
+			}
+		default:
+			collected = append(collected, NewGauge(sample.Name, sample.Value, labels))
+		}
+	}
+
+	return collected, nil
+}
+
+// labels returns the labels of the sample with the labels of the target.
+func (t scrapeTarget) labels(sampleLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(t.Labels)+len(sampleLabels)+2)
+	for label, value := range t.Labels {
+		labels[label] = value
+	}
+	for label, value := range sampleLabels {
+		if label == "job" || label == "instance" || label == metrics.AgentLabel {
+			label = "exported_" + label
+		}
+		labels[label] = value
+	}
+	labels["job"] = t.Name
+	labels["instance"] = t.instance
+	return labels
+}
+
+// delta returns the counter with the increase of the cumulative value since the previous scrape.
+// The second value is false for the first scrape of the series. The caller should hold the lock.
+func (c *ScrapeCollector) delta(name string, value float64, labels map[string]string) (metrics.Metrics, bool) {
+	key := metrics.SeriesKey(name, "", labels)
+	last, ok := c.last[key]
+	c.last[key] = value
+	if !ok {
+		return metrics.Metrics{}, false
+	}
+
+	// The deltas of the integer parts add up to the integer part of the value, so no fraction is lost over time.
+	delta := int64(math.Floor(value))
+	if value >= last {
+		delta -= int64(math.Floor(last))
+	}
+	return NewCounter(name, delta, labels), true
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// exporter serves the exposition set by set, so a test changes the values between scrapes.
+type exporter struct {
+	mu   sync.Mutex
+	body string
+}
+
+func (e *exporter) set(body string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.body = body
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(e.body))
+}
+
+// collected collects the metrics of the collector and returns them by their type and series key.
+func collected(t *testing.T, c *ScrapeCollector) map[string]metrics.Metrics {
+	t.Helper()
+	collected, err := c.Collect()
+	require.NoError(t, err)
+	byKey := map[string]metrics.Metrics{}
+	for _, metric := range collected {
+		byKey[metric.MType+":"+string(metric.Key())] = metric
+	}
+	return byKey
+}
+
+func exposition(requests, sum, created string) string {
+	return `# TYPE requests counter
+requests_total{job="exporter",path="/api"} ` + requests + `
+requests_created{job="exporter",path="/api"} ` + created + `
+# TYPE temperature gauge
+temperature{agent="host1"} 21.5
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum ` + sum + `
+latency_seconds_count 4
+`
+}
+
+func TestScrapeCollector(t *testing.T) {
+	e := &exporter{}
+	server := httptest.NewServer(e)
+	defer server.Close()
+	address, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	c, err := NewScrapeCollector([]metrics.ScrapeTarget{{Name: "api", URL: server.URL + "/metrics", Labels: map[string]string{"env": "prod"}}})
+	require.NoError(t, err)
+	labels := func(extra map[string]string) map[string]string {
+		labels := map[string]string{"job": "api", "instance": address.Host, "env": "prod"}
+		for label, value := range extra {
+			labels[label] = value
+		}
+		return labels
+	}
+	gauge := func(name string, extra map[string]string) string {
+		return "gauge:" + string(metrics.SeriesKey(name, "", labels(extra)))
+	}
+	counter := func(name string, extra map[string]string) string {
+		return "counter:" + string(metrics.SeriesKey(name, "", labels(extra)))
+	}
+
+	// The first scrape reports the gauges only, the cumulative values are the base of the deltas.
+	e.set(exposition("10.5", "0.75", "1700000000"))
+	got := collected(t, c)
+	require.Equal(t, 21.5, *got[gauge("temperature", map[string]string{"exported_agent": "host1"})].Value)
+	require.Equal(t, 0.75, *got[gauge("latency_seconds_sum", nil)].Value)
+	require.Equal(t, 1.0, *got["gauge:"+string(metrics.SeriesKey("up", "", map[string]string{"job": "api", "instance": address.Host}))].Value)
+	require.NotContains(t, got, counter("requests_total", map[string]string{"exported_job": "exporter", "path": "/api"}))
+	for key := range got {
+		require.NotContains(t, key, "_created")
+	}
+
+	// The deltas of the integer parts carry the fractions to the next scrape.
+	e.set(exposition("12.7", "1.5", "1700000000"))
+	got = collected(t, c)
+	require.Equal(t, int64(2), *got[counter("requests_total", map[string]string{"exported_job": "exporter", "path": "/api"})].Delta)
+	require.Equal(t, int64(0), *got[counter("latency_seconds_count", nil)].Delta)
+	require.Equal(t, int64(0), *got[counter("latency_seconds_bucket", map[string]string{"le": "1"})].Delta)
+	require.Equal(t, 1.5, *got[gauge("latency_seconds_sum", nil)].Value)
+
+	// A value lower than the previous one is a restart of the exporter, the whole value is the increase.
+	e.set(exposition("3", "0.25", "1700000100"))
+	got = collected(t, c)
+	require.Equal(t, int64(3), *got[counter("requests_total", map[string]string{"exported_job": "exporter", "path": "/api"})].Delta)
+}
+
+func TestScrapeCollector_Down(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	c, err := NewScrapeCollector([]metrics.ScrapeTarget{
+		{Name: "slow", URL: slow.URL, Timeout: "50ms"},
+		{Name: "failing", URL: failing.URL},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	got, err := c.Collect()
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), defaultScrapeTimeout)
+	require.Len(t, got, 2)
+	for _, metric := range got {
+		require.Equal(t, "up", metric.ID)
+		require.Equal(t, 0.0, *metric.Value)
+	}
+}
+
+func TestNewScrapeCollector_Invalid(t *testing.T) {
+	for _, targets := range [][]metrics.ScrapeTarget{
+		{{URL: "http://localhost:9100/metrics"}},
+		{{Name: "node", URL: "localhost:9100"}},
+		{{Name: "node", URL: "http://localhost:9100/metrics", Timeout: "-1s"}},
+		{{Name: "node", URL: "http://localhost:9100/metrics", Labels: map[string]string{"1env": "prod"}}},
+		{{Name: "node", URL: "http://localhost:9100/metrics"}, {Name: "node", URL: "http://localhost:9200/metrics"}},
+	} {
+		_, err := NewScrapeCollector(targets)
+		require.Error(t, err, targets)
+	}
+}
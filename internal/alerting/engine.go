@@ -0,0 +1,299 @@
+package alerting
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// MyLog is the logger used for alerting logs. It is initialized with log.Default() by default.
+var MyLog = log.Default()
+
+// State is the state of an alert.
+type State string
+
+// States of alerts. An alert is pending while the condition of its rule holds for less than the rule's for,
+// then it is firing until the condition stops holding, and then it is resolved.
+const (
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// resolvedRetention is how long resolved alerts are kept in the list of alerts.
+const resolvedRetention = 15 * time.Minute
+
+// Alert is the state of a rule for a single series of its metric.
+type Alert struct {
+	Rule        string         `json:"rule"`
+	Metric      metrics.Metric `json:"metric"`
+	State       State          `json:"state"`
+	Value       float64        `json:"value"`
+	ActiveSince time.Time      `json:"active_since"`
+	FiredAt     *time.Time     `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time     `json:"resolved_at,omitempty"`
+}
+
+type alertKey struct {
+	rule   string
+	metric metrics.Metric
+}
+
+// Engine periodically evaluates rules against the storage and tracks the states of alerts.
+type Engine struct {
+	storage  storage.Storage
+	path     string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	rules   []Rule
+	alerts  map[alertKey]*Alert
+	modTime time.Time
+}
+
+// NewEngine creates an Engine and loads the rules from the file.
+//
+// Parameters:
+//   - s: The storage rules are evaluated against.
+//   - path: The path to the JSON file with rules.
+//   - interval: The interval between evaluations.
+//
+// Returns:
+//   - A pointer to the Engine and an error if the rules can not be loaded.
+func NewEngine(s storage.Storage, path string, interval time.Duration) (*Engine, error) {
+	e := &Engine{
+		storage:  s,
+		path:     path,
+		interval: interval,
+		alerts:   map[alertKey]*Alert{},
+	}
+
+	err := e.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Reload loads the rules from the file again. The alerts of the rules which are kept keep their states.
+// If the new rules are invalid, the engine continues with the old ones.
+func (e *Engine) Reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	// The modification time is remembered even if the rules are invalid, so they are not reloaded
+	// until the file is modified again.
+	e.mu.Lock()
+	e.modTime = info.ModTime()
+	e.mu.Unlock()
+
+	rules, err := LoadRules(e.path)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+	for key := range e.alerts {
+		if !names[key.rule] {
+			delete(e.alerts, key)
+		}
+	}
+
+	return nil
+}
+
+// Rules returns the loaded rules.
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// Alerts returns the current alerts sorted by state (firing, pending, resolved), rule and metric.
+// If state is not empty, only the alerts in this state are returned.
+func (e *Engine) Alerts(state State) []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		if state == "" || alert.State == state {
+			alerts = append(alerts, *alert)
+		}
+	}
+
+	order := map[State]int{StateFiring: 0, StatePending: 1, StateResolved: 2}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].State != alerts[j].State {
+			return order[alerts[i].State] < order[alerts[j].State]
+		}
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Metric < alerts[j].Metric
+	})
+
+	return alerts
+}
+
+// Evaluate checks all the rules at the moment now and updates the states of alerts.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) error {
+	rules := e.Rules()
+
+	resGauge := e.storage.LoadDataGaugeContext(ctx)
+	if resGauge.Err != nil {
+		return resGauge.Err
+	}
+	resCounter := e.storage.LoadDataCounterContext(ctx)
+	if resCounter.Err != nil {
+		return resCounter.Err
+	}
+	dataGauge := resGauge.Value.(map[metrics.Metric]metrics.Gauge)
+	dataCounter := resCounter.Value.(map[metrics.Metric]metrics.Counter)
+
+	active := map[alertKey]float64{}
+	for _, rule := range rules {
+		var keys []metrics.Metric
+		if rule.MType == "gauge" {
+			for key := range dataGauge {
+				keys = append(keys, key)
+			}
+		} else {
+			for key := range dataCounter {
+				keys = append(keys, key)
+			}
+		}
+
+		for _, key := range keys {
+			name, labels, err := metrics.ParseSeriesKey(key)
+			if err != nil || !rule.matches(name, labels) {
+				continue
+			}
+
+			var value float64
+			switch {
+			case rule.Expr == ExprRate:
+				res := e.storage.LoadRangeContext(ctx, "counter", key, now.Add(-rule.window), now, 0)
+				if res.Err != nil {
+					MyLog.Println(res.Err)
+					continue
+				}
+				value = metrics.CounterRate(res.Value.([]metrics.CounterSample), rule.window)
+			case rule.MType == "gauge":
+				value = float64(dataGauge[key])
+			default:
+				value = float64(dataCounter[key])
+			}
+
+			ok, _ := metrics.Compare(value, rule.Op, rule.Threshold)
+			if ok {
+				active[alertKey{rule: rule.Name, metric: key}] = value
+			}
+		}
+	}
+
+	forDurations := map[string]time.Duration{}
+	for _, rule := range rules {
+		forDurations[rule.Name] = rule.forDuration
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, value := range active {
+		alert, ok := e.alerts[key]
+		if !ok || alert.State == StateResolved {
+			alert = &Alert{Rule: key.rule, Metric: key.metric, State: StatePending, ActiveSince: now}
+			e.alerts[key] = alert
+		}
+		alert.Value = value
+		if alert.State == StatePending && now.Sub(alert.ActiveSince) >= forDurations[key.rule] {
+			firedAt := now
+			alert.State = StateFiring
+			alert.FiredAt = &firedAt
+			MyLog.Printf("alert %s is firing for %s, value %g", key.rule, key.metric, value)
+		}
+	}
+	for key, alert := range e.alerts {
+		if _, ok := active[key]; ok {
+			continue
+		}
+		switch alert.State {
+		case StatePending:
+			delete(e.alerts, key)
+		case StateFiring:
+			resolvedAt := now
+			alert.State = StateResolved
+			alert.ResolvedAt = &resolvedAt
+			MyLog.Printf("alert %s is resolved for %s", key.rule, key.metric)
+		case StateResolved:
+			if now.Sub(*alert.ResolvedAt) > resolvedRetention {
+				delete(e.alerts, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run evaluates the rules every interval until ctx is done.
+// The rules are reloaded when the file is modified or the process receives SIGHUP.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			err := e.Reload()
+			if err != nil {
+				MyLog.Println("alerting: keeping old rules:", err)
+			}
+		case now := <-ticker.C:
+			if e.modified() {
+				err := e.Reload()
+				if err != nil {
+					MyLog.Println("alerting: keeping old rules:", err)
+				}
+			}
+			err := e.Evaluate(ctx, now)
+			if err != nil {
+				MyLog.Println(err)
+			}
+		}
+	}
+}
+
+// modified reports whether the file with rules was modified after the last load.
+func (e *Engine) modified() bool {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return !info.ModTime().Equal(e.modTime)
+}
@@ -0,0 +1,146 @@
+package alerting
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+func writeRules(t *testing.T, dir string, rules string) string {
+	t.Helper()
+	rulesPath := path.Join(dir, "rules.json")
+	err := os.WriteFile(rulesPath, []byte(rules), 0666)
+	require.NoError(t, err)
+	return rulesPath
+}
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name:  "valid rules",
+			rules: `{"rules": [{"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "op": "<", "threshold": 500, "for": "5m"}]}`,
+		},
+		{
+			name:    "unknown operator",
+			rules:   `{"rules": [{"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "op": "=<", "threshold": 500}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "rate of gauge",
+			rules:   `{"rules": [{"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "expr": "rate", "op": "<", "threshold": 500}]}`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate names",
+			rules: `{"rules": [{"name": "A", "metric": "FreeMemory", "type": "gauge", "op": "<", "threshold": 500},
+				{"name": "A", "metric": "Alloc", "type": "gauge", "op": ">", "threshold": 500}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid for",
+			rules:   `{"rules": [{"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "op": "<", "threshold": 500, "for": "often"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadRules(writeRules(t, t.TempDir(), tt.rules))
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEngine_Value(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	rulesPath := writeRules(t, t.TempDir(),
+		`{"rules": [{"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "op": "<", "threshold": 500, "for": "5m"}]}`)
+	engine, err := NewEngine(s, rulesPath, time.Second)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	start := time.Now()
+	require.NoError(t, s.StoreContext(ctx, metrics.SeriesKey("FreeMemory", "host1", nil), metrics.Gauge(100)))
+	require.NoError(t, s.StoreContext(ctx, metrics.SeriesKey("FreeMemory", "host2", nil), metrics.Gauge(1000)))
+
+	require.NoError(t, engine.Evaluate(ctx, start))
+	alerts := engine.Alerts("")
+	require.Len(t, alerts, 1)
+	require.Equal(t, StatePending, alerts[0].State)
+	require.Equal(t, metrics.SeriesKey("FreeMemory", "host1", nil), alerts[0].Metric)
+
+	require.NoError(t, engine.Evaluate(ctx, start.Add(5*time.Minute)))
+	alerts = engine.Alerts(StateFiring)
+	require.Len(t, alerts, 1)
+	require.Equal(t, 100.0, alerts[0].Value)
+
+	require.NoError(t, s.StoreContext(ctx, metrics.SeriesKey("FreeMemory", "host1", nil), metrics.Gauge(1000)))
+	require.NoError(t, engine.Evaluate(ctx, start.Add(6*time.Minute)))
+	alerts = engine.Alerts("")
+	require.Len(t, alerts, 1)
+	require.Equal(t, StateResolved, alerts[0].State)
+	require.NotNil(t, alerts[0].ResolvedAt)
+
+	require.NoError(t, engine.Evaluate(ctx, start.Add(30*time.Minute)))
+	require.Empty(t, engine.Alerts(""))
+}
+
+func TestEngine_Rate(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	rulesPath := writeRules(t, t.TempDir(),
+		`{"rules": [{"name": "AgentStalled", "metric": "PollCount", "type": "counter", "expr": "rate", "window": "2m", "op": "==", "threshold": 0}]}`)
+	engine, err := NewEngine(s, rulesPath, time.Second)
+	require.NoError(t, err)
+
+	now := time.Now()
+	alive := metrics.SeriesKey("PollCount", "alive", nil)
+	stalled := metrics.SeriesKey("PollCount", "stalled", nil)
+	s.DataCounter[alive] = 30
+	s.HistoryCounter[alive] = []metrics.CounterSample{
+		{Timestamp: now.Add(-time.Minute), Value: 10},
+		{Timestamp: now.Add(-30 * time.Second), Value: 20},
+		{Timestamp: now, Value: 30},
+	}
+	s.DataCounter[stalled] = 10
+	s.HistoryCounter[stalled] = []metrics.CounterSample{
+		{Timestamp: now.Add(-10 * time.Minute), Value: 10},
+	}
+
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	alerts := engine.Alerts(StateFiring)
+	require.Len(t, alerts, 1)
+	require.Equal(t, stalled, alerts[0].Metric)
+}
+
+func TestEngine_Reload(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	dir := t.TempDir()
+	rulesPath := writeRules(t, dir, `{"rules": [{"name": "A", "metric": "Alloc", "type": "gauge", "op": ">", "threshold": 1}]}`)
+	engine, err := NewEngine(s, rulesPath, time.Second)
+	require.NoError(t, err)
+	require.Len(t, engine.Rules(), 1)
+
+	writeRules(t, dir, `{"rules": [{"name": "A", "metric": "Alloc", "type": "gauge", "op": ">", "threshold": 1},
+		{"name": "B", "metric": "Alloc", "type": "gauge", "op": "<", "threshold": 1}]}`)
+	require.NoError(t, engine.Reload())
+	require.Len(t, engine.Rules(), 2)
+
+	writeRules(t, dir, `{"rules": [{"name": "A", "metric": "Alloc", "type": "histogram", "op": ">", "threshold": 1}]}`)
+	require.Error(t, engine.Reload())
+	require.Len(t, engine.Rules(), 2)
+}
@@ -0,0 +1,146 @@
+// Package alerting provides the rules engine of the server.
+// Rules are loaded from a JSON file and periodically evaluated against storage.Storage,
+// every rule tracks a separate alert for every series of its metric.
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// Expressions evaluated by rules.
+const (
+	ExprValue = "value" // the current value of the metric.
+	ExprRate  = "rate"  // the per-second rate of increase of the counter over the window.
+)
+
+// defaultRateWindow is the window of the rate expression if the rule does not set it.
+const defaultRateWindow = time.Minute
+
+var errInvalidRule = errors.New("invalid rule")
+
+// Rule describes a condition on a metric, e.g. FreeMemory < 500MB for 5m or rate(PollCount) == 0 for 2m.
+// The condition is checked for every series of the metric having all the labels of the rule.
+//
+// The file with rules looks like:
+//
+//	{"rules": [
+//	  {"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "op": "<", "threshold": 524288000, "for": "5m"},
+//	  {"name": "AgentStalled", "metric": "PollCount", "type": "counter", "expr": "rate", "window": "2m", "op": "==", "threshold": 0, "for": "2m"}
+//	]}
+type Rule struct {
+	Name      string            `json:"name"`
+	Metric    string            `json:"metric"`
+	MType     string            `json:"type"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Expr      string            `json:"expr,omitempty"`
+	Window    string            `json:"window,omitempty"`
+	Op        string            `json:"op"`
+	Threshold float64           `json:"threshold"`
+	For       string            `json:"for,omitempty"`
+
+	window      time.Duration
+	forDuration time.Duration
+}
+
+// RulesFile is the content of the file with rules.
+type RulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadRules reads and validates the rules from the file.
+//
+// Parameters:
+//   - path: The path to the JSON file with rules.
+//
+// Returns:
+//   - The rules and an error if the file can not be read or any rule is invalid.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rulesFile RulesFile
+	err = json.Unmarshal(data, &rulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range rulesFile.Rules {
+		err = rulesFile.Rules[i].validate()
+		if err != nil {
+			return nil, err
+		}
+		if names[rulesFile.Rules[i].Name] {
+			return nil, fmt.Errorf("%w: duplicate name %q", errInvalidRule, rulesFile.Rules[i].Name)
+		}
+		names[rulesFile.Rules[i].Name] = true
+	}
+
+	return rulesFile.Rules, nil
+}
+
+// validate checks the rule and fills its parsed durations.
+func (r *Rule) validate() error {
+	if r.Name == "" || r.Metric == "" {
+		return fmt.Errorf("%w: name and metric are required", errInvalidRule)
+	}
+	if r.MType != "gauge" && r.MType != "counter" {
+		return fmt.Errorf("%w %q: not allowed type %q", errInvalidRule, r.Name, r.MType)
+	}
+	if err := metrics.ValidateLabels(r.Labels); err != nil {
+		return fmt.Errorf("%w %q: %s", errInvalidRule, r.Name, err)
+	}
+	if _, err := metrics.Compare(0, r.Op, r.Threshold); err != nil {
+		return fmt.Errorf("%w %q: %s", errInvalidRule, r.Name, err)
+	}
+
+	switch r.Expr {
+	case "", ExprValue:
+		r.Expr = ExprValue
+	case ExprRate:
+		if r.MType != "counter" {
+			return fmt.Errorf("%w %q: rate is allowed only for counters", errInvalidRule, r.Name)
+		}
+		r.window = defaultRateWindow
+		if r.Window != "" {
+			window, err := time.ParseDuration(r.Window)
+			if err != nil || window <= 0 {
+				return fmt.Errorf("%w %q: invalid window", errInvalidRule, r.Name)
+			}
+			r.window = window
+		}
+	default:
+		return fmt.Errorf("%w %q: unknown expr %q", errInvalidRule, r.Name, r.Expr)
+	}
+
+	if r.For != "" {
+		forDuration, err := time.ParseDuration(r.For)
+		if err != nil || forDuration < 0 {
+			return fmt.Errorf("%w %q: invalid for", errInvalidRule, r.Name)
+		}
+		r.forDuration = forDuration
+	}
+
+	return nil
+}
+
+// matches reports whether the series with the given name and labels is checked by the rule.
+func (r *Rule) matches(name string, labels map[string]string) bool {
+	if name != r.Metric {
+		return false
+	}
+	for label, value := range r.Labels {
+		if labels[label] != value {
+			return false
+		}
+	}
+	return true
+}
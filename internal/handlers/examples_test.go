@@ -30,6 +30,25 @@ func ExampleHandlerGet() {
 	response.Body.Close()
 }
 
+// ExampleHandlerHistory demonstrates how to make a simple HTTP GET to HandlerHistory.
+// It requests the samples of the gauge metric for the given hour with one-minute resolution.
+func ExampleHandlerHistory() {
+	response, err := http.Get("http://example.com/history/gauge/gaugeMetric?from=2024-01-01T10:00:00Z&to=2024-01-01T11:00:00Z&step=1m")
+	if err != nil {
+		// skip error handling.
+	}
+	response.Body.Close()
+}
+
+// ExampleHandlerMetrics demonstrates how to get all the metrics in the Prometheus text format.
+func ExampleHandlerMetrics() {
+	response, err := http.Get("http://example.com/metrics")
+	if err != nil {
+		// skip error handling.
+	}
+	response.Body.Close()
+}
+
 // ExampleHandlerPing demonstrates how to send an HTTP GET request to check the server's status.
 func ExampleHandlerPing() {
 	response, err := http.Get("http://example.com/ping")
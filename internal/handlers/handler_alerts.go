@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/luckyseadog/go-dev/internal/alerting"
+)
+
+// HandlerAlerts is an HTTP handler that responds to GET requests by sending the current alerts as JSON.
+// The query parameter state ("pending", "firing" or "resolved") filters alerts by their state.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - engine: The alerting engine which tracks alerts.
+func HandlerAlerts(w http.ResponseWriter, r *http.Request, engine *alerting.Engine) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "HandlerAlerts: Only GET requests are allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := alerting.State(r.URL.Query().Get("state"))
+	switch state {
+	case "", alerting.StatePending, alerting.StateFiring, alerting.StateResolved:
+	default:
+		http.Error(w, "HandlerAlerts: unknown state", http.StatusBadRequest)
+		return
+	}
+
+	jsonData, err := json.Marshal(engine.Alerts(state))
+	if err != nil {
+		http.Error(w, "HandlerAlerts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonData)
+	if err != nil {
+		http.Error(w, "HandlerAlerts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/luckyseadog/go-dev/internal/webhooks"
+)
+
+// HandlerDeadLetters is an HTTP handler that responds to GET requests by sending as JSON
+// the webhook payloads which were not delivered after all the retries.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - dispatcher: The webhooks.Dispatcher which keeps dead letters.
+func HandlerDeadLetters(w http.ResponseWriter, r *http.Request, dispatcher *webhooks.Dispatcher) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "HandlerDeadLetters: Only GET requests are allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonData, err := json.Marshal(dispatcher.DeadLetters())
+	if err != nil {
+		http.Error(w, "HandlerDeadLetters: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonData)
+	if err != nil {
+		http.Error(w, "HandlerDeadLetters: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
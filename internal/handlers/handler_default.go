@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"html"
 	"net/http"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
@@ -9,7 +10,8 @@ import (
 )
 
 // HandlerDefault is an HTTP handler that responds to GET requests by displaying the list of metric IDs in HTML format.
-// It retrieves gauge and counter metrics from the provided storage and generates an HTML response containing these metrics.
+// It retrieves gauge, counter and histogram metrics from the provided storage and generates an HTML response containing these metrics.
+// A metric with declared metadata is followed by its help and unit, see metrics.Metadata.Describe.
 // The function checks for errors while retrieving metrics and writing to the response, returning appropriate HTTP error
 // responses in case of errors.
 //
@@ -23,6 +25,13 @@ func HandlerDefault(w http.ResponseWriter, r *http.Request, storage storage.Stor
 		return
 	}
 
+	res := storage.LoadMetadataContext(r.Context())
+	if res.Err != nil {
+		http.Error(w, "HandlerDefault: "+res.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metadata := res.Value.(map[string]metrics.Metadata)
+
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 	_, err := fmt.Fprintf(w, "<html><body>")
@@ -31,13 +40,13 @@ func HandlerDefault(w http.ResponseWriter, r *http.Request, storage storage.Stor
 		return
 	}
 
-	res := storage.LoadDataGaugeContext(r.Context())
+	res = storage.LoadDataGaugeContext(r.Context())
 	if res.Err != nil {
 		http.Error(w, "HandlerDefault: "+res.Err.Error(), http.StatusInternalServerError)
 		return
 	}
 	for key := range res.Value.(map[metrics.Metric]metrics.Gauge) {
-		_, err = fmt.Fprintf(w, "<p>%s</p>", string(key))
+		_, err = fmt.Fprintf(w, "<p>%s</p>", metricHTML(key, metadata))
 		if err != nil {
 			http.Error(w, "HandlerDefault: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -51,7 +60,21 @@ func HandlerDefault(w http.ResponseWriter, r *http.Request, storage storage.Stor
 	}
 
 	for key := range res.Value.(map[metrics.Metric]metrics.Counter) {
-		_, err = fmt.Fprintf(w, "<p>%s</p>", string(key))
+		_, err = fmt.Fprintf(w, "<p>%s</p>", metricHTML(key, metadata))
+		if err != nil {
+			http.Error(w, "HandlerDefault: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	res = storage.LoadDataHistogramContext(r.Context())
+	if res.Err != nil {
+		http.Error(w, "HandlerDefault: "+res.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for key := range res.Value.(map[metrics.Metric]metrics.Histogram) {
+		_, err = fmt.Fprintf(w, "<p>%s</p>", metricHTML(key, metadata))
 		if err != nil {
 			http.Error(w, "HandlerDefault: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -63,3 +86,12 @@ func HandlerDefault(w http.ResponseWriter, r *http.Request, storage storage.Stor
 		return
 	}
 }
+
+// metricHTML returns the escaped series key followed by the description of its metric if it has metadata.
+func metricHTML(key metrics.Metric, metadata map[string]metrics.Metadata) string {
+	description := metadata[metrics.SeriesName(key)].Describe()
+	if description == "" {
+		return html.EscapeString(string(key))
+	}
+	return html.EscapeString(string(key)) + " &mdash; " + html.EscapeString(description)
+}
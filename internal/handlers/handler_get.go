@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
 	"github.com/luckyseadog/go-dev/internal/storage"
@@ -11,6 +13,10 @@ import (
 
 // HandlerGet is an HTTP handler that responds to GET requests by sending required metric.
 // It gets required metric by parsing URL, where should be parameters such as metricType and metricName.
+// The agent and the labels of the metric are selected by query parameters, e.g. /value/gauge/Alloc?agent=host1&env=prod.
+// Gauges and counters are sent as plain text, histograms as JSON.
+// A statistic of a gauge over a window is selected by query parameters window and stat, e.g.
+// /value/gauge/HeapAlloc?window=5m&stat=max, see metrics.RollupStats; stat is "avg" by default.
 // The function checks for errors while retrieving metrics and writing to the response, returning appropriate HTTP error
 // responses in case of errors.
 //
@@ -31,10 +37,25 @@ func HandlerGet(w http.ResponseWriter, r *http.Request, storage storage.Storage)
 	}
 
 	metricType, metricName := splitPath[len(splitPath)-2], splitPath[len(splitPath)-1]
+	query := r.URL.Query()
+	seriesKey, err := seriesKeyFromQuery(metricName, query, "window", "stat")
+	if err != nil {
+		http.Error(w, "HandlerGet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if query.Has("window") || query.Has("stat") {
+		if metricType != "gauge" {
+			http.Error(w, "HandlerGet: statistics are kept only for gauges", http.StatusBadRequest)
+			return
+		}
+		getRollup(w, r, storage, seriesKey)
+		return
+	}
 
 	switch metricType {
 	case "gauge":
-		res := storage.LoadContext(r.Context(), metricType, metrics.Metric(metricName))
+		res := storage.LoadContext(r.Context(), metricType, seriesKey)
 		if res.Err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -53,7 +74,7 @@ func HandlerGet(w http.ResponseWriter, r *http.Request, storage storage.Storage)
 		}
 
 	case "counter":
-		res := storage.LoadContext(r.Context(), metricType, metrics.Metric(metricName))
+		res := storage.LoadContext(r.Context(), metricType, seriesKey)
 		if res.Err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -70,6 +91,63 @@ func HandlerGet(w http.ResponseWriter, r *http.Request, storage storage.Storage)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+
+	case "histogram":
+		res := storage.LoadContext(r.Context(), metricType, seriesKey)
+		if res.Err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		jsonData, err := json.Marshal(res.Value)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(jsonData)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+}
+
+// getRollup sends the statistic of the gauge over the window selected by query parameters window and stat.
+func getRollup(w http.ResponseWriter, r *http.Request, storage storage.Storage, seriesKey metrics.Metric) {
+	query := r.URL.Query()
+	window, err := time.ParseDuration(query.Get("window"))
+	if err != nil {
+		http.Error(w, "HandlerGet: invalid window", http.StatusBadRequest)
+		return
+	}
+	stat := query.Get("stat")
+	if stat == "" {
+		stat = "avg"
 	}
 
+	res := storage.LoadRollupContext(r.Context(), seriesKey, window)
+	if res.Err != nil {
+		http.Error(w, "HandlerGet: "+res.Err.Error(), http.StatusNotFound)
+		return
+	}
+	rollup, ok := res.Value.(metrics.Rollup)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	value, err := rollup.Stat(stat)
+	if err != nil {
+		http.Error(w, "HandlerGet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(fmt.Sprintf("%g", value)))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// defaultHistoryRange is the time range returned by HandlerHistory if the parameter from is not set.
+const defaultHistoryRange = time.Hour
+
+// HandlerHistory is an HTTP handler that responds to GET requests by sending the samples of required metric as JSON.
+// It gets required metric by parsing URL /history/{metricType}/{metricName}, the time range is set by
+// query parameters from and to in RFC 3339 format and the resolution by parameter step (e.g. "1m").
+// By default, the samples of the last hour are sent without downsampling.
+// The other query parameters select the agent and the labels of the metric as in HandlerGet.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - storage: An instance of storage.Storage used to retrieve metric data.
+func HandlerHistory(w http.ResponseWriter, r *http.Request, storage storage.Storage) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "HandlerHistory: Only GET requests are allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	splitPath := strings.Split(r.URL.Path, "/")
+	if len(splitPath) != 4 {
+		http.Error(w, "HandlerHistory: invalid request", http.StatusNotFound)
+		return
+	}
+	metricType, metricName := splitPath[len(splitPath)-2], splitPath[len(splitPath)-1]
+	if metricType != "gauge" && metricType != "counter" {
+		http.Error(w, "HandlerHistory: Not allowed type", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	seriesKey, err := seriesKeyFromQuery(metricName, query, "from", "to", "step")
+	if err != nil {
+		http.Error(w, "HandlerHistory: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if toStr := query.Get("to"); toStr != "" {
+		to, err = time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			http.Error(w, "HandlerHistory: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-defaultHistoryRange)
+	if fromStr := query.Get("from"); fromStr != "" {
+		from, err = time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			http.Error(w, "HandlerHistory: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var step time.Duration
+	if stepStr := query.Get("step"); stepStr != "" {
+		step, err = time.ParseDuration(stepStr)
+		if err != nil || step < 0 {
+			http.Error(w, "HandlerHistory: invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "HandlerHistory: from should be before to", http.StatusBadRequest)
+		return
+	}
+
+	res := storage.LoadRangeContext(r.Context(), metricType, seriesKey, from, to, step)
+	if res.Err != nil {
+		http.Error(w, "HandlerHistory: "+res.Err.Error(), loadErrorStatus(res.Err))
+		return
+	}
+
+	jsonData, err := json.Marshal(res.Value)
+	if err != nil {
+		http.Error(w, "HandlerHistory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonData)
+	if err != nil {
+		http.Error(w, "HandlerHistory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
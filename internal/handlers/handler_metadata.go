@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// HandlerMetadata is an HTTP handler that manages the metadata of metrics.
+// GET /metadata sends the declared metadata ordered by name as a JSON array,
+// POST /metadata declares the metadata of the JSON array in the body, e.g.
+// [{"name":"Alloc","type":"gauge","unit":"bytes","help":"Bytes of allocated heap objects."}].
+// A name declared with another type than before is rejected with 409 Conflict and nothing is declared;
+// the unit and the help of a declared name are replaced.
+// DELETE /metadata/{name} removes the declaration of the name, so it can be declared again with another type.
+//
+// If a secret key is set, the header HashSHA256 of a POST request has to hold the HMAC-SHA256 of the request body
+// and the header of a DELETE request the HMAC-SHA256 of the name.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - storage: Storage instance which keeps the metadata.
+//   - key: Secret key used for digital signature verification.
+func HandlerMetadata(w http.ResponseWriter, r *http.Request, storage storage.Storage, key []byte) {
+	switch r.Method {
+	case http.MethodGet:
+		res := storage.LoadMetadataContext(r.Context())
+		if res.Err != nil {
+			http.Error(w, "HandlerMetadata: "+res.Err.Error(), http.StatusInternalServerError)
+			return
+		}
+		metadata := sortedMetadata(res.Value.(map[string]metrics.Metadata))
+
+		jsonData, err := json.Marshal(metadata)
+		if err != nil {
+			http.Error(w, "HandlerMetadata: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(jsonData)
+		if err != nil {
+			http.Error(w, "HandlerMetadata: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "HandlerMetadata: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if !validSignature(r, string(body), key) {
+			http.Error(w, "HandlerMetadata: invalid signature", http.StatusBadRequest)
+			return
+		}
+
+		metadata := make([]metrics.Metadata, 0)
+		err = json.Unmarshal(body, &metadata)
+		if err != nil {
+			http.Error(w, "HandlerMetadata: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, m := range metadata {
+			err = m.Validate()
+			if err != nil {
+				http.Error(w, "HandlerMetadata: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = storage.RegisterMetadataContext(r.Context(), metadata)
+		if err != nil {
+			http.Error(w, "HandlerMetadata: "+err.Error(), storeErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		splitPath := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+		if len(splitPath) != 3 || splitPath[2] == "" {
+			http.Error(w, "HandlerMetadata: name is required", http.StatusNotFound)
+			return
+		}
+		name := splitPath[2]
+
+		if !validSignature(r, name, key) {
+			http.Error(w, "HandlerMetadata: invalid signature", http.StatusBadRequest)
+			return
+		}
+
+		err := storage.DeleteMetadataContext(r.Context(), []string{name})
+		if err != nil {
+			http.Error(w, "HandlerMetadata: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "HandlerMetadata: Only GET, POST and DELETE requests are allowed!", http.StatusMethodNotAllowed)
+	}
+}
+
+// validSignature reports whether the header HashSHA256 of the request holds the HMAC-SHA256 of the signed string.
+// Every request is valid if the key is empty.
+func validSignature(r *http.Request, signed string, key []byte) bool {
+	if len(key) == 0 {
+		return true
+	}
+	decodedComputedHash, err := hex.DecodeString(security.Hash(signed, key))
+	if err != nil {
+		return false
+	}
+	decodedRequestHash, err := hex.DecodeString(r.Header.Get("HashSHA256"))
+	return err == nil && hmac.Equal(decodedComputedHash, decodedRequestHash)
+}
+
+// sortedMetadata returns the metadata by name as a slice ordered by name.
+func sortedMetadata(metadata map[string]metrics.Metadata) []metrics.Metadata {
+	sorted := make([]metrics.Metadata, 0, len(metadata))
+	for _, m := range metadata {
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// storeErrorStatus returns the status of the response to a request whose values or metadata were rejected
+// by the storage: 409 Conflict if a metric is declared with another type, 400 Bad Request if the idempotency key
+// is too long and 500 Internal Server Error otherwise.
+func storeErrorStatus(err error) int {
+	if errors.Is(err, storage.ErrTypeConflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, storage.ErrInvalidBatchKey) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// loadErrorStatus returns the status of the response to a request whose values could not be loaded
+// from the storage: 404 Not Found if there is no such metric, 500 Internal Server Error otherwise.
+func loadErrorStatus(err error) int {
+	if errors.Is(err, storage.ErrNoSuchMetric) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+var invalidPromNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// promSample is a single line of the Prometheus text format.
+// The suffix is added to the name of the family, it is used by the series of histograms.
+// Lines are sorted by series, which are the labels of the stored metric, and keep their order within a series.
+type promSample struct {
+	series string
+	suffix string
+	labels map[string]string
+	value  string
+}
+
+// HandlerMetrics is an HTTP handler that responds to GET requests by sending all the gauges, counters and
+// histograms in the Prometheus text exposition format, so the server can be scraped by Prometheus.
+// Series of a metric are grouped under a single # TYPE line, the agent and the labels of a series become
+// Prometheus labels. Characters not allowed in Prometheus names are replaced by underscores; if a gauge and
+// a counter get the same name, the counter is exposed with the suffix _total, repeated while the name is taken
+// by a gauge or another counter, see promCounterNames. A histogram whose name or whose
+// series _bucket, _sum or _count are taken by a gauge or a counter is exposed with the suffix _histogram.
+// A metric with declared metadata gets a # HELP line with its help and unit, see metrics.Metadata.Describe.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - storage: An instance of storage.Storage used to retrieve metric data.
+func HandlerMetrics(w http.ResponseWriter, r *http.Request, storage storage.Storage) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "HandlerMetrics: Only GET requests are allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resMetadata := storage.LoadMetadataContext(r.Context())
+	if resMetadata.Err != nil {
+		http.Error(w, "HandlerMetrics: "+resMetadata.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metadata := resMetadata.Value.(map[string]metrics.Metadata)
+	// helps holds the descriptions of the families by their Prometheus names.
+	helps := map[string]string{}
+
+	resGauge := storage.LoadDataGaugeContext(r.Context())
+	if resGauge.Err != nil {
+		http.Error(w, "HandlerMetrics: "+resGauge.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resCounter := storage.LoadDataCounterContext(r.Context())
+	if resCounter.Err != nil {
+		http.Error(w, "HandlerMetrics: "+resCounter.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gauges := map[string][]promSample{}
+	for key, value := range resGauge.Value.(map[metrics.Metric]metrics.Gauge) {
+		name, labels, err := metrics.ParseSeriesKey(key)
+		if err != nil {
+			continue
+		}
+		helps[promName(name)] = metadata[name].Describe()
+		name = promName(name)
+		gauges[name] = append(gauges[name], promSample{series: promLabels(labels), labels: labels, value: strconv.FormatFloat(float64(value), 'g', -1, 64)})
+	}
+	counterSamples := map[string][]promSample{}
+	counterHelps := map[string]string{}
+	for key, value := range resCounter.Value.(map[metrics.Metric]metrics.Counter) {
+		name, labels, err := metrics.ParseSeriesKey(key)
+		if err != nil {
+			continue
+		}
+		counterHelps[promName(name)] = metadata[name].Describe()
+		name = promName(name)
+		counterSamples[name] = append(counterSamples[name], promSample{series: promLabels(labels), labels: labels, value: strconv.FormatInt(int64(value), 10)})
+	}
+	counters := map[string][]promSample{}
+	for name, exposed := range promCounterNames(counterSamples, gauges) {
+		helps[exposed] = counterHelps[name]
+		counters[exposed] = counterSamples[name]
+	}
+
+	resHistogram := storage.LoadDataHistogramContext(r.Context())
+	if resHistogram.Err != nil {
+		http.Error(w, "HandlerMetrics: "+resHistogram.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	histograms := map[string][]promSample{}
+	for key, value := range resHistogram.Value.(map[metrics.Metric]metrics.Histogram) {
+		name, labels, err := metrics.ParseSeriesKey(key)
+		if err != nil {
+			continue
+		}
+		description := metadata[name].Describe()
+		name = promName(name)
+		if promHistogramClashes(name, gauges, counters) {
+			name += "_histogram"
+		}
+		helps[name] = description
+		histograms[name] = append(histograms[name], promHistogramSamples(labels, value)...)
+	}
+
+	var buf bytes.Buffer
+	writePromFamilies(&buf, "gauge", gauges, helps)
+	writePromFamilies(&buf, "counter", counters, helps)
+	writePromFamilies(&buf, "histogram", histograms, helps)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		http.Error(w, "HandlerMetrics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// writePromFamilies writes the metric families of the given type sorted by name,
+// a family with a non-empty description in helps is preceded by a # HELP line.
+func writePromFamilies(buf *bytes.Buffer, mType string, families map[string][]promSample, helps map[string]string) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	helpEscaper := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	for _, name := range names {
+		if help := helps[name]; help != "" {
+			buf.WriteString("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+		}
+		buf.WriteString("# TYPE " + name + " " + mType + "\n")
+
+		samples := families[name]
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].series < samples[j].series })
+		for _, sample := range samples {
+			buf.WriteString(name + sample.suffix + promLabels(sample.labels) + " " + sample.value + "\n")
+		}
+	}
+}
+
+// promCounterNames returns the names the counter families are exposed with by their Prometheus names.
+// A counter whose name is taken by a gauge gets the suffix _total, the suffix is repeated while the name is taken
+// by a gauge or another counter, so the series of different metrics never share a family. The names are resolved
+// in sorted order, so a counter is exposed with the same name by every scrape.
+func promCounterNames(counters, gauges map[string][]promSample) map[string]string {
+	names := make([]string, 0, len(counters))
+	taken := map[string]bool{}
+	for name := range counters {
+		names = append(names, name)
+		taken[name] = true
+	}
+	sort.Strings(names)
+	for name := range gauges {
+		taken[name] = true
+	}
+
+	exposed := make(map[string]string, len(names))
+	for _, name := range names {
+		if _, ok := gauges[name]; !ok {
+			exposed[name] = name
+			continue
+		}
+		renamed := name + "_total"
+		for taken[renamed] {
+			renamed += "_total"
+		}
+		taken[renamed] = true
+		exposed[name] = renamed
+	}
+	return exposed
+}
+
+// promHistogramClashes reports whether the family of a histogram with the name clashes with the families
+// of other types: the name or the name of one of its series is taken by them.
+func promHistogramClashes(name string, families ...map[string][]promSample) bool {
+	for _, suffix := range []string{"", "_bucket", "_sum", "_count"} {
+		for _, family := range families {
+			if _, ok := family[name+suffix]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// promHistogramSamples returns the series of the histogram: the cumulative _bucket series with the label le
+// for every bound and +Inf, _sum and _count.
+func promHistogramSamples(labels map[string]string, h metrics.Histogram) []promSample {
+	series := promLabels(labels)
+	samples := make([]promSample, 0, len(h.Counts)+2)
+	var cumulative uint64
+	for i, count := range h.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+		}
+		bucketLabels := map[string]string{"le": le}
+		for label, value := range labels {
+			bucketLabels[label] = value
+		}
+		samples = append(samples, promSample{series: series, suffix: "_bucket", labels: bucketLabels, value: strconv.FormatUint(cumulative, 10)})
+	}
+	samples = append(samples,
+		promSample{series: series, suffix: "_sum", labels: labels, value: strconv.FormatFloat(h.Sum, 'g', -1, 64)},
+		promSample{series: series, suffix: "_count", labels: labels, value: strconv.FormatUint(h.Count, 10)},
+	)
+	return samples
+}
+
+// promLabels formats the labels as {name="value",...} sorted by name, escaping the values.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + escaper.Replace(labels[name]) + `"`)
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// promName replaces the characters not allowed in Prometheus metric names by underscores.
+func promName(name string) string {
+	name = invalidPromNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// defaultRateWindow is the window of HandlerRate if the parameter window is not set.
+const defaultRateWindow = 5 * time.Minute
+
+// Rate is the per-second rate of increase of a counter over the window ending now.
+type Rate struct {
+	ID     string  `json:"id"`
+	Window string  `json:"window"`
+	Rate   float64 `json:"rate"`
+}
+
+// HandlerRate is an HTTP handler that responds to GET requests by sending the rate of the counter as JSON.
+// It gets required counter by parsing URL /rate/counter/{metricName}, the window is set by query
+// parameter window (e.g. "1m"), 5 minutes by default. The rate is computed from the history of the counter
+// by metrics.CounterRate, so resets of cumulative counters do not produce negative rates.
+// The other query parameters select the agent and the labels of the metric as in HandlerGet.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - storage: An instance of storage.Storage used to retrieve metric data.
+func HandlerRate(w http.ResponseWriter, r *http.Request, storage storage.Storage) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "HandlerRate: Only GET requests are allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	splitPath := strings.Split(r.URL.Path, "/")
+	if len(splitPath) != 4 {
+		http.Error(w, "HandlerRate: invalid request", http.StatusNotFound)
+		return
+	}
+	metricType, metricName := splitPath[len(splitPath)-2], splitPath[len(splitPath)-1]
+	if metricType != "counter" {
+		http.Error(w, "HandlerRate: Not allowed type", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	seriesKey, err := seriesKeyFromQuery(metricName, query, "window")
+	if err != nil {
+		http.Error(w, "HandlerRate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	window := defaultRateWindow
+	if windowStr := query.Get("window"); windowStr != "" {
+		window, err = time.ParseDuration(windowStr)
+		if err != nil || window <= 0 {
+			http.Error(w, "HandlerRate: invalid window", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	res := storage.LoadRangeContext(r.Context(), metricType, seriesKey, now.Add(-window), now, 0)
+	if res.Err != nil {
+		http.Error(w, "HandlerRate: "+res.Err.Error(), loadErrorStatus(res.Err))
+		return
+	}
+	samples, ok := res.Value.([]metrics.CounterSample)
+	if !ok {
+		http.Error(w, "HandlerRate: Load error", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(Rate{ID: metricName, Window: window.String(), Rate: metrics.CounterRate(samples, window)})
+	if err != nil {
+		http.Error(w, "HandlerRate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonData)
+	if err != nil {
+		http.Error(w, "HandlerRate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
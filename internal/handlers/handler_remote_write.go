@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/storage"
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// maxRemoteWriteSize is the maximum size of a decompressed remote-write request.
+const maxRemoteWriteSize = 32 << 20
+
+// HandlerRemoteWrite is an HTTP handler that accepts Prometheus remote-write requests (snappy-compressed
+// protobuf WriteRequest) and stores their samples.
+// The label __name__ is the name of the metric and the other labels become the labels of the series.
+// A series is stored as a counter if the metadata of its family says so, if its name ends with _total or
+// if it is the _count or _bucket series of a histogram or a summary; otherwise it is stored as a gauge.
+// The _sum series of a histogram or a summary is a fractional cumulative value, it is stored as a gauge,
+// so its increase is not rounded away.
+// Remote-write counters are cumulative, so they are stored as metrics.CounterTotal: the increase since
+// the previous sample is added to the counter and a value going down is treated as a reset of the client.
+// A counter sample with a fractional value, e.g. of process_cpu_seconds_total, is stored as a gauge with
+// the cumulative value like the _sum series: rounded, its rate would become a step function.
+//
+// Only the latest sample of a series is stored, the series of the request are stored atomically. The storages
+// record a sample at the moment it is stored, so the older samples of a request, e.g. of a client catching up
+// after an outage, are dropped: the history of the series has one sample per request.
+//
+// If a secret key is set, the header HashSHA256 has to hold the HMAC-SHA256 of the request body.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - storage: Storage instance to store the metric data.
+//   - key: Secret key used for digital signature verification.
+func HandlerRemoteWrite(w http.ResponseWriter, r *http.Request, storage storage.Storage, key []byte) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "HandlerRemoteWrite: Only POST requests are allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "HandlerRemoteWrite: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(key) > 0 {
+		decodedComputedHash, err := hex.DecodeString(security.Hash(string(body), key))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		decodedRequestHash, err := hex.DecodeString(r.Header.Get("HashSHA256"))
+		if err != nil || !hmac.Equal(decodedComputedHash, decodedRequestHash) {
+			http.Error(w, "HandlerRemoteWrite: invalid signature", http.StatusBadRequest)
+			return
+		}
+	}
+
+	decodedLen, err := snappy.DecodedLen(body)
+	if err != nil || decodedLen > maxRemoteWriteSize {
+		http.Error(w, "HandlerRemoteWrite: invalid snappy data", http.StatusBadRequest)
+		return
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, "HandlerRemoteWrite: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req pb.WriteRequest
+	err = proto.Unmarshal(data, &req)
+	if err != nil {
+		http.Error(w, "HandlerRemoteWrite: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	familyTypes := map[string]pb.MetricMetadata_MetricType{}
+	for _, metadata := range req.GetMetadata() {
+		familyTypes[metadata.GetMetricFamilyName()] = metadata.GetType()
+	}
+
+	batch := make([]metricValue, 0, len(req.GetTimeseries()))
+	for _, ts := range req.GetTimeseries() {
+		name, labels := "", map[string]string{}
+		for _, label := range ts.GetLabels() {
+			switch {
+			case label.GetName() == "__name__":
+				name = label.GetValue()
+			case strings.HasPrefix(label.GetName(), "__"):
+			default:
+				labels[label.GetName()] = label.GetValue()
+			}
+		}
+		if name == "" {
+			http.Error(w, "HandlerRemoteWrite: series without __name__", http.StatusBadRequest)
+			return
+		}
+		err = metrics.Metrics{ID: name, Labels: labels}.Validate()
+		if err != nil {
+			http.Error(w, "HandlerRemoteWrite: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var latest *pb.Sample
+		for _, sample := range ts.GetSamples() {
+			if latest == nil || sample.GetTimestamp() >= latest.GetTimestamp() {
+				latest = sample
+			}
+		}
+		if latest == nil || math.IsNaN(latest.GetValue()) {
+			continue
+		}
+
+		seriesKey := metrics.SeriesKey(name, "", labels)
+		value := latest.GetValue()
+		if remoteWriteType(name, labels, familyTypes) == "gauge" || value != math.Trunc(value) {
+			batch = append(batch, metricValue{Metric: seriesKey, Value: metrics.Gauge(value)})
+		} else {
+			batch = append(batch, metricValue{Metric: seriesKey, Value: metrics.CounterTotal(value)})
+		}
+	}
+
+	_, _, err = storage.StoreBatchContext(r.Context(), "", batch)
+	if err != nil {
+		http.Error(w, "HandlerRemoteWrite: "+err.Error(), storeErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remoteWriteType returns the type ("gauge" or "counter") the series of a remote-write request is stored as.
+func remoteWriteType(name string, labels map[string]string, familyTypes map[string]pb.MetricMetadata_MetricType) string {
+	if familyType, ok := familyTypes[name]; ok {
+		if familyType == pb.MetricMetadata_COUNTER {
+			return "counter"
+		}
+		return "gauge"
+	}
+	for _, suffix := range []string{"_count", "_bucket"} {
+		familyType := familyTypes[strings.TrimSuffix(name, suffix)]
+		if strings.HasSuffix(name, suffix) && (familyType == pb.MetricMetadata_HISTOGRAM || familyType == pb.MetricMetadata_SUMMARY) {
+			return "counter"
+		}
+	}
+	if strings.HasSuffix(name, "_total") {
+		return "counter"
+	}
+	return "gauge"
+}
@@ -12,7 +12,7 @@ import (
 
 // HandlerUpdate is an HTTP handler that responds to POST requests by soring metric into the storage.
 // It stores metric into the storage by retrieving URL parameters and generates an JSON response
-// containing the new value of metric.
+// containing the new value of metric. The agent and the labels of the metric are set by query parameters.
 // The function checks for errors while retrieving metrics and writing to the response, returning appropriate HTTP error
 // responses in case of errors.
 //
@@ -36,8 +36,18 @@ func HandlerUpdate(w http.ResponseWriter, r *http.Request, storage storage.Stora
 		return
 	}
 
-	metricType, metric, metricValueString := splitPath[len(splitPath)-3],
-		metrics.Metric(splitPath[len(splitPath)-2]), splitPath[len(splitPath)-1]
+	metricType, metricName, metricValueString := splitPath[len(splitPath)-3],
+		splitPath[len(splitPath)-2], splitPath[len(splitPath)-1]
+	err := metrics.ValidateName(metricName)
+	if err != nil {
+		http.Error(w, "HandlerUpdate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	metric, err := seriesKeyFromQuery(metricName, r.URL.Query())
+	if err != nil {
+		http.Error(w, "HandlerUpdate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	switch metricType {
 	case "gauge":
@@ -48,7 +58,7 @@ func HandlerUpdate(w http.ResponseWriter, r *http.Request, storage storage.Stora
 		}
 		err = storage.StoreContext(r.Context(), metric, metrics.Gauge(metricValue))
 		if err != nil {
-			http.Error(w, "HandlerUpdate: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "HandlerUpdate: "+err.Error(), storeErrorStatus(err))
 			return
 		}
 
@@ -85,7 +95,7 @@ func HandlerUpdate(w http.ResponseWriter, r *http.Request, storage storage.Stora
 
 		err = storage.StoreContext(r.Context(), metric, metrics.Counter(metricValue))
 		if err != nil {
-			http.Error(w, "HandlerUpdate: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "HandlerUpdate: "+err.Error(), storeErrorStatus(err))
 			return
 		}
 
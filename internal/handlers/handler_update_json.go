@@ -27,7 +27,9 @@ import (
 // Notes:
 //   - For making requests through this method the agent should send JSON array with id and type and
 //
-// delta or value fields for consistency with Metrics.
+// delta, value or histogram fields for consistency with Metrics. A cumulative counter is sent with the field
+// total instead of delta, the server adds to the counter its increase since the previous total and treats
+// a total going down as a reset.
 func HandlerUpdateJSON(w http.ResponseWriter, r *http.Request, storage storage.Storage, key []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
@@ -49,16 +51,22 @@ func HandlerUpdateJSON(w http.ResponseWriter, r *http.Request, storage storage.S
 		http.Error(w, "HandlerUpdateJSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	err = metricCurrent.Validate()
+	if err != nil {
+		http.Error(w, "HandlerUpdateJSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	seriesKey := metricCurrent.Key()
 
 	switch metricCurrent.MType {
 	case "gauge":
-		if metricCurrent.Value == nil || metricCurrent.Delta != nil {
+		if metricCurrent.Value == nil || metricCurrent.Delta != nil || metricCurrent.Total != nil {
 			http.Error(w, "HandlerUpdateJSON: Error in passing metric gauge", http.StatusBadRequest)
 			return
 		}
 
 		if len(key) > 0 {
-			computedHash := security.Hash(fmt.Sprintf("%s:gauge:%f", metricCurrent.ID, *metricCurrent.Value), key)
+			computedHash := security.Hash(fmt.Sprintf("%s:gauge:%f", seriesKey, *metricCurrent.Value), key)
 			decodedComputedHash, err := hex.DecodeString(computedHash)
 			if err != nil {
 				log.Println(err)
@@ -73,22 +81,63 @@ func HandlerUpdateJSON(w http.ResponseWriter, r *http.Request, storage storage.S
 			}
 		}
 
-		err = storage.StoreContext(r.Context(), metrics.Metric(metricCurrent.ID), metrics.Gauge(*metricCurrent.Value))
+		err = storage.StoreContext(r.Context(), seriesKey, metrics.Gauge(*metricCurrent.Value))
 		if err != nil {
-			http.Error(w, "HandlerUpdateJSON: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "HandlerUpdateJSON: "+err.Error(), storeErrorStatus(err))
 			return
 		}
 
 	case "counter":
-		if metricCurrent.Delta == nil || metricCurrent.Value != nil {
+		if (metricCurrent.Delta == nil) == (metricCurrent.Total == nil) || metricCurrent.Value != nil {
 			http.Error(w, "HandlerUpdateJSON: Error in passing metric counter", http.StatusBadRequest)
 			return
 		}
+		// A cumulative counter is sent as total, its hash differs from the hash of a delta with the same value.
+		var value any
+		var hashString string
+		if metricCurrent.Total != nil {
+			value = metrics.CounterTotal(*metricCurrent.Total)
+			hashString = fmt.Sprintf("%s:counter_total:%d", seriesKey, *metricCurrent.Total)
+		} else {
+			value = metrics.Counter(*metricCurrent.Delta)
+			hashString = fmt.Sprintf("%s:counter:%d", seriesKey, *metricCurrent.Delta)
+		}
+
+		if len(key) > 0 {
+			computedHash := security.Hash(hashString, key)
+			decodedComputedHash, err := hex.DecodeString(computedHash)
+			if err != nil {
+				log.Println(err)
+			}
+			decodedMetricHash, err := hex.DecodeString(metricCurrent.Hash)
+			if err != nil {
+				log.Println(err)
+			}
+			if !hmac.Equal(decodedComputedHash, decodedMetricHash) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = storage.StoreContext(r.Context(), seriesKey, value)
+		if err != nil {
+			http.Error(w, "HandlerUpdateJSON: "+err.Error(), storeErrorStatus(err))
+			return
+		}
+
+	case "histogram":
+		if metricCurrent.Histogram == nil || metricCurrent.Value != nil || metricCurrent.Delta != nil || metricCurrent.Total != nil {
+			http.Error(w, "HandlerUpdateJSON: Error in passing metric histogram", http.StatusBadRequest)
+			return
+		}
+		err = metricCurrent.Histogram.Validate()
+		if err != nil {
+			http.Error(w, "HandlerUpdateJSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		if len(key) > 0 {
-			//fmt.Println(fmt.Sprintf("%s:counter:%d", string(key), *metric.Delta))
-			//fmt.Println(key)
-			computedHash := security.Hash(fmt.Sprintf("%s:counter:%d", metricCurrent.ID, *metricCurrent.Delta), key)
+			computedHash := security.Hash(fmt.Sprintf("%s:histogram:%s", seriesKey, metricCurrent.Histogram.HashString()), key)
 			decodedComputedHash, err := hex.DecodeString(computedHash)
 			if err != nil {
 				log.Println(err)
@@ -103,9 +152,9 @@ func HandlerUpdateJSON(w http.ResponseWriter, r *http.Request, storage storage.S
 			}
 		}
 
-		err = storage.StoreContext(r.Context(), metrics.Metric(metricCurrent.ID), metrics.Counter(*metricCurrent.Delta))
+		err = storage.StoreContext(r.Context(), seriesKey, *metricCurrent.Histogram)
 		if err != nil {
-			http.Error(w, "HandlerUpdateJSON: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "HandlerUpdateJSON: "+err.Error(), storeErrorStatus(err))
 			return
 		}
 
@@ -116,7 +165,7 @@ func HandlerUpdateJSON(w http.ResponseWriter, r *http.Request, storage storage.S
 
 	var metricsAnswer metrics.Metrics
 
-	res := storage.LoadContext(r.Context(), metricCurrent.MType, metrics.Metric(metricCurrent.ID))
+	res := storage.LoadContext(r.Context(), metricCurrent.MType, seriesKey)
 	if res.Err != nil {
 		http.Error(w, "HandlerUpdateJSON: "+res.Err.Error(), http.StatusInternalServerError)
 		return
@@ -124,12 +173,19 @@ func HandlerUpdateJSON(w http.ResponseWriter, r *http.Request, storage storage.S
 	switch metricCurrent.MType {
 	case "gauge":
 		valueFloat64 := float64(res.Value.(metrics.Gauge))
-		hashMetric := security.Hash(fmt.Sprintf("%s:gauge:%f", metricCurrent.ID, valueFloat64), key)
-		metricsAnswer = metrics.Metrics{ID: metricCurrent.ID, MType: metricCurrent.MType, Value: &valueFloat64, Hash: hashMetric}
+		hashMetric := security.Hash(fmt.Sprintf("%s:gauge:%f", seriesKey, valueFloat64), key)
+		metricsAnswer = metrics.Metrics{ID: metricCurrent.ID, MType: metricCurrent.MType, Value: &valueFloat64, Hash: hashMetric,
+			Agent: metricCurrent.Agent, Labels: metricCurrent.Labels}
 	case "counter":
 		valueInt64 := int64(res.Value.(metrics.Counter))
-		hashMetric := security.Hash(fmt.Sprintf("%s:counter:%d", metricCurrent.ID, valueInt64), key)
-		metricsAnswer = metrics.Metrics{ID: metricCurrent.ID, MType: metricCurrent.MType, Delta: &valueInt64, Hash: hashMetric}
+		hashMetric := security.Hash(fmt.Sprintf("%s:counter:%d", seriesKey, valueInt64), key)
+		metricsAnswer = metrics.Metrics{ID: metricCurrent.ID, MType: metricCurrent.MType, Delta: &valueInt64, Hash: hashMetric,
+			Agent: metricCurrent.Agent, Labels: metricCurrent.Labels}
+	case "histogram":
+		valueHistogram := res.Value.(metrics.Histogram)
+		hashMetric := security.Hash(fmt.Sprintf("%s:histogram:%s", seriesKey, valueHistogram.HashString()), key)
+		metricsAnswer = metrics.Metrics{ID: metricCurrent.ID, MType: metricCurrent.MType, Histogram: &valueHistogram, Hash: hashMetric,
+			Agent: metricCurrent.Agent, Labels: metricCurrent.Labels}
 	default:
 		http.Error(w, "HandlerUpdateJSON: Load error", http.StatusInternalServerError)
 		return
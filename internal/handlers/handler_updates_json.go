@@ -13,6 +13,12 @@ import (
 	"github.com/luckyseadog/go-dev/internal/storage"
 )
 
+// IdempotencyKeyHeader is the header with the idempotency key of a batch sent to HandlerUpdatesJSON.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// metricValue is a value of a batch stored by storage.Storage.StoreBatchContext.
+type metricValue = storage.MetricValue
+
 // HandlerUpdatesJSON is an HTTP handler that responds to POST requests by processing JSON-encoded metric data
 // and storing it into the specified storage. It performs verification of the provided metric data integrity
 // using a digital signature (if a secret key is provided).
@@ -29,7 +35,13 @@ import (
 // array-like
 //   - For making requests through this method the agent should send JSON array with id and type and
 //
-// delta or value fields for consistency with Metrics.
+// delta, value or histogram fields for consistency with Metrics. A cumulative counter is sent with the field
+// total instead of delta, see HandlerUpdateJSON.
+//   - The metrics of the batch are validated first and then stored atomically, so an invalid metric rejects
+//
+// the whole batch. A batch with the header Idempotency-Key is applied once: a batch with the key remembered
+// by the storage is a replay of an applied one, it is acknowledged with the current values but not stored again.
+// The values of the response are those returned by the storage with the batch, they are not loaded again.
 func HandlerUpdatesJSON(w http.ResponseWriter, r *http.Request, storage storage.Storage, key []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
@@ -52,16 +64,22 @@ func HandlerUpdatesJSON(w http.ResponseWriter, r *http.Request, storage storage.
 		return
 	}
 
+	batch := make([]metricValue, 0, len(metricsCurrent))
 	for _, metric := range metricsCurrent {
+		err = metric.Validate()
+		if err != nil {
+			http.Error(w, "HandlerUpdatesJSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		switch metric.MType {
 		case "gauge":
-			if metric.Value == nil || metric.Delta != nil {
+			if metric.Value == nil || metric.Delta != nil || metric.Total != nil {
 				http.Error(w, "HandlerUpdatesJSON: Error in passing metric gauge", http.StatusBadRequest)
 				return
 			}
 
 			if len(key) > 0 {
-				computedHash := security.Hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), key)
+				computedHash := security.Hash(fmt.Sprintf("%s:gauge:%f", metric.Key(), *metric.Value), key)
 				decodedComputedHash, err := hex.DecodeString(computedHash)
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
@@ -77,20 +95,25 @@ func HandlerUpdatesJSON(w http.ResponseWriter, r *http.Request, storage storage.
 					return
 				}
 			}
-			err = storage.StoreContext(r.Context(), metrics.Metric(metric.ID), metrics.Gauge(*metric.Value))
-			if err != nil {
-				http.Error(w, "HandlerUpdatesJSON: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+			batch = append(batch, metricValue{Metric: metric.Key(), Value: metrics.Gauge(*metric.Value)})
 
 		case "counter":
-			if metric.Delta == nil || metric.Value != nil {
+			if (metric.Delta == nil) == (metric.Total == nil) || metric.Value != nil {
 				http.Error(w, "HandlerUpdatesJSON: Error in passing metric counter", http.StatusBadRequest)
 				return
 			}
+			var value any
+			var hashString string
+			if metric.Total != nil {
+				value = metrics.CounterTotal(*metric.Total)
+				hashString = fmt.Sprintf("%s:counter_total:%d", metric.Key(), *metric.Total)
+			} else {
+				value = metrics.Counter(*metric.Delta)
+				hashString = fmt.Sprintf("%s:counter:%d", metric.Key(), *metric.Delta)
+			}
 
 			if len(key) > 0 {
-				computedHash := security.Hash(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta), key)
+				computedHash := security.Hash(hashString, key)
 				decodedComputedHash, err := hex.DecodeString(computedHash)
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
@@ -106,22 +129,56 @@ func HandlerUpdatesJSON(w http.ResponseWriter, r *http.Request, storage storage.
 					return
 				}
 			}
-			err = storage.StoreContext(r.Context(), metrics.Metric(metric.ID), metrics.Counter(*metric.Delta))
+			batch = append(batch, metricValue{Metric: metric.Key(), Value: value})
+
+		case "histogram":
+			if metric.Histogram == nil || metric.Value != nil || metric.Delta != nil || metric.Total != nil {
+				http.Error(w, "HandlerUpdatesJSON: Error in passing metric histogram", http.StatusBadRequest)
+				return
+			}
+			err = metric.Histogram.Validate()
 			if err != nil {
-				http.Error(w, "HandlerUpdatesJSON: "+err.Error(), http.StatusInternalServerError)
+				http.Error(w, "HandlerUpdatesJSON: "+err.Error(), http.StatusBadRequest)
 				return
 			}
 
+			if len(key) > 0 {
+				computedHash := security.Hash(fmt.Sprintf("%s:histogram:%s", metric.Key(), metric.Histogram.HashString()), key)
+				decodedComputedHash, err := hex.DecodeString(computedHash)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				decodedMetricHash, err := hex.DecodeString(metric.Hash)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if !hmac.Equal(decodedComputedHash, decodedMetricHash) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			batch = append(batch, metricValue{Metric: metric.Key(), Value: *metric.Histogram})
+
 		default:
 			http.Error(w, "HandlerUpdatesJSON: Not allowed type", http.StatusNotImplemented)
 			return
 		}
 	}
 
+	// The batch is stored atomically once all its metrics are validated. A replay of the batch with the same
+	// idempotency key is not applied again, it is acknowledged with the current values.
+	stored, _, err := storage.StoreBatchContext(r.Context(), r.Header.Get(IdempotencyKeyHeader), batch)
+	if err != nil {
+		http.Error(w, "HandlerUpdatesJSON: "+err.Error(), storeErrorStatus(err))
+		return
+	}
+
 	metricsAnswer := make([]metrics.Metrics, 0)
 
 	for _, metric := range metricsCurrent {
-		res := storage.LoadContext(r.Context(), metric.MType, metrics.Metric(metric.ID))
+		res := stored.Load(metric.MType, metric.Key())
 		if res.Err != nil {
 			http.Error(w, "HandlerUpdatesJSON: Load error", http.StatusInternalServerError)
 			return
@@ -129,12 +186,19 @@ func HandlerUpdatesJSON(w http.ResponseWriter, r *http.Request, storage storage.
 		switch metric.MType {
 		case "gauge":
 			valueFloat64 := float64(res.Value.(metrics.Gauge))
-			hashMetric := security.Hash(fmt.Sprintf("%s:gauge:%f", metric.ID, valueFloat64), key)
-			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.ID, MType: metric.MType, Value: &valueFloat64, Hash: hashMetric})
+			hashMetric := security.Hash(fmt.Sprintf("%s:gauge:%f", metric.Key(), valueFloat64), key)
+			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.ID, MType: metric.MType, Value: &valueFloat64, Hash: hashMetric,
+				Agent: metric.Agent, Labels: metric.Labels})
 		case "counter":
 			valueInt64 := int64(res.Value.(metrics.Counter))
-			hashMetric := security.Hash(fmt.Sprintf("%s:counter:%d", metric.ID, valueInt64), key)
-			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.ID, MType: metric.MType, Delta: &valueInt64, Hash: hashMetric})
+			hashMetric := security.Hash(fmt.Sprintf("%s:counter:%d", metric.Key(), valueInt64), key)
+			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.ID, MType: metric.MType, Delta: &valueInt64, Hash: hashMetric,
+				Agent: metric.Agent, Labels: metric.Labels})
+		case "histogram":
+			valueHistogram := res.Value.(metrics.Histogram)
+			hashMetric := security.Hash(fmt.Sprintf("%s:histogram:%s", metric.Key(), valueHistogram.HashString()), key)
+			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.ID, MType: metric.MType, Histogram: &valueHistogram, Hash: hashMetric,
+				Agent: metric.Agent, Labels: metric.Labels})
 		default:
 			http.Error(w, "HandlerUpdatesJSON: Load error", http.StatusInternalServerError)
 			return
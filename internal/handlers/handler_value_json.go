@@ -55,15 +55,20 @@ func HandlerValueJSON(w http.ResponseWriter, r *http.Request, storage storage.St
 	}
 
 	for i := 0; i < len(metricsCurrent); i++ {
-		if metricsCurrent[i].Value != nil || metricsCurrent[i].Delta != nil {
-			http.Error(w, "HandlerValueJSON: Fields value and delta should be empty", http.StatusBadRequest)
+		if metricsCurrent[i].Value != nil || metricsCurrent[i].Delta != nil || metricsCurrent[i].Histogram != nil {
+			http.Error(w, "HandlerValueJSON: Fields value, delta and histogram should be empty", http.StatusBadRequest)
 			return
 		}
-		metricID, metricType := metricsCurrent[i].ID, metricsCurrent[i].MType
+		err = metrics.ValidateLabels(metricsCurrent[i].Labels)
+		if err != nil {
+			http.Error(w, "HandlerValueJSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		seriesKey, metricType := metricsCurrent[i].Key(), metricsCurrent[i].MType
 
 		switch metricType {
 		case "gauge":
-			res := storage.LoadContext(r.Context(), metricType, metrics.Metric(metricID))
+			res := storage.LoadContext(r.Context(), metricType, seriesKey)
 			if res.Err != nil {
 				http.Error(w, "HandlerValueJSON: No such metric", http.StatusNotFound)
 				return
@@ -71,10 +76,10 @@ func HandlerValueJSON(w http.ResponseWriter, r *http.Request, storage storage.St
 			valueFloat64 := float64(res.Value.(metrics.Gauge))
 			metricsCurrent[i].Value = &valueFloat64
 			if len(key) > 0 {
-				metricsCurrent[i].Hash = security.Hash(fmt.Sprintf("%s:gauge:%f", metricsCurrent[i].ID, valueFloat64), key)
+				metricsCurrent[i].Hash = security.Hash(fmt.Sprintf("%s:gauge:%f", seriesKey, valueFloat64), key)
 			}
 		case "counter":
-			res := storage.LoadContext(r.Context(), metricType, metrics.Metric(metricID))
+			res := storage.LoadContext(r.Context(), metricType, seriesKey)
 			if res.Err != nil {
 				http.Error(w, "HandlerValueJSON: "+res.Err.Error(), http.StatusNotFound)
 				return
@@ -82,7 +87,18 @@ func HandlerValueJSON(w http.ResponseWriter, r *http.Request, storage storage.St
 			valueInt64 := int64(res.Value.(metrics.Counter))
 			metricsCurrent[i].Delta = &valueInt64
 			if len(key) > 0 {
-				metricsCurrent[i].Hash = security.Hash(fmt.Sprintf("%s:counter:%d", metricsCurrent[i].ID, valueInt64), key)
+				metricsCurrent[i].Hash = security.Hash(fmt.Sprintf("%s:counter:%d", seriesKey, valueInt64), key)
+			}
+		case "histogram":
+			res := storage.LoadContext(r.Context(), metricType, seriesKey)
+			if res.Err != nil {
+				http.Error(w, "HandlerValueJSON: "+res.Err.Error(), http.StatusNotFound)
+				return
+			}
+			valueHistogram := res.Value.(metrics.Histogram)
+			metricsCurrent[i].Histogram = &valueHistogram
+			if len(key) > 0 {
+				metricsCurrent[i].Hash = security.Hash(fmt.Sprintf("%s:histogram:%s", seriesKey, valueHistogram.HashString()), key)
 			}
 		default:
 			http.Error(w, "HandlerValueJSON: Not allowed type", http.StatusNotImplemented)
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/luckyseadog/go-dev/internal/webhooks"
+)
+
+// HandlerWebhooks is an HTTP handler that manages webhook subscriptions.
+// GET /webhooks sends the list of subscriptions without their secrets,
+// POST /webhooks registers the subscription from the JSON body and sends it back with the generated ID and secret,
+// DELETE /webhooks/{id} removes the subscription.
+//
+// Parameters:
+//   - w: The http.ResponseWriter to write the HTTP response.
+//   - r: The http.Request received from the client.
+//   - dispatcher: The webhooks.Dispatcher which keeps subscriptions.
+func HandlerWebhooks(w http.ResponseWriter, r *http.Request, dispatcher *webhooks.Dispatcher) {
+	splitPath := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+
+	var response any
+	status := http.StatusOK
+	switch {
+	case r.Method == http.MethodGet && len(splitPath) == 2:
+		response = dispatcher.Subscriptions()
+	case r.Method == http.MethodPost && len(splitPath) == 2:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "HandlerWebhooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var sub webhooks.Subscription
+		err = json.Unmarshal(body, &sub)
+		if err != nil {
+			http.Error(w, "HandlerWebhooks: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub, err = dispatcher.Add(sub)
+		if err != nil {
+			http.Error(w, "HandlerWebhooks: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, status = sub, http.StatusCreated
+	case r.Method == http.MethodDelete && len(splitPath) == 3:
+		err := dispatcher.Remove(splitPath[2])
+		if errors.Is(err, webhooks.ErrNoSuchSubscription) {
+			http.Error(w, "HandlerWebhooks: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "HandlerWebhooks: invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "HandlerWebhooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(jsonData)
+	if err != nil {
+		http.Error(w, "HandlerWebhooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -2,20 +2,28 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
 	"github.com/luckyseadog/go-dev/internal/storage"
+	"github.com/luckyseadog/go-dev/internal/webhooks"
+	pb "github.com/luckyseadog/go-dev/protobuf"
 )
 
 func setupRoutes(s storage.Storage, key []byte) *chi.Mux {
@@ -26,6 +34,29 @@ func setupRoutes(s storage.Storage, key []byte) *chi.Mux {
 	r.Get("/value/{^+}/*", func(w http.ResponseWriter, r *http.Request) {
 		HandlerGet(w, r, s)
 	})
+	r.Get("/history/{^+}/*", func(w http.ResponseWriter, r *http.Request) {
+		HandlerHistory(w, r, s)
+	})
+	r.Get("/rate/{^+}/*", func(w http.ResponseWriter, r *http.Request) {
+		HandlerRate(w, r, s)
+	})
+	r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		HandlerMetrics(w, r, s)
+	})
+	r.Post("/api/v1/write", func(w http.ResponseWriter, r *http.Request) {
+		HandlerRemoteWrite(w, r, s, key)
+	})
+	r.Route("/metadata", func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			HandlerMetadata(w, r, s, key)
+		})
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			HandlerMetadata(w, r, s, key)
+		})
+		r.Delete("/{_}", func(w http.ResponseWriter, r *http.Request) {
+			HandlerMetadata(w, r, s, key)
+		})
+	})
 	r.Route("/value", func(r chi.Router) {
 		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
 			HandlerValueJSON(w, r, s, key)
@@ -150,6 +181,43 @@ func TestHandlerGet(t *testing.T) {
 	}
 }
 
+func TestHandlerGet_Rollup(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, []byte{})
+
+	for _, request := range []string{"/update/gauge/HeapAlloc/10", "/update/gauge/HeapAlloc/90", "/update/gauge/HeapAlloc/20"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, request, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		request string
+		want    int
+		body    string
+	}{
+		{request: "/value/gauge/HeapAlloc?window=1h&stat=max", want: http.StatusOK, body: "90"},
+		{request: "/value/gauge/HeapAlloc?window=1m&stat=min", want: http.StatusOK, body: "10"},
+		{request: "/value/gauge/HeapAlloc?window=5m", want: http.StatusOK, body: "40"},
+		{request: "/value/gauge/HeapAlloc?window=5m&stat=count", want: http.StatusOK, body: "3"},
+		{request: "/value/gauge/HeapAlloc", want: http.StatusOK, body: "20"},
+		{request: "/value/gauge/HeapAlloc?window=2m&stat=max", want: http.StatusNotFound},
+		{request: "/value/gauge/HeapAlloc?window=1h&stat=median", want: http.StatusBadRequest},
+		{request: "/value/gauge/HeapAlloc?stat=max", want: http.StatusBadRequest},
+		{request: "/value/counter/HeapAlloc?window=1h", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.request, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.request, nil))
+			require.Equal(t, tt.want, w.Code)
+			if tt.want == http.StatusOK {
+				require.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
 func TestHandlerUpdate(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -191,6 +259,11 @@ func TestHandlerUpdate(t *testing.T) {
 			want:    http.StatusNotFound,
 			request: "http://127.0.0.1:8080/update/gauge/",
 		},
+		{
+			name:    "invalid name",
+			want:    http.StatusBadRequest,
+			request: "http://127.0.0.1:8080/update/gauge/Alloc%7Benv=%22prod%22%7D/1.0",
+		},
 	}
 	s := storage.NewStorage(nil, time.Second)
 	r := setupRoutes(s, []byte{})
@@ -296,6 +369,179 @@ func TestHandlerUpdatesJSON(t *testing.T) {
 	}
 }
 
+func TestHandlerUpdatesJSON_InvalidName(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, []byte{})
+
+	for _, body := range []string{
+		`[{"id":"Alloc","type":"gauge","value":1},{"id":"Alloc{env=\"prod\"}","type":"gauge","value":1}]`,
+		`[{"id":"","type":"gauge","value":1}]`,
+		`{"id":"api,requests","type":"counter","delta":1}`,
+	} {
+		path := "/updates/"
+		if body[0] == '{' {
+			path = "/update/"
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		require.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	require.Empty(t, s.DataGauge)
+	require.Empty(t, s.DataCounter)
+}
+
+func TestHandlerUpdatesJSON_CounterTotal(t *testing.T) {
+	key := []byte("secret")
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, key)
+
+	send := func(body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(body)))
+		return w.Code
+	}
+	total := func(value int64) string {
+		hash := security.Hash(fmt.Sprintf("requests:counter_total:%d", value), key)
+		return fmt.Sprintf(`[{"id":"requests", "type":"counter", "total":%d, "hash":"%s"}]`, value, hash)
+	}
+
+	require.Equal(t, http.StatusOK, send(total(10)))
+	require.Equal(t, http.StatusOK, send(total(10)))
+	require.Equal(t, http.StatusOK, send(total(25)))
+	require.Equal(t, metrics.Counter(25), s.DataCounter["requests"])
+	require.Equal(t, http.StatusOK, send(total(5)))
+	require.Equal(t, metrics.Counter(30), s.DataCounter["requests"])
+
+	// The hash of a delta does not match a total with the same value.
+	hash := security.Hash("requests:counter:40", key)
+	require.Equal(t, http.StatusBadRequest, send(fmt.Sprintf(`[{"id":"requests", "type":"counter", "total":40, "hash":"%s"}]`, hash)))
+	require.Equal(t, http.StatusBadRequest, send(`[{"id":"requests", "type":"counter", "total":40, "delta":1}]`))
+	require.Equal(t, metrics.Counter(30), s.DataCounter["requests"])
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rate/counter/requests?window=1m", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var rate Rate
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rate))
+	require.Equal(t, "requests", rate.ID)
+	require.Equal(t, "1m0s", rate.Window)
+	// The increase is counted from the first sample in the window, 10.
+	require.InDelta(t, 20.0/60, rate.Rate, 1e-9)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rate/gauge/requests", nil))
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestHandlerUpdatesJSON_IdempotencyKey(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, []byte{})
+
+	send := func(batchKey string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(body))
+		if batchKey != "" {
+			request.Header.Set(IdempotencyKeyHeader, batchKey)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w
+	}
+
+	body := `[{"id":"PollCount", "type":"counter", "delta":5}]`
+	require.Equal(t, http.StatusOK, send("batch-1", body).Code)
+	// The replay is acknowledged with the current value and not applied.
+	w := send("batch-1", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	var answer []metrics.Metrics
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&answer))
+	require.Len(t, answer, 1)
+	require.Equal(t, int64(5), *answer[0].Delta)
+	require.Equal(t, metrics.Counter(5), s.DataCounter["PollCount"])
+
+	require.Equal(t, http.StatusOK, send("batch-2", body).Code)
+	require.Equal(t, http.StatusOK, send("", body).Code)
+	require.Equal(t, http.StatusOK, send("", body).Code)
+	require.Equal(t, metrics.Counter(20), s.DataCounter["PollCount"])
+
+	// An invalid batch is not applied at all and its key is not remembered.
+	require.Equal(t, http.StatusBadRequest, send("batch-3", `[{"id":"PollCount", "type":"counter", "delta":5}, {"id":"Errors", "type":"counter"}]`).Code)
+	require.Equal(t, metrics.Counter(20), s.DataCounter["PollCount"])
+	require.Equal(t, http.StatusOK, send("batch-3", body).Code)
+	require.Equal(t, metrics.Counter(25), s.DataCounter["PollCount"])
+
+	require.Equal(t, http.StatusBadRequest, send(strings.Repeat("k", 129), body).Code)
+	require.Equal(t, metrics.Counter(25), s.DataCounter["PollCount"])
+}
+
+// failingLoadStorage is a storage whose values can not be loaded one by one after a batch is stored.
+type failingLoadStorage struct {
+	storage.Storage
+}
+
+func (failingLoadStorage) LoadContext(ctx context.Context, metricType string, metric metrics.Metric) storage.Result {
+	return storage.Result{Err: errors.New("connection refused")}
+}
+
+func TestHandlerUpdatesJSON_StoredValues(t *testing.T) {
+	r := setupRoutes(failingLoadStorage{storage.NewStorage(nil, time.Second)}, []byte{})
+
+	body := `[{"id":"PollCount", "type":"counter", "delta":5}, {"id":"Alloc", "type":"gauge", "value":1.5}, {"id":"PollCount", "type":"counter", "delta":2}]`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The answer has the values returned with the stored batch, a metric sent twice has its resulting value twice.
+	var answer []metrics.Metrics
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&answer))
+	require.Len(t, answer, 3)
+	require.Equal(t, int64(7), *answer[0].Delta)
+	require.Equal(t, 1.5, *answer[1].Value)
+	require.Equal(t, int64(7), *answer[2].Delta)
+}
+
+func TestHandlerUpdatesJSON_Agents(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, []byte("secret"))
+
+	for _, agent := range []string{"host1", "host2"} {
+		delta := int64(1)
+		metric := metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta, Agent: agent, Labels: map[string]string{"env": "prod"}}
+		metric.Hash = security.Hash(fmt.Sprintf("%s:counter:%d", metric.Key(), delta), []byte("secret"))
+		body, err := json.Marshal([]metrics.Metrics{metric, metric})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	require.Equal(t, metrics.Counter(2), s.DataCounter[`PollCount{agent="host1",env="prod"}`])
+	require.Equal(t, metrics.Counter(2), s.DataCounter[`PollCount{agent="host2",env="prod"}`])
+	require.NotContains(t, s.DataCounter, metrics.Metric("PollCount"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/value/counter/PollCount?agent=host1&env=prod", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "2", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/value/counter/PollCount?agent=host3&env=prod", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	body := []byte(`{"id":"PollCount", "type":"counter", "agent":"host2", "labels":{"env":"prod"}}`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var answer metrics.Metrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	require.Equal(t, int64(2), *answer.Delta)
+	require.Equal(t, "host2", answer.Agent)
+
+	body = []byte(`[{"id":"PollCount", "type":"counter", "delta":1, "labels":{"1env":"prod"}}]`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestHandlerValueJSON(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -377,6 +623,455 @@ func TestHandlerValueJSON(t *testing.T) {
 
 }
 
+func TestHandlerHistory(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, []byte{})
+
+	for _, request := range []string{"/update/gauge/Alloc/1.0", "/update/gauge/Alloc/2.0", "/update/counter/Poll/3"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, request, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		want    int
+		samples int
+	}{
+		{
+			name:    "TestHandlerHistory #1",
+			request: "/history/gauge/Alloc",
+			want:    http.StatusOK,
+			samples: 2,
+		},
+		{
+			name:    "TestHandlerHistory #2",
+			request: "/history/gauge/Alloc?step=1h",
+			want:    http.StatusOK,
+			samples: 1,
+		},
+		{
+			name:    "TestHandlerHistory #3",
+			request: "/history/counter/Poll",
+			want:    http.StatusOK,
+			samples: 1,
+		},
+		{
+			name:    "TestHandlerHistory #4",
+			request: "/history/gauge/Alloc?from=2000-01-01T00:00:00Z&to=2000-01-02T00:00:00Z",
+			want:    http.StatusOK,
+			samples: 0,
+		},
+		{
+			name:    "TestHandlerHistory #5",
+			request: "/history/gauge/Alloc?from=yesterday",
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "TestHandlerHistory #6",
+			request: "/history/counter/unknown",
+			want:    http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			require.Equal(t, tt.want, result.StatusCode)
+			defer result.Body.Close()
+
+			if tt.want == http.StatusOK {
+				var samples []map[string]any
+				err := json.NewDecoder(result.Body).Decode(&samples)
+				require.NoError(t, err)
+				require.Len(t, samples, tt.samples)
+			}
+		})
+	}
+}
+
+// failingRangeStorage is a storage whose history can not be read, e.g. because the database is down.
+type failingRangeStorage struct {
+	storage.Storage
+}
+
+func (failingRangeStorage) LoadRangeContext(ctx context.Context, metricType string, metric metrics.Metric, from, to time.Time, step time.Duration) storage.Result {
+	return storage.Result{Err: errors.New("connection refused")}
+}
+
+func TestHandlerHistory_LoadError(t *testing.T) {
+	r := setupRoutes(failingRangeStorage{storage.NewStorage(nil, time.Second)}, []byte{})
+	for _, request := range []string{"/history/gauge/Alloc", "/rate/counter/Poll"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, request, nil))
+		require.Equal(t, http.StatusInternalServerError, w.Code, request)
+	}
+}
+
+func TestHandlerHistogram(t *testing.T) {
+	key := []byte("some key")
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, key)
+
+	histogram := metrics.Histogram{Bounds: []float64{0.1, 1}, Counts: []uint64{2, 1, 0}, Sum: 0.7, Count: 3}
+	metric := metrics.Metrics{ID: "latency", MType: "histogram", Histogram: &histogram, Labels: map[string]string{"path": "/api"}}
+	metric.Hash = security.Hash(fmt.Sprintf("%s:histogram:%s", metric.Key(), histogram.HashString()), key)
+	for i := 0; i < 2; i++ {
+		body, err := json.Marshal(metric)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// Summaries are not stored, their quantiles are sent as gauges.
+	body, err := json.Marshal(metrics.Metrics{ID: "latency", MType: "summary", Histogram: &histogram})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+
+	invalid := metric
+	invalid.Hash = security.Hash("latency:histogram:", key)
+	body, err = json.Marshal(invalid)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	body, err = json.Marshal(metrics.Metrics{ID: "latency", MType: "histogram", Labels: map[string]string{"path": "/api"}})
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var answer metrics.Metrics
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&answer))
+	require.NotNil(t, answer.Histogram)
+	require.Equal(t, []uint64{4, 2, 0}, answer.Histogram.Counts)
+	require.Equal(t, uint64(6), answer.Histogram.Count)
+	require.Equal(t, security.Hash(fmt.Sprintf("%s:histogram:%s", metric.Key(), answer.Histogram.HashString()), key), answer.Hash)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	want := `# TYPE latency histogram
+latency_bucket{le="0.1",path="/api"} 4
+latency_bucket{le="1",path="/api"} 6
+latency_bucket{le="+Inf",path="/api"} 6
+latency_sum{path="/api"} 1.4
+latency_count{path="/api"} 6
+`
+	require.Equal(t, want, w.Body.String())
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	s.DataGauge = map[metrics.Metric]metrics.Gauge{
+		"Alloc": 1.5,
+		metrics.SeriesKey("Alloc", "host1", map[string]string{"env": "pr\"od"}): 2,
+		"Free.Memory": 3,
+		"PollCount":   4,
+	}
+	s.DataCounter = map[metrics.Metric]metrics.Counter{
+		"PollCount": 5,
+		metrics.SeriesKey("Requests", "host1", nil): 6,
+	}
+	r := setupRoutes(s, []byte{})
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	want := `# TYPE Alloc gauge
+Alloc 1.5
+Alloc{agent="host1",env="pr\"od"} 2
+# TYPE Free_Memory gauge
+Free_Memory 3
+# TYPE PollCount gauge
+PollCount 4
+# TYPE PollCount_total counter
+PollCount_total 5
+# TYPE Requests counter
+Requests{agent="host1"} 6
+`
+	require.Equal(t, want, w.Body.String())
+
+	// A histogram which clashes with a gauge or a counter gets its own family.
+	histogram := metrics.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}
+	s.DataHistogram = map[metrics.Metric]metrics.Histogram{"Alloc": histogram, "Poll": histogram}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	want += `# TYPE Alloc_histogram histogram
+Alloc_histogram_bucket{le="1"} 1
+Alloc_histogram_bucket{le="+Inf"} 1
+Alloc_histogram_sum 0.5
+Alloc_histogram_count 1
+# TYPE Poll histogram
+Poll_bucket{le="1"} 1
+Poll_bucket{le="+Inf"} 1
+Poll_sum 0.5
+Poll_count 1
+`
+	require.Equal(t, want, w.Body.String())
+
+	s.DataCounter["Poll_count"] = 1
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, w.Body.String(), "# TYPE Poll_histogram histogram\n")
+	require.Equal(t, 1, strings.Count(w.Body.String(), "# TYPE Poll_count "))
+}
+
+func TestHandlerMetrics_CounterTotalTaken(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	s.DataGauge = map[metrics.Metric]metrics.Gauge{"Requests": 1, "Errors": 2, "Errors_total": 3}
+	s.DataCounter = map[metrics.Metric]metrics.Counter{"Requests": 4, "Requests_total": 5, "Errors": 6}
+	r := setupRoutes(s, []byte{})
+
+	// The counters renamed for the gauges do not share a family with another counter or a gauge.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	want := `# TYPE Errors gauge
+Errors 2
+# TYPE Errors_total gauge
+Errors_total 3
+# TYPE Requests gauge
+Requests 1
+# TYPE Errors_total_total counter
+Errors_total_total 6
+# TYPE Requests_total counter
+Requests_total 5
+# TYPE Requests_total_total counter
+Requests_total_total 4
+`
+	require.Equal(t, want, w.Body.String())
+}
+
+func TestHandlerMetadata(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, []byte{})
+
+	post := func(path, body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusNoContent, post("/metadata/", `[
+		{"name":"PollCount","type":"counter","help":"Number of polls."},
+		{"name":"Alloc","type":"gauge","unit":"bytes","help":"Bytes of allocated heap objects."}]`))
+	require.Equal(t, http.StatusBadRequest, post("/metadata/", `[{"name":"Alloc","type":"summary"}]`))
+	require.Equal(t, http.StatusBadRequest, post("/metadata/", `[{"name":"Alloc{env=\"prod\"}","type":"gauge"}]`))
+	// The type of a declared name can not be changed, nothing of the request is declared then.
+	require.Equal(t, http.StatusConflict, post("/metadata/", `[{"name":"Frees","type":"counter"},{"name":"Alloc","type":"counter"}]`))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metadata/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var metadata []metrics.Metadata
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metadata))
+	require.Equal(t, []metrics.Metadata{
+		{Name: "Alloc", MType: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects."},
+		{Name: "PollCount", MType: "counter", Help: "Number of polls."},
+	}, metadata)
+
+	// The values of a declared name are rejected if they have another type, whatever their labels.
+	require.Equal(t, http.StatusOK, post("/update/gauge/Alloc/1.5", ""))
+	require.Equal(t, http.StatusConflict, post("/update/counter/Alloc/1", ""))
+	require.Equal(t, http.StatusConflict, post("/update/", `{"id":"PollCount","type":"gauge","value":1,"labels":{"env":"prod"}}`))
+	// Only the conflicting values of a batch are dropped, the other ones are stored.
+	require.Equal(t, http.StatusConflict, post("/updates/", `[{"id":"Frees","type":"gauge","value":2},{"id":"Alloc","type":"counter","delta":1}]`))
+	res := s.LoadContext(context.Background(), "gauge", "Frees")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Gauge(2), res.Value)
+	require.Equal(t, http.StatusOK, post("/updates/", `[{"id":"Frees","type":"gauge","value":1},{"id":"PollCount","type":"counter","delta":1}]`))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "# HELP Alloc Bytes of allocated heap objects. Unit: bytes.\n# TYPE Alloc gauge\n")
+	require.Contains(t, w.Body.String(), "# HELP PollCount Number of polls.\n# TYPE PollCount counter\n")
+	require.NotContains(t, w.Body.String(), "# HELP Frees")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "<p>Alloc &mdash; Bytes of allocated heap objects. Unit: bytes.</p>")
+
+	// A declaration is corrected by deleting it and declaring the name again.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/metadata/Alloc", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, http.StatusNoContent, post("/metadata/", `[{"name":"Alloc","type":"counter"}]`))
+	require.Equal(t, http.StatusOK, post("/update/counter/Alloc/1", ""))
+}
+
+func TestHandlerMetadataSignature(t *testing.T) {
+	key := []byte("some key")
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, key)
+
+	send := func(method, path, body, signed string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("HashSHA256", security.Hash(signed, key))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	body := `[{"name":"Alloc","type":"gauge"}]`
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/metadata/", body, "other"))
+	require.Equal(t, http.StatusNoContent, send(http.MethodPost, "/metadata/", body, body))
+	require.Equal(t, http.StatusBadRequest, send(http.MethodDelete, "/metadata/Alloc", "", "Frees"))
+	require.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/metadata/Alloc", "", "Alloc"))
+
+	res := s.LoadMetadataContext(context.Background())
+	require.NoError(t, res.Err)
+	require.Empty(t, res.Value)
+}
+
+func TestHandlerRemoteWrite(t *testing.T) {
+	key := []byte("some key")
+	s := storage.NewStorage(nil, time.Second)
+	r := setupRoutes(s, key)
+
+	writeRequest := func(requests int, signature func(body []byte) string) int {
+		req := &pb.WriteRequest{
+			Timeseries: []*pb.TimeSeries{
+				{
+					Labels: []*pb.Label{{Name: "__name__", Value: "temperature"}, {Name: "room", Value: "kitchen"}},
+					Samples: []*pb.Sample{
+						{Value: 20.5, Timestamp: 1000},
+						{Value: 21.5, Timestamp: 2000},
+					},
+				},
+				{
+					Labels:  []*pb.Label{{Name: "__name__", Value: "requests_total"}, {Name: "job", Value: "api"}},
+					Samples: []*pb.Sample{{Value: float64(requests), Timestamp: 2000}},
+				},
+				{
+					Labels:  []*pb.Label{{Name: "__name__", Value: "http_requests"}},
+					Samples: []*pb.Sample{{Value: 7, Timestamp: 2000}},
+				},
+				{
+					Labels:  []*pb.Label{{Name: "__name__", Value: "latency_seconds_sum"}},
+					Samples: []*pb.Sample{{Value: 0.25 * float64(requests), Timestamp: 2000}},
+				},
+				{
+					Labels:  []*pb.Label{{Name: "__name__", Value: "latency_seconds_count"}},
+					Samples: []*pb.Sample{{Value: float64(requests), Timestamp: 2000}},
+				},
+				{
+					Labels:  []*pb.Label{{Name: "__name__", Value: "process_cpu_seconds_total"}},
+					Samples: []*pb.Sample{{Value: 1.25 * float64(requests), Timestamp: 2000}},
+				},
+			},
+			Metadata: []*pb.MetricMetadata{
+				{Type: pb.MetricMetadata_COUNTER, MetricFamilyName: "http_requests"},
+				{Type: pb.MetricMetadata_HISTOGRAM, MetricFamilyName: "latency_seconds"},
+			},
+		}
+		data, err := proto.Marshal(req)
+		require.NoError(t, err)
+		body := snappy.Encode(nil, data)
+
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", "snappy")
+		request.Header.Set("HashSHA256", signature(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w.Code
+	}
+	sign := func(body []byte) string { return security.Hash(string(body), key) }
+
+	require.Equal(t, http.StatusNoContent, writeRequest(10, sign))
+	require.Equal(t, metrics.Gauge(21.5), s.DataGauge[metrics.SeriesKey("temperature", "", map[string]string{"room": "kitchen"})])
+	require.Equal(t, metrics.Counter(10), s.DataCounter[metrics.SeriesKey("requests_total", "", map[string]string{"job": "api"})])
+	require.Equal(t, metrics.Counter(7), s.DataCounter["http_requests"])
+	// The fractional _sum of a histogram is kept as a gauge, the _count is a counter.
+	require.Equal(t, metrics.Gauge(2.5), s.DataGauge["latency_seconds_sum"])
+	require.Equal(t, metrics.Counter(10), s.DataCounter["latency_seconds_count"])
+	// A fractional counter is kept as a gauge too instead of being rounded.
+	require.Equal(t, metrics.Gauge(12.5), s.DataGauge["process_cpu_seconds_total"])
+	require.NotContains(t, s.DataCounter, metrics.Metric("process_cpu_seconds_total"))
+
+	require.Equal(t, http.StatusNoContent, writeRequest(15, sign))
+	require.Equal(t, metrics.Counter(15), s.DataCounter[metrics.SeriesKey("requests_total", "", map[string]string{"job": "api"})])
+	require.Equal(t, metrics.Counter(7), s.DataCounter["http_requests"])
+
+	// The client has been restarted, the whole value after the reset is the increase.
+	require.Equal(t, http.StatusNoContent, writeRequest(3, sign))
+	require.Equal(t, metrics.Counter(18), s.DataCounter[metrics.SeriesKey("requests_total", "", map[string]string{"job": "api"})])
+
+	require.Equal(t, http.StatusBadRequest, writeRequest(20, func(body []byte) string { return security.Hash(string(body), []byte("other key")) }))
+	require.Equal(t, metrics.Counter(18), s.DataCounter[metrics.SeriesKey("requests_total", "", map[string]string{"job": "api"})])
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewBufferString("not snappy"))
+	request.Header.Set("HashSHA256", sign([]byte("not snappy")))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandlerWebhooks(t *testing.T) {
+	dispatcher := webhooks.NewDispatcher(webhooks.Config{})
+	r := chi.NewRouter()
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			HandlerWebhooks(w, r, dispatcher)
+		})
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			HandlerWebhooks(w, r, dispatcher)
+		})
+		r.Delete("/{_}", func(w http.ResponseWriter, r *http.Request) {
+			HandlerWebhooks(w, r, dispatcher)
+		})
+		r.Get("/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+			HandlerDeadLetters(w, r, dispatcher)
+		})
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(`{"url": "ftp://example.com", "metric": "Alloc"}`)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(`{"url": "http://example.com/hook", "metric": "Free*"}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var sub webhooks.Subscription
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sub))
+	require.NotEmpty(t, sub.ID)
+	require.NotEmpty(t, sub.Secret)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var subs []webhooks.Subscription
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&subs))
+	require.Len(t, subs, 1)
+	require.Empty(t, subs[0].Secret)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webhooks/dead-letters", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/webhooks/"+sub.ID, nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/webhooks/"+sub.ID, nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func BenchmarkHandlerUpdatesJSON(b *testing.B) {
 	s := storage.NewStorage(nil, time.Second)
 	r := setupRoutes(s, []byte("some key"))
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/url"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// seriesKeyFromQuery builds the series key of the metric from its name and the query parameters:
+// the parameter agent sets the agent and all the others, except reserved ones, set the labels.
+func seriesKeyFromQuery(name string, query url.Values, reserved ...string) (metrics.Metric, error) {
+	labels := map[string]string{}
+	for label := range query {
+		labels[label] = query.Get(label)
+	}
+	for _, label := range reserved {
+		delete(labels, label)
+	}
+
+	err := metrics.ValidateLabels(labels)
+	if err != nil {
+		return "", err
+	}
+
+	return metrics.SeriesKey(name, "", labels), nil
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var errInvalidHistogram = errors.New("invalid histogram")
+
+// Histogram is a distribution of observed values, e.g. request latencies.
+// Bounds are the upper bounds of the buckets in increasing order. Counts[i] is the number of values
+// in (Bounds[i-1], Bounds[i]], the last element of Counts is the number of values above the last bound,
+// so Counts has one element more than Bounds. Sum is the sum and Count is the number of all the values.
+//
+// Like counters, histograms are sent as the observations made since the previous report,
+// and the server adds them to the stored histogram.
+//
+// Summaries are not a type of their own: their quantiles are computed by the client over its own window,
+// so they can not be added up across reports or agents. The quantiles of a summary are reported as gauges
+// and its count as a counter, a distribution to alert on is reported as a histogram.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// NewHistogram returns an empty histogram with the given bucket bounds.
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds the value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	i := 0
+	for i < len(h.Bounds) && value > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += value
+	h.Count++
+}
+
+// Validate checks that the bounds are increasing, that there is a count for every bucket
+// and that Count is the sum of the counts of the buckets.
+func (h Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: %d bounds need %d counts", errInvalidHistogram, len(h.Bounds), len(h.Bounds)+1)
+	}
+	for i, bound := range h.Bounds {
+		if math.IsNaN(bound) || (i > 0 && bound <= h.Bounds[i-1]) {
+			return fmt.Errorf("%w: bounds are not increasing", errInvalidHistogram)
+		}
+	}
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if count != h.Count {
+		return fmt.Errorf("%w: count %d is not the sum of buckets %d", errInvalidHistogram, h.Count, count)
+	}
+	return nil
+}
+
+// SameBounds reports whether the histograms have the same buckets.
+func (h Histogram) SameBounds(other Histogram) bool {
+	if len(h.Bounds) != len(other.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns the histogram with the observations of both histograms.
+// If the buckets differ, the stored observations can not be combined with the new ones,
+// and other is returned as is. The callers which must not drop observations check SameBounds first.
+func (h Histogram) Merge(other Histogram) Histogram {
+	if !h.SameBounds(other) {
+		return other.Copy()
+	}
+	merged := h.Copy()
+	for i := range merged.Counts {
+		merged.Counts[i] += other.Counts[i]
+	}
+	merged.Sum += other.Sum
+	merged.Count += other.Count
+	return merged
+}
+
+// Copy returns a deep copy of the histogram.
+func (h Histogram) Copy() Histogram {
+	return Histogram{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// HashString returns the representation of the histogram used in the digital signature of the metric:
+// the hashed string is "<key>:histogram:<HashString>", where HashString is "b1,b2,...;c1,c2,...;sum;count"
+// with bounds and sum formatted by %f.
+func (h Histogram) HashString() string {
+	bounds := make([]string, len(h.Bounds))
+	for i, bound := range h.Bounds {
+		bounds[i] = fmt.Sprintf("%f", bound)
+	}
+	counts := make([]string, len(h.Counts))
+	for i, count := range h.Counts {
+		counts[i] = fmt.Sprintf("%d", count)
+	}
+	return fmt.Sprintf("%s;%s;%f;%d", strings.Join(bounds, ","), strings.Join(counts, ","), h.Sum, h.Count)
+}
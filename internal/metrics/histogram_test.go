@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, value := range []float64{0.5, 1, 3, 10} {
+		h.Observe(value)
+	}
+	require.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	require.Equal(t, uint64(4), h.Count)
+	require.Equal(t, 14.5, h.Sum)
+	require.NoError(t, h.Validate())
+	require.Equal(t, "1.000000,5.000000;2,1,1;14.500000;4", h.HashString())
+
+	merged := h.Merge(h)
+	require.Equal(t, []uint64{4, 2, 2}, merged.Counts)
+	require.Equal(t, []uint64{2, 1, 1}, h.Counts)
+
+	other := NewHistogram([]float64{2})
+	require.Equal(t, other, h.Merge(other))
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		histogram Histogram
+		wantErr   bool
+	}{
+		{
+			name:      "valid",
+			histogram: Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 2}, Sum: 10, Count: 3},
+		},
+		{
+			name:      "without bounds",
+			histogram: Histogram{Counts: []uint64{3}, Sum: 10, Count: 3},
+		},
+		{
+			name:      "missing count of +Inf bucket",
+			histogram: Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 0}, Sum: 10, Count: 1},
+			wantErr:   true,
+		},
+		{
+			name:      "decreasing bounds",
+			histogram: Histogram{Bounds: []float64{2, 1}, Counts: []uint64{1, 0, 2}, Sum: 10, Count: 3},
+			wantErr:   true,
+		},
+		{
+			name:      "wrong count",
+			histogram: Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 2}, Sum: 10, Count: 4},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.histogram.Validate()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
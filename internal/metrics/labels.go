@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AgentLabel is the name of the label that holds the identifier of the agent which sent the metric.
+const AgentLabel = "agent"
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// invalidNameChars are the characters which break the syntax of the series keys, see SeriesKey.
+// The other characters are allowed, the names are sanitized where the syntax is stricter, e.g. for Prometheus.
+const invalidNameChars = "{},=\"\n"
+
+var (
+	errInvalidMetricName = errors.New("invalid metric name")
+	errInvalidLabelName  = errors.New("invalid label name")
+	errInvalidSeriesKey  = errors.New("invalid series key")
+)
+
+// SeriesKey returns the key under which the metric with the given name, agent and labels is stored.
+// The key has the form name{label1="value1",label2="value2"} with labels sorted by name, the agent
+// is kept as the label AgentLabel. A metric without agent and labels is stored under its name, so
+// metrics sent by the clients unaware of labels keep their keys.
+func SeriesKey(name string, agent string, labels map[string]string) Metric {
+	if agent == "" && len(labels) == 0 {
+		return Metric(name)
+	}
+
+	names := make([]string, 0, len(labels)+1)
+	for label := range labels {
+		if label != AgentLabel {
+			names = append(names, label)
+		}
+	}
+	if agent == "" {
+		agent = labels[AgentLabel]
+	}
+	if agent != "" {
+		names = append(names, AgentLabel)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, label := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := labels[label]
+		if label == AgentLabel {
+			value = agent
+		}
+		b.WriteString(label)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(value))
+	}
+	b.WriteByte('}')
+
+	return Metric(b.String())
+}
+
+// ParseSeriesKey splits the key built by SeriesKey into the name of the metric and its labels.
+// The agent is returned as the label AgentLabel. For a key without labels the map is empty.
+func ParseSeriesKey(key Metric) (string, map[string]string, error) {
+	labels := map[string]string{}
+	str := string(key)
+	open := strings.IndexByte(str, '{')
+	if open < 0 {
+		return str, labels, nil
+	}
+	if !strings.HasSuffix(str, "}") {
+		return "", nil, errInvalidSeriesKey
+	}
+
+	name, rest := str[:open], str[open+1:len(str)-1]
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, errInvalidSeriesKey
+		}
+		label := rest[:eq]
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return "", nil, errInvalidSeriesKey
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", nil, errInvalidSeriesKey
+		}
+		labels[label] = value
+
+		rest = rest[eq+1+len(quoted):]
+		if rest != "" {
+			if rest[0] != ',' {
+				return "", nil, errInvalidSeriesKey
+			}
+			rest = rest[1:]
+		}
+	}
+
+	return name, labels, nil
+}
+
+// ValidateName checks that the name of the metric is not empty and has none of the characters of the syntax
+// of the series keys: braces, commas, equal signs, quotes and newlines. Names like api.requests or cache-hits
+// are valid.
+func ValidateName(name string) error {
+	if name == "" || strings.ContainsAny(name, invalidNameChars) {
+		return fmt.Errorf("%w: %q", errInvalidMetricName, name)
+	}
+	return nil
+}
+
+// ValidateLabels checks that all the label names consist of latin letters, digits and underscores
+// and do not start with a digit.
+func ValidateLabels(labels map[string]string) error {
+	for label := range labels {
+		if !labelNameRegexp.MatchString(label) {
+			return fmt.Errorf("%w: %q", errInvalidLabelName, label)
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses labels written as "name1=value1,name2=value2".
+func ParseLabels(str string) (map[string]string, error) {
+	labels := map[string]string{}
+	if strings.TrimSpace(str) == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		label, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q", pair)
+		}
+		labels[strings.TrimSpace(label)] = strings.TrimSpace(value)
+	}
+
+	return labels, ValidateLabels(labels)
+}
+
+// Validate checks the name and the label names of the metric, see ValidateName and ValidateLabels.
+func (m Metrics) Validate() error {
+	err := ValidateName(m.ID)
+	if err != nil {
+		return err
+	}
+	return ValidateLabels(m.Labels)
+}
+
+// Key returns the series key of the metric, see SeriesKey.
+func (m Metrics) Key() Metric {
+	return SeriesKey(m.ID, m.Agent, m.Labels)
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		agent  string
+		labels map[string]string
+		want   Metric
+	}{
+		{
+			name: "without labels",
+			id:   "Alloc",
+			want: "Alloc",
+		},
+		{
+			name:  "agent only",
+			id:    "Alloc",
+			agent: "host1",
+			want:  `Alloc{agent="host1"}`,
+		},
+		{
+			name:   "labels are sorted",
+			id:     "Alloc",
+			agent:  "host1",
+			labels: map[string]string{"env": "prod", "dc": "eu"},
+			want:   `Alloc{agent="host1",dc="eu",env="prod"}`,
+		},
+		{
+			name:   "agent field overrides label",
+			id:     "Alloc",
+			agent:  "host1",
+			labels: map[string]string{"agent": "host2"},
+			want:   `Alloc{agent="host1"}`,
+		},
+		{
+			name:   "values are escaped",
+			id:     "Alloc",
+			labels: map[string]string{"path": `C:\tmp "x"`},
+			want:   `Alloc{path="C:\\tmp \"x\""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := SeriesKey(tt.id, tt.agent, tt.labels)
+			require.Equal(t, tt.want, key)
+
+			name, labels, err := ParseSeriesKey(key)
+			require.NoError(t, err)
+			require.Equal(t, tt.id, name)
+			require.Equal(t, key, SeriesKey(name, "", labels))
+		})
+	}
+}
+
+func TestParseSeriesKey_Invalid(t *testing.T) {
+	for _, key := range []Metric{`Alloc{agent="host1"`, `Alloc{agent=host1}`, `Alloc{agent="host1"env="prod"}`} {
+		_, _, err := ParseSeriesKey(key)
+		require.Error(t, err, key)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"Alloc", "http_requests_total", "node:cpu:rate5m", "_hidden", "api.requests", "cache-hits", "1Alloc"} {
+		require.NoError(t, ValidateName(name), name)
+	}
+	for _, name := range []string{"", `Alloc{env="prod"}`, "Alloc}", "a,b", "a=b", `a"b`, "a\nb"} {
+		require.Error(t, ValidateName(name), name)
+	}
+
+	require.NoError(t, Metrics{ID: "Alloc", Labels: map[string]string{"env": "prod"}}.Validate())
+	require.NoError(t, Metrics{ID: "Alloc-1"}.Validate())
+	require.Error(t, Metrics{ID: "Alloc,1"}.Validate())
+	require.Error(t, Metrics{ID: "Alloc", Labels: map[string]string{"1env": "prod"}}.Validate())
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("env=prod, dc=eu")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env": "prod", "dc": "eu"}, labels)
+
+	labels, err = ParseLabels("")
+	require.NoError(t, err)
+	require.Empty(t, labels)
+
+	_, err = ParseLabels("env")
+	require.Error(t, err)
+
+	_, err = ParseLabels("1env=prod")
+	require.Error(t, err)
+}
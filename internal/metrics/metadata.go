@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errInvalidMetadataName = errors.New("metadata: metric name must be a valid name without labels")
+	errInvalidMetadataType = errors.New("metadata: type must be gauge, counter or histogram")
+)
+
+// Metadata describes a metric by name: the type it is declared with, the unit of its values, e.g. "bytes",
+// and a help text. It covers all the series of the metric, whatever their agent and labels.
+type Metadata struct {
+	Name  string `json:"name"`
+	MType string `json:"type"`
+	Unit  string `json:"unit,omitempty"`
+	Help  string `json:"help,omitempty"`
+}
+
+// Validate checks that the metadata has a name without labels and one of the types of metrics.
+func (m Metadata) Validate() error {
+	if err := ValidateName(m.Name); err != nil {
+		return fmt.Errorf("%w: %q", errInvalidMetadataName, m.Name)
+	}
+	switch m.MType {
+	case "gauge", "counter", "histogram":
+		return nil
+	default:
+		return fmt.Errorf("%w, got %q for %s", errInvalidMetadataType, m.MType, m.Name)
+	}
+}
+
+// Describe returns the help text followed by the unit, e.g. "Bytes of allocated heap objects. Unit: bytes.",
+// for the pages and the exports which have no place for the unit.
+func (m Metadata) Describe() string {
+	if m.Unit == "" {
+		return m.Help
+	}
+	if m.Help == "" {
+		return "Unit: " + m.Unit + "."
+	}
+	return strings.TrimSuffix(m.Help, ".") + ". Unit: " + m.Unit + "."
+}
+
+// MetadataHashString returns the string the signature of the metadata is computed over: the JSON array
+// of the metadata, the body of POST /metadata, so the metadata sent over HTTP and gRPC is signed the same way.
+func MetadataHashString(metadata []Metadata) string {
+	data, _ := json.Marshal(metadata)
+	return string(data)
+}
+
+// SeriesName returns the name of the metric of the series key built by SeriesKey.
+func SeriesName(key Metric) string {
+	name, _, _ := strings.Cut(string(key), "{")
+	return name
+}
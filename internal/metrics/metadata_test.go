@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata_Validate(t *testing.T) {
+	require.NoError(t, Metadata{Name: "Alloc", MType: "gauge", Unit: "bytes"}.Validate())
+	require.NoError(t, Metadata{Name: "PollCount", MType: "counter"}.Validate())
+	require.Error(t, Metadata{MType: "gauge"}.Validate())
+	require.Error(t, Metadata{Name: `Alloc{agent="a"}`, MType: "gauge"}.Validate())
+	require.Error(t, Metadata{Name: "Alloc", MType: "summary"}.Validate())
+}
+
+func TestMetadata_Describe(t *testing.T) {
+	require.Equal(t, "Bytes of allocated heap objects. Unit: bytes.",
+		Metadata{Help: "Bytes of allocated heap objects.", Unit: "bytes"}.Describe())
+	require.Equal(t, "Unit: percent.", Metadata{Unit: "percent"}.Describe())
+	require.Equal(t, "Number of polls", Metadata{Help: "Number of polls"}.Describe())
+}
+
+func TestSeriesName(t *testing.T) {
+	require.Equal(t, "Alloc", SeriesName(SeriesKey("Alloc", "agent-1", map[string]string{"host": "a"})))
+	require.Equal(t, "Alloc", SeriesName("Alloc"))
+}
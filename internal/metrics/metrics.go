@@ -1,13 +1,30 @@
 package metrics
 
 import (
+	"encoding/json"
+	"fmt"
 	"runtime"
+	"time"
 )
 
 type Gauge float64
 
 type Counter int64
 
+// CounterTotal is an absolute value of a cumulative counter as reported by its source,
+// the increase of the counter is computed from the previous total by Increase.
+type CounterTotal int64
+
+// Increase returns the increase of a cumulative counter from the previous total to total.
+// A total going down is treated as a reset of the counter, the whole total is then the increase.
+// On the first observation (seen is false) the whole total is the increase as well.
+func (total CounterTotal) Increase(previous CounterTotal, seen bool) Counter {
+	if !seen || total < previous {
+		return Counter(total)
+	}
+	return Counter(total - previous)
+}
+
 type Metric string
 
 const (
@@ -81,16 +98,80 @@ func GetMetrics(memStats runtime.MemStats) map[Metric]Gauge {
 }
 
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID        string            `json:"id"`
+	MType     string            `json:"type"`
+	Delta     *int64            `json:"delta,omitempty"`
+	Total     *int64            `json:"total,omitempty"` // The absolute value of a cumulative counter, sent instead of Delta.
+	Value     *float64          `json:"value,omitempty"`
+	Histogram *Histogram        `json:"histogram,omitempty"`
+	Hash      string            `json:"hash,omitempty"`
+	Agent     string            `json:"agent,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// GaugeSample is a value of a gauge observed at the given moment.
+type GaugeSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     Gauge     `json:"value"`
+}
+
+// CounterSample is an accumulated value of a counter observed at the given moment.
+type CounterSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     Counter   `json:"value"`
+}
+
+// CounterRate returns the per-second rate of increase of the counter over the window ending at the last sample.
+// Samples have to be sorted by time. A value going down is treated as a reset of the counter, and the value
+// after the reset is counted as the increase. Less than two samples mean no observed increase.
+func CounterRate(samples []CounterSample, window time.Duration) float64 {
+	if len(samples) < 2 || window <= 0 {
+		return 0
+	}
+
+	var increase Counter
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Value >= samples[i-1].Value {
+			increase += samples[i].Value - samples[i-1].Value
+		} else {
+			increase += samples[i].Value
+		}
+	}
+
+	return float64(increase) / window.Seconds()
+}
+
+// Compare applies the comparison operator op ("<", "<=", ">", ">=", "==" or "!=") to value and threshold.
+// It returns an error for an unknown operator.
+func Compare(value float64, op string, threshold float64) (bool, error) {
+	switch op {
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	default:
+		return false, fmt.Errorf("unknown operator %q", op)
+	}
 }
 
 type FileData struct {
-	DataGauge   map[Metric]Gauge   `json:"data_gauge"`
-	DataCounter map[Metric]Counter `json:"data_counter"`
+	DataGauge      map[Metric]Gauge                    `json:"data_gauge"`
+	DataCounter    map[Metric]Counter                  `json:"data_counter"`
+	DataHistogram  map[Metric]Histogram                `json:"data_histogram,omitempty"`
+	HistoryGauge   map[Metric][]GaugeSample            `json:"history_gauge,omitempty"`
+	HistoryCounter map[Metric][]CounterSample          `json:"history_counter,omitempty"`
+	CounterTotals  map[Metric]CounterTotal             `json:"counter_totals,omitempty"`
+	Rollups        map[Metric]map[string]RollingRollup `json:"rollups,omitempty"`
+	BatchKeys      map[string]time.Time                `json:"batch_keys,omitempty"`
+	Metadata       map[string]Metadata                 `json:"metadata,omitempty"`
 }
 
 type ConfigAgent struct {
@@ -101,6 +182,30 @@ type ConfigAgent struct {
 	RateLimit      string `json:"rate_limit,omitempty"`
 	CryptoKey      string `json:"crypto_key,omitempty"`
 	GRPC           string `json:"grpc,omitempty"`
+	AgentID        string `json:"agent_id,omitempty"`
+	Labels         string `json:"labels,omitempty"`
+	SpoolDir       string `json:"spool_dir,omitempty"`
+	SpoolMaxSize   string `json:"spool_max_size,omitempty"`
+	SpoolMaxAge    string `json:"spool_max_age,omitempty"`
+	RetryAttempts  string `json:"retry_max_attempts,omitempty"`
+	RetryBackoff   string `json:"retry_initial_backoff,omitempty"`
+	RetryMaxDelay  string `json:"retry_max_backoff,omitempty"`
+	RetryJitter    string `json:"retry_jitter,omitempty"`
+	Collectors     string `json:"collectors,omitempty"`
+	PushAddress    string `json:"push_address,omitempty"`
+
+	// CollectorOptions holds the options of the collectors by name, they are parsed by the collectors.
+	CollectorOptions map[string]json.RawMessage `json:"collector_options,omitempty"`
+	// ScrapeTargets are the exporters in Prometheus format the agent scrapes.
+	ScrapeTargets []ScrapeTarget `json:"scrape_targets,omitempty"`
+}
+
+// ScrapeTarget is an exporter in Prometheus format scraped by the agent on every poll.
+type ScrapeTarget struct {
+	Name    string            `json:"name"`              // The name of the target, the value of the label job.
+	URL     string            `json:"url"`               // The URL of the metrics, e.g. http://127.0.0.1:9100/metrics.
+	Labels  map[string]string `json:"labels,omitempty"`  // The labels added to every metric of the target.
+	Timeout string            `json:"timeout,omitempty"` // The timeout of a scrape, 5s by default.
 }
 
 type ConfigServer struct {
@@ -113,4 +218,15 @@ type ConfigServer struct {
 	CryptoKey      string `json:"crypto_key,omitempty"`
 	TrustedSubnet  string `json:"trusted_subnet,omitempty"`
 	GRPC           string `json:"grpc,omitempty"`
+	RulesFile      string `json:"rules_file,omitempty"`
+	RulesInterval  string `json:"rules_interval,omitempty"`
+	WebhookBatch   string `json:"webhook_batch_interval,omitempty"`
+	WebhookPrivate string `json:"webhook_allow_private,omitempty"`
+	StatsdAddress  string `json:"statsd_address,omitempty"`
+	StatsdFlush    string `json:"statsd_flush_interval,omitempty"`
+	StatsdPercents string `json:"statsd_percentiles,omitempty"`
+	RollupWindows  string `json:"rollup_windows,omitempty"`
+	WALDir         string `json:"wal_dir,omitempty"`
+	WALFsync       string `json:"wal_fsync,omitempty"`
+	WALSnapshot    string `json:"wal_snapshot_interval,omitempty"`
 }
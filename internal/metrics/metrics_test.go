@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterRate(t *testing.T) {
+	start := time.Now()
+	samples := []CounterSample{
+		{Timestamp: start, Value: 10},
+		{Timestamp: start.Add(30 * time.Second), Value: 40},
+		{Timestamp: start.Add(40 * time.Second), Value: 5},
+		{Timestamp: start.Add(60 * time.Second), Value: 15},
+	}
+	require.Equal(t, 45.0/60, CounterRate(samples, time.Minute))
+	require.Equal(t, 0.0, CounterRate(samples[:1], time.Minute))
+	require.Equal(t, 0.0, CounterRate(nil, time.Minute))
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRollupWindows are the windows of the gauge rollups kept by the server by default.
+const DefaultRollupWindows = "1m,5m,1h"
+
+// RollupStats are the statistics of a rollup which can be queried.
+var RollupStats = []string{"min", "max", "avg", "sum", "count", "last"}
+
+var errInvalidRollupWindow = errors.New("invalid rollup window")
+
+// RollupBuckets is the number of the sub-buckets the window of a RollingRollup is split into.
+const RollupBuckets = 10
+
+// Rollup holds the statistics of the values of a gauge stored within a period, Start is the beginning of the period.
+// It is a sub-bucket of a RollingRollup or the statistics over the trailing window merged from the sub-buckets.
+type Rollup struct {
+	Start time.Time `json:"start"`
+	Min   Gauge     `json:"min"`
+	Max   Gauge     `json:"max"`
+	Sum   float64   `json:"sum"`
+	Count int64     `json:"count"`
+	Last  Gauge     `json:"last"`
+}
+
+// Observe returns the rollup with the value stored at the moment added. Periods are aligned to their duration,
+// e.g. the 30s periods are [12:00:00, 12:00:30), [12:00:30, 12:01:00) and so on; a value stored after the period
+// of the rollup starts the rollup of its period.
+func (r Rollup) Observe(value Gauge, at time.Time, period time.Duration) Rollup {
+	start := at.Truncate(period)
+	if r.Count == 0 || !start.Equal(r.Start) {
+		return Rollup{Start: start, Min: value, Max: value, Sum: float64(value), Count: 1, Last: value}
+	}
+
+	return r.merge(Rollup{Start: start, Min: value, Max: value, Sum: float64(value), Count: 1, Last: value})
+}
+
+// merge returns the statistics of the rollup and the next one, the last value is the one of the next rollup.
+func (r Rollup) merge(next Rollup) Rollup {
+	if r.Count == 0 {
+		return next
+	}
+	if next.Count == 0 {
+		return r
+	}
+	if next.Min < r.Min {
+		r.Min = next.Min
+	}
+	if next.Max > r.Max {
+		r.Max = next.Max
+	}
+	r.Sum += next.Sum
+	r.Count += next.Count
+	r.Last = next.Last
+	return r
+}
+
+// RollupBucket returns the duration of the sub-buckets of the window.
+func RollupBucket(window time.Duration) time.Duration {
+	return window / RollupBuckets
+}
+
+// RollingRollup holds the statistics of the values of a gauge stored within the trailing window.
+// The window is split into RollupBuckets sub-buckets aligned to their duration, ordered by start, and the statistics
+// over the window are merged from the sub-buckets overlapping it, so the window slides by a sub-bucket at a time
+// and a spike is kept in Max for the whole window after it, whenever it happened.
+type RollingRollup struct {
+	Buckets []Rollup `json:"buckets"`
+}
+
+// Observe returns the rolling rollup with the value stored at the moment added to its sub-bucket,
+// the sub-buckets which are out of the window of the moment are dropped. The rollup itself is not changed,
+// so a copy of it can be read concurrently.
+func (r RollingRollup) Observe(value Gauge, at time.Time, window time.Duration) RollingRollup {
+	bucket := RollupBucket(window)
+	start := at.Truncate(bucket)
+	from := start.Add(-window)
+
+	buckets := make([]Rollup, 0, len(r.Buckets)+1)
+	observed := false
+	for _, b := range r.Buckets {
+		if !b.Start.After(from) {
+			continue
+		}
+		switch {
+		case b.Start.Equal(start):
+			b = b.Observe(value, at, bucket)
+			observed = true
+		case b.Start.After(start) && !observed:
+			// A value stored late goes before the newer sub-buckets.
+			buckets = append(buckets, Rollup{}.Observe(value, at, bucket))
+			observed = true
+		}
+		buckets = append(buckets, b)
+	}
+	if !observed {
+		buckets = append(buckets, Rollup{}.Observe(value, at, bucket))
+	}
+	return RollingRollup{Buckets: buckets}
+}
+
+// Over returns the statistics of the values stored within the trailing window of the moment: the sub-bucket
+// containing the moment and the previous ones up to the window are merged, Start is the start of the oldest of them.
+// The second value is false if no value has been stored within the window.
+func (r RollingRollup) Over(now time.Time, window time.Duration) (Rollup, bool) {
+	from := now.Truncate(RollupBucket(window)).Add(-window)
+
+	var merged Rollup
+	for _, b := range r.Buckets {
+		if b.Start.After(from) && !b.Start.After(now) {
+			merged = merged.merge(b)
+		}
+	}
+	return merged, merged.Count > 0
+}
+
+// UnmarshalJSON decodes the rolling rollup. The files of the older versions keep a single rollup of the window
+// aligned to its duration, such a rollup becomes the only sub-bucket.
+func (r *RollingRollup) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Buckets []Rollup `json:"buckets"`
+		Rollup
+	}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	r.Buckets = decoded.Buckets
+	if r.Buckets == nil && decoded.Count > 0 {
+		r.Buckets = []Rollup{decoded.Rollup}
+	}
+	return nil
+}
+
+// Stat returns the statistic of the rollup by name, see RollupStats.
+func (r Rollup) Stat(name string) (float64, error) {
+	switch name {
+	case "min":
+		return float64(r.Min), nil
+	case "max":
+		return float64(r.Max), nil
+	case "avg":
+		if r.Count == 0 {
+			return 0, nil
+		}
+		return r.Sum / float64(r.Count), nil
+	case "sum":
+		return r.Sum, nil
+	case "count":
+		return float64(r.Count), nil
+	case "last":
+		return float64(r.Last), nil
+	default:
+		return 0, fmt.Errorf("unknown statistic %q, expected one of %s", name, strings.Join(RollupStats, ", "))
+	}
+}
+
+// ParseRollupWindows parses a comma-separated list of rollup windows, e.g. "1m,5m,1h".
+// The windows are returned sorted and without duplicates, an empty string means no rollups.
+func ParseRollupWindows(s string) ([]time.Duration, error) {
+	windows := make([]time.Duration, 0)
+	seen := map[time.Duration]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		window, err := time.ParseDuration(part)
+		if err != nil || window < time.Second {
+			return nil, fmt.Errorf("%w: %q", errInvalidRollupWindow, part)
+		}
+		if !seen[window] {
+			seen[window] = true
+			windows = append(windows, window)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return windows, nil
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollup(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 5, 0, 0, time.UTC)
+	var r Rollup
+	for i, value := range []Gauge{3, 10, 2, 5} {
+		r = r.Observe(value, start.Add(time.Duration(i)*time.Minute), 5*time.Minute)
+	}
+	require.Equal(t, Rollup{Start: start, Min: 2, Max: 10, Sum: 20, Count: 4, Last: 5}, r)
+
+	for stat, want := range map[string]float64{"min": 2, "max": 10, "avg": 5, "sum": 20, "count": 4, "last": 5} {
+		value, err := r.Stat(stat)
+		require.NoError(t, err)
+		require.Equal(t, want, value, stat)
+	}
+	_, err := r.Stat("median")
+	require.Error(t, err)
+
+	// A value of the next period starts a new rollup.
+	r = r.Observe(7, start.Add(5*time.Minute), 5*time.Minute)
+	require.Equal(t, Rollup{Start: start.Add(5 * time.Minute), Min: 7, Max: 7, Sum: 7, Count: 1, Last: 7}, r)
+}
+
+func TestRollingRollup(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	window := 5 * time.Minute
+	var r RollingRollup
+	// A spike right before the end of an aligned window is kept after the window ends.
+	r = r.Observe(3, start.Add(4*time.Minute), window)
+	r = r.Observe(100, start.Add(4*time.Minute+50*time.Second), window)
+	r = r.Observe(5, start.Add(5*time.Minute+10*time.Second), window)
+
+	rollup, ok := r.Over(start.Add(5*time.Minute+20*time.Second), window)
+	require.True(t, ok)
+	require.Equal(t, Rollup{Start: start.Add(4 * time.Minute), Min: 3, Max: 100, Sum: 108, Count: 3, Last: 5}, rollup)
+
+	// The window slides by a sub-bucket: the values of the sub-buckets out of the window are not counted.
+	rollup, ok = r.Over(start.Add(9*time.Minute+30*time.Second), window)
+	require.True(t, ok)
+	require.Equal(t, Rollup{Start: start.Add(5 * time.Minute), Min: 5, Max: 5, Sum: 5, Count: 1, Last: 5}, rollup)
+	_, ok = r.Over(start.Add(10*time.Minute+30*time.Second), window)
+	require.False(t, ok)
+
+	// The sub-buckets out of the window of a new value are dropped, a late value goes before the newer sub-buckets.
+	r = r.Observe(7, start.Add(9*time.Minute+45*time.Second), window)
+	r = r.Observe(1, start.Add(5*time.Minute+40*time.Second), window)
+	require.Len(t, r.Buckets, 3)
+	rollup, ok = r.Over(start.Add(9*time.Minute+50*time.Second), window)
+	require.True(t, ok)
+	require.Equal(t, Rollup{Start: start.Add(5 * time.Minute), Min: 1, Max: 7, Sum: 13, Count: 3, Last: 7}, rollup)
+}
+
+func TestRollingRollup_UnmarshalJSON(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var r RollingRollup
+	require.NoError(t, json.Unmarshal([]byte(`{"start":"2024-01-01T12:00:00Z","min":1,"max":3,"sum":4,"count":2,"last":3}`), &r))
+	require.Equal(t, RollingRollup{Buckets: []Rollup{{Start: start, Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3}}}, r)
+
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+	var decoded RollingRollup
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, r, decoded)
+}
+
+func TestParseRollupWindows(t *testing.T) {
+	windows, err := ParseRollupWindows("1h, 1m,5m,1m")
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{time.Minute, 5 * time.Minute, time.Hour}, windows)
+
+	windows, err = ParseRollupWindows("")
+	require.NoError(t, err)
+	require.Empty(t, windows)
+
+	_, err = ParseRollupWindows("1m,soon")
+	require.Error(t, err)
+	_, err = ParseRollupWindows("10ms")
+	require.Error(t, err)
+}
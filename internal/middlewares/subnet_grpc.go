@@ -38,3 +38,29 @@ func SubnetInterceptor(trustedSubnet string) func(ctx context.Context, req any,
 		}
 	}
 }
+
+// SubnetStreamInterceptor is the stream counterpart of SubnetInterceptor: it rejects the streams
+// opened from the addresses outside of the trusted subnet. The address is taken from the X-Real-IP metadata.
+func SubnetStreamInterceptor(trustedSubnet string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if trustedSubnet == "" {
+			return handler(srv, ss)
+		}
+
+		_, ipNet, err := net.ParseCIDR(trustedSubnet)
+		if err != nil {
+			return err
+		}
+
+		md, ok := metadata.FromIncomingContext(ss.Context())
+		if !ok {
+			return errors.New("error with SubnetStreamInterceptor")
+		}
+		values := md.Get("X-Real-IP")
+		if len(values) == 0 || !ipNet.Contains(net.ParseIP(values[0])) {
+			return errors.New("error with SubnetStreamInterceptor")
+		}
+
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,191 @@
+// Package promtext parses the Prometheus text exposition format, the format of /metrics of the exporters.
+package promtext
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Types of metric families. Samples of the families without # TYPE are TypeUntyped.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+	TypeSummary   = "summary"
+	TypeUntyped   = "untyped"
+)
+
+var errInvalidLine = errors.New("invalid line")
+
+// suffixes are the suffixes of the samples of histograms, summaries and OpenMetrics counters.
+var suffixes = []string{"_bucket", "_count", "_sum", "_total", "_created"}
+
+// Sample is a single line of the exposition.
+type Sample struct {
+	Name   string            // The name of the sample, e.g. http_request_duration_seconds_bucket.
+	Family string            // The name of the family the sample belongs to, e.g. http_request_duration_seconds.
+	Type   string            // The type of the family.
+	Labels map[string]string // The labels of the sample, empty if there are none.
+	Value  float64
+}
+
+// Parse reads the exposition and returns its samples in order. Comments other than # TYPE and timestamps are ignored.
+//
+// Parameters:
+//   - r: The reader of the exposition.
+//
+// Returns:
+//   - The samples and an error with the number of the line if the exposition is malformed.
+func Parse(r io.Reader) ([]Sample, error) {
+	types := map[string]string{}
+	var samples []Sample
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = strings.ToLower(fields[3])
+			}
+			continue
+		}
+
+		sample, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		sample.Family, sample.Type = family(sample.Name, types)
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// family returns the family of the sample and its type.
+func family(name string, types map[string]string) (string, string) {
+	if t, ok := types[name]; ok {
+		return name, t
+	}
+	for _, suffix := range suffixes {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			if t, ok := types[base]; ok {
+				return base, t
+			}
+		}
+	}
+	return name, TypeUntyped
+}
+
+// parseSample parses the line name{label="value",...} value [timestamp].
+func parseSample(line string) (Sample, error) {
+	sample := Sample{Labels: map[string]string{}}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return sample, errInvalidLine
+	}
+	sample.Name, line = line[:end], line[end:]
+
+	if line[0] == '{' {
+		rest, err := parseLabels(line[1:], sample.Labels)
+		if err != nil {
+			return sample, err
+		}
+		line = rest
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 1 || len(fields) > 2 {
+		return sample, errInvalidLine
+	}
+	value, err := parseValue(fields[0])
+	if err != nil {
+		return sample, err
+	}
+	sample.Value = value
+
+	return sample, nil
+}
+
+// parseLabels parses the labels up to the closing brace into labels and returns the rest of the line.
+func parseLabels(line string, labels map[string]string) (string, error) {
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return "", errInvalidLine
+		}
+		if line[0] == '}' {
+			return line[1:], nil
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return "", errInvalidLine
+		}
+		label := strings.TrimSpace(line[:eq])
+		line = strings.TrimLeft(line[eq+1:], " \t")
+		if line == "" || line[0] != '"' {
+			return "", errInvalidLine
+		}
+
+		var value strings.Builder
+		i := 1
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] != '\\' {
+				value.WriteByte(line[i])
+				continue
+			}
+			i++
+			if i == len(line) {
+				return "", errInvalidLine
+			}
+			switch line[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(line[i])
+			default:
+				return "", errInvalidLine
+			}
+		}
+		if i == len(line) {
+			return "", errInvalidLine
+		}
+		labels[label] = value.String()
+
+		line = strings.TrimLeft(line[i+1:], " \t")
+		if strings.HasPrefix(line, ",") {
+			line = line[1:]
+		}
+	}
+}
+
+// parseValue parses the value of a sample including +Inf, -Inf and NaN.
+func parseValue(str string) (float64, error) {
+	switch str {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: value %q", errInvalidLine, str)
+	}
+	return value, nil
+}
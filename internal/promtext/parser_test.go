@@ -0,0 +1,63 @@
+package promtext
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	exposition := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# A comment.
+msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9
+
+# TYPE queue_size gauge
+queue_size 12
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 5
+request_duration_seconds_bucket{le="+Inf"} 8
+request_duration_seconds_sum 1.5
+request_duration_seconds_count 8
+go_goroutines NaN
+max_value +Inf
+`
+	samples, err := Parse(strings.NewReader(exposition))
+	require.NoError(t, err)
+	require.Len(t, samples, 10)
+
+	assert.Equal(t, Sample{Name: "http_requests_total", Family: "http_requests_total", Type: TypeCounter,
+		Labels: map[string]string{"method": "post", "code": "400"}, Value: 3}, samples[1])
+	assert.Equal(t, map[string]string{"path": `C:\DIR\FILE.TXT`, "error": "Cannot find file:\n\"FILE.TXT\""}, samples[2].Labels)
+	assert.Equal(t, TypeUntyped, samples[2].Type)
+	assert.Equal(t, Sample{Name: "queue_size", Family: "queue_size", Type: TypeGauge, Labels: map[string]string{}, Value: 12}, samples[3])
+	assert.Equal(t, "request_duration_seconds", samples[5].Family)
+	assert.Equal(t, TypeHistogram, samples[5].Type)
+	assert.Equal(t, map[string]string{"le": "+Inf"}, samples[5].Labels)
+	assert.Equal(t, TypeHistogram, samples[7].Type)
+	assert.True(t, math.IsNaN(samples[8].Value))
+	assert.True(t, math.IsInf(samples[9].Value, 1))
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []string{
+		`metric{label="value"`,
+		`metric{label=value} 1`,
+		`metric abc`,
+		`metric 1 2 3`,
+		`{label="value"} 1`,
+		`metric{label="\x"} 1`,
+	}
+	for _, exposition := range tests {
+		t.Run(exposition, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(exposition))
+			assert.Error(t, err)
+		})
+	}
+}
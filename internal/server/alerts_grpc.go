@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/luckyseadog/go-dev/internal/alerting"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// AlertsServer exposes the alerts tracked by the alerting engine over gRPC.
+type AlertsServer struct {
+	pb.UnimplementedAlertsServer
+	Engine *alerting.Engine
+}
+
+// ListAlerts returns the current alerts, filtered by state if it is set in the request.
+func (as *AlertsServer) ListAlerts(ctx context.Context, in *pb.ListAlertsRequest) (*pb.ListAlertsResponse, error) {
+	state := alerting.State(in.State)
+	switch state {
+	case "", alerting.StatePending, alerting.StateFiring, alerting.StateResolved:
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unknown state")
+	}
+
+	var response pb.ListAlertsResponse
+	for _, alert := range as.Engine.Alerts(state) {
+		alertProto := &pb.Alert{
+			Rule:        alert.Rule,
+			Metric:      string(alert.Metric),
+			State:       string(alert.State),
+			Value:       alert.Value,
+			ActiveSince: timestamppb.New(alert.ActiveSince),
+		}
+		if alert.FiredAt != nil {
+			alertProto.FiredAt = timestamppb.New(*alert.FiredAt)
+		}
+		if alert.ResolvedAt != nil {
+			alertProto.ResolvedAt = timestamppb.New(*alert.ResolvedAt)
+		}
+		response.Alerts = append(response.Alerts, alertProto)
+	}
+
+	return &response, nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/storage"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// RegisterMetadata declares the metadata of the request, see storage.Storage.RegisterMetadataContext.
+// A name declared with another type than before is rejected with FailedPrecondition and nothing is declared.
+// If the server has a secret key, the hash of the request has to be the HMAC-SHA256 of metrics.MetadataHashString,
+// a request with another hash is rejected with Unauthenticated.
+func (mcs *MetricsCollectServer) RegisterMetadata(ctx context.Context, in *pb.RegisterMetadataRequest) (*pb.RegisterMetadataResponse, error) {
+	metadata := make([]metrics.Metadata, 0, len(in.Metadata))
+	for _, descriptor := range in.Metadata {
+		m := metadataFromProto(descriptor)
+		if err := m.Validate(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		metadata = append(metadata, m)
+	}
+
+	if len(mcs.Key) > 0 {
+		decodedComputedHash, err := hex.DecodeString(security.Hash(metrics.MetadataHashString(metadata), mcs.Key))
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		decodedRequestHash, err := hex.DecodeString(in.Hash)
+		if err != nil || !hmac.Equal(decodedComputedHash, decodedRequestHash) {
+			return nil, status.Error(codes.Unauthenticated, "invalid signature")
+		}
+	}
+
+	err := mcs.Storage.RegisterMetadataContext(ctx, metadata)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return &pb.RegisterMetadataResponse{}, nil
+}
+
+// ListMetadata returns the declared metadata of the metrics with the name starting with the prefix of the request,
+// sorted by name.
+func (mqs *MetricsQueryServer) ListMetadata(ctx context.Context, in *pb.ListMetadataRequest) (*pb.ListMetadataResponse, error) {
+	res := mqs.Storage.LoadMetadataContext(ctx)
+	if res.Err != nil {
+		return nil, status.Error(codes.Internal, res.Err.Error())
+	}
+
+	list := make([]*pb.MetricDescriptor, 0)
+	for name, m := range res.Value.(map[string]metrics.Metadata) {
+		if strings.HasPrefix(name, in.Prefix) {
+			list = append(list, metadataToProto(m))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return &pb.ListMetadataResponse{Metadata: list}, nil
+}
+
+// storeError converts an error of the storage to a gRPC status: FailedPrecondition if a metric is declared
+// with another type, so the client does not retry, InvalidArgument if the idempotency key is too long and
+// Unavailable otherwise. The values of a batch
+// which do not conflict with the declared types are stored, so a retry would apply them twice.
+func storeError(err error) error {
+	if errors.Is(err, storage.ErrTypeConflict) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, storage.ErrInvalidBatchKey) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// metadataFromProto converts the protobuf message to metrics.Metadata.
+func metadataFromProto(d *pb.MetricDescriptor) metrics.Metadata {
+	return metrics.Metadata{Name: d.Name, MType: d.MType, Unit: d.Unit, Help: d.Help}
+}
+
+// metadataToProto converts metrics.Metadata to the protobuf message.
+func metadataToProto(m metrics.Metadata) *pb.MetricDescriptor {
+	return &pb.MetricDescriptor{Name: m.Name, MType: m.MType, Unit: m.Unit, Help: m.Help}
+}
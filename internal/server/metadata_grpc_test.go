@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/storage"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+func TestRegisterMetadata(t *testing.T) {
+	key := []byte("some key")
+	s := storage.NewStorage(nil, time.Second)
+	mcs := &MetricsCollectServer{Storage: s, Key: key}
+	ctx := context.Background()
+
+	metadata := []metrics.Metadata{{Name: "Alloc", MType: "gauge", Unit: "bytes"}}
+	request := &pb.RegisterMetadataRequest{Metadata: []*pb.MetricDescriptor{{Name: "Alloc", MType: "gauge", Unit: "bytes"}}}
+
+	_, err := mcs.RegisterMetadata(ctx, request)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	request.Hash = security.Hash(metrics.MetadataHashString(metadata), []byte("other key"))
+	_, err = mcs.RegisterMetadata(ctx, request)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	request.Hash = security.Hash(metrics.MetadataHashString(metadata), key)
+	_, err = mcs.RegisterMetadata(ctx, request)
+	require.NoError(t, err)
+
+	counter := []metrics.Metadata{{Name: "Alloc", MType: "counter"}}
+	_, err = mcs.RegisterMetadata(ctx, &pb.RegisterMetadataRequest{
+		Metadata: []*pb.MetricDescriptor{{Name: "Alloc", MType: "counter"}},
+		Hash:     security.Hash(metrics.MetadataHashString(counter), key),
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	res := s.LoadMetadataContext(ctx)
+	require.NoError(t, res.Err)
+	require.Equal(t, map[string]metrics.Metadata{"Alloc": metadata[0]}, res.Value)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// watchBuffer is the number of changes buffered for a single WatchMetrics stream.
+// Changes are dropped for the clients which do not keep up.
+const watchBuffer = 256
+
+// MetricsQueryServer exposes the metrics of the storage over gRPC.
+// It is subscribed to the storage and passes the stored values to the WatchMetrics streams.
+type MetricsQueryServer struct {
+	pb.UnimplementedMetricsQueryServer
+	Storage storage.Storage
+
+	mu       sync.Mutex
+	watchers map[chan storage.Update]struct{}
+}
+
+// NewMetricsQueryServer creates a MetricsQueryServer and subscribes it to the storage.
+func NewMetricsQueryServer(s storage.Storage) *MetricsQueryServer {
+	mqs := &MetricsQueryServer{
+		Storage:  s,
+		watchers: map[chan storage.Update]struct{}{},
+	}
+	s.Subscribe(mqs)
+	return mqs
+}
+
+// OnStore implements storage.Observer. It passes the update to all the WatchMetrics streams.
+func (mqs *MetricsQueryServer) OnStore(update storage.Update) {
+	mqs.mu.Lock()
+	defer mqs.mu.Unlock()
+	for ch := range mqs.watchers {
+		select {
+		case ch <- update:
+		default:
+			MyLog.Println("WatchMetrics: client is too slow, change is dropped")
+		}
+	}
+}
+
+// GetMetric returns the value of the metric with the given name, type, agent and labels.
+func (mqs *MetricsQueryServer) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	if !validType(in.MType) {
+		return nil, status.Error(codes.InvalidArgument, "not allowed type")
+	}
+	if err := metrics.ValidateLabels(in.Labels); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	seriesKey := metrics.SeriesKey(in.Id, in.Agent, in.Labels)
+	res := mqs.Storage.LoadContext(ctx, in.MType, seriesKey)
+	if res.Err != nil {
+		return nil, status.Error(codes.NotFound, res.Err.Error())
+	}
+	metric, err := metricToProto(seriesKey, in.MType, res.Value)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.GetMetricResponse{Metric: metric}, nil
+}
+
+// ListMetrics returns the metrics with the name starting with the prefix of the request, sorted by series key.
+// If the type is set in the request, only the metrics of this type are returned.
+func (mqs *MetricsQueryServer) ListMetrics(ctx context.Context, in *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	if in.MType != "" && !validType(in.MType) {
+		return nil, status.Error(codes.InvalidArgument, "not allowed type")
+	}
+
+	list, err := mqs.list(ctx, in.Prefix, in.MType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListMetricsResponse{Metrics: list}, nil
+}
+
+// WatchMetrics sends every stored value of the metrics with the name starting with the prefix of the request
+// until the client cancels the stream. If send_current is set, the current values are sent first.
+func (mqs *MetricsQueryServer) WatchMetrics(in *pb.WatchMetricsRequest, stream pb.MetricsQuery_WatchMetricsServer) error {
+	if in.MType != "" && !validType(in.MType) {
+		return status.Error(codes.InvalidArgument, "not allowed type")
+	}
+
+	ch := make(chan storage.Update, watchBuffer)
+	mqs.mu.Lock()
+	mqs.watchers[ch] = struct{}{}
+	mqs.mu.Unlock()
+	defer func() {
+		mqs.mu.Lock()
+		delete(mqs.watchers, ch)
+		mqs.mu.Unlock()
+	}()
+
+	if in.SendCurrent {
+		list, err := mqs.list(stream.Context(), in.Prefix, in.MType)
+		if err != nil {
+			return err
+		}
+		for _, metric := range list {
+			if err := stream.Send(metric); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case update := <-ch:
+			if in.MType != "" && update.MType != in.MType {
+				continue
+			}
+			var value any
+			switch update.MType {
+			case "gauge":
+				value = metrics.Gauge(update.Value)
+			case "counter":
+				value = metrics.Counter(update.Value)
+			case "histogram":
+				value = *update.Histogram
+			}
+			metric, err := metricToProto(update.Metric, update.MType, value)
+			if err != nil || !strings.HasPrefix(metric.Id, in.Prefix) {
+				continue
+			}
+			if err := stream.Send(metric); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// list returns the metrics of the storage with the name starting with prefix and of the type mType if it is set.
+func (mqs *MetricsQueryServer) list(ctx context.Context, prefix string, mType string) ([]*pb.Metric, error) {
+	type stored struct {
+		key   metrics.Metric
+		mType string
+		value any
+	}
+	var all []stored
+
+	if mType == "" || mType == "gauge" {
+		res := mqs.Storage.LoadDataGaugeContext(ctx)
+		if res.Err != nil {
+			return nil, status.Error(codes.Internal, res.Err.Error())
+		}
+		for key, value := range res.Value.(map[metrics.Metric]metrics.Gauge) {
+			all = append(all, stored{key: key, mType: "gauge", value: value})
+		}
+	}
+	if mType == "" || mType == "counter" {
+		res := mqs.Storage.LoadDataCounterContext(ctx)
+		if res.Err != nil {
+			return nil, status.Error(codes.Internal, res.Err.Error())
+		}
+		for key, value := range res.Value.(map[metrics.Metric]metrics.Counter) {
+			all = append(all, stored{key: key, mType: "counter", value: value})
+		}
+	}
+	if mType == "" || mType == "histogram" {
+		res := mqs.Storage.LoadDataHistogramContext(ctx)
+		if res.Err != nil {
+			return nil, status.Error(codes.Internal, res.Err.Error())
+		}
+		for key, value := range res.Value.(map[metrics.Metric]metrics.Histogram) {
+			all = append(all, stored{key: key, mType: "histogram", value: value})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].key != all[j].key {
+			return all[i].key < all[j].key
+		}
+		return all[i].mType < all[j].mType
+	})
+
+	list := make([]*pb.Metric, 0, len(all))
+	for _, s := range all {
+		metric, err := metricToProto(s.key, s.mType, s.value)
+		if err != nil || !strings.HasPrefix(metric.Id, prefix) {
+			continue
+		}
+		list = append(list, metric)
+	}
+
+	return list, nil
+}
+
+// metricToProto converts the stored value to the protobuf message, splitting the series key
+// into the name, the agent and the labels of the metric.
+func metricToProto(seriesKey metrics.Metric, mType string, value any) (*pb.Metric, error) {
+	name, labels, err := metrics.ParseSeriesKey(seriesKey)
+	if err != nil {
+		return nil, err
+	}
+	agent := labels[metrics.AgentLabel]
+	delete(labels, metrics.AgentLabel)
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	metric := &pb.Metric{Id: name, MType: mType, Agent: agent, Labels: labels}
+	switch value := value.(type) {
+	case metrics.Gauge:
+		metric.Value = float64(value)
+	case metrics.Counter:
+		metric.Delta = int64(value)
+	case metrics.Histogram:
+		metric.Histogram = histogramToProto(value)
+	}
+
+	return metric, nil
+}
+
+// validType reports whether the metric type is supported by the storage.
+func validType(mType string) bool {
+	return mType == "gauge" || mType == "counter" || mType == "histogram"
+}
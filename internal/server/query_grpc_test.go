@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/middlewares"
+	"github.com/luckyseadog/go-dev/internal/storage"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// newBufconnClient serves the services registered by register on an in-memory listener until the end of the test
+// and returns a client connection to it. The streams pass the interceptor of the trusted subnet, as on the server.
+func newBufconnClient(t *testing.T, trustedSubnet string, register func(s *grpc.Server)) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(grpc.ChainStreamInterceptor(middlewares.SubnetStreamInterceptor(trustedSubnet)))
+	register(s)
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// newQueryClient stores the metrics of the tests and returns a client of the MetricsQueryServer on the storage.
+func newQueryClient(t *testing.T, trustedSubnet string) (pb.MetricsQueryClient, *MetricsQueryServer, storage.Storage) {
+	s := storage.NewStorage(nil, time.Second)
+	ctx := context.Background()
+	require.NoError(t, s.StoreContext(ctx, metrics.SeriesKey("Alloc", "host1", map[string]string{"env": "prod"}), metrics.Gauge(1.5)))
+	require.NoError(t, s.StoreContext(ctx, "AllocCount", metrics.Counter(3)))
+	require.NoError(t, s.StoreContext(ctx, "Frees", metrics.Gauge(2)))
+
+	mqs := NewMetricsQueryServer(s)
+	conn := newBufconnClient(t, trustedSubnet, func(srv *grpc.Server) { pb.RegisterMetricsQueryServer(srv, mqs) })
+	return pb.NewMetricsQueryClient(conn), mqs, s
+}
+
+func TestMetricsQueryServer_GetMetric(t *testing.T) {
+	client, _, _ := newQueryClient(t, "")
+	ctx := context.Background()
+
+	res, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", MType: "gauge", Agent: "host1", Labels: map[string]string{"env": "prod"}})
+	require.NoError(t, err)
+	require.Equal(t, "Alloc", res.Metric.Id)
+	require.Equal(t, "host1", res.Metric.Agent)
+	require.Equal(t, map[string]string{"env": "prod"}, res.Metric.Labels)
+	require.Equal(t, 1.5, res.Metric.Value)
+
+	res, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "AllocCount", MType: "counter"})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), res.Metric.Delta)
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", MType: "gauge"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", MType: "summary"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", MType: "gauge", Labels: map[string]string{"1env": "prod"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMetricsQueryServer_ListMetrics(t *testing.T) {
+	client, _, _ := newQueryClient(t, "")
+	ctx := context.Background()
+
+	ids := func(list []*pb.Metric) []string {
+		ids := make([]string, 0, len(list))
+		for _, metric := range list {
+			ids = append(ids, metric.Id+":"+metric.MType)
+		}
+		return ids
+	}
+
+	// The metrics are sorted by series key, the labels of Alloc sort it after AllocCount.
+	res, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AllocCount:counter", "Alloc:gauge", "Frees:gauge"}, ids(res.Metrics))
+
+	res, err = client.ListMetrics(ctx, &pb.ListMetricsRequest{Prefix: "Alloc"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AllocCount:counter", "Alloc:gauge"}, ids(res.Metrics))
+
+	res, err = client.ListMetrics(ctx, &pb.ListMetricsRequest{Prefix: "Alloc", MType: "gauge"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Alloc:gauge"}, ids(res.Metrics))
+
+	_, err = client.ListMetrics(ctx, &pb.ListMetricsRequest{MType: "summary"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMetricsQueryServer_WatchMetrics(t *testing.T) {
+	client, mqs, s := newQueryClient(t, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.WatchMetrics(ctx, &pb.WatchMetricsRequest{Prefix: "Alloc", MType: "gauge", SendCurrent: true})
+	require.NoError(t, err)
+	current, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "Alloc", current.Id)
+	require.Equal(t, 1.5, current.Value)
+
+	// The stream is registered before the current values are sent, so no change is missed after them.
+	require.Eventually(t, func() bool {
+		mqs.mu.Lock()
+		defer mqs.mu.Unlock()
+		return len(mqs.watchers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The changes of the other names and types are not sent.
+	require.NoError(t, s.StoreContext(context.Background(), "Frees", metrics.Gauge(5)))
+	require.NoError(t, s.StoreContext(context.Background(), "AllocCount", metrics.Counter(1)))
+	require.NoError(t, s.StoreContext(context.Background(), "AllocBytes", metrics.Gauge(7)))
+	change, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "AllocBytes", change.Id)
+	require.Equal(t, 7.0, change.Value)
+
+	// The stream ends when the client cancels it and the server forgets it.
+	cancel()
+	_, err = stream.Recv()
+	require.Equal(t, codes.Canceled, status.Code(err))
+	require.Eventually(t, func() bool {
+		mqs.mu.Lock()
+		defer mqs.mu.Unlock()
+		return len(mqs.watchers) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMetricsQueryServer_WatchMetricsSubnet(t *testing.T) {
+	client, _, _ := newQueryClient(t, "10.0.0.0/8")
+
+	for _, md := range []metadata.MD{nil, metadata.Pairs("X-Real-IP", "192.0.2.1")} {
+		ctx := context.Background()
+		if md != nil {
+			ctx = metadata.NewOutgoingContext(ctx, md)
+		}
+		stream, err := client.WatchMetrics(ctx, &pb.WatchMetricsRequest{SendCurrent: true})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Error(t, err, md)
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), metadata.Pairs("X-Real-IP", "10.1.2.3")))
+	defer cancel()
+	stream, err := client.WatchMetrics(ctx, &pb.WatchMetricsRequest{SendCurrent: true})
+	require.NoError(t, err)
+	current, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "AllocCount", current.Id)
+}
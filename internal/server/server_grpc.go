@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/luckyseadog/go-dev/internal/storage"
@@ -26,12 +27,23 @@ import (
 type MetricsCollectServer struct {
 	pb.UnimplementedMetricsCollectServer
 	Storage storage.Storage
+	// Key is the secret key RegisterMetadata requests are signed with, no signature is required if it is empty.
+	Key []byte
+
+	mu          sync.Mutex
+	connections map[uint64]*agentConnection
+	lastID      uint64
 }
 
 func (mcs *MetricsCollectServer) AddMetrics(ctx context.Context, in *pb.AddMetricsRequest) (*pb.AddMetricsResponse, error) {
 	metricsCurrent := in.Metrics
 
+	batch := make([]storage.MetricValue, 0, len(metricsCurrent))
 	for _, metric := range metricsCurrent {
+		if err := (metrics.Metrics{ID: metric.Id, Labels: metric.Labels}).Validate(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		seriesKey := metrics.SeriesKey(metric.Id, metric.Agent, metric.Labels)
 		switch metric.MType {
 		case "gauge":
 			// if metric.Value == -1 || metric.Delta != -1 {
@@ -39,7 +51,7 @@ func (mcs *MetricsCollectServer) AddMetrics(ctx context.Context, in *pb.AddMetri
 			// }
 
 			if len(in.Key) > 0 {
-				computedHash := security.Hash(fmt.Sprintf("%s:gauge:%f", metric.Id, metric.Value), in.Key)
+				computedHash := security.Hash(fmt.Sprintf("%s:gauge:%f", seriesKey, metric.Value), in.Key)
 				decodedComputedHash, err := hex.DecodeString(computedHash)
 				if err != nil {
 					return nil, status.Error(codes.Unknown, "2Error")
@@ -52,18 +64,23 @@ func (mcs *MetricsCollectServer) AddMetrics(ctx context.Context, in *pb.AddMetri
 					return nil, status.Error(codes.Unknown, "4Error")
 				}
 			}
-			err := mcs.Storage.StoreContext(ctx, metrics.Metric(metric.Id), metrics.Gauge(metric.Value))
-			if err != nil {
-				return nil, status.Error(codes.Unknown, "5Error")
-			}
+			batch = append(batch, storage.MetricValue{Metric: seriesKey, Value: metrics.Gauge(metric.Value)})
 
 		case "counter":
 			// if metric.Delta == -1 || metric.Value != -1 {
 			// 	return nil, status.Error(codes.Unknown, "6Error")
 			// }
 
+			// A cumulative counter is sent as total, its hash differs from the hash of a delta with the same value.
+			var value any = metrics.Counter(metric.Delta)
+			hashString := fmt.Sprintf("%s:counter:%d", seriesKey, metric.Delta)
+			if metric.Total != nil {
+				value = metrics.CounterTotal(*metric.Total)
+				hashString = fmt.Sprintf("%s:counter_total:%d", seriesKey, *metric.Total)
+			}
+
 			if len(in.Key) > 0 {
-				computedHash := security.Hash(fmt.Sprintf("%s:counter:%d", metric.Id, metric.Delta), in.Key)
+				computedHash := security.Hash(hashString, in.Key)
 				decodedComputedHash, err := hex.DecodeString(computedHash)
 				if err != nil {
 					return nil, status.Error(codes.Unknown, "7Error")
@@ -76,32 +93,69 @@ func (mcs *MetricsCollectServer) AddMetrics(ctx context.Context, in *pb.AddMetri
 					return nil, status.Error(codes.Unknown, "9Error")
 				}
 			}
-			err := mcs.Storage.StoreContext(ctx, metrics.Metric(metric.Id), metrics.Counter(metric.Delta))
-			if err != nil {
-				return nil, status.Error(codes.Unknown, "10Error")
+			batch = append(batch, storage.MetricValue{Metric: seriesKey, Value: value})
+
+		case "histogram":
+			if metric.Histogram == nil {
+				return nil, status.Error(codes.InvalidArgument, "histogram is empty")
+			}
+			histogram := histogramFromProto(metric.Histogram)
+			if err := histogram.Validate(); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+
+			if len(in.Key) > 0 {
+				computedHash := security.Hash(fmt.Sprintf("%s:histogram:%s", seriesKey, histogram.HashString()), in.Key)
+				decodedComputedHash, err := hex.DecodeString(computedHash)
+				if err != nil {
+					return nil, status.Error(codes.Unknown, "2Error")
+				}
+				decodedMetricHash, err := hex.DecodeString(metric.Hash)
+				if err != nil {
+					return nil, status.Error(codes.Unknown, "3Error")
+				}
+				if !hmac.Equal(decodedComputedHash, decodedMetricHash) {
+					return nil, status.Error(codes.Unknown, "4Error")
+				}
 			}
+			batch = append(batch, storage.MetricValue{Metric: seriesKey, Value: histogram})
 
 		default:
 			return nil, status.Error(codes.Unknown, "11Error")
 		}
 	}
 
+	// The batch is stored atomically once all its metrics are validated. A batch with an idempotency key
+	// is applied once, its replay is acknowledged with the current values.
+	stored, _, err := mcs.Storage.StoreBatchContext(ctx, in.IdempotencyKey, batch)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
 	metricsAnswer := make([]metrics.Metrics, 0)
 
 	for _, metric := range metricsCurrent {
-		res := mcs.Storage.LoadContext(ctx, metric.MType, metrics.Metric(metric.Id))
+		seriesKey := metrics.SeriesKey(metric.Id, metric.Agent, metric.Labels)
+		res := stored.Load(metric.MType, seriesKey)
 		if res.Err != nil {
 			return nil, status.Error(codes.Unknown, "12Error")
 		}
 		switch metric.MType {
 		case "gauge":
 			valueFloat64 := float64(res.Value.(metrics.Gauge))
-			hashMetric := security.Hash(fmt.Sprintf("%s:gauge:%f", metric.Id, valueFloat64), in.Key)
-			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.Id, MType: metric.MType, Value: &valueFloat64, Hash: hashMetric})
+			hashMetric := security.Hash(fmt.Sprintf("%s:gauge:%f", seriesKey, valueFloat64), in.Key)
+			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.Id, MType: metric.MType, Value: &valueFloat64, Hash: hashMetric,
+				Agent: metric.Agent, Labels: metric.Labels})
 		case "counter":
 			valueInt64 := int64(res.Value.(metrics.Counter))
-			hashMetric := security.Hash(fmt.Sprintf("%s:counter:%d", metric.Id, valueInt64), in.Key)
-			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.Id, MType: metric.MType, Delta: &valueInt64, Hash: hashMetric})
+			hashMetric := security.Hash(fmt.Sprintf("%s:counter:%d", seriesKey, valueInt64), in.Key)
+			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.Id, MType: metric.MType, Delta: &valueInt64, Hash: hashMetric,
+				Agent: metric.Agent, Labels: metric.Labels})
+		case "histogram":
+			valueHistogram := res.Value.(metrics.Histogram)
+			hashMetric := security.Hash(fmt.Sprintf("%s:histogram:%s", seriesKey, valueHistogram.HashString()), in.Key)
+			metricsAnswer = append(metricsAnswer, metrics.Metrics{ID: metric.Id, MType: metric.MType, Histogram: &valueHistogram, Hash: hashMetric,
+				Agent: metric.Agent, Labels: metric.Labels})
 		default:
 			return nil, status.Error(codes.Unknown, "13Error")
 		}
@@ -110,37 +164,48 @@ func (mcs *MetricsCollectServer) AddMetrics(ctx context.Context, in *pb.AddMetri
 	var response pb.AddMetricsResponse
 
 	for _, metric := range metricsAnswer {
-		if metric.Delta == nil {
-			response.Metrics = append(response.Metrics, &pb.Metric{
-				Id:    metric.ID,
-				MType: metric.MType,
-				Value: *metric.Value,
-				Hash:  metric.Hash,
-			})
+		pbMetric := &pb.Metric{
+			Id:     metric.ID,
+			MType:  metric.MType,
+			Hash:   metric.Hash,
+			Agent:  metric.Agent,
+			Labels: metric.Labels,
 		}
-
-		if metric.Value == nil {
-			response.Metrics = append(response.Metrics, &pb.Metric{
-				Id:    metric.ID,
-				MType: metric.MType,
-				Delta: *metric.Delta,
-				Hash:  metric.Hash,
-			})
+		switch {
+		case metric.Value != nil:
+			pbMetric.Value = *metric.Value
+		case metric.Delta != nil:
+			pbMetric.Delta = *metric.Delta
+		case metric.Histogram != nil:
+			pbMetric.Histogram = histogramToProto(*metric.Histogram)
 		}
+		response.Metrics = append(response.Metrics, pbMetric)
 	}
 	MyLog.Println("Success", status.Code(nil))
 	return &response, nil
 }
 
+// histogramFromProto converts the histogram of the protobuf message to metrics.Histogram.
+func histogramFromProto(h *pb.Histogram) metrics.Histogram {
+	return metrics.Histogram{Bounds: h.Bounds, Counts: h.Counts, Sum: h.Sum, Count: h.Count}
+}
+
+// histogramToProto converts metrics.Histogram to the protobuf message.
+func histogramToProto(h metrics.Histogram) *pb.Histogram {
+	return &pb.Histogram{Bounds: h.Bounds, Counts: h.Counts, Sum: h.Sum, Count: h.Count}
+}
+
 type ServerGRPC struct {
 	*grpc.Server
 	address string
 }
 
-func NewServerGRPC(address string, tlsConfig *tls.Config, gzipInterceptor grpc.UnaryServerInterceptor, subnetInterceptor grpc.UnaryServerInterceptor) *ServerGRPC {
+func NewServerGRPC(address string, tlsConfig *tls.Config, gzipInterceptor grpc.UnaryServerInterceptor, subnetInterceptor grpc.UnaryServerInterceptor,
+	subnetStreamInterceptor grpc.StreamServerInterceptor) *ServerGRPC {
 	grpcServer := grpc.NewServer(
 		grpc.Creds(credentials.NewTLS(tlsConfig)),
 		grpc.ChainUnaryInterceptor(gzipInterceptor, subnetInterceptor),
+		grpc.ChainStreamInterceptor(subnetStreamInterceptor),
 		// Add more options or interceptors as needed
 	)
 	return &ServerGRPC{
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/statsd"
+	"github.com/luckyseadog/go-dev/internal/storage"
 )
 
 type EnvVariables struct {
@@ -25,6 +27,17 @@ type EnvVariables struct {
 	CryptoKeyDir   string
 	TrustedSubnet  string
 	GRPC           bool
+	RulesFile      string
+	RulesInterval  time.Duration
+	WebhookBatch   time.Duration
+	WebhookPrivate bool
+	StatsdAddress  string
+	StatsdFlush    time.Duration
+	StatsdPercents []float64
+	RollupWindows  []time.Duration
+	WALDir         string
+	WALFsync       string
+	WALSnapshot    time.Duration
 }
 
 func SetUp() (*EnvVariables, error) {
@@ -40,6 +53,17 @@ func SetUp() (*EnvVariables, error) {
 	var cFlag string
 	var trustedSubnetFlag string
 	var gRPCFlag string
+	var rulesFileFlag string
+	var rulesIntervalStrFlag string
+	var webhookBatchStrFlag string
+	var webhookPrivateFlag string
+	var statsdAddressFlag string
+	var statsdFlushStrFlag string
+	var statsdPercentsFlag string
+	var rollupWindowsFlag string
+	var walDirFlag string
+	var walFsyncFlag string
+	var walSnapshotStrFlag string
 
 	flag.StringVar(&addressFlag, "a", "127.0.0.1:8080", "address of server")
 	flag.StringVar(&storeIntervalStrFlag, "i", "300", "time to make new write in disk")
@@ -53,6 +77,17 @@ func SetUp() (*EnvVariables, error) {
 	flag.StringVar(&cFlag, "c", "", "path to config")
 	flag.StringVar(&trustedSubnetFlag, "t", "", "mask of subnet which is trusted")
 	flag.StringVar(&gRPCFlag, "grpc", "false", "whether to use gRPC")
+	flag.StringVar(&rulesFileFlag, "rules", "", "file with alerting rules")
+	flag.StringVar(&rulesIntervalStrFlag, "rules-interval", "15s", "time between evaluations of alerting rules")
+	flag.StringVar(&webhookBatchStrFlag, "webhook-batch", "1s", "time between sending batches to webhooks")
+	flag.StringVar(&webhookPrivateFlag, "webhook-allow-private", "false", "whether to allow webhooks to loopback and private addresses")
+	flag.StringVar(&statsdAddressFlag, "statsd", "", "UDP address of StatsD listener, it is disabled if empty")
+	flag.StringVar(&statsdFlushStrFlag, "statsd-flush", "10s", "time between writes of StatsD aggregates")
+	flag.StringVar(&statsdPercentsFlag, "statsd-percentiles", "50,90,99", "percentiles of StatsD timers")
+	flag.StringVar(&rollupWindowsFlag, "rollup-windows", metrics.DefaultRollupWindows, "windows of gauge statistics, e.g. 1m,5m,1h")
+	flag.StringVar(&walDirFlag, "wal", "", "directory of write-ahead log storage, it is used instead of the file if set")
+	flag.StringVar(&walFsyncFlag, "wal-fsync", "always", "fsync mode of write-ahead log: always, interval or never")
+	flag.StringVar(&walSnapshotStrFlag, "wal-snapshot", "5m", "time between snapshots of write-ahead log storage")
 	flag.Parse()
 
 	var configPath string
@@ -108,6 +143,50 @@ func SetUp() (*EnvVariables, error) {
 		gRPCFlag = Config.GRPC
 	}
 
+	if rulesFileFlag == "" {
+		rulesFileFlag = Config.RulesFile
+	}
+
+	if rulesIntervalStrFlag == "" {
+		rulesIntervalStrFlag = Config.RulesInterval
+	}
+
+	if webhookBatchStrFlag == "" {
+		webhookBatchStrFlag = Config.WebhookBatch
+	}
+
+	if webhookPrivateFlag == "" {
+		webhookPrivateFlag = Config.WebhookPrivate
+	}
+
+	if statsdAddressFlag == "" {
+		statsdAddressFlag = Config.StatsdAddress
+	}
+
+	if statsdFlushStrFlag == "" {
+		statsdFlushStrFlag = Config.StatsdFlush
+	}
+
+	if statsdPercentsFlag == "" {
+		statsdPercentsFlag = Config.StatsdPercents
+	}
+
+	if rollupWindowsFlag == "" {
+		rollupWindowsFlag = Config.RollupWindows
+	}
+
+	if walDirFlag == "" {
+		walDirFlag = Config.WALDir
+	}
+
+	if walFsyncFlag == "" {
+		walFsyncFlag = Config.WALFsync
+	}
+
+	if walSnapshotStrFlag == "" {
+		walSnapshotStrFlag = Config.WALSnapshot
+	}
+
 	address := os.Getenv("ADDRESS")
 	if address == "" {
 		if addressFlag == "" {
@@ -190,6 +269,118 @@ func SetUp() (*EnvVariables, error) {
 		}
 	}
 
+	rulesFile := os.Getenv("RULES_FILE")
+	if rulesFile == "" {
+		rulesFile = rulesFileFlag
+	}
+
+	var rulesInterval time.Duration
+	rulesIntervalStr := os.Getenv("RULES_INTERVAL")
+	if rulesIntervalStr == "" {
+		rulesIntervalStr = rulesIntervalStrFlag
+	}
+	if rulesIntervalStr == "" {
+		rulesInterval = 15 * time.Second
+	} else if duration, err := time.ParseDuration(rulesIntervalStr); err == nil && duration > 0 {
+		rulesInterval = duration
+	} else {
+		return nil, errors.New("invalid rulesInterval")
+	}
+
+	var webhookBatch time.Duration
+	webhookBatchStr := os.Getenv("WEBHOOK_BATCH_INTERVAL")
+	if webhookBatchStr == "" {
+		webhookBatchStr = webhookBatchStrFlag
+	}
+	if webhookBatchStr == "" {
+		webhookBatch = time.Second
+	} else if duration, err := time.ParseDuration(webhookBatchStr); err == nil && duration > 0 {
+		webhookBatch = duration
+	} else {
+		return nil, errors.New("invalid webhookBatch")
+	}
+
+	var webhookPrivate bool
+	webhookPrivateStr := os.Getenv("WEBHOOK_ALLOW_PRIVATE")
+	if webhookPrivateStr == "" {
+		webhookPrivateStr = webhookPrivateFlag
+	}
+	if webhookPrivateStr == "" {
+		webhookPrivate = false
+	} else {
+		if strings.ToLower(webhookPrivateStr) == "true" {
+			webhookPrivate = true
+		} else if strings.ToLower(webhookPrivateStr) == "false" {
+			webhookPrivate = false
+		} else {
+			return nil, errors.New("invalid webhookPrivate")
+		}
+	}
+
+	statsdAddress := os.Getenv("STATSD_ADDRESS")
+	if statsdAddress == "" {
+		statsdAddress = statsdAddressFlag
+	}
+
+	var statsdFlush time.Duration
+	statsdFlushStr := os.Getenv("STATSD_FLUSH_INTERVAL")
+	if statsdFlushStr == "" {
+		statsdFlushStr = statsdFlushStrFlag
+	}
+	if statsdFlushStr == "" {
+		statsdFlush = 10 * time.Second
+	} else if duration, err := time.ParseDuration(statsdFlushStr); err == nil && duration > 0 {
+		statsdFlush = duration
+	} else {
+		return nil, errors.New("invalid statsdFlush")
+	}
+
+	statsdPercentsStr := os.Getenv("STATSD_PERCENTILES")
+	if statsdPercentsStr == "" {
+		statsdPercentsStr = statsdPercentsFlag
+	}
+	statsdPercents, err := statsd.ParsePercentiles(statsdPercentsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	rollupWindowsStr := os.Getenv("ROLLUP_WINDOWS")
+	if rollupWindowsStr == "" {
+		rollupWindowsStr = rollupWindowsFlag
+	}
+	rollupWindows, err := metrics.ParseRollupWindows(rollupWindowsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	walDir := os.Getenv("WAL_DIR")
+	if walDir == "" {
+		walDir = walDirFlag
+	}
+
+	walFsync := os.Getenv("WAL_FSYNC")
+	if walFsync == "" {
+		walFsync = walFsyncFlag
+	}
+	if walFsync == "" {
+		walFsync = storage.FsyncAlways
+	} else if walFsync != storage.FsyncAlways && walFsync != storage.FsyncInterval && walFsync != storage.FsyncNever {
+		return nil, errors.New("invalid walFsync")
+	}
+
+	var walSnapshot time.Duration
+	walSnapshotStr := os.Getenv("WAL_SNAPSHOT_INTERVAL")
+	if walSnapshotStr == "" {
+		walSnapshotStr = walSnapshotStrFlag
+	}
+	if walSnapshotStr == "" {
+		walSnapshot = 5 * time.Minute
+	} else if duration, err := time.ParseDuration(walSnapshotStr); err == nil && duration >= 0 {
+		walSnapshot = duration
+	} else {
+		return nil, errors.New("invalid walSnapshot")
+	}
+
 	envVariables := &EnvVariables{Address: address,
 		StoreInterval:  storeInterval,
 		StoreFile:      storeFile,
@@ -201,6 +392,17 @@ func SetUp() (*EnvVariables, error) {
 		CryptoKeyDir:   cryptoKeyStr,
 		TrustedSubnet:  trustedSubnetStr,
 		GRPC:           gRPC,
+		RulesFile:      rulesFile,
+		RulesInterval:  rulesInterval,
+		WebhookBatch:   webhookBatch,
+		WebhookPrivate: webhookPrivate,
+		StatsdAddress:  statsdAddress,
+		StatsdFlush:    statsdFlush,
+		StatsdPercents: statsdPercents,
+		RollupWindows:  rollupWindows,
+		WALDir:         walDir,
+		WALFsync:       walFsync,
+		WALSnapshot:    walSnapshot,
 	}
 
 	if _, err := os.Stat(envVariables.Dir); os.IsNotExist(err) {
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// AgentIDMetadata is the metadata key with which the agent identifies itself when it opens the StreamMetrics stream.
+const AgentIDMetadata = "x-agent-id"
+
+// agentConnection is an open StreamMetrics stream of an agent.
+type agentConnection struct {
+	agent       string
+	peer        string
+	connectedAt time.Time
+	lastBatchAt time.Time
+	batches     uint64
+}
+
+// StreamMetrics receives the batches of metrics from the agent over a long-lived stream and stores them as AddMetrics does.
+// Every batch is acknowledged with the same seq and the stored values, a batch which can not be stored is acknowledged
+// with the error and its status code, so the agent tells a rejected batch from a transient failure, and the stream stays open. The agent is listed by ListAgents while the stream is open.
+func (mcs *MetricsCollectServer) StreamMetrics(stream pb.MetricsCollect_StreamMetricsServer) error {
+	ctx := stream.Context()
+	id, conn := mcs.connect(ctx)
+	MyLog.Printf("agent %q connected from %s", conn.agent, conn.peer)
+	defer func() {
+		conn := mcs.disconnect(id)
+		MyLog.Printf("agent %q disconnected after %d batches", conn.agent, conn.batches)
+	}()
+
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ack := &pb.StreamMetricsAck{Seq: in.Seq}
+		response, err := mcs.AddMetrics(ctx, in)
+		if err != nil {
+			st := status.Convert(err)
+			ack.Error, ack.Code = st.Message(), uint32(st.Code())
+		} else {
+			ack.Metrics = response.Metrics
+		}
+		mcs.batchReceived(id, in)
+
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// ListAgents returns the agents having an open StreamMetrics stream sorted by agent and the time of connection.
+func (mcs *MetricsCollectServer) ListAgents(ctx context.Context, in *pb.ListAgentsRequest) (*pb.ListAgentsResponse, error) {
+	mcs.mu.Lock()
+	connections := make([]agentConnection, 0, len(mcs.connections))
+	for _, conn := range mcs.connections {
+		connections = append(connections, *conn)
+	}
+	mcs.mu.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].agent != connections[j].agent {
+			return connections[i].agent < connections[j].agent
+		}
+		return connections[i].connectedAt.Before(connections[j].connectedAt)
+	})
+
+	var response pb.ListAgentsResponse
+	for _, conn := range connections {
+		agent := &pb.ConnectedAgent{
+			Agent:       conn.agent,
+			Peer:        conn.peer,
+			ConnectedAt: timestamppb.New(conn.connectedAt),
+			Batches:     conn.batches,
+		}
+		if !conn.lastBatchAt.IsZero() {
+			agent.LastBatchAt = timestamppb.New(conn.lastBatchAt)
+		}
+		response.Agents = append(response.Agents, agent)
+	}
+
+	return &response, nil
+}
+
+// connect registers the stream opened with ctx and returns its id and a copy of the connection.
+func (mcs *MetricsCollectServer) connect(ctx context.Context) (uint64, agentConnection) {
+	conn := &agentConnection{connectedAt: time.Now()}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(AgentIDMetadata); len(values) > 0 {
+			conn.agent = values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		conn.peer = p.Addr.String()
+	}
+
+	mcs.mu.Lock()
+	defer mcs.mu.Unlock()
+	if mcs.connections == nil {
+		mcs.connections = map[uint64]*agentConnection{}
+	}
+	mcs.lastID++
+	mcs.connections[mcs.lastID] = conn
+
+	return mcs.lastID, *conn
+}
+
+// batchReceived updates the statistics of the connection. If the agent did not identify itself
+// on connect, it is taken from the metrics of the batch.
+func (mcs *MetricsCollectServer) batchReceived(id uint64, in *pb.AddMetricsRequest) {
+	mcs.mu.Lock()
+	defer mcs.mu.Unlock()
+	conn, ok := mcs.connections[id]
+	if !ok {
+		return
+	}
+	conn.batches++
+	conn.lastBatchAt = time.Now()
+	if conn.agent == "" && len(in.Metrics) > 0 {
+		conn.agent = in.Metrics[0].Agent
+	}
+}
+
+// disconnect removes the stream from the connected agents and returns the last state of the connection.
+func (mcs *MetricsCollectServer) disconnect(id uint64) agentConnection {
+	mcs.mu.Lock()
+	defer mcs.mu.Unlock()
+	conn := *mcs.connections[id]
+	delete(mcs.connections, id)
+	return conn
+}
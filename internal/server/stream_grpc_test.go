@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+
+	pb "github.com/luckyseadog/go-dev/protobuf"
+)
+
+// newCollectClient returns a client of a MetricsCollectServer without a key on an empty storage.
+func newCollectClient(t *testing.T) (pb.MetricsCollectClient, storage.Storage) {
+	s := storage.NewStorage(nil, time.Second)
+	mcs := &MetricsCollectServer{Storage: s}
+	conn := newBufconnClient(t, "", func(srv *grpc.Server) { pb.RegisterMetricsCollectServer(srv, mcs) })
+	return pb.NewMetricsCollectClient(conn), s
+}
+
+// listAgents returns the connected agents as agent:batches.
+func listAgents(t *testing.T, client pb.MetricsCollectClient) []string {
+	t.Helper()
+	res, err := client.ListAgents(context.Background(), &pb.ListAgentsRequest{})
+	require.NoError(t, err)
+	agents := make([]string, 0, len(res.Agents))
+	for _, agent := range res.Agents {
+		agents = append(agents, fmt.Sprintf("%s:%d", agent.Agent, agent.Batches))
+	}
+	return agents
+}
+
+func TestStreamMetrics_Ack(t *testing.T) {
+	client, s := newCollectClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+
+	// Every batch is acknowledged with its seq and the stored values.
+	for i, delta := range []int64{2, 3} {
+		seq := uint64(i + 1)
+		require.NoError(t, stream.Send(&pb.AddMetricsRequest{Seq: seq, Metrics: []*pb.Metric{{Id: "PollCount", MType: "counter", Delta: delta}}}))
+		ack, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, seq, ack.Seq)
+		require.Empty(t, ack.Error)
+		require.Len(t, ack.Metrics, 1)
+		require.Equal(t, []int64{2, 5}[i], ack.Metrics[0].Delta)
+	}
+
+	// A failed batch is acknowledged with the error and its code, the stream stays open.
+	require.NoError(t, stream.Send(&pb.AddMetricsRequest{Seq: 3, Metrics: []*pb.Metric{{Id: "Poll{Count", MType: "counter", Delta: 1}}}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ack.Seq)
+	require.NotEmpty(t, ack.Error)
+	require.Equal(t, uint32(codes.InvalidArgument), ack.Code)
+
+	require.NoError(t, s.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "Alloc", MType: "gauge"}}))
+	require.NoError(t, stream.Send(&pb.AddMetricsRequest{Seq: 4, Metrics: []*pb.Metric{{Id: "Alloc", MType: "counter", Delta: 1}}}))
+	ack, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), ack.Seq)
+	require.Equal(t, uint32(codes.FailedPrecondition), ack.Code)
+
+	require.NoError(t, stream.Send(&pb.AddMetricsRequest{Seq: 5, Metrics: []*pb.Metric{{Id: "Alloc", MType: "gauge", Value: 1.5}}}))
+	ack, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), ack.Seq)
+	require.Empty(t, ack.Error)
+	require.Equal(t, 1.5, ack.Metrics[0].Value)
+}
+
+func TestStreamMetrics_ListAgents(t *testing.T) {
+	client, _ := newCollectClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The agent identifies itself by the metadata or by the metrics of its first batch.
+	identified, err := client.StreamMetrics(metadata.AppendToOutgoingContext(ctx, AgentIDMetadata, "host1"))
+	require.NoError(t, err)
+	require.NoError(t, identified.Send(&pb.AddMetricsRequest{Seq: 1}))
+	_, err = identified.Recv()
+	require.NoError(t, err)
+	anonymous, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	for seq := uint64(1); seq <= 2; seq++ {
+		require.NoError(t, anonymous.Send(&pb.AddMetricsRequest{Seq: seq, Metrics: []*pb.Metric{{Id: "Alloc", MType: "gauge", Agent: "host2"}}}))
+		_, err = anonymous.Recv()
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{"host1:1", "host2:2"}, listAgents(t, client))
+	res, err := client.ListAgents(ctx, &pb.ListAgentsRequest{})
+	require.NoError(t, err)
+	for _, agent := range res.Agents {
+		require.NotEmpty(t, agent.Peer)
+		require.NotNil(t, agent.ConnectedAt)
+		require.NotNil(t, agent.LastBatchAt)
+	}
+
+	// The agent is deregistered when its stream is closed.
+	require.NoError(t, identified.CloseSend())
+	_, err = identified.Recv()
+	require.True(t, errors.Is(err, io.EOF), err)
+	require.Eventually(t, func() bool {
+		agents := listAgents(t, client)
+		return len(agents) == 1 && agents[0] == "host2:2"
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,390 @@
+// Package spool provides the on-disk queue of the agent for the batches of metrics which are not sent yet.
+// Every batch is kept in a separate file of the spool directory named by its sequence number, so the batches
+// survive restarts of the agent and are replayed in the order they were collected.
+//
+// The size and the age of the queue are limited. When a limit is exceeded, the oldest batch is folded into the next one:
+// its gauges are dropped as they are superseded by the newer values, and its counter deltas and histograms are added
+// to the next batch, so the totals of counters are not lost. A batch which has been sent at least once is never folded:
+// the server may have applied it under its key, and its deltas sent again under the key of another batch would be
+// counted twice. Batches with histograms of different buckets are not folded either.
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// MyLog is the logger used for spool logs. It is initialized with log.Default() by default.
+var MyLog = log.Default()
+
+// fileExt is the extension of the files with batches.
+const fileExt = ".json"
+
+// ErrRejected is returned by the send function of Replay, possibly wrapped, when the server rejected the batch
+// and sending it again is useless. Such a batch is removed from the queue, so it does not block the newer ones.
+var ErrRejected = errors.New("batch is rejected")
+
+// errBucketsDiffer is returned by fold when the histograms of a series have different buckets.
+var errBucketsDiffer = errors.New("histogram buckets differ")
+
+// Batch is a batch of metrics collected by the agent in one report interval.
+// Key is the idempotency key of the batch, it is sent with every attempt, so the server applies the batch once.
+// Attempted is set before the batch is sent for the first time, such a batch is not folded any more.
+type Batch struct {
+	Seq       uint64            `json:"seq"`
+	Key       string            `json:"key,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Attempted bool              `json:"attempted,omitempty"`
+	Metrics   []metrics.Metrics `json:"metrics"`
+}
+
+type entry struct {
+	seq       uint64
+	size      int64
+	createdAt time.Time
+	attempted bool
+}
+
+// Spool is the on-disk queue of batches. It is safe for concurrent use.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu      sync.Mutex
+	entries []entry
+	size    int64
+	lastSeq uint64
+}
+
+// Open opens the spool in the directory, creating the directory if needed, and loads the batches left by the previous run.
+// The files which can not be read are removed.
+//
+// Parameters:
+//   - dir: The directory of the spool.
+//   - maxBytes: The maximum total size of the batches, zero means no limit.
+//   - maxAge: The maximum age of the oldest batch, zero means no limit.
+//
+// Returns:
+//   - A pointer to the Spool and an error if the directory can not be read.
+func Open(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// A temporary file of a write interrupted by a crash.
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		batch, size, err := s.read(seq)
+		if err != nil {
+			MyLog.Printf("spool: removing unreadable batch %s: %v", name, err)
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		s.entries = append(s.entries, entry{seq: seq, size: size, createdAt: batch.CreatedAt, attempted: batch.Attempted})
+		s.size += size
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+	if len(s.entries) > 0 {
+		s.lastSeq = s.entries[len(s.entries)-1].seq
+	}
+
+	return s, nil
+}
+
+// Len returns the number of batches in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Append writes the batch with its idempotency key to the end of the queue and then enforces the limits of the spool.
+// The batch is on disk when Append returns without error.
+func (s *Spool) Append(key string, batch []metrics.Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.lastSeq + 1
+	now := time.Now()
+	size, err := s.write(Batch{Seq: seq, Key: key, CreatedAt: now, Metrics: batch})
+	if err != nil {
+		return err
+	}
+	s.lastSeq = seq
+	s.entries = append(s.entries, entry{seq: seq, size: size, createdAt: now})
+	s.size += size
+
+	return s.compact()
+}
+
+// Oldest returns the oldest batch of the queue. The second value is false if the queue is empty.
+func (s *Spool) Oldest() (Batch, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return Batch{}, false, nil
+	}
+	batch, _, err := s.read(s.entries[0].seq)
+	if err != nil {
+		return Batch{}, false, err
+	}
+	return batch, true, nil
+}
+
+// attempt returns the oldest batch of the queue like Oldest and marks it as attempted on disk before it is sent,
+// so the batch is not folded into the next one while the server may have applied it.
+func (s *Spool) attempt() (Batch, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return Batch{}, false, nil
+	}
+	batch, _, err := s.read(s.entries[0].seq)
+	if err != nil {
+		return Batch{}, false, err
+	}
+	if !batch.Attempted {
+		batch.Attempted = true
+		size, err := s.write(batch)
+		if err != nil {
+			return Batch{}, false, err
+		}
+		s.size += size - s.entries[0].size
+		s.entries[0].size = size
+		s.entries[0].attempted = true
+	}
+	return batch, true, nil
+}
+
+// Remove removes the batch with the sequence number from the queue after it is sent.
+func (s *Spool) Remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.entries {
+		if e.seq != seq {
+			continue
+		}
+		err := os.Remove(s.path(seq))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+		s.size -= e.size
+		return nil
+	}
+
+	return nil
+}
+
+// Replay sends the batches from the oldest one and removes every batch once send succeeds.
+// It stops at the first error of send, so the failed batch and the newer ones stay in the queue in order.
+// A batch for which send returns ErrRejected is removed and the replay continues, so send should return ErrRejected
+// for every error which repeats when the batch is sent again, otherwise the batch blocks the queue.
+// The batches are sent with their idempotency keys, the batches of the older versions of the spool have no key.
+// Every batch is marked as attempted before it is sent, so it is never folded into a newer batch afterwards.
+//
+// Returns:
+//   - The number of sent batches and the error of send or of the spool.
+func (s *Spool) Replay(send func(key string, batch []metrics.Metrics) error) (int, error) {
+	sent := 0
+	for {
+		batch, ok, err := s.attempt()
+		if err != nil || !ok {
+			return sent, err
+		}
+
+		sendErr := send(batch.Key, batch.Metrics)
+		if sendErr != nil && !errors.Is(sendErr, ErrRejected) {
+			return sent, sendErr
+		}
+		err = s.Remove(batch.Seq)
+		if err != nil {
+			return sent, err
+		}
+		if sendErr != nil {
+			MyLog.Printf("spool: batch %d is dropped: %v", batch.Seq, sendErr)
+			continue
+		}
+		sent++
+	}
+}
+
+// compact folds the oldest batches into the next ones while the size or the age of the queue exceeds the limits.
+// The newest batch and the attempted batches are never folded, neither are the batches with histograms
+// of different buckets, see fold.
+func (s *Spool) compact() error {
+	for i := 0; i+1 < len(s.entries); {
+		if s.entries[i].attempted || s.entries[i+1].attempted {
+			i++
+			continue
+		}
+		tooBig := s.maxBytes > 0 && s.size > s.maxBytes
+		tooOld := s.maxAge > 0 && time.Since(s.entries[i].createdAt) > s.maxAge
+		if !tooBig && !tooOld {
+			return nil
+		}
+
+		older, _, err := s.read(s.entries[i].seq)
+		if err != nil {
+			return err
+		}
+		next, _, err := s.read(s.entries[i+1].seq)
+		if err != nil {
+			return err
+		}
+		next.Metrics, err = fold(older.Metrics, next.Metrics)
+		if err != nil {
+			MyLog.Printf("spool: batch %d is not folded into batch %d: %v", older.Seq, next.Seq, err)
+			i++
+			continue
+		}
+		size, err := s.write(next)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(s.path(older.Seq))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		MyLog.Printf("spool: limits exceeded, batch %d is folded into batch %d", older.Seq, next.Seq)
+
+		s.size += size - s.entries[i].size - s.entries[i+1].size
+		s.entries[i+1].size = size
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	}
+
+	return nil
+}
+
+// fold adds the counters and the histograms of the older batch to the newer one. The gauges of the older batch are dropped.
+// The newer batch is not changed if the batches have histograms of a series with different buckets, the observations
+// of them can not be added up; an error is returned then.
+func fold(older []metrics.Metrics, newer []metrics.Metrics) ([]metrics.Metrics, error) {
+	index := map[string]int{}
+	for i, metric := range newer {
+		index[metric.MType+":"+string(metric.Key())] = i
+	}
+	for _, metric := range older {
+		i, ok := index[metric.MType+":"+string(metric.Key())]
+		if ok && metric.Histogram != nil && newer[i].Histogram != nil && !metric.Histogram.SameBounds(*newer[i].Histogram) {
+			return nil, fmt.Errorf("%w: %s", errBucketsDiffer, metric.Key())
+		}
+	}
+
+	folded := append([]metrics.Metrics(nil), newer...)
+	for _, metric := range older {
+		if metric.MType != "counter" && metric.MType != "histogram" {
+			continue
+		}
+		i, ok := index[metric.MType+":"+string(metric.Key())]
+		if !ok {
+			index[metric.MType+":"+string(metric.Key())] = len(folded)
+			folded = append(folded, metric)
+			continue
+		}
+
+		switch metric.MType {
+		case "counter":
+			if metric.Delta != nil && folded[i].Delta != nil {
+				delta := *metric.Delta + *folded[i].Delta
+				folded[i].Delta = &delta
+			}
+		case "histogram":
+			if metric.Histogram != nil && folded[i].Histogram != nil {
+				histogram := metric.Histogram.Merge(*folded[i].Histogram)
+				folded[i].Histogram = &histogram
+			}
+		}
+	}
+
+	return folded, nil
+}
+
+// path returns the path of the file of the batch.
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, fileExt))
+}
+
+// read reads the batch from its file and returns it with the size of the file.
+func (s *Spool) read(seq uint64) (Batch, int64, error) {
+	data, err := os.ReadFile(s.path(seq))
+	if err != nil {
+		return Batch{}, 0, err
+	}
+
+	var batch Batch
+	err = json.Unmarshal(data, &batch)
+	if err != nil {
+		return Batch{}, 0, err
+	}
+	batch.Seq = seq
+
+	return batch, int64(len(data)), nil
+}
+
+// write writes the batch to its file atomically: the data is written to a temporary file
+// which is synced and renamed, so a crash leaves either the old or the new content.
+func (s *Spool) write(batch Batch) (int64, error) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "batch-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(tmp.Name(), s.path(batch.Seq))
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
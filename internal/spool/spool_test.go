@@ -0,0 +1,185 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+func gauge(name string, value float64) metrics.Metrics {
+	return metrics.Metrics{ID: name, MType: "gauge", Value: &value, Agent: "h1"}
+}
+
+func counter(name string, delta int64) metrics.Metrics {
+	return metrics.Metrics{ID: name, MType: "counter", Delta: &delta, Agent: "h1"}
+}
+
+func TestSpool_Replay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Append("k1", []metrics.Metrics{counter("PollCount", 1)}))
+	require.NoError(t, s.Append("k2", []metrics.Metrics{counter("PollCount", 2)}))
+	require.NoError(t, s.Append("k3", []metrics.Metrics{counter("PollCount", 3)}))
+
+	// The server is down: nothing is removed.
+	sent, err := s.Replay(func(key string, batch []metrics.Metrics) error { return errors.New("connection refused") })
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 3, s.Len())
+
+	// The agent is restarted.
+	s, err = Open(dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, s.Len())
+
+	// The failed batch is retried with the same idempotency key.
+	var deltas []int64
+	var keys []string
+	calls := 0
+	sent, err = s.Replay(func(key string, batch []metrics.Metrics) error {
+		calls++
+		keys = append(keys, key)
+		if calls == 2 {
+			return errors.New("server error")
+		}
+		deltas = append(deltas, *batch[0].Delta)
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 2, s.Len())
+
+	sent, err = s.Replay(func(key string, batch []metrics.Metrics) error {
+		keys = append(keys, key)
+		deltas = append(deltas, *batch[0].Delta)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, []int64{1, 2, 3}, deltas)
+	assert.Equal(t, []string{"k1", "k2", "k2", "k3"}, keys)
+	assert.Equal(t, 0, s.Len())
+
+	// A rejected batch does not block the newer ones.
+	require.NoError(t, s.Append("", []metrics.Metrics{counter("PollCount", 1)}))
+	require.NoError(t, s.Append("", []metrics.Metrics{counter("PollCount", 2)}))
+	sent, err = s.Replay(func(key string, batch []metrics.Metrics) error {
+		if *batch[0].Delta == 1 {
+			return fmt.Errorf("%w: invalid hash", ErrRejected)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 0, s.Len())
+
+	// New batches continue the sequence after a restart.
+	require.NoError(t, s.Append("", []metrics.Metrics{counter("PollCount", 4)}))
+	s, err = Open(dir, 0, 0)
+	require.NoError(t, err)
+	batch, ok, err := s.Oldest()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(6), batch.Seq)
+}
+
+func TestSpool_Limits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxAge   time.Duration
+	}{
+		{name: "size", maxBytes: 1},
+		{name: "age", maxAge: time.Nanosecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open(t.TempDir(), tt.maxBytes, tt.maxAge)
+			require.NoError(t, err)
+
+			require.NoError(t, s.Append("", []metrics.Metrics{gauge("Alloc", 1), counter("PollCount", 5), counter("Errors", 1)}))
+			time.Sleep(time.Millisecond)
+			require.NoError(t, s.Append("", []metrics.Metrics{gauge("Alloc", 2), counter("PollCount", 7)}))
+			assert.Equal(t, 1, s.Len())
+
+			batch, ok, err := s.Oldest()
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, uint64(2), batch.Seq)
+
+			values := map[string]float64{}
+			for _, metric := range batch.Metrics {
+				if metric.Delta != nil {
+					values[metric.ID] = float64(*metric.Delta)
+				} else {
+					values[metric.ID] = *metric.Value
+				}
+			}
+			assert.Equal(t, map[string]float64{"Alloc": 2, "PollCount": 12, "Errors": 1}, values)
+		})
+	}
+}
+
+func TestSpool_LimitsAttempted(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1, 0)
+	require.NoError(t, err)
+
+	// The server applies the batch, but the response is lost.
+	require.NoError(t, s.Append("k1", []metrics.Metrics{counter("PollCount", 1)}))
+	_, err = s.Replay(func(key string, batch []metrics.Metrics) error { return errors.New("timeout") })
+	require.Error(t, err)
+
+	// The attempted batch is not folded, the newer ones are folded into each other.
+	require.NoError(t, s.Append("k2", []metrics.Metrics{counter("PollCount", 2)}))
+	require.NoError(t, s.Append("k3", []metrics.Metrics{counter("PollCount", 3)}))
+	assert.Equal(t, 2, s.Len())
+
+	// The attempted mark survives a restart.
+	s, err = Open(dir, 1, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Append("k4", []metrics.Metrics{counter("PollCount", 4)}))
+	assert.Equal(t, 2, s.Len())
+
+	deltas := map[string]int64{}
+	sent, err := s.Replay(func(key string, batch []metrics.Metrics) error {
+		deltas[key] = *batch[0].Delta
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, map[string]int64{"k1": 1, "k4": 9}, deltas)
+}
+
+func TestSpool_LimitsHistogramBuckets(t *testing.T) {
+	s, err := Open(t.TempDir(), 1, 0)
+	require.NoError(t, err)
+	histogram := func(bounds ...float64) metrics.Metrics {
+		h := metrics.NewHistogram(bounds)
+		h.Observe(0.5)
+		return metrics.Metrics{ID: "Latency", MType: "histogram", Histogram: &h}
+	}
+
+	// The observations of histograms with different buckets can not be added up, the batches are kept.
+	require.NoError(t, s.Append("k1", []metrics.Metrics{histogram(1), counter("PollCount", 1)}))
+	require.NoError(t, s.Append("k2", []metrics.Metrics{histogram(1, 2)}))
+	assert.Equal(t, 2, s.Len())
+
+	require.NoError(t, s.Append("k3", []metrics.Metrics{histogram(1, 2)}))
+	assert.Equal(t, 2, s.Len())
+	var counts []uint64
+	_, err = s.Replay(func(key string, batch []metrics.Metrics) error {
+		counts = append(counts, batch[0].Histogram.Count)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, counts)
+}
@@ -0,0 +1,88 @@
+// Package statsd provides the StatsD listener of the server.
+// The listener receives StatsD lines over UDP, aggregates them and writes the aggregates to storage.Storage
+// every flush interval: counters as metrics.Counter, gauges as metrics.Gauge and timers as percentiles.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+var (
+	errInvalidLine       = errors.New("invalid statsd line")
+	errInvalidPercentile = errors.New("invalid percentile")
+)
+
+// Types of StatsD metrics supported by the listener.
+const (
+	TypeCounter = "c"
+	TypeGauge   = "g"
+	TypeTimer   = "ms"
+	TypeHisto   = "h" // an alias of the timer used by some clients.
+)
+
+// Line is a parsed StatsD line name:value|type[|@rate][|#tag:value,...].
+// The DogStatsD tags become the labels of the metric.
+type Line struct {
+	Name       string
+	Value      float64
+	Type       string
+	SampleRate float64
+	// Relative is set for gauges with the value prefixed by a sign, such values change the current gauge.
+	Relative bool
+	Labels   map[string]string
+}
+
+// ParseLine parses a single StatsD line.
+func ParseLine(str string) (Line, error) {
+	name, rest, ok := strings.Cut(str, ":")
+	if !ok || name == "" {
+		return Line{}, fmt.Errorf("%w: %q", errInvalidLine, str)
+	}
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return Line{}, fmt.Errorf("%w: %q", errInvalidLine, str)
+	}
+
+	line := Line{Name: name, Type: parts[1], SampleRate: 1, Labels: map[string]string{}}
+	switch line.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHisto:
+	default:
+		return Line{}, fmt.Errorf("%w: unsupported type %q", errInvalidLine, line.Type)
+	}
+
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Line{}, fmt.Errorf("%w: %q", errInvalidLine, str)
+	}
+	line.Value = value
+	line.Relative = line.Type == TypeGauge && (parts[0][0] == '+' || parts[0][0] == '-')
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Line{}, fmt.Errorf("%w: invalid sample rate %q", errInvalidLine, part)
+			}
+			line.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				label, value, _ := strings.Cut(tag, ":")
+				line.Labels[label] = value
+			}
+		}
+	}
+
+	err = metrics.Metrics{ID: line.Name, Labels: line.Labels}.Validate()
+	if err != nil {
+		return Line{}, err
+	}
+
+	return line, nil
+}
@@ -0,0 +1,260 @@
+package statsd
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// MyLog is the logger used for StatsD logs. It is initialized with log.Default() by default.
+var MyLog = log.Default()
+
+// DefaultPercentiles are the percentiles of timers written if no percentiles are configured.
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// maxPacketSize is the maximum size of a UDP datagram.
+const maxPacketSize = 65535
+
+// timerSeries holds the values of a timer received during the flush interval.
+type timerSeries struct {
+	name   string
+	labels map[string]string
+	values []float64
+}
+
+// gaugeSeries is a gauge received during the flush interval. A relative gauge got only deltas,
+// they are added to the stored value at flush.
+type gaugeSeries struct {
+	value    float64
+	relative bool
+}
+
+// Server is the StatsD listener. Values received during the flush interval are aggregated:
+// counters are summed taking the sample rate into account, the last value of a gauge is kept and
+// the values of a timer are turned into percentiles. The fraction of a sampled counter which is not written
+// is carried to the next flush, so e.g. a counter sampled at @0.3 does not lose the increments it is rounded by. The percentile p of the timer name is written
+// as the gauge name{quantile="p/100"} and the number of its values as the counter name_count.
+type Server struct {
+	address       string
+	storage       storage.Storage
+	flushInterval time.Duration
+	percentiles   []float64
+
+	conn net.PacketConn
+
+	mu         sync.Mutex
+	counters   map[metrics.Metric]float64
+	remainders map[metrics.Metric]float64
+	gauges     map[metrics.Metric]gaugeSeries
+	timers     map[metrics.Metric]*timerSeries
+}
+
+// NewServer creates a StatsD listener.
+//
+// Parameters:
+//   - address: The UDP address to listen on.
+//   - s: The storage the aggregates are written to.
+//   - flushInterval: The interval of aggregation.
+//   - percentiles: The percentiles of timers, DefaultPercentiles are used if it is empty.
+//
+// Returns:
+//   - A pointer to the Server.
+func NewServer(address string, s storage.Storage, flushInterval time.Duration, percentiles []float64) *Server {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	return &Server{
+		address:       address,
+		storage:       s,
+		flushInterval: flushInterval,
+		percentiles:   percentiles,
+		counters:      map[metrics.Metric]float64{},
+		remainders:    map[metrics.Metric]float64{},
+		gauges:        map[metrics.Metric]gaugeSeries{},
+		timers:        map[metrics.Metric]*timerSeries{},
+	}
+}
+
+// Listen opens the UDP socket.
+func (s *Server) Listen() error {
+	conn, err := net.ListenPacket("udp", s.address)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Addr returns the address the listener is bound to, it is valid after Listen.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Serve reads StatsD packets and flushes the aggregates every flush interval until ctx is done.
+// The aggregates received before ctx is done are flushed before Serve returns.
+func (s *Server) Serve(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, _, err := s.conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					MyLog.Println("statsd:", err)
+				}
+				return
+			}
+			for _, str := range strings.Split(string(buf[:n]), "\n") {
+				str = strings.TrimSpace(str)
+				if str == "" {
+					continue
+				}
+				line, err := ParseLine(str)
+				if err != nil {
+					MyLog.Println("statsd:", err)
+					continue
+				}
+				s.Handle(line)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.conn.Close()
+			<-done
+			s.Flush(context.Background())
+			return
+		case <-ticker.C:
+			s.Flush(ctx)
+		}
+	}
+}
+
+// Handle adds the parsed line to the aggregates of the current flush interval.
+// It does not access the storage, the deltas of gauges are resolved by Flush.
+func (s *Server) Handle(line Line) {
+	key := metrics.SeriesKey(line.Name, "", line.Labels)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch line.Type {
+	case TypeCounter:
+		s.counters[key] += line.Value / line.SampleRate
+	case TypeGauge:
+		gauge, ok := s.gauges[key]
+		switch {
+		case !line.Relative:
+			gauge = gaugeSeries{value: line.Value}
+		case ok:
+			gauge.value += line.Value
+		default:
+			gauge = gaugeSeries{value: line.Value, relative: true}
+		}
+		s.gauges[key] = gauge
+	case TypeTimer, TypeHisto:
+		timer, ok := s.timers[key]
+		if !ok {
+			timer = &timerSeries{name: line.Name, labels: line.Labels}
+			s.timers[key] = timer
+		}
+		timer.values = append(timer.values, line.Value)
+	}
+}
+
+// Flush writes the aggregates of the current flush interval to the storage and starts a new interval.
+// The integer part of a counter is written and its fraction is kept for the next flush.
+// The deltas of a gauge without an absolute value in the interval are added to the stored value, a missing gauge is 0.
+func (s *Server) Flush(ctx context.Context) {
+	s.mu.Lock()
+	counters, gauges, timers := s.counters, s.gauges, s.timers
+	s.counters = map[metrics.Metric]float64{}
+	s.gauges = map[metrics.Metric]gaugeSeries{}
+	s.timers = map[metrics.Metric]*timerSeries{}
+	increments := make(map[metrics.Metric]float64, len(counters))
+	for key, value := range counters {
+		value += s.remainders[key]
+		increments[key] = math.Trunc(value)
+		if remainder := value - increments[key]; remainder != 0 {
+			s.remainders[key] = remainder
+		} else {
+			delete(s.remainders, key)
+		}
+	}
+	s.mu.Unlock()
+
+	for key, value := range increments {
+		s.store(ctx, key, metrics.Counter(value))
+	}
+	for key, gauge := range gauges {
+		value := gauge.value
+		if gauge.relative {
+			res := s.storage.LoadContext(ctx, "gauge", key)
+			if res.Err == nil {
+				value += float64(res.Value.(metrics.Gauge))
+			}
+		}
+		s.store(ctx, key, metrics.Gauge(value))
+	}
+	for _, timer := range timers {
+		sort.Float64s(timer.values)
+		for _, p := range s.percentiles {
+			labels := map[string]string{"quantile": strconv.FormatFloat(p/100, 'g', -1, 64)}
+			for label, value := range timer.labels {
+				labels[label] = value
+			}
+			s.store(ctx, metrics.SeriesKey(timer.name, "", labels), metrics.Gauge(percentile(timer.values, p)))
+		}
+		s.store(ctx, metrics.SeriesKey(timer.name+"_count", "", timer.labels), metrics.Counter(len(timer.values)))
+	}
+}
+
+// store writes the value to the storage and logs the error.
+func (s *Server) store(ctx context.Context, key metrics.Metric, value any) {
+	err := s.storage.StoreContext(ctx, key, value)
+	if err != nil {
+		MyLog.Println("statsd:", err)
+	}
+}
+
+// percentile returns the percentile p of the sorted values by the nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// ParsePercentiles parses percentiles written as "50,90,99".
+func ParsePercentiles(str string) ([]float64, error) {
+	var percentiles []float64
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(part, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, errInvalidPercentile
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
@@ -0,0 +1,182 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Line
+		wantErr bool
+	}{
+		{
+			name: "counter",
+			line: "requests:1|c",
+			want: Line{Name: "requests", Value: 1, Type: TypeCounter, SampleRate: 1, Labels: map[string]string{}},
+		},
+		{
+			name: "counter with sample rate and tags",
+			line: "requests:2|c|@0.5|#env:prod,host:web1",
+			want: Line{Name: "requests", Value: 2, Type: TypeCounter, SampleRate: 0.5, Labels: map[string]string{"env": "prod", "host": "web1"}},
+		},
+		{
+			name: "relative gauge",
+			line: "queue:-3|g",
+			want: Line{Name: "queue", Value: -3, Type: TypeGauge, SampleRate: 1, Relative: true, Labels: map[string]string{}},
+		},
+		{
+			name: "timer",
+			line: "latency:320|ms",
+			want: Line{Name: "latency", Value: 320, Type: TypeTimer, SampleRate: 1, Labels: map[string]string{}},
+		},
+		{
+			name:    "set",
+			line:    "users:42|s",
+			wantErr: true,
+		},
+		{
+			name:    "without type",
+			line:    "requests:1",
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			line:    "requests:one|c",
+			wantErr: true,
+		},
+		{
+			name:    "invalid sample rate",
+			line:    "requests:1|c|@2",
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag",
+			line:    "requests:1|c|#1env:prod",
+			wantErr: true,
+		},
+		{
+			name: "dotted name",
+			line: "api.http-requests:1|c",
+			want: Line{Name: "api.http-requests", Value: 1, Type: TypeCounter, SampleRate: 1, Labels: map[string]string{}},
+		},
+		{
+			name:    "invalid name",
+			line:    "api{requests:1|c",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, err := ParseLine(tt.line)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, line)
+		})
+	}
+}
+
+func TestServer_Flush(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	s.DataGauge["queue"] = 10
+	server := NewServer("", s, time.Second, []float64{50, 90})
+	ctx := context.Background()
+
+	for _, str := range []string{"requests:1|c", "requests:2|c|@0.5", "queue:+5|g", "queue:-2|g", "temp:3|g", "temp:4|g"} {
+		line, err := ParseLine(str)
+		require.NoError(t, err)
+		server.Handle(line)
+	}
+	for i := 1; i <= 10; i++ {
+		server.Handle(Line{Name: "latency", Value: float64(i * 10), Type: TypeTimer, SampleRate: 1, Labels: map[string]string{"env": "prod"}})
+	}
+	server.Flush(ctx)
+
+	require.Equal(t, metrics.Counter(5), s.DataCounter["requests"])
+	require.Equal(t, metrics.Gauge(13), s.DataGauge["queue"])
+	require.Equal(t, metrics.Gauge(4), s.DataGauge["temp"])
+	require.Equal(t, metrics.Gauge(50), s.DataGauge[metrics.SeriesKey("latency", "", map[string]string{"env": "prod", "quantile": "0.5"})])
+	require.Equal(t, metrics.Gauge(90), s.DataGauge[metrics.SeriesKey("latency", "", map[string]string{"env": "prod", "quantile": "0.9"})])
+	require.Equal(t, metrics.Counter(10), s.DataCounter[metrics.SeriesKey("latency_count", "", map[string]string{"env": "prod"})])
+
+	server.Flush(ctx)
+	require.Equal(t, metrics.Counter(5), s.DataCounter["requests"])
+}
+
+func TestServer_FlushSampledCounter(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	server := NewServer("", s, time.Second, nil)
+	ctx := context.Background()
+
+	// Every line is 2.5 increments, the half is written by the next flush.
+	line, err := ParseLine("hits:1|c|@0.4")
+	require.NoError(t, err)
+	for _, want := range []metrics.Counter{2, 5, 7, 10} {
+		server.Handle(line)
+		server.Flush(ctx)
+		require.Equal(t, want, s.DataCounter["hits"])
+	}
+}
+
+func TestServer_FlushRelativeGauge(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	server := NewServer("", s, time.Second, nil)
+	ctx := context.Background()
+
+	for _, str := range []string{"depth:+2|g", "temp:3|g", "temp:+1|g", "missing:-1|g"} {
+		line, err := ParseLine(str)
+		require.NoError(t, err)
+		server.Handle(line)
+	}
+	// The deltas are added to the value stored at the moment of the flush.
+	s.DataGauge["depth"] = 1
+	s.DataGauge["temp"] = 100
+	server.Flush(ctx)
+
+	require.Equal(t, metrics.Gauge(3), s.DataGauge["depth"])
+	require.Equal(t, metrics.Gauge(4), s.DataGauge["temp"])
+	require.Equal(t, metrics.Gauge(-1), s.DataGauge["missing"])
+}
+
+func TestServer_Serve(t *testing.T) {
+	s := storage.NewStorage(nil, time.Second)
+	server := NewServer("127.0.0.1:0", s, time.Hour, nil)
+	require.NoError(t, server.Listen())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx)
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("requests:3|c\nbroken\ntemp:21.5|g\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.counters) == 1 && len(server.gauges) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+	require.Equal(t, metrics.Counter(3), s.DataCounter["requests"])
+	require.Equal(t, metrics.Gauge(21.5), s.DataGauge["temp"])
+}
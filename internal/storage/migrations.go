@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationLockKey is the key of the PostgreSQL advisory lock held while the migrations are applied,
+// so the replicas of the server starting together do not apply them concurrently.
+const migrationLockKey int64 = 0x6d6574726963
+
+// sqliteBusyTimeout is how long a migration on SQLite waits for the write lock held by another process.
+const sqliteBusyTimeout = 30 * time.Second
+
+// migrationFiles are the migrations of SQLStorage, a directory per database. A file is named by the version
+// and the name of the migration, e.g. 0003_create_history.sql, and has statements separated by semicolons.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var errInvalidMigration = errors.New("invalid migration file name, expected <version>_<name>.sql")
+
+// Migration is a versioned change of the schema of SQLStorage.
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus is a migration with the moment it was applied, Applied is nil for a pending migration.
+type MigrationStatus struct {
+	Migration
+	Applied *time.Time
+}
+
+// Migrations returns the migrations of the database of the storage ordered by version.
+//
+// Returns:
+//   - The migrations embedded into the binary.
+//   - An error if a migration file is invalid.
+func (ss *SQLStorage) Migrations() ([]Migration, error) {
+	dir := "migrations/postgres"
+	if ss.sqlite {
+		dir = "migrations/sqlite"
+	}
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		versionStr, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.ParseInt(versionStr, 10, 64)
+		if !ok || err != nil || version <= 0 || !strings.HasSuffix(entry.Name(), ".sql") {
+			return nil, fmt.Errorf("%w: %s", errInvalidMigration, entry.Name())
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("%w: version %d is duplicated", errInvalidMigration, migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate applies the pending migrations in the order of their versions. Every migration is applied
+// in its own transaction together with its row in table 'schema_migrations', so a failed migration
+// is applied again on the next start. On PostgreSQL the migrations are applied under an advisory lock,
+// the other replicas wait for it and find the migrations applied; on SQLite every migration takes the write lock
+// of the database before its version is checked.
+//
+// The first migrations create the tables if they do not exist, so the databases created before
+// the migrations were introduced are taken over.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//
+// Returns:
+//   - The migrations applied by the call.
+//   - An error if a migration fails, the migrations before it stay applied.
+func (ss *SQLStorage) Migrate(ctx context.Context) ([]Migration, error) {
+	migrations, err := ss.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// All the statements are executed on one connection: the advisory lock belongs to the session,
+	// and the pool of SQLite has a single connection.
+	conn, err := ss.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if ss.sqlite {
+		// The other processes wait for the write lock instead of failing at once.
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA busy_timeout = %d`, sqliteBusyTimeout.Milliseconds()))
+		if err != nil {
+			return nil, err
+		}
+		// The journal mode can not be changed in a transaction, reads are not blocked by a write in WAL mode.
+		_, err = conn.ExecContext(ctx, `PRAGMA journal_mode=WAL`)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	}
+
+	err = ss.createMigrationsTable(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0)
+	for _, migration := range migrations {
+		ok, err := ss.applyMigration(ctx, conn, migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// createMigrationsTable creates table 'schema_migrations' with the versions of the applied migrations.
+func (ss *SQLStorage) createMigrationsTable(ctx context.Context, conn *sql.Conn) error {
+	timestampType := "TIMESTAMPTZ"
+	if ss.sqlite {
+		timestampType = "TIMESTAMP"
+	}
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+				  version BIGINT PRIMARY KEY,
+				  name TEXT,
+				  applied_at `+timestampType+`
+				)`)
+	return err
+}
+
+// migrationTx executes the statements of a migration, *sql.Tx on PostgreSQL and the connection itself on SQLite.
+type migrationTx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// applyMigration applies the migration unless its version is in table 'schema_migrations'.
+// It returns false if the migration has already been applied.
+func (ss *SQLStorage) applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) (bool, error) {
+	var tx migrationTx
+	var commit func() error
+	if ss.sqlite {
+		// A deferred transaction of SQLite takes the write lock at its first write, after the version is checked,
+		// so two processes could both find the migration pending. BEGIN IMMEDIATE takes the lock first,
+		// the other process waits for it and finds the migration applied.
+		_, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`)
+		if err != nil {
+			return false, err
+		}
+		committed := false
+		defer func() {
+			if !committed {
+				_, _ = conn.ExecContext(context.Background(), `ROLLBACK`)
+			}
+		}()
+		tx = conn
+		commit = func() error {
+			_, err := conn.ExecContext(ctx, `COMMIT`)
+			committed = err == nil
+			return err
+		}
+	} else {
+		sqlTx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return false, err
+		}
+		defer sqlTx.Rollback()
+		tx = sqlTx
+		commit = sqlTx.Commit
+	}
+
+	var count int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, migration.Version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	for _, statement := range migrationStatements(migration.SQL) {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+		migration.Version, migration.Name, ss.timestamp(time.Now()))
+	if err != nil {
+		return false, err
+	}
+
+	return true, commit()
+}
+
+// migrationStatements splits the SQL of a migration into statements. The comment lines are dropped,
+// the statements are separated by semicolons, so a migration has no semicolons in literals.
+func migrationStatements(migrationSQL string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(migrationSQL, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	statements := make([]string, 0)
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		statement = strings.TrimSpace(statement)
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// MigrationStatus returns the migrations of the storage with the moments they were applied.
+// The versions applied by a newer binary are listed too, their SQL is empty.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//
+// Returns:
+//   - The migrations ordered by version.
+//   - An error if the applied versions can not be read.
+func (ss *SQLStorage) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := ss.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ss.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = ss.createMigrationsTable(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	known := map[int64]int{}
+	for i, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{Migration: migration})
+		known[migration.Version] = i
+	}
+	for rows.Next() {
+		var version int64
+		var name string
+		var applied time.Time
+		err = rows.Scan(&version, &name, &applied)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := known[version]; ok {
+			statuses[i].Applied = &applied
+		} else {
+			statuses = append(statuses, MigrationStatus{Migration: Migration{Version: version, Name: name}, Applied: &applied})
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
@@ -0,0 +1,15 @@
+-- Gauges and counters by series key. The first versions created the column metric as VARCHAR(100),
+-- the series keys include the agent and the labels, so it is altered to TEXT.
+CREATE TABLE IF NOT EXISTS gauge (
+  metric TEXT UNIQUE,
+  val DOUBLE PRECISION
+);
+
+CREATE TABLE IF NOT EXISTS counter (
+  metric TEXT UNIQUE,
+  val BIGINT
+);
+
+ALTER TABLE gauge ALTER COLUMN metric TYPE TEXT;
+
+ALTER TABLE counter ALTER COLUMN metric TYPE TEXT;
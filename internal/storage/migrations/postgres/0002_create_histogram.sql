@@ -0,0 +1,5 @@
+-- Histograms as JSON, a NULL value is the placeholder of a histogram being merged.
+CREATE TABLE IF NOT EXISTS histogram (
+  metric TEXT UNIQUE,
+  val TEXT
+);
@@ -0,0 +1,16 @@
+-- The samples of gauges and counters for range queries.
+CREATE TABLE IF NOT EXISTS gauge_history (
+  metric TEXT,
+  val DOUBLE PRECISION,
+  ts TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS gauge_history_metric_ts ON gauge_history (metric, ts);
+
+CREATE TABLE IF NOT EXISTS counter_history (
+  metric TEXT,
+  val BIGINT,
+  ts TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS counter_history_metric_ts ON counter_history (metric, ts);
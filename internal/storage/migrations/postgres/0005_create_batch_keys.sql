@@ -0,0 +1,7 @@
+-- The idempotency keys of the applied batches.
+CREATE TABLE IF NOT EXISTS batch_keys (
+  key TEXT PRIMARY KEY,
+  remembered_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS batch_keys_remembered_at ON batch_keys (remembered_at);
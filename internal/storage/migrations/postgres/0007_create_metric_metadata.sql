@@ -0,0 +1,7 @@
+-- The metadata declared for the metrics by name.
+CREATE TABLE IF NOT EXISTS metric_metadata (
+  name TEXT PRIMARY KEY,
+  mtype TEXT NOT NULL,
+  unit TEXT NOT NULL,
+  help TEXT NOT NULL
+);
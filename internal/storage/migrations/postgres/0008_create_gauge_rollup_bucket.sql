@@ -0,0 +1,16 @@
+-- The statistics of the gauges by sub-bucket of the window, they replace the rollups of the whole windows.
+DROP TABLE IF EXISTS gauge_rollup;
+
+CREATE TABLE IF NOT EXISTS gauge_rollup_bucket (
+  metric TEXT,
+  win TEXT,
+  start TIMESTAMPTZ,
+  min DOUBLE PRECISION,
+  max DOUBLE PRECISION,
+  sum DOUBLE PRECISION,
+  count BIGINT,
+  last DOUBLE PRECISION,
+  PRIMARY KEY (metric, win, start)
+);
+
+CREATE INDEX IF NOT EXISTS gauge_rollup_bucket_win_start ON gauge_rollup_bucket (win, start);
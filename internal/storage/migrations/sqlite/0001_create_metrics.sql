@@ -0,0 +1,10 @@
+-- Gauges and counters by series key.
+CREATE TABLE IF NOT EXISTS gauge (
+  metric TEXT UNIQUE,
+  val DOUBLE PRECISION
+);
+
+CREATE TABLE IF NOT EXISTS counter (
+  metric TEXT UNIQUE,
+  val BIGINT
+);
@@ -0,0 +1,5 @@
+-- The last totals of the counters sent as cumulative totals.
+CREATE TABLE IF NOT EXISTS counter_total (
+  metric TEXT UNIQUE,
+  val BIGINT
+);
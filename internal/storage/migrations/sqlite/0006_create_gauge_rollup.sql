@@ -0,0 +1,12 @@
+-- The statistics of the gauges by window.
+CREATE TABLE IF NOT EXISTS gauge_rollup (
+  metric TEXT,
+  win TEXT,
+  start TIMESTAMP,
+  min DOUBLE PRECISION,
+  max DOUBLE PRECISION,
+  sum DOUBLE PRECISION,
+  count BIGINT,
+  last DOUBLE PRECISION,
+  PRIMARY KEY (metric, win)
+);
@@ -0,0 +1,4 @@
+-- The samples older than the retention are deleted by their timestamps across the metrics.
+CREATE INDEX IF NOT EXISTS gauge_history_ts ON gauge_history (ts);
+
+CREATE INDEX IF NOT EXISTS counter_history_ts ON counter_history (ts);
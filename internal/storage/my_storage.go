@@ -1,7 +1,8 @@
 // Package storage provides functionalities for keeping data on server
-// this package have two types of storage:
+// this package have three types of storage:
 // - MyStorage that keeps data in map and periodically saves it to file
 // - SQLStorage that keeps data as SQL database
+// - WALStorage that keeps data in map and writes every update to a write-ahead log with periodic snapshots
 package storage
 
 import (
@@ -9,14 +10,25 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
 )
 
-// MyStorage holds Gauge metrics as DataGauge and Counter metrics as DataCounter
+// MyStorage holds Gauge metrics as DataGauge, Counter metrics as DataCounter and Histogram metrics as DataHistogram
 // and provides synchronization mechanisms for concurrent access.
+// CounterTotals holds the last totals of the counters sent as metrics.CounterTotal, they are used
+// to compute the increase of the counter when the next total arrives.
+// Rollups holds the statistics of every gauge by window (e.g. "5m0s"), they are updated by every stored value.
+// BatchKeys holds the idempotency keys of the applied batches with the moments they were remembered,
+// keys older than batchKeyRetention are dropped.
+// Metadata holds the metadata declared by name, the values of another type than the declared one are rejected.
+// Every stored value is also appended to HistoryGauge or HistoryCounter, samples older than
+// historyRetention are dropped, those of the series which are not stored any more at most once a minute.
+//
+// Observers subscribed via Notifier are notified about every stored value.
 //
 // AutoSavingParams serves for sending save-to-file-signal in case of storeInterval = 0.
 // If storeInterval != 0 then data is saved at intervals and MyStorage don't need to send signal
@@ -25,7 +37,26 @@ type MyStorage struct {
 	DataCounter map[metrics.Metric]metrics.Counter
 	mu          sync.RWMutex
 
+	DataHistogram map[metrics.Metric]metrics.Histogram
+
+	HistoryGauge   map[metrics.Metric][]metrics.GaugeSample
+	HistoryCounter map[metrics.Metric][]metrics.CounterSample
+
+	CounterTotals map[metrics.Metric]metrics.CounterTotal
+
+	Rollups       map[metrics.Metric]map[string]metrics.RollingRollup
+	rollupWindows []time.Duration
+
+	historyPruned time.Time
+
+	BatchKeys       map[string]time.Time
+	batchKeysPruned time.Time
+
+	Metadata map[string]metrics.Metadata
+
 	autoSavingParams AutoSavingParams
+
+	Notifier
 }
 
 // NewStorage creates and initializes a new instance of MyStorage with the provided parameters.
@@ -42,9 +73,17 @@ func NewStorage(storageChan chan struct{}, storeInterval time.Duration) *MyStora
 	dataGauge := map[metrics.Metric]metrics.Gauge{}
 	dataCounter := map[metrics.Metric]metrics.Counter{}
 	return &MyStorage{
-		DataGauge:   dataGauge,
-		DataCounter: dataCounter,
-		mu:          sync.RWMutex{},
+		DataGauge:      dataGauge,
+		DataCounter:    dataCounter,
+		mu:             sync.RWMutex{},
+		DataHistogram:  map[metrics.Metric]metrics.Histogram{},
+		HistoryGauge:   map[metrics.Metric][]metrics.GaugeSample{},
+		HistoryCounter: map[metrics.Metric][]metrics.CounterSample{},
+		CounterTotals:  map[metrics.Metric]metrics.CounterTotal{},
+		Rollups:        map[metrics.Metric]map[string]metrics.RollingRollup{},
+		rollupWindows:  defaultRollupWindows(),
+		BatchKeys:      map[string]time.Time{},
+		Metadata:       map[string]metrics.Metadata{},
 		autoSavingParams: AutoSavingParams{
 			storageChan:   storageChan,
 			storeInterval: storeInterval,
@@ -52,6 +91,25 @@ func NewStorage(storageChan chan struct{}, storeInterval time.Duration) *MyStora
 	}
 }
 
+// SetRollupWindows sets the windows of the gauge rollups, the rollups of the other windows are dropped.
+// It should be called before the storage is used.
+//
+// Parameters:
+//   - windows: The windows of the rollups, e.g. 1m, 5m and 1h.
+func (s *MyStorage) SetRollupWindows(windows []time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollupWindows = append([]time.Duration(nil), windows...)
+	for _, rollups := range s.Rollups {
+		for window := range rollups {
+			duration, err := time.ParseDuration(window)
+			if err != nil || !hasWindow(s.rollupWindows, duration) {
+				delete(rollups, window)
+			}
+		}
+	}
+}
+
 // StoreContext stores a metric value associated with the given metric key in the storage.
 // It operates within the provided context, allowing for cancellation and timeout management.
 //
@@ -86,6 +144,16 @@ func (s *MyStorage) StoreContext(ctx context.Context, metric metrics.Metric, met
 // Returns:
 //   - An error if the storage operation fails or if the provided metric value type is not expected.
 func (s *MyStorage) Store(metric metrics.Metric, metricValue any) error {
+	update, err := s.store(metric, metricValue)
+	if err != nil {
+		return err
+	}
+	s.notify(update)
+	return nil
+}
+
+// store writes the value under the write lock and returns the update for the observers.
+func (s *MyStorage) store(metric metrics.Metric, metricValue any) (Update, error) {
 	s.mu.Lock()
 	defer func() {
 		s.mu.Unlock()
@@ -93,22 +161,447 @@ func (s *MyStorage) Store(metric metrics.Metric, metricValue any) error {
 			s.autoSavingParams.storageChan <- struct{}{}
 		}
 	}()
+	_, err := filterDeclared([]MetricValue{{Metric: metric, Value: metricValue}}, s.declaredType)
+	if err != nil {
+		return Update{}, err
+	}
+	return s.apply(metric, metricValue, time.Now())
+}
+
+// StoreBatchContext stores the values of the batch atomically.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - key: The idempotency key of the batch of at most maxBatchKeyLength bytes, an empty key means the batch
+//     is always applied.
+//   - batch: The metric keys and the values to be stored.
+//
+// Returns:
+//   - The stored values of the metrics of the batch, see StoreBatch.
+//   - false if the key is already remembered and the batch is not applied again.
+//   - An error if a value of the batch can not be stored, nothing is stored then, or if the context is canceled.
+//     An error wrapping ErrTypeConflict if values have another type than the declared one, the other values are stored.
+func (s *MyStorage) StoreBatchContext(ctx context.Context, key string, batch []MetricValue) (BatchValues, bool, error) {
+	type result struct {
+		values  BatchValues
+		applied bool
+		err     error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		values, applied, err := s.StoreBatch(key, batch)
+		ch <- result{values: values, applied: applied, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.values, res.applied, res.err
+	case <-ctx.Done():
+		return BatchValues{}, false, ctx.Err()
+	}
+}
+
+// StoreBatch stores the values of the batch under one write lock, so the batch is seen either entirely or not at all.
+// The values are validated first and the idempotency key is remembered with the values.
+// The values of another type than the declared one are dropped.
+//
+// Parameters:
+//   - key: The idempotency key of the batch of at most maxBatchKeyLength bytes, an empty key means the batch
+//     is always applied.
+//   - batch: The metric keys and the values to be stored.
+//
+// Returns:
+//   - The values of the metrics of the batch read under the same lock, the current ones for a replay.
+//     The dropped values have none.
+//   - false if the key is already remembered and the batch is not applied again.
+//   - An error if a value of the batch can not be stored, nothing is stored then.
+//     An error wrapping ErrTypeConflict if values have another type than the declared one, the other values are stored.
+func (s *MyStorage) StoreBatch(key string, batch []MetricValue) (BatchValues, bool, error) {
+	err := validateBatch(key, batch)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	return s.storeBatchAt(key, batch, time.Now())
+}
+
+// storeBatchAt applies the validated batch as stored at the moment now, the moment is recorded in the history
+// and the rollups of the values. The values of another type than the declared one are dropped and reported
+// by the returned error.
+func (s *MyStorage) storeBatchAt(key string, batch []MetricValue, now time.Time) (BatchValues, bool, error) {
+	s.mu.Lock()
+	if key != "" && !s.rememberBatch(key, now) {
+		values := s.batchValues(batch)
+		s.mu.Unlock()
+		return values, false, nil
+	}
+	batch, conflictErr := filterDeclared(batch, s.declaredType)
+	updates := make([]Update, 0, len(batch))
+	for _, value := range batch {
+		update, err := s.apply(value.Metric, value.Value, now)
+		if err != nil {
+			// The values are validated, so it does not happen.
+			s.mu.Unlock()
+			return BatchValues{}, false, err
+		}
+		updates = append(updates, update)
+	}
+	values := s.batchValues(batch)
+	s.mu.Unlock()
+	if s.autoSavingParams.storeInterval == 0 {
+		s.autoSavingParams.storageChan <- struct{}{}
+	}
+
+	for _, update := range updates {
+		s.notify(update)
+	}
+	return values, true, conflictErr
+}
+
+// batchValues returns the stored values of the metrics of the batch. The caller must hold the lock.
+func (s *MyStorage) batchValues(batch []MetricValue) BatchValues {
+	values := newBatchValues()
+	for _, value := range batch {
+		switch valueType(value.Value) {
+		case "gauge":
+			if valueGauge, ok := s.DataGauge[value.Metric]; ok {
+				values.Gauges[value.Metric] = valueGauge
+			}
+		case "counter":
+			if valueCounter, ok := s.DataCounter[value.Metric]; ok {
+				values.Counters[value.Metric] = valueCounter
+			}
+		case "histogram":
+			if valueHistogram, ok := s.DataHistogram[value.Metric]; ok {
+				values.Histograms[value.Metric] = valueHistogram.Copy()
+			}
+		}
+	}
+	return values
+}
+
+// apply writes the value and returns the update for the observers. The caller must hold the write lock.
+func (s *MyStorage) apply(metric metrics.Metric, metricValue any, now time.Time) (Update, error) {
+	s.pruneHistory(now)
 	switch metricValue := metricValue.(type) {
 	case metrics.Gauge:
 		s.DataGauge[metric] = metricValue
-		return nil
+		s.appendGaugeSample(metric, metrics.GaugeSample{Timestamp: now, Value: metricValue})
+		s.observeRollups(metric, metricValue, now)
+		return Update{Metric: metric, MType: "gauge", Value: float64(metricValue), Timestamp: now}, nil
 	case float64:
 		s.DataGauge[metric] = metrics.Gauge(metricValue)
-		return nil
+		s.appendGaugeSample(metric, metrics.GaugeSample{Timestamp: now, Value: metrics.Gauge(metricValue)})
+		s.observeRollups(metric, metrics.Gauge(metricValue), now)
+		return Update{Metric: metric, MType: "gauge", Value: metricValue, Timestamp: now}, nil
 	case metrics.Counter:
 		s.DataCounter[metric] += metricValue
-		return nil
+		s.appendCounterSample(metric, metrics.CounterSample{Timestamp: now, Value: s.DataCounter[metric]})
+		return Update{Metric: metric, MType: "counter", Value: float64(s.DataCounter[metric]), Timestamp: now}, nil
 	case int64:
 		s.DataCounter[metric] += metrics.Counter(metricValue)
-		return nil
+		s.appendCounterSample(metric, metrics.CounterSample{Timestamp: now, Value: s.DataCounter[metric]})
+		return Update{Metric: metric, MType: "counter", Value: float64(s.DataCounter[metric]), Timestamp: now}, nil
+	case metrics.CounterTotal:
+		if s.CounterTotals == nil {
+			s.CounterTotals = map[metrics.Metric]metrics.CounterTotal{}
+		}
+		previous, seen := s.CounterTotals[metric]
+		s.CounterTotals[metric] = metricValue
+		s.DataCounter[metric] += metricValue.Increase(previous, seen)
+		s.appendCounterSample(metric, metrics.CounterSample{Timestamp: now, Value: s.DataCounter[metric]})
+		return Update{Metric: metric, MType: "counter", Value: float64(s.DataCounter[metric]), Timestamp: now}, nil
+	case metrics.Histogram:
+		err := metricValue.Validate()
+		if err != nil {
+			return Update{}, err
+		}
+		if s.DataHistogram == nil {
+			s.DataHistogram = map[metrics.Metric]metrics.Histogram{}
+		}
+		histogram := s.DataHistogram[metric].Merge(metricValue)
+		s.DataHistogram[metric] = histogram
+		histogram = histogram.Copy()
+		return Update{Metric: metric, MType: "histogram", Value: float64(histogram.Count), Histogram: &histogram, Timestamp: now}, nil
 	default:
-		return errNotExpectedType
+		return Update{}, errNotExpectedType
+	}
+}
+
+// pruneHistory drops the samples of all the series which are older than historyRetention at the moment now,
+// the series without samples are removed. It is done at most once a minute, so the series which are not stored
+// any more do not keep their samples. The caller must hold the write lock.
+func (s *MyStorage) pruneHistory(now time.Time) {
+	if now.Sub(s.historyPruned) <= time.Minute {
+		return
+	}
+	s.historyPruned = now
+	for metric, samples := range s.HistoryGauge {
+		expired := 0
+		for expired < len(samples) && now.Sub(samples[expired].Timestamp) > historyRetention {
+			expired++
+		}
+		if expired == len(samples) {
+			delete(s.HistoryGauge, metric)
+		} else if expired > 0 {
+			s.HistoryGauge[metric] = samples[expired:]
+		}
+	}
+	for metric, samples := range s.HistoryCounter {
+		expired := 0
+		for expired < len(samples) && now.Sub(samples[expired].Timestamp) > historyRetention {
+			expired++
+		}
+		if expired == len(samples) {
+			delete(s.HistoryCounter, metric)
+		} else if expired > 0 {
+			s.HistoryCounter[metric] = samples[expired:]
+		}
+	}
+}
+
+// appendGaugeSample adds sample to the history of the gauge and drops samples that are older than historyRetention.
+// The caller must hold the write lock.
+func (s *MyStorage) appendGaugeSample(metric metrics.Metric, sample metrics.GaugeSample) {
+	if s.HistoryGauge == nil {
+		s.HistoryGauge = map[metrics.Metric][]metrics.GaugeSample{}
+	}
+	samples := append(s.HistoryGauge[metric], sample)
+	expired := 0
+	for expired < len(samples) && sample.Timestamp.Sub(samples[expired].Timestamp) > historyRetention {
+		expired++
+	}
+	s.HistoryGauge[metric] = samples[expired:]
+}
+
+// observeRollups adds the value of the gauge to its rollups of all the windows.
+// The caller must hold the write lock.
+func (s *MyStorage) observeRollups(metric metrics.Metric, value metrics.Gauge, now time.Time) {
+	if len(s.rollupWindows) == 0 {
+		return
+	}
+	if s.Rollups == nil {
+		s.Rollups = map[metrics.Metric]map[string]metrics.RollingRollup{}
 	}
+	rollups, ok := s.Rollups[metric]
+	if !ok {
+		rollups = map[string]metrics.RollingRollup{}
+		s.Rollups[metric] = rollups
+	}
+	for _, window := range s.rollupWindows {
+		rollups[window.String()] = rollups[window.String()].Observe(value, now, window)
+	}
+}
+
+// appendCounterSample adds sample to the history of the counter and drops samples that are older than historyRetention.
+// The caller must hold the write lock.
+func (s *MyStorage) appendCounterSample(metric metrics.Metric, sample metrics.CounterSample) {
+	if s.HistoryCounter == nil {
+		s.HistoryCounter = map[metrics.Metric][]metrics.CounterSample{}
+	}
+	samples := append(s.HistoryCounter[metric], sample)
+	expired := 0
+	for expired < len(samples) && sample.Timestamp.Sub(samples[expired].Timestamp) > historyRetention {
+		expired++
+	}
+	s.HistoryCounter[metric] = samples[expired:]
+}
+
+// rememberBatch records the idempotency key of a batch applied at the moment now. The keys older than
+// batchKeyRetention are dropped at most once a minute, or when maxBatchKeys are remembered. If there are still
+// maxBatchKeys keys then, the oldest tenth of them is forgotten. The caller must hold the write lock.
+// It returns false if the key is already remembered and the batch must not be applied again.
+func (s *MyStorage) rememberBatch(key string, now time.Time) bool {
+	if s.BatchKeys == nil {
+		s.BatchKeys = map[string]time.Time{}
+	}
+	if remembered, ok := s.BatchKeys[key]; ok && now.Sub(remembered) <= batchKeyRetention {
+		return false
+	}
+
+	if now.Sub(s.batchKeysPruned) > time.Minute || len(s.BatchKeys) >= maxBatchKeys {
+		for batchKey, remembered := range s.BatchKeys {
+			if now.Sub(remembered) > batchKeyRetention {
+				delete(s.BatchKeys, batchKey)
+			}
+		}
+		s.batchKeysPruned = now
+	}
+	if len(s.BatchKeys) >= maxBatchKeys {
+		s.forgetOldestBatchKeys(maxBatchKeys / 10)
+	}
+	s.BatchKeys[key] = now
+	return true
+}
+
+// forgetOldestBatchKeys drops the n idempotency keys remembered first. The caller must hold the write lock.
+func (s *MyStorage) forgetOldestBatchKeys(n int) {
+	keys := make([]string, 0, len(s.BatchKeys))
+	for key := range s.BatchKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.BatchKeys[keys[i]].Before(s.BatchKeys[keys[j]])
+	})
+	if n > len(keys) {
+		n = len(keys)
+	}
+	for _, key := range keys[:n] {
+		delete(s.BatchKeys, key)
+	}
+}
+
+// declaredType returns the type declared for the name by the metadata, an empty string for an undeclared name.
+// The caller must hold the lock.
+func (s *MyStorage) declaredType(name string) string {
+	return s.Metadata[name].MType
+}
+
+// RegisterMetadataContext declares the metadata of metrics by name, see RegisterMetadata.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metadata: The metadata to declare.
+//
+// Returns:
+//   - An error if the metadata is invalid or conflicts with the declared types, or if the context is canceled.
+func (s *MyStorage) RegisterMetadataContext(ctx context.Context, metadata []metrics.Metadata) error {
+	ch := make(chan error, 1)
+
+	go func() {
+		ch <- s.RegisterMetadata(metadata)
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RegisterMetadata declares the metadata of metrics by name. The metadata is validated first, nothing is declared
+// if a name is declared with another type; the unit and the help of a declared name are replaced.
+//
+// Parameters:
+//   - metadata: The metadata to declare.
+//
+// Returns:
+//   - An error if the metadata is invalid or ErrTypeConflict if it conflicts with the declared types.
+func (s *MyStorage) RegisterMetadata(metadata []metrics.Metadata) error {
+	s.mu.Lock()
+	err := validateMetadata(metadata, s.declaredType)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.declare(metadata)
+	s.mu.Unlock()
+
+	if s.autoSavingParams.storeInterval == 0 {
+		s.autoSavingParams.storageChan <- struct{}{}
+	}
+	return nil
+}
+
+// declare stores the validated metadata. The caller must hold the write lock.
+func (s *MyStorage) declare(metadata []metrics.Metadata) {
+	if s.Metadata == nil {
+		s.Metadata = map[string]metrics.Metadata{}
+	}
+	for _, m := range metadata {
+		s.Metadata[m.Name] = m
+	}
+}
+
+// DeleteMetadataContext removes the declarations of the names.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - names: The names whose declarations are removed.
+//
+// Returns:
+//   - An error if the context is canceled.
+func (s *MyStorage) DeleteMetadataContext(ctx context.Context, names []string) error {
+	ch := make(chan error, 1)
+
+	go func() {
+		ch <- s.DeleteMetadata(names)
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeleteMetadata removes the declarations of the names, so a name can be declared again with another type.
+// The stored values of the names are kept. Undeclared names are ignored.
+//
+// Parameters:
+//   - names: The names whose declarations are removed.
+//
+// Returns:
+//   - Always nil, the error is returned for the symmetry with RegisterMetadata.
+func (s *MyStorage) DeleteMetadata(names []string) error {
+	s.mu.Lock()
+	s.undeclare(names)
+	s.mu.Unlock()
+
+	if s.autoSavingParams.storeInterval == 0 {
+		s.autoSavingParams.storageChan <- struct{}{}
+	}
+	return nil
+}
+
+// undeclare removes the declarations of the names. The caller must hold the write lock.
+func (s *MyStorage) undeclare(names []string) {
+	for _, name := range names {
+		delete(s.Metadata, name)
+	}
+}
+
+// LoadMetadataContext retrieves a copy of the declared metadata.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//
+// Returns:
+//   - A Result containing map[string]metrics.Metadata by name and any associated error.
+func (s *MyStorage) LoadMetadataContext(ctx context.Context) Result {
+	ch := make(chan Result, 1)
+
+	go func() {
+		ch <- s.LoadMetadata()
+	}()
+
+	select {
+	case res := <-ch:
+		return res
+	case <-ctx.Done():
+		return Result{Value: nil, Err: ctx.Err()}
+	}
+}
+
+// LoadMetadata retrieves a copy of the declared metadata.
+//
+// Returns:
+//   - A Result containing map[string]metrics.Metadata by name.
+func (s *MyStorage) LoadMetadata() Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	metadata := make(map[string]metrics.Metadata, len(s.Metadata))
+	for name, m := range s.Metadata {
+		metadata[name] = m
+	}
+	return Result{Value: metadata, Err: nil}
 }
 
 // LoadContext retrieves the value of a specific metric associated with the provided metric type and key from the storage.
@@ -116,7 +609,7 @@ func (s *MyStorage) Store(metric metrics.Metric, metricValue any) error {
 //
 // Parameters:
 //   - ctx: The context in which the operation should be performed.
-//   - metricType: The type of metric to load ("gauge" or "counter").
+//   - metricType: The type of metric to load ("gauge", "counter" or "histogram").
 //   - metric: The metric key associated with the value to be retrieved.
 //
 // Returns:
@@ -139,7 +632,7 @@ func (s *MyStorage) LoadContext(ctx context.Context, metricType string, metric m
 // Load retrieves the value of a specific metric associated with the provided metric type and key from the storage.
 //
 // Parameters:
-//   - metricType: The type of metric to load ("gauge" or "counter").
+//   - metricType: The type of metric to load ("gauge", "counter" or "histogram").
 //   - metric: The metric key associated with the value to be retrieved.
 //
 // Returns:
@@ -151,16 +644,22 @@ func (s *MyStorage) Load(metricType string, metric metrics.Metric) Result {
 		if valueGauge, ok := s.DataGauge[metric]; ok {
 			return Result{Value: valueGauge, Err: nil}
 		} else {
-			return Result{Value: nil, Err: errNoSuchMetric}
+			return Result{Value: nil, Err: ErrNoSuchMetric}
 		}
 	} else if metricType == "counter" {
 		if valueCounter, ok := s.DataCounter[metric]; ok {
 			return Result{Value: valueCounter, Err: nil}
 		} else {
-			return Result{Value: nil, Err: errNoSuchMetric}
+			return Result{Value: nil, Err: ErrNoSuchMetric}
+		}
+	} else if metricType == "histogram" {
+		if valueHistogram, ok := s.DataHistogram[metric]; ok {
+			return Result{Value: valueHistogram.Copy(), Err: nil}
+		} else {
+			return Result{Value: nil, Err: ErrNoSuchMetric}
 		}
 	} else {
-		return Result{Value: nil, Err: errNoSuchMetric}
+		return Result{Value: nil, Err: ErrNoSuchMetric}
 	}
 }
 
@@ -242,8 +741,177 @@ func (s *MyStorage) LoadDataCounter() Result {
 	return Result{Value: copyDataCounter, Err: nil}
 }
 
-// SaveToFile saves the gauge and counter metric data stored in the storage to the specified file.
+// LoadDataHistogramContext retrieves a copy of the data stored in the histogram metrics of the storage.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//
+// Returns:
+//   - A Result containing the retrieved copy of histogram metric data and any associated error.
+func (s *MyStorage) LoadDataHistogramContext(ctx context.Context) Result {
+	ch := make(chan Result, 1)
+
+	go func() {
+		ch <- s.LoadDataHistogram()
+	}()
+
+	select {
+	case res := <-ch:
+		return res
+	case <-ctx.Done():
+		return Result{Value: nil, Err: ctx.Err()}
+	}
+}
+
+// LoadDataHistogram retrieves a copy of the data stored in the histogram metrics of the storage.
+//
+// Returns:
+//   - A Result containing the retrieved copy of histogram metric data and any associated error.
+func (s *MyStorage) LoadDataHistogram() Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	copyDataHistogram := make(map[metrics.Metric]metrics.Histogram)
+
+	for key, value := range s.DataHistogram {
+		copyDataHistogram[key] = value.Copy()
+	}
+
+	return Result{Value: copyDataHistogram, Err: nil}
+}
+
+// LoadRangeContext retrieves the samples of a specific metric stored between from and to inclusive.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metricType: The type of metric to load ("gauge" or "counter").
+//   - metric: The metric key associated with the samples to be retrieved.
+//   - from: The beginning of the time range.
+//   - to: The end of the time range.
+//   - step: The resolution of the result. Only the latest sample of every step is returned,
+//     step = 0 means returning all samples.
+//
+// Returns:
+//   - A Result containing []metrics.GaugeSample or []metrics.CounterSample and any associated error.
+//     ErrNoSuchMetric if the metric has no samples at all, an empty slice if it has none in the range.
+func (s *MyStorage) LoadRangeContext(ctx context.Context, metricType string, metric metrics.Metric, from, to time.Time, step time.Duration) Result {
+	ch := make(chan Result, 1)
+
+	go func() {
+		ch <- s.LoadRange(metricType, metric, from, to, step)
+	}()
+
+	select {
+	case res := <-ch:
+		return res
+	case <-ctx.Done():
+		return Result{Value: nil, Err: ctx.Err()}
+	}
+}
+
+// LoadRange retrieves the samples of a specific metric stored between from and to inclusive.
+//
+// Parameters:
+//   - metricType: The type of metric to load ("gauge" or "counter").
+//   - metric: The metric key associated with the samples to be retrieved.
+//   - from: The beginning of the time range.
+//   - to: The end of the time range.
+//   - step: The resolution of the result. Only the latest sample of every step is returned,
+//     step = 0 means returning all samples.
+//
+// Returns:
+//   - A Result containing []metrics.GaugeSample or []metrics.CounterSample and any associated error.
+//     ErrNoSuchMetric if the metric has no samples at all, an empty slice if it has none in the range.
+func (s *MyStorage) LoadRange(metricType string, metric metrics.Metric, from, to time.Time, step time.Duration) Result {
+	if to.Before(from) {
+		return Result{Value: nil, Err: errInvalidRange}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if metricType == "gauge" {
+		history, ok := s.HistoryGauge[metric]
+		if !ok {
+			return Result{Value: nil, Err: ErrNoSuchMetric}
+		}
+		samples := make([]metrics.GaugeSample, 0)
+		for _, sample := range history {
+			if !sample.Timestamp.Before(from) && !sample.Timestamp.After(to) {
+				samples = append(samples, sample)
+			}
+		}
+		samples = downsample(samples, func(sample metrics.GaugeSample) time.Time { return sample.Timestamp }, from, step)
+		return Result{Value: samples, Err: nil}
+	} else if metricType == "counter" {
+		history, ok := s.HistoryCounter[metric]
+		if !ok {
+			return Result{Value: nil, Err: ErrNoSuchMetric}
+		}
+		samples := make([]metrics.CounterSample, 0)
+		for _, sample := range history {
+			if !sample.Timestamp.Before(from) && !sample.Timestamp.After(to) {
+				samples = append(samples, sample)
+			}
+		}
+		samples = downsample(samples, func(sample metrics.CounterSample) time.Time { return sample.Timestamp }, from, step)
+		return Result{Value: samples, Err: nil}
+	} else {
+		return Result{Value: nil, Err: ErrNoSuchMetric}
+	}
+}
+
+// LoadRollupContext retrieves the rollup of a gauge for the window.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metric: The metric key of the gauge.
+//   - window: The window of the rollup, one of the windows of the storage.
+//
+// Returns:
+//   - A Result containing metrics.Rollup and any associated error.
+func (s *MyStorage) LoadRollupContext(ctx context.Context, metric metrics.Metric, window time.Duration) Result {
+	ch := make(chan Result, 1)
+
+	go func() {
+		ch <- s.LoadRollup(metric, window)
+	}()
+
+	select {
+	case res := <-ch:
+		return res
+	case <-ctx.Done():
+		return Result{Value: nil, Err: ctx.Err()}
+	}
+}
+
+// LoadRollup retrieves the statistics of a gauge over the trailing window, see metrics.RollingRollup.Over.
+//
+// Parameters:
+//   - metric: The metric key of the gauge.
+//   - window: The window of the rollup, one of the windows of the storage.
+//
+// Returns:
+//   - A Result containing metrics.Rollup and any associated error.
+func (s *MyStorage) LoadRollup(metric metrics.Metric, window time.Duration) Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !hasWindow(s.rollupWindows, window) {
+		return Result{Value: nil, Err: errNoSuchRollup}
+	}
+	rollup, ok := s.Rollups[metric][window.String()].Over(time.Now(), window)
+	if !ok {
+		return Result{Value: nil, Err: ErrNoSuchMetric}
+	}
+	return Result{Value: rollup, Err: nil}
+}
+
+// SaveToFile saves the gauge, counter and histogram metric data stored in the storage to the specified file.
 // The data is serialized into JSON format and written to the file.
+// The history is not saved: with storeInterval = 0 the file is rewritten by every stored value, and the samples
+// of a day would make every write as big as the whole history. The history is lost on restart then, the samples
+// survive restarts with the WAL or the SQL storage.
 //
 // Parameters:
 //   - filepath: The path to the file where the data should be saved.
@@ -257,6 +925,22 @@ func (s *MyStorage) SaveToFile(filepath string) error {
 		return nil
 	}
 
+	data, err := json.Marshal(s.fileData(false))
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath, data, 0777)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// fileData returns a copy of the data of the storage in the format of the file, with the history of the gauges
+// and the counters if history is true. The caller must hold the lock.
+func (s *MyStorage) fileData(history bool) metrics.FileData {
 	dataGauge := map[metrics.Metric]metrics.Gauge{}
 	for key, value := range s.DataGauge {
 		dataGauge[key] = value
@@ -266,22 +950,61 @@ func (s *MyStorage) SaveToFile(filepath string) error {
 		dataCounter[key] = value
 	}
 
-	fileData := metrics.FileData{DataGauge: dataGauge, DataCounter: dataCounter}
+	dataHistogram := map[metrics.Metric]metrics.Histogram{}
+	for key, value := range s.DataHistogram {
+		dataHistogram[key] = value.Copy()
+	}
 
-	data, err := json.Marshal(fileData)
-	if err != nil {
-		return err
+	var historyGauge map[metrics.Metric][]metrics.GaugeSample
+	var historyCounter map[metrics.Metric][]metrics.CounterSample
+	if history {
+		historyGauge = map[metrics.Metric][]metrics.GaugeSample{}
+		for key, value := range s.HistoryGauge {
+			historyGauge[key] = append([]metrics.GaugeSample(nil), value...)
+		}
+		historyCounter = map[metrics.Metric][]metrics.CounterSample{}
+		for key, value := range s.HistoryCounter {
+			historyCounter[key] = append([]metrics.CounterSample(nil), value...)
+		}
 	}
 
-	err = os.WriteFile(filepath, data, 0777)
-	if err != nil {
-		return err
+	counterTotals := map[metrics.Metric]metrics.CounterTotal{}
+	for key, value := range s.CounterTotals {
+		counterTotals[key] = value
 	}
 
-	return nil
+	rollups := map[metrics.Metric]map[string]metrics.RollingRollup{}
+	for key, value := range s.Rollups {
+		rollups[key] = map[string]metrics.RollingRollup{}
+		for window, rollup := range value {
+			rollups[key][window] = rollup
+		}
+	}
+
+	batchKeys := map[string]time.Time{}
+	for key, value := range s.BatchKeys {
+		batchKeys[key] = value
+	}
+
+	metadata := map[string]metrics.Metadata{}
+	for key, value := range s.Metadata {
+		metadata[key] = value
+	}
+
+	return metrics.FileData{
+		DataGauge:      dataGauge,
+		DataCounter:    dataCounter,
+		DataHistogram:  dataHistogram,
+		HistoryGauge:   historyGauge,
+		HistoryCounter: historyCounter,
+		CounterTotals:  counterTotals,
+		Rollups:        rollups,
+		BatchKeys:      batchKeys,
+		Metadata:       metadata,
+	}
 }
 
-// LoadFromFile loads gauge and counter metric data from the specified file and populates the storage.
+// LoadFromFile loads gauge, counter and histogram metric data from the specified file and populates the storage.
 // The data is deserialized from JSON format and stored in the respective gauge and counter maps.
 //
 // Parameters:
@@ -322,6 +1045,99 @@ func (s *MyStorage) LoadFromFile(filepath string) error {
 			return err
 		}
 	}
+	for key, value := range fileData.DataHistogram {
+		err = s.Store(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Store has just put a sample of the restored value into the history, the saved history replaces it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range fileData.HistoryGauge {
+		s.HistoryGauge[key] = value
+	}
+	for key, value := range fileData.HistoryCounter {
+		s.HistoryCounter[key] = value
+	}
+	if s.CounterTotals == nil {
+		s.CounterTotals = map[metrics.Metric]metrics.CounterTotal{}
+	}
+	for key, value := range fileData.CounterTotals {
+		s.CounterTotals[key] = value
+	}
+	// The rollups are replaced as well, only the windows of the storage are restored.
+	for key, value := range fileData.Rollups {
+		rollups := map[string]metrics.RollingRollup{}
+		for window, rollup := range value {
+			duration, err := time.ParseDuration(window)
+			if err == nil && hasWindow(s.rollupWindows, duration) {
+				rollups[window] = rollup
+			}
+		}
+		s.Rollups[key] = rollups
+	}
+	if s.BatchKeys == nil {
+		s.BatchKeys = map[string]time.Time{}
+	}
+	for key, value := range fileData.BatchKeys {
+		s.BatchKeys[key] = value
+	}
+	if s.Metadata == nil {
+		s.Metadata = map[string]metrics.Metadata{}
+	}
+	for key, value := range fileData.Metadata {
+		s.Metadata[key] = value
+	}
 
 	return nil
 }
+
+// restore replaces the data of the storage with the data of the file, only the rollups of the windows
+// of the storage are restored. The caller must hold the write lock.
+func (s *MyStorage) restore(fileData metrics.FileData) {
+	s.DataGauge = map[metrics.Metric]metrics.Gauge{}
+	for key, value := range fileData.DataGauge {
+		s.DataGauge[key] = value
+	}
+	s.DataCounter = map[metrics.Metric]metrics.Counter{}
+	for key, value := range fileData.DataCounter {
+		s.DataCounter[key] = value
+	}
+	s.DataHistogram = map[metrics.Metric]metrics.Histogram{}
+	for key, value := range fileData.DataHistogram {
+		s.DataHistogram[key] = value
+	}
+	s.HistoryGauge = map[metrics.Metric][]metrics.GaugeSample{}
+	for key, value := range fileData.HistoryGauge {
+		s.HistoryGauge[key] = value
+	}
+	s.HistoryCounter = map[metrics.Metric][]metrics.CounterSample{}
+	for key, value := range fileData.HistoryCounter {
+		s.HistoryCounter[key] = value
+	}
+	s.CounterTotals = map[metrics.Metric]metrics.CounterTotal{}
+	for key, value := range fileData.CounterTotals {
+		s.CounterTotals[key] = value
+	}
+	s.Rollups = map[metrics.Metric]map[string]metrics.RollingRollup{}
+	for key, value := range fileData.Rollups {
+		rollups := map[string]metrics.RollingRollup{}
+		for window, rollup := range value {
+			duration, err := time.ParseDuration(window)
+			if err == nil && hasWindow(s.rollupWindows, duration) {
+				rollups[window] = rollup
+			}
+		}
+		s.Rollups[key] = rollups
+	}
+	s.BatchKeys = map[string]time.Time{}
+	for key, value := range fileData.BatchKeys {
+		s.BatchKeys[key] = value
+	}
+	s.Metadata = map[string]metrics.Metadata{}
+	for key, value := range fileData.Metadata {
+		s.Metadata[key] = value
+	}
+}
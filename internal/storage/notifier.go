@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// Update describes a value written to the storage. For a counter Value is the accumulated value
+// after the write, for a gauge it is the stored value. For a histogram Histogram is the accumulated
+// histogram and Value is the number of its observations.
+type Update struct {
+	Metric    metrics.Metric
+	MType     string
+	Value     float64
+	Histogram *metrics.Histogram
+	Timestamp time.Time
+}
+
+// Observer is notified about every value written to the storage.
+// OnStore is called on the write path, so it should not block.
+type Observer interface {
+	OnStore(update Update)
+}
+
+// Notifier keeps observers of the storage and passes updates to them.
+// It is embedded into the storages, so every storage.Storage can be observed.
+type Notifier struct {
+	mu        sync.RWMutex
+	observers []Observer
+}
+
+// Subscribe adds the observer which is notified about all the subsequent writes.
+func (n *Notifier) Subscribe(observer Observer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.observers = append(n.observers, observer)
+}
+
+// notify passes the update to all the observers.
+func (n *Notifier) notify(update Update) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, observer := range n.observers {
+		observer.OnStore(update)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// postgresDSNEnv is the environment variable with the data source name of the PostgreSQL database of the tests,
+// the tests are skipped without it.
+const postgresDSNEnv = "TEST_POSTGRES_DSN"
+
+// newTestPostgresDB opens the database of TEST_POSTGRES_DSN with a new schema as the search path,
+// the schema is dropped at the end of the test.
+func newTestPostgresDB(t *testing.T) *sql.DB {
+	dataSourceName := os.Getenv(postgresDSNEnv)
+	if dataSourceName == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	admin, err := sql.Open("pgx", dataSourceName)
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("test_%s_%d", strings.ToLower(t.Name()), time.Now().UnixNano())
+	schema = strings.NewReplacer("/", "_", "-", "_").Replace(schema)
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	config, err := pgx.ParseConfig(dataSourceName)
+	require.NoError(t, err)
+	config.RuntimeParams["search_path"] = schema
+	db := stdlib.OpenDB(*config)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPostgresStorage_MigrateLegacyTables(t *testing.T) {
+	db := newTestPostgresDB(t)
+	ctx := context.Background()
+
+	// The first versions of the server created the tables without migrations and with short keys.
+	_, err := db.Exec(`CREATE TABLE gauge (metric VARCHAR(100) UNIQUE, val DOUBLE PRECISION)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE counter (metric VARCHAR(100) UNIQUE, val BIGINT)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO gauge (metric, val) VALUES ('Alloc', 1.5)`)
+	require.NoError(t, err)
+
+	storage := NewSQLStorage(db)
+	_, err = storage.Migrate(ctx)
+	require.NoError(t, err)
+
+	res := storage.LoadDataGaugeContext(ctx)
+	require.NoError(t, res.Err)
+	require.Contains(t, res.Value, metrics.Metric("Alloc"))
+	long := metrics.Metric(strings.Repeat("a", 200))
+	require.NoError(t, storage.StoreContext(ctx, long, 2.5))
+	require.NoError(t, storage.StoreContext(ctx, long, int64(3)))
+}
+
+func TestPostgresStorage_MigrateLock(t *testing.T) {
+	db := newTestPostgresDB(t)
+	ctx := context.Background()
+
+	// Another replica holds the advisory lock.
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+	require.NoError(t, err)
+
+	storage := NewSQLStorage(db)
+	done := make(chan error, 1)
+	go func() {
+		_, err := storage.Migrate(ctx)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("Migrate did not wait for the advisory lock: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	require.NoError(t, err)
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Migrate did not finish after the advisory lock was released")
+	}
+}
+
+func TestPostgresStorage_MigrateConcurrently(t *testing.T) {
+	db := newTestPostgresDB(t)
+	ctx := context.Background()
+
+	storages := make([]*SQLStorage, 4)
+	for i := range storages {
+		storages[i] = NewSQLStorage(db)
+	}
+	var wg sync.WaitGroup
+	applied := make([][]Migration, len(storages))
+	errs := make([]error, len(storages))
+	for i, storage := range storages {
+		wg.Add(1)
+		go func(i int, storage *SQLStorage) {
+			defer wg.Done()
+			applied[i], errs[i] = storage.Migrate(ctx)
+		}(i, storage)
+	}
+	wg.Wait()
+
+	migrations, err := storages[0].Migrations()
+	require.NoError(t, err)
+	total := 0
+	for i := range storages {
+		require.NoError(t, errs[i])
+		total += len(applied[i])
+	}
+	require.Equal(t, len(migrations), total)
+}
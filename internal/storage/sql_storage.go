@@ -1,20 +1,59 @@
 // Package storage provides functionalities for keeping data on server
-// this package have two types of storage:
+// this package have three types of storage:
 // - MyStorage that keeps data in map and periodically saves it to file
 // - SQLStorage that keeps data as SQL database
+// - WALStorage that keeps data in map and writes every update to a write-ahead log with periodic snapshots
 package storage
 
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
 )
 
-// SQLStorage holds metrics as SQL Database.
+// maxBatchRows is the maximum number of rows written by one statement of StoreBatchContext,
+// it keeps the number of parameters of a statement far below the limit of PostgreSQL.
+const maxBatchRows = 1000
+
+// SQLiteScheme is the scheme of the data source names of SQLite databases, e.g. sqlite:///var/lib/metrics.db.
+const SQLiteScheme = "sqlite://"
+
+// queryRollup upserts the sub-buckets of the rolling rollups of gauges, a sub-bucket is merged with the stored one.
+// The statement has the verbs of the functions returning the smaller and the greater value, rollupQuery fills them in
+// and leaves a single %s verb for the VALUES list.
+const queryRollup = `
+       INSERT INTO gauge_rollup_bucket (metric, win, start, min, max, sum, count, last)
+       VALUES %%s
+       ON CONFLICT (metric, win, start)
+       DO UPDATE SET
+         min = %s(gauge_rollup_bucket.min, EXCLUDED.min),
+         max = %s(gauge_rollup_bucket.max, EXCLUDED.max),
+         sum = gauge_rollup_bucket.sum + EXCLUDED.sum,
+         count = gauge_rollup_bucket.count + EXCLUDED.count,
+         last = EXCLUDED.last
+   `
+
+// SQLStorage holds metrics as SQL Database, PostgreSQL or SQLite.
+// Observers subscribed via Notifier are notified about every committed value.
 type SQLStorage struct {
 	DB *sql.DB
+
+	rollupWindows []time.Duration
+	sqlite        bool
+
+	pruneMu         sync.Mutex
+	batchKeysPruned time.Time
+	historyPruned   time.Time
+
+	Notifier
 }
 
 // NewSQLStorage initializes a new instance of SQLStorage.
@@ -26,39 +65,108 @@ type SQLStorage struct {
 // Returns:
 // -A pointer to the initialized SQLStorage
 func NewSQLStorage(db *sql.DB) *SQLStorage {
-	return &SQLStorage{DB: db}
+	return &SQLStorage{DB: db, rollupWindows: defaultRollupWindows()}
 }
 
-// CreateTables creates the necessary database tables if they do not already exist.
-// It creates tables named 'gauge' and 'counter' for storing gauge and counter metrics respectively.
-// If the tables already exist, this function does nothing.
+// NewSQLiteStorage initializes a new instance of SQLStorage on a SQLite database, it has the same tables.
+// SQLite has a single writer and no row locks, so the pool of the database is limited to one connection
+// and the transactions are serialized by it.
 //
 // Parameters:
-//   - ss: A pointer to an initialized SQLStorage instance.
+// - db: The database opened with a SQLite driver registered as "sqlite".
 //
 // Returns:
-//   - An error if there was a problem creating the tables; otherwise, it returns nil.
-func (ss *SQLStorage) CreateTables() error {
-	_, err := ss.DB.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS gauge (
-				  metric VARCHAR(100) UNIQUE,
-				  val DOUBLE PRECISION
-				)`)
-	if err != nil {
-		return err
+// -A pointer to the initialized SQLStorage
+func NewSQLiteStorage(db *sql.DB) *SQLStorage {
+	db.SetMaxOpenConns(1)
+	return &SQLStorage{DB: db, rollupWindows: defaultRollupWindows(), sqlite: true}
+}
+
+// SQLitePath returns the path of the database file if the data source name has SQLiteScheme,
+// e.g. /var/lib/metrics.db for sqlite:///var/lib/metrics.db.
+//
+// Parameters:
+// - dataSourceName: The data source name of the database.
+//
+// Returns:
+// - The path of the database file and true, or false if it is not a SQLite data source name.
+func SQLitePath(dataSourceName string) (string, bool) {
+	if !strings.HasPrefix(dataSourceName, SQLiteScheme) {
+		return "", false
 	}
+	return strings.TrimPrefix(dataSourceName, SQLiteScheme), true
+}
 
-	_, err = ss.DB.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS counter (
-				  metric VARCHAR(100) UNIQUE,
-				  val BIGINT
-				)`)
-	if err != nil {
-		return err
+// rollupQuery returns queryRollup with the functions of the database.
+func (ss *SQLStorage) rollupQuery() string {
+	if ss.sqlite {
+		return fmt.Sprintf(queryRollup, "min", "max")
 	}
+	return fmt.Sprintf(queryRollup, "LEAST", "GREATEST")
+}
 
-	return nil
+// forUpdate returns the clause locking the selected rows, SQLite has none and locks the database instead.
+func (ss *SQLStorage) forUpdate() string {
+	if ss.sqlite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// timestamp returns the argument of a timestamp column. SQLite keeps timestamps as text, they are written in UTC,
+// so they are compared in the order of time.
+func (ss *SQLStorage) timestamp(t time.Time) time.Time {
+	if ss.sqlite {
+		return t.UTC()
+	}
+	return t
+}
+
+// pruneDue reports whether the pruning last done at the moment *pruned is due at the moment now, it is done
+// at most once a minute. If it is due, the moment now is recorded.
+func (ss *SQLStorage) pruneDue(pruned *time.Time, now time.Time) bool {
+	ss.pruneMu.Lock()
+	defer ss.pruneMu.Unlock()
+	if now.Sub(*pruned) <= time.Minute {
+		return false
+	}
+	*pruned = now
+	return true
+}
+
+// SetRollupWindows sets the windows of the gauge rollups. It should be called before the storage is used.
+//
+// Parameters:
+//   - windows: The windows of the rollups, e.g. 1m, 5m and 1h.
+func (ss *SQLStorage) SetRollupWindows(windows []time.Duration) {
+	ss.rollupWindows = append([]time.Duration(nil), windows...)
+}
+
+// CreateTables brings the schema of the database up to date by applying the pending migrations, see Migrate.
+// The tables are 'gauge' and 'counter' for storing gauge and counter metrics respectively,
+// table 'histogram' for storing histograms as JSON and tables 'gauge_history' and 'counter_history' for storing their samples.
+// The samples are kept for historyRetention, like the history of MyStorage.
+// Table 'counter_total' keeps the last totals of the counters sent as metrics.CounterTotal
+// and table 'batch_keys' keeps the idempotency keys of the applied batches.
+// Table 'gauge_rollup_bucket' keeps the statistics of the gauges by sub-bucket of the rollup windows.
+// Table 'metric_metadata' keeps the metadata declared for the metrics by name.
+// Metrics are stored under series keys which include the agent and the labels, so the column metric is TEXT.
+// SQLite has no TIMESTAMPTZ, the timestamps are TIMESTAMP columns in UTC there.
+//
+// Parameters:
+//   - ss: A pointer to an initialized SQLStorage instance.
+//
+// Returns:
+//   - An error if there was a problem creating the tables; otherwise, it returns nil.
+func (ss *SQLStorage) CreateTables() error {
+	_, err := ss.Migrate(context.Background())
+	return err
 }
 
 // StoreContext stores a metric value associated with the given metric key in the storage.
+// The value and the sample in the history are written in a single transaction, the expired samples are deleted
+// in it, see pruneHistory. Histograms have no history, they are merged with the stored ones, see storeHistogram.
+// The increase of a counter sent as metrics.CounterTotal is computed in the same transaction, see counterIncrease.
 // It operates within the provided context, allowing for cancellation and timeout management.
 //
 // Parameters:
@@ -69,47 +177,774 @@ func (ss *SQLStorage) CreateTables() error {
 // Returns:
 //   - An error if the storage operation fails or if the context is canceled.
 func (ss *SQLStorage) StoreContext(ctx context.Context, metric metrics.Metric, metricValue any) error {
+	if histogram, ok := metricValue.(metrics.Histogram); ok {
+		return ss.storeHistogram(ctx, metric, histogram)
+	}
+
 	queryGauge := `
        INSERT INTO gauge (metric, val)
        VALUES ($1, $2)
        ON CONFLICT (metric)
-       DO UPDATE SET val = EXCLUDED.val;
+       DO UPDATE SET val = EXCLUDED.val
+       RETURNING val;
+   `
+	queryGaugeHistory := `
+       INSERT INTO gauge_history (metric, val, ts)
+       VALUES ($1, $2, $3);
    `
 	queryCounter := `
        INSERT INTO counter (metric, val)
        VALUES ($1, $2)
        ON CONFLICT (metric)
-       DO UPDATE SET val = counter.val + EXCLUDED.val;
+       DO UPDATE SET val = counter.val + EXCLUDED.val
+       RETURNING val;
+   `
+	queryCounterHistory := `
+       INSERT INTO counter_history (metric, val, ts)
+       VALUES ($1, $2, $3);
    `
 
-	switch metricValue := metricValue.(type) {
-	case metrics.Gauge:
-		_, err := ss.DB.ExecContext(ctx, queryGauge, metric, metricValue)
+	update := Update{Metric: metric, Timestamp: ss.timestamp(time.Now())}
+	var query, queryHistory string
+	switch metricValue.(type) {
+	case metrics.Gauge, float64:
+		query, queryHistory = queryGauge, queryGaugeHistory
+		update.MType = "gauge"
+	case metrics.Counter, int64, metrics.CounterTotal:
+		query, queryHistory = queryCounter, queryCounterHistory
+		update.MType = "counter"
+	default:
+		return errNotExpectedType
+	}
+
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	value := []MetricValue{{Metric: metric, Value: metricValue}}
+	declared, err := ss.declaredTypes(ctx, tx, value)
+	if err != nil {
+		return err
+	}
+	_, err = filterDeclared(value, declared)
+	if err != nil {
+		return err
+	}
+
+	if total, ok := metricValue.(metrics.CounterTotal); ok {
+		metricValue, err = ss.counterIncrease(ctx, tx, metric, total)
 		if err != nil {
 			return err
 		}
-		return nil
-	case float64:
-		_, err := ss.DB.ExecContext(ctx, queryGauge, metric, metricValue)
+	}
+
+	// The stored value is returned, so the history of a counter gets its accumulated value.
+	var val any
+	if update.MType == "gauge" {
+		var gauge float64
+		err = tx.QueryRowContext(ctx, query, metric, metricValue).Scan(&gauge)
+		val, update.Value = gauge, gauge
+	} else {
+		var counter int64
+		err = tx.QueryRowContext(ctx, query, metric, metricValue).Scan(&counter)
+		val, update.Value = counter, float64(counter)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, queryHistory, metric, val, update.Timestamp)
+	if err != nil {
+		return err
+	}
+	err = ss.pruneHistory(ctx, tx, update.Timestamp)
+	if err != nil {
+		return err
+	}
+	if update.MType == "gauge" {
+		err = ss.pruneRollups(ctx, tx, update.Timestamp)
 		if err != nil {
 			return err
 		}
-		return nil
-	case metrics.Counter:
-		_, err := ss.DB.ExecContext(ctx, queryCounter, metric, metricValue)
+		err = insertRows(ctx, tx, ss.rollupQuery(), ss.rollupRows(metric, []metrics.Gauge{metrics.Gauge(update.Value)}, update.Timestamp))
 		if err != nil {
 			return err
 		}
-		return nil
-	case int64:
-		_, err := ss.DB.ExecContext(ctx, queryCounter, metric, metricValue)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	ss.notify(update)
+
+	return nil
+}
+
+// counterIncrease replaces the stored total of the counter with total and returns the increase of the counter.
+// The row is created first and then locked, so concurrent totals of the same counter are serialized.
+// The arguments are in the order of their placeholders, as SQLite drivers may bind them by position.
+func (ss *SQLStorage) counterIncrease(ctx context.Context, tx *sql.Tx, metric metrics.Metric, total metrics.CounterTotal) (metrics.Counter, error) {
+	_, err := tx.ExecContext(ctx, `INSERT INTO counter_total (metric, val) VALUES ($1, NULL) ON CONFLICT (metric) DO NOTHING`, metric)
+	if err != nil {
+		return 0, err
+	}
+
+	var previous sql.NullInt64
+	err = tx.QueryRowContext(ctx, `SELECT val FROM counter_total WHERE metric = $1`+ss.forUpdate(), metric).Scan(&previous)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE counter_total SET val = $1 WHERE metric = $2`, int64(total), metric)
+	if err != nil {
+		return 0, err
+	}
+
+	return total.Increase(metrics.CounterTotal(previous.Int64), previous.Valid), nil
+}
+
+// storeHistogram adds the observations of the histogram to the stored one in a transaction.
+func (ss *SQLStorage) storeHistogram(ctx context.Context, metric metrics.Metric, histogram metrics.Histogram) error {
+	err := histogram.Validate()
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	value := []MetricValue{{Metric: metric, Value: histogram}}
+	declared, err := ss.declaredTypes(ctx, tx, value)
+	if err != nil {
+		return err
+	}
+	_, err = filterDeclared(value, declared)
+	if err != nil {
+		return err
+	}
+
+	merged, err := ss.mergeHistogram(ctx, tx, metric, histogram)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	ss.notify(Update{Metric: metric, MType: "histogram", Value: float64(merged.Count), Histogram: &merged, Timestamp: time.Now()})
+
+	return nil
+}
+
+// mergeHistogram adds the observations of the histogram to the stored one and returns the result.
+// The row is created first and then locked, so concurrent writes of the same histogram are serialized.
+func (ss *SQLStorage) mergeHistogram(ctx context.Context, tx *sql.Tx, metric metrics.Metric, histogram metrics.Histogram) (metrics.Histogram, error) {
+	_, err := tx.ExecContext(ctx, `INSERT INTO histogram (metric, val) VALUES ($1, NULL) ON CONFLICT (metric) DO NOTHING`, metric)
+	if err != nil {
+		return metrics.Histogram{}, err
+	}
+
+	var val sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT val FROM histogram WHERE metric = $1`+ss.forUpdate(), metric).Scan(&val)
+	if err != nil {
+		return metrics.Histogram{}, err
+	}
+	var stored metrics.Histogram
+	if val.Valid {
+		err = json.Unmarshal([]byte(val.String), &stored)
+		if err != nil {
+			return metrics.Histogram{}, err
+		}
+	}
+
+	merged := stored.Merge(histogram)
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return metrics.Histogram{}, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE histogram SET val = $1 WHERE metric = $2`, string(data), metric)
+	if err != nil {
+		return metrics.Histogram{}, err
+	}
+
+	return merged, nil
+}
+
+// StoreBatchContext stores the values of the batch in a single transaction.
+// The values of a type are written by multi-row statements: the gauges of the batch are upserted by one statement
+// and the counters by another, their samples are inserted into the history the same way.
+// Several values of a metric in the batch are combined first: the last gauge wins and the counter deltas are added up.
+// Counter totals and histograms need the stored values, they are written row by row in the same transaction.
+// The rows of every table are written in the order of their metrics, so concurrent batches do not deadlock.
+//
+// A non-empty key is inserted into table 'batch_keys' in the transaction, so of concurrent requests with the same key
+// only one applies the batch. The keys older than batchKeyRetention are deleted first, and at most once a minute
+// the keys older than the latest maxBatchKeys ones. The stored values of the metrics are returned by the statements
+// which write them, the values of a replayed batch are loaded in the transaction by a statement per table.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - key: The idempotency key of the batch of at most maxBatchKeyLength bytes, an empty key means the batch
+//     is always applied.
+//   - batch: The metric keys and the values to be stored.
+//
+// Returns:
+//   - The values of the metrics of the batch stored in the transaction, the current ones for a replay.
+//     The dropped values have none.
+//   - false if the key is already remembered and the batch is not applied again.
+//   - An error if a value of the batch can not be stored or a query fails, nothing is stored then.
+//     An error wrapping ErrTypeConflict if values have another type than the declared one, the other values are stored.
+func (ss *SQLStorage) StoreBatchContext(ctx context.Context, key string, batch []MetricValue) (BatchValues, bool, error) {
+	err := validateBatch(key, batch)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	defer tx.Rollback()
+
+	declared, err := ss.declaredTypes(ctx, tx, batch)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	batch, conflictErr := filterDeclared(batch, declared)
+	// The rows are written in the order of their metrics, so concurrent batches lock the rows they share
+	// in the same order and do not deadlock each other.
+	batch = sortedByMetric(batch)
+
+	now := ss.timestamp(time.Now())
+	if key != "" {
+		_, err = tx.ExecContext(ctx, `DELETE FROM batch_keys WHERE remembered_at < $1`, now.Add(-batchKeyRetention))
+		if err != nil {
+			return BatchValues{}, false, err
+		}
+		if ss.pruneDue(&ss.batchKeysPruned, now) {
+			_, err = tx.ExecContext(ctx, `
+				DELETE FROM batch_keys WHERE remembered_at < (
+				  SELECT remembered_at FROM batch_keys ORDER BY remembered_at DESC LIMIT 1 OFFSET $1
+				)`, maxBatchKeys-1)
+			if err != nil {
+				return BatchValues{}, false, err
+			}
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO batch_keys (key, remembered_at) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`, key, now)
+		if err != nil {
+			return BatchValues{}, false, err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return BatchValues{}, false, err
+		}
+		if inserted == 0 {
+			values, err := ss.loadBatchValues(ctx, tx, batch)
+			if err != nil {
+				return BatchValues{}, false, err
+			}
+			return values, false, nil
+		}
+	}
+
+	var gaugeOrder, counterOrder []metrics.Metric
+	gauges := map[metrics.Metric]float64{}
+	gaugeValues := map[metrics.Metric][]metrics.Gauge{}
+	counters := map[metrics.Metric]int64{}
+	updates := make([]Update, 0, len(batch))
+	values := newBatchValues()
+	for _, value := range batch {
+		var delta int64
+		switch v := value.Value.(type) {
+		case metrics.Gauge, float64:
+			if _, ok := gauges[value.Metric]; !ok {
+				gaugeOrder = append(gaugeOrder, value.Metric)
+			}
+			gauges[value.Metric] = toFloat64(v)
+			gaugeValues[value.Metric] = append(gaugeValues[value.Metric], metrics.Gauge(toFloat64(v)))
+			continue
+		case metrics.Counter:
+			delta = int64(v)
+		case int64:
+			delta = v
+		case metrics.CounterTotal:
+			increase, err := ss.counterIncrease(ctx, tx, value.Metric, v)
+			if err != nil {
+				return BatchValues{}, false, err
+			}
+			delta = int64(increase)
+		case metrics.Histogram:
+			merged, err := ss.mergeHistogram(ctx, tx, value.Metric, v)
+			if err != nil {
+				return BatchValues{}, false, err
+			}
+			values.Histograms[value.Metric] = merged
+			updates = append(updates, Update{Metric: value.Metric, MType: "histogram", Value: float64(merged.Count), Histogram: &merged, Timestamp: now})
+			continue
+		}
+		if _, ok := counters[value.Metric]; !ok {
+			counterOrder = append(counterOrder, value.Metric)
+		}
+		counters[value.Metric] += delta
+	}
+
+	gaugeRows := make([][]any, 0, len(gaugeOrder))
+	for _, metric := range gaugeOrder {
+		gaugeRows = append(gaugeRows, []any{metric, gauges[metric]})
+	}
+	storedGauges, err := upsertRows(ctx, tx, `INSERT INTO gauge (metric, val) VALUES %s
+       ON CONFLICT (metric) DO UPDATE SET val = EXCLUDED.val
+       RETURNING metric, val`, gaugeRows, func(rows *sql.Rows) (metrics.Metric, any, error) {
+		var metric metrics.Metric
+		var val float64
+		err := rows.Scan(&metric, &val)
+		return metric, val, err
+	})
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+
+	counterRows := make([][]any, 0, len(counterOrder))
+	for _, metric := range counterOrder {
+		counterRows = append(counterRows, []any{metric, counters[metric]})
+	}
+	storedCounters, err := upsertRows(ctx, tx, `INSERT INTO counter (metric, val) VALUES %s
+       ON CONFLICT (metric) DO UPDATE SET val = counter.val + EXCLUDED.val
+       RETURNING metric, val`, counterRows, func(rows *sql.Rows) (metrics.Metric, any, error) {
+		var metric metrics.Metric
+		var val int64
+		err := rows.Scan(&metric, &val)
+		return metric, val, err
+	})
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+
+	// The history gets the stored values, so the samples of a counter are its accumulated values.
+	gaugeHistory := make([][]any, 0, len(gaugeOrder))
+	for _, metric := range gaugeOrder {
+		val := storedGauges[metric].(float64)
+		gaugeHistory = append(gaugeHistory, []any{metric, val, now})
+		values.Gauges[metric] = metrics.Gauge(val)
+		updates = append(updates, Update{Metric: metric, MType: "gauge", Value: val, Timestamp: now})
+	}
+	err = insertRows(ctx, tx, `INSERT INTO gauge_history (metric, val, ts) VALUES %s`, gaugeHistory)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	// All the values of a gauge in the batch are added to its rollups, not only the stored last one.
+	if len(gaugeOrder) > 0 {
+		err = ss.pruneRollups(ctx, tx, now)
+		if err != nil {
+			return BatchValues{}, false, err
+		}
+	}
+	rollupRows := make([][]any, 0, len(gaugeOrder)*len(ss.rollupWindows))
+	for _, metric := range gaugeOrder {
+		rollupRows = append(rollupRows, ss.rollupRows(metric, gaugeValues[metric], now)...)
+	}
+	err = insertRows(ctx, tx, ss.rollupQuery(), rollupRows)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	counterHistory := make([][]any, 0, len(counterOrder))
+	for _, metric := range counterOrder {
+		val := storedCounters[metric].(int64)
+		counterHistory = append(counterHistory, []any{metric, val, now})
+		values.Counters[metric] = metrics.Counter(val)
+		updates = append(updates, Update{Metric: metric, MType: "counter", Value: float64(val), Timestamp: now})
+	}
+	err = insertRows(ctx, tx, `INSERT INTO counter_history (metric, val, ts) VALUES %s`, counterHistory)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	err = ss.pruneHistory(ctx, tx, now)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	for _, update := range updates {
+		ss.notify(update)
+	}
+
+	return values, true, conflictErr
+}
+
+// loadBatchValues loads the stored values of the metrics of the batch in the transaction. The values of a type
+// are selected from the table of the type by one statement for every maxBatchRows metrics.
+func (ss *SQLStorage) loadBatchValues(ctx context.Context, tx *sql.Tx, batch []MetricValue) (BatchValues, error) {
+	type typedMetric struct {
+		mType  string
+		metric metrics.Metric
+	}
+	keys := map[string][]any{}
+	seen := map[typedMetric]bool{}
+	for _, value := range batch {
+		mType := valueType(value.Value)
+		if !seen[typedMetric{mType: mType, metric: value.Metric}] {
+			seen[typedMetric{mType: mType, metric: value.Metric}] = true
+			keys[mType] = append(keys[mType], value.Metric)
+		}
+	}
+
+	values := newBatchValues()
+	for _, mType := range []string{"gauge", "counter", "histogram"} {
+		for start := 0; start < len(keys[mType]); start += maxBatchRows {
+			end := start + maxBatchRows
+			if end > len(keys[mType]) {
+				end = len(keys[mType])
+			}
+			err := ss.loadValues(ctx, tx, mType, keys[mType][start:end], values)
+			if err != nil {
+				return BatchValues{}, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// loadValues adds the values of the metrics stored in the table of the type to values.
+func (ss *SQLStorage) loadValues(ctx context.Context, tx *sql.Tx, mType string, keys []any, values BatchValues) error {
+	rows, err := tx.QueryContext(ctx, `SELECT metric, val FROM `+mType+` WHERE metric IN (`+placeholders(len(keys))+`)`, keys...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var metric metrics.Metric
+		switch mType {
+		case "gauge":
+			var val metrics.Gauge
+			err = rows.Scan(&metric, &val)
+			values.Gauges[metric] = val
+		case "counter":
+			var val metrics.Counter
+			err = rows.Scan(&metric, &val)
+			values.Counters[metric] = val
+		case "histogram":
+			var val sql.NullString
+			err = rows.Scan(&metric, &val)
+			if err == nil && val.Valid {
+				var histogram metrics.Histogram
+				err = json.Unmarshal([]byte(val.String), &histogram)
+				values.Histograms[metric] = histogram
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// declaredTypes loads the types declared for the names of the batch in table 'metric_metadata' and returns
+// the declared type of a name, an empty string for an undeclared name, as needed by filterDeclared.
+func (ss *SQLStorage) declaredTypes(ctx context.Context, tx *sql.Tx, batch []MetricValue) (func(name string) string, error) {
+	names := make([]any, 0, len(batch))
+	seen := map[string]bool{}
+	for _, value := range batch {
+		name := metrics.SeriesName(value.Metric)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	declared := map[string]string{}
+	for start := 0; start < len(names); start += maxBatchRows {
+		end := start + maxBatchRows
+		if end > len(names) {
+			end = len(names)
+		}
+		err := ss.loadDeclared(ctx, tx, names[start:end], declared)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(name string) string { return declared[name] }, nil
+}
+
+// loadDeclared adds the types declared for the names in table 'metric_metadata' to declared.
+func (ss *SQLStorage) loadDeclared(ctx context.Context, tx *sql.Tx, names []any, declared map[string]string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT name, mtype FROM metric_metadata WHERE name IN (`+placeholders(len(names))+`)`, names...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, mType string
+		err = rows.Scan(&name, &mType)
 		if err != nil {
 			return err
 		}
+		declared[name] = mType
+	}
+	return rows.Err()
+}
+
+// RegisterMetadataContext declares the metadata of metrics by name in a single transaction.
+// The declared rows are locked first, so concurrent declarations of a name with different types do not both succeed.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metadata: The metadata to declare.
+//
+// Returns:
+//   - An error if the metadata is invalid, ErrTypeConflict if it conflicts with the declared types,
+//     or an error if a query fails or the context is canceled.
+func (ss *SQLStorage) RegisterMetadataContext(ctx context.Context, metadata []metrics.Metadata) error {
+	for _, m := range metadata {
+		err := m.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	declared := map[string]string{}
+	for _, m := range metadata {
+		if _, ok := declared[m.Name]; ok {
+			continue
+		}
+		var mType string
+		err = tx.QueryRowContext(ctx, `SELECT mtype FROM metric_metadata WHERE name = $1`+ss.forUpdate(), m.Name).Scan(&mType)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		declared[m.Name] = mType
+	}
+	err = validateMetadata(metadata, func(name string) string { return declared[name] })
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metadata {
+		_, err = tx.ExecContext(ctx, `INSERT INTO metric_metadata (name, mtype, unit, help) VALUES ($1, $2, $3, $4)
+       ON CONFLICT (name) DO UPDATE SET mtype = EXCLUDED.mtype, unit = EXCLUDED.unit, help = EXCLUDED.help`,
+			m.Name, m.MType, m.Unit, m.Help)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteMetadataContext removes the declarations of the names from table 'metric_metadata'.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - names: The names whose declarations are removed.
+//
+// Returns:
+//   - An error if a query fails or the context is canceled.
+func (ss *SQLStorage) DeleteMetadataContext(ctx context.Context, names []string) error {
+	for start := 0; start < len(names); start += maxBatchRows {
+		end := start + maxBatchRows
+		if end > len(names) {
+			end = len(names)
+		}
+		placeholders := make([]string, 0, end-start)
+		args := make([]any, 0, end-start)
+		for i, name := range names[start:end] {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+			args = append(args, name)
+		}
+		_, err := ss.DB.ExecContext(ctx, `DELETE FROM metric_metadata WHERE name IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadMetadataContext retrieves the declared metadata from table 'metric_metadata'.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//
+// Returns:
+//   - A Result containing map[string]metrics.Metadata by name and any associated error.
+func (ss *SQLStorage) LoadMetadataContext(ctx context.Context) Result {
+	rows, err := ss.DB.QueryContext(ctx, `SELECT name, mtype, unit, help FROM metric_metadata`)
+	if err != nil {
+		return Result{Value: nil, Err: err}
+	}
+	defer rows.Close()
+
+	metadata := map[string]metrics.Metadata{}
+	for rows.Next() {
+		var m metrics.Metadata
+		err = rows.Scan(&m.Name, &m.MType, &m.Unit, &m.Help)
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		metadata[m.Name] = m
+	}
+
+	if rows.Err() != nil {
+		return Result{Value: nil, Err: rows.Err()}
+	}
+	return Result{Value: metadata, Err: nil}
+}
+
+// rollupRows returns the rows of table 'gauge_rollup_bucket' with the sub-buckets of the rolling rollups
+// of the values of the gauge stored at the moment.
+func (ss *SQLStorage) rollupRows(metric metrics.Metric, values []metrics.Gauge, now time.Time) [][]any {
+	rows := make([][]any, 0, len(ss.rollupWindows))
+	for _, window := range ss.rollupWindows {
+		var rollup metrics.Rollup
+		for _, value := range values {
+			rollup = rollup.Observe(value, now, metrics.RollupBucket(window))
+		}
+		rows = append(rows, []any{metric, window.String(), ss.timestamp(rollup.Start), float64(rollup.Min), float64(rollup.Max),
+			rollup.Sum, rollup.Count, float64(rollup.Last)})
+	}
+	return rows
+}
+
+// pruneRollups deletes the sub-buckets of table 'gauge_rollup_bucket' which are out of their windows at the moment.
+func (ss *SQLStorage) pruneRollups(ctx context.Context, tx *sql.Tx, now time.Time) error {
+	for _, window := range ss.rollupWindows {
+		_, err := tx.ExecContext(ctx, `DELETE FROM gauge_rollup_bucket WHERE win = $1 AND start <= $2`,
+			window.String(), ss.timestamp(now.Truncate(metrics.RollupBucket(window)).Add(-window)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneHistory deletes the samples of tables 'gauge_history' and 'counter_history' older than historyRetention
+// at the moment, it is done at most once a minute.
+func (ss *SQLStorage) pruneHistory(ctx context.Context, tx *sql.Tx, now time.Time) error {
+	if !ss.pruneDue(&ss.historyPruned, now) {
 		return nil
-	default:
-		return errNotExpectedType
 	}
+	for _, table := range []string{"gauge_history", "counter_history"} {
+		_, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE ts < $1`, now.Add(-historyRetention))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedByMetric returns a copy of the batch sorted by metric, the values of a metric keep their order in the batch.
+func sortedByMetric(batch []MetricValue) []MetricValue {
+	sorted := make([]MetricValue, len(batch))
+	copy(sorted, batch)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Metric < sorted[j].Metric })
+	return sorted
+}
+
+// toFloat64 converts a gauge value of the batch to float64.
+func toFloat64(value any) float64 {
+	if gauge, ok := value.(metrics.Gauge); ok {
+		return float64(gauge)
+	}
+	return value.(float64)
+}
+
+// multiRow returns the multi-row statement for the rows and its arguments. The query has a single %s verb
+// which is replaced with the VALUES list, e.g. "($1, $2), ($3, $4)".
+func multiRow(query string, rows [][]any) (string, []any) {
+	var values strings.Builder
+	args := make([]any, 0, len(rows)*len(rows[0]))
+	for i, row := range rows {
+		if i > 0 {
+			values.WriteString(", ")
+		}
+		values.WriteByte('(')
+		for j, column := range row {
+			if j > 0 {
+				values.WriteString(", ")
+			}
+			args = append(args, column)
+			fmt.Fprintf(&values, "$%d", len(args))
+		}
+		values.WriteByte(')')
+	}
+	return fmt.Sprintf(query, values.String()), args
+}
+
+// placeholders returns the list of n placeholders of the arguments of a statement, "$1, $2, ..., $n".
+func placeholders(n int) string {
+	list := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		list = append(list, fmt.Sprintf("$%d", i+1))
+	}
+	return strings.Join(list, ", ")
+}
+
+// insertRows executes the multi-row statement for the rows in chunks of maxBatchRows rows.
+// The statement has a single %s verb for the VALUES list.
+func insertRows(ctx context.Context, tx *sql.Tx, query string, rows [][]any) error {
+	for start := 0; start < len(rows); start += maxBatchRows {
+		end := start + maxBatchRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+		statement, args := multiRow(query, rows[start:end])
+		_, err := tx.ExecContext(ctx, statement, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertRows executes the multi-row statement returning the stored values for the rows in chunks of maxBatchRows rows
+// and returns the values scanned by scan by metric. The statement has a single %s verb for the VALUES list.
+func upsertRows(ctx context.Context, tx *sql.Tx, query string, rows [][]any,
+	scan func(rows *sql.Rows) (metrics.Metric, any, error)) (map[metrics.Metric]any, error) {
+	stored := map[metrics.Metric]any{}
+	for start := 0; start < len(rows); start += maxBatchRows {
+		end := start + maxBatchRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+		statement, args := multiRow(query, rows[start:end])
+		result, err := tx.QueryContext(ctx, statement, args...)
+		if err != nil {
+			return nil, err
+		}
+		for result.Next() {
+			metric, val, err := scan(result)
+			if err != nil {
+				result.Close()
+				return nil, err
+			}
+			stored[metric] = val
+		}
+		err = result.Err()
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
 }
 
 // LoadContext retrieves the value of a specific metric associated with the provided metric type and key from the storage.
@@ -117,7 +952,7 @@ func (ss *SQLStorage) StoreContext(ctx context.Context, metric metrics.Metric, m
 //
 // Parameters:
 //   - ctx: The context in which the operation should be performed.
-//   - metricType: The type of metric to load ("gauge" or "counter").
+//   - metricType: The type of metric to load ("gauge", "counter" or "histogram").
 //   - metric: The metric key associated with the value to be retrieved.
 //
 // Returns:
@@ -139,11 +974,67 @@ func (ss *SQLStorage) LoadContext(ctx context.Context, metricType string, metric
 			return Result{Value: nil, Err: errors.New("no such metric")}
 		}
 		return Result{Value: valueCounter, Err: nil}
+	} else if metricType == "histogram" {
+		var val sql.NullString
+		row := ss.DB.QueryRowContext(ctx, `SELECT val FROM histogram WHERE histogram.metric = $1`, metric)
+		err := row.Scan(&val)
+		if err != nil || !val.Valid {
+			return Result{Value: nil, Err: errors.New("no such metric")}
+		}
+		var valueHistogram metrics.Histogram
+		err = json.Unmarshal([]byte(val.String), &valueHistogram)
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		return Result{Value: valueHistogram, Err: nil}
 	} else {
 		return Result{Value: nil, Err: errors.New("no such metric")}
 	}
 }
 
+// LoadRollupContext retrieves the statistics of a gauge over the trailing window merged from the sub-buckets
+// of table 'gauge_rollup_bucket', see metrics.RollingRollup.Over.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metric: The metric key of the gauge.
+//   - window: The window of the rollup, one of the windows of the storage.
+//
+// Returns:
+//   - A Result containing metrics.Rollup and any associated error.
+func (ss *SQLStorage) LoadRollupContext(ctx context.Context, metric metrics.Metric, window time.Duration) Result {
+	if !hasWindow(ss.rollupWindows, window) {
+		return Result{Value: nil, Err: errNoSuchRollup}
+	}
+
+	now := time.Now()
+	rows, err := ss.DB.QueryContext(ctx, `SELECT start, min, max, sum, count, last FROM gauge_rollup_bucket
+       WHERE metric = $1 AND win = $2 AND start > $3 ORDER BY start`, metric, window.String(), ss.timestamp(now.Add(-2*window)))
+	if err != nil {
+		return Result{Value: nil, Err: err}
+	}
+	defer rows.Close()
+
+	var rolling metrics.RollingRollup
+	for rows.Next() {
+		var bucket metrics.Rollup
+		err = rows.Scan(&bucket.Start, &bucket.Min, &bucket.Max, &bucket.Sum, &bucket.Count, &bucket.Last)
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		rolling.Buckets = append(rolling.Buckets, bucket)
+	}
+	if rows.Err() != nil {
+		return Result{Value: nil, Err: rows.Err()}
+	}
+
+	rollup, ok := rolling.Over(now, window)
+	if !ok {
+		return Result{Value: nil, Err: ErrNoSuchMetric}
+	}
+	return Result{Value: rollup, Err: nil}
+}
+
 // LoadDataGaugeContext retrieves a copy of the data stored in the gauge metrics of the storage.
 // It operates within the provided context, allowing for cancellation and timeout management.
 //
@@ -209,3 +1100,136 @@ func (ss *SQLStorage) LoadDataCounterContext(ctx context.Context) Result {
 	}
 	return Result{Value: copyDataCounter, Err: nil}
 }
+
+// LoadDataHistogramContext retrieves a copy of the data stored in the histogram metrics of the storage.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//
+// Returns:
+//   - A Result containing the retrieved copy of histogram metric data and any associated error.
+func (ss *SQLStorage) LoadDataHistogramContext(ctx context.Context) Result {
+	rowsHistogram, err := ss.DB.QueryContext(ctx, `SELECT metric, val FROM histogram WHERE val IS NOT NULL`)
+	copyDataHistogram := make(map[metrics.Metric]metrics.Histogram)
+	if err != nil {
+		return Result{Value: nil, Err: err}
+	}
+	defer rowsHistogram.Close()
+
+	for rowsHistogram.Next() {
+		var metric metrics.Metric
+		var val string
+
+		err = rowsHistogram.Scan(&metric, &val)
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		var histogram metrics.Histogram
+		err = json.Unmarshal([]byte(val), &histogram)
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		copyDataHistogram[metric] = histogram
+	}
+
+	if rowsHistogram.Err() != nil {
+		return Result{Value: nil, Err: rowsHistogram.Err()}
+	}
+	return Result{Value: copyDataHistogram, Err: nil}
+}
+
+// LoadRangeContext retrieves the samples of a specific metric stored between from and to inclusive.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metricType: The type of metric to load ("gauge" or "counter").
+//   - metric: The metric key associated with the samples to be retrieved.
+//   - from: The beginning of the time range.
+//   - to: The end of the time range.
+//   - step: The resolution of the result. Only the latest sample of every step is returned,
+//     step = 0 means returning all samples.
+//
+// Returns:
+//   - A Result containing []metrics.GaugeSample or []metrics.CounterSample and any associated error.
+//     ErrNoSuchMetric if the metric has no samples at all, an empty slice if it has none in the range.
+func (ss *SQLStorage) LoadRangeContext(ctx context.Context, metricType string, metric metrics.Metric, from, to time.Time, step time.Duration) Result {
+	if to.Before(from) {
+		return Result{Value: nil, Err: errInvalidRange}
+	}
+
+	if metricType == "gauge" {
+		rows, err := ss.DB.QueryContext(ctx, `SELECT val, ts FROM gauge_history
+			WHERE metric = $1 AND ts >= $2 AND ts <= $3 ORDER BY ts`, metric, ss.timestamp(from), ss.timestamp(to))
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		defer rows.Close()
+
+		samples := make([]metrics.GaugeSample, 0)
+		for rows.Next() {
+			var sample metrics.GaugeSample
+			err = rows.Scan(&sample.Value, &sample.Timestamp)
+			if err != nil {
+				return Result{Value: nil, Err: err}
+			}
+			samples = append(samples, sample)
+		}
+		if rows.Err() != nil {
+			return Result{Value: nil, Err: rows.Err()}
+		}
+		if len(samples) == 0 {
+			err = ss.checkHistory(ctx, "gauge_history", metric)
+			if err != nil {
+				return Result{Value: nil, Err: err}
+			}
+		}
+		samples = downsample(samples, func(sample metrics.GaugeSample) time.Time { return sample.Timestamp }, from, step)
+		return Result{Value: samples, Err: nil}
+	} else if metricType == "counter" {
+		rows, err := ss.DB.QueryContext(ctx, `SELECT val, ts FROM counter_history
+			WHERE metric = $1 AND ts >= $2 AND ts <= $3 ORDER BY ts`, metric, ss.timestamp(from), ss.timestamp(to))
+		if err != nil {
+			return Result{Value: nil, Err: err}
+		}
+		defer rows.Close()
+
+		samples := make([]metrics.CounterSample, 0)
+		for rows.Next() {
+			var sample metrics.CounterSample
+			err = rows.Scan(&sample.Value, &sample.Timestamp)
+			if err != nil {
+				return Result{Value: nil, Err: err}
+			}
+			samples = append(samples, sample)
+		}
+		if rows.Err() != nil {
+			return Result{Value: nil, Err: rows.Err()}
+		}
+		if len(samples) == 0 {
+			err = ss.checkHistory(ctx, "counter_history", metric)
+			if err != nil {
+				return Result{Value: nil, Err: err}
+			}
+		}
+		samples = downsample(samples, func(sample metrics.CounterSample) time.Time { return sample.Timestamp }, from, step)
+		return Result{Value: samples, Err: nil}
+	} else {
+		return Result{Value: nil, Err: ErrNoSuchMetric}
+	}
+}
+
+// checkHistory returns ErrNoSuchMetric if the history table has no samples of the metric,
+// so an unknown series is told from a series without samples in the range, like by MyStorage.
+func (ss *SQLStorage) checkHistory(ctx context.Context, table string, metric metrics.Metric) error {
+	var exists bool
+	err := ss.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+table+` WHERE metric = $1)`, metric).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoSuchMetric
+	}
+	return nil
+}
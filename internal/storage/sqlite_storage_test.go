@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func newTestSQLiteStorage(t *testing.T) *SQLStorage {
+	sqlitePath, ok := SQLitePath(SQLiteScheme + path.Join(t.TempDir(), "metrics.db"))
+	require.True(t, ok)
+	db, err := sql.Open("sqlite", sqlitePath)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	storage := NewSQLiteStorage(db)
+	require.NoError(t, storage.CreateTables())
+	// The tables are created again on every start of the server.
+	require.NoError(t, storage.CreateTables())
+	return storage
+}
+
+func TestSQLiteStorage_Store(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1.5)))
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(2)))
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(3)))
+	require.NoError(t, storage.StoreContext(ctx, "Total", metrics.CounterTotal(10)))
+	require.NoError(t, storage.StoreContext(ctx, "Total", metrics.CounterTotal(4)))
+	histogram := metrics.NewHistogram([]float64{1, 10})
+	histogram.Observe(5)
+	require.NoError(t, storage.StoreContext(ctx, "Latency", histogram))
+	require.NoError(t, storage.StoreContext(ctx, "Latency", histogram))
+
+	res := storage.LoadContext(ctx, "gauge", "Alloc")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Gauge(1.5), res.Value)
+	res = storage.LoadContext(ctx, "counter", "PollCount")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Counter(5), res.Value)
+	// The total is reset, the whole new total is added.
+	res = storage.LoadContext(ctx, "counter", "Total")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Counter(14), res.Value)
+	res = storage.LoadContext(ctx, "histogram", "Latency")
+	require.NoError(t, res.Err)
+	require.Equal(t, uint64(2), res.Value.(metrics.Histogram).Count)
+	res = storage.LoadContext(ctx, "gauge", "Unknown")
+	require.Error(t, res.Err)
+
+	now := time.Now()
+	res = storage.LoadRangeContext(ctx, "counter", "PollCount", now.Add(-time.Minute), now, 0)
+	require.NoError(t, res.Err)
+	samples := res.Value.([]metrics.CounterSample)
+	require.Len(t, samples, 2)
+	require.Equal(t, metrics.Counter(5), samples[1].Value)
+
+	res = storage.LoadRollupContext(ctx, "Alloc", time.Minute)
+	require.NoError(t, res.Err)
+	require.Equal(t, int64(1), res.Value.(metrics.Rollup).Count)
+}
+
+func TestSQLiteStorage_StoreBatch(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+
+	histogram := metrics.NewHistogram([]float64{1, 10})
+	histogram.Observe(5)
+	batch := []MetricValue{
+		{Metric: "Alloc", Value: metrics.Gauge(1)},
+		{Metric: "PollCount", Value: metrics.Counter(2)},
+		{Metric: "Alloc", Value: metrics.Gauge(3)},
+		{Metric: "PollCount", Value: metrics.Counter(5)},
+		{Metric: "Latency", Value: histogram},
+	}
+	values, applied, err := storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.True(t, applied)
+	require.Equal(t, map[metrics.Metric]metrics.Gauge{"Alloc": 3}, values.Gauges)
+	require.Equal(t, map[metrics.Metric]metrics.Counter{"PollCount": 7}, values.Counters)
+	require.Equal(t, uint64(1), values.Histograms["Latency"].Count)
+	values, applied, err = storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.False(t, applied)
+	require.Equal(t, map[metrics.Metric]metrics.Gauge{"Alloc": 3}, values.Gauges)
+	require.Equal(t, map[metrics.Metric]metrics.Counter{"PollCount": 7}, values.Counters)
+	require.Equal(t, uint64(1), values.Load("histogram", "Latency").Value.(metrics.Histogram).Count)
+
+	res := storage.LoadDataGaugeContext(ctx)
+	require.NoError(t, res.Err)
+	require.Equal(t, map[metrics.Metric]metrics.Gauge{"Alloc": 3}, res.Value)
+	res = storage.LoadDataCounterContext(ctx)
+	require.NoError(t, res.Err)
+	require.Equal(t, map[metrics.Metric]metrics.Counter{"PollCount": 7}, res.Value)
+
+	res = storage.LoadRollupContext(ctx, "Alloc", time.Minute)
+	require.NoError(t, res.Err)
+	rollup := res.Value.(metrics.Rollup)
+	require.Equal(t, metrics.Gauge(1), rollup.Min)
+	require.Equal(t, metrics.Gauge(3), rollup.Max)
+	require.Equal(t, int64(2), rollup.Count)
+}
+
+func TestSQLiteStorage_StoreBatchKeys(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+	batch := []MetricValue{{Metric: "PollCount", Value: metrics.Counter(1)}}
+
+	_, _, err := storage.StoreBatchContext(ctx, strings.Repeat("k", maxBatchKeyLength+1), batch)
+	require.ErrorIs(t, err, ErrInvalidBatchKey)
+
+	// The keys older than the latest maxBatchKeys ones are deleted.
+	insertKeys := func(prefix string, n int, remembered time.Time) {
+		_, err := storage.DB.ExecContext(ctx, `
+			WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < $1)
+			INSERT INTO batch_keys (key, remembered_at) SELECT $2 || i, $3 FROM n`,
+			n, prefix, storage.timestamp(remembered))
+		require.NoError(t, err)
+	}
+	insertKeys("old-", 10, time.Now().Add(-2*time.Hour))
+	insertKeys("new-", maxBatchKeys, time.Now().Add(-time.Hour))
+	_, applied, err := storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.True(t, applied)
+	var count int
+	require.NoError(t, storage.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM batch_keys WHERE key LIKE 'old-%'`).Scan(&count))
+	require.Zero(t, count)
+	_, applied, err = storage.StoreBatchContext(ctx, "new-1", batch)
+	require.NoError(t, err)
+	require.False(t, applied)
+}
+
+func TestSQLiteStorage_PruneHistory(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+	expired := storage.timestamp(time.Now().Add(-historyRetention - time.Minute))
+	_, err := storage.DB.ExecContext(ctx, `INSERT INTO gauge_history (metric, val, ts) VALUES ('Alloc', 1, $1), ('Idle', 2, $1)`, expired)
+	require.NoError(t, err)
+	_, err = storage.DB.ExecContext(ctx, `INSERT INTO counter_history (metric, val, ts) VALUES ('PollCount', 1, $1)`, expired)
+	require.NoError(t, err)
+
+	// The expired samples of every metric are deleted, the new ones are kept.
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(3)))
+	count := func(table string) int {
+		var n int
+		require.NoError(t, storage.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table).Scan(&n))
+		return n
+	}
+	require.Equal(t, 1, count("gauge_history"))
+	require.Equal(t, 0, count("counter_history"))
+
+	// The history is pruned at most once a minute.
+	_, err = storage.DB.ExecContext(ctx, `INSERT INTO counter_history (metric, val, ts) VALUES ('PollCount', 1, $1)`, expired)
+	require.NoError(t, err)
+	_, _, err = storage.StoreBatchContext(ctx, "", []MetricValue{{Metric: "PollCount", Value: metrics.Counter(1)}})
+	require.NoError(t, err)
+	require.Equal(t, 2, count("counter_history"))
+	storage.historyPruned = time.Time{}
+	_, _, err = storage.StoreBatchContext(ctx, "", []MetricValue{{Metric: "PollCount", Value: metrics.Counter(1)}})
+	require.NoError(t, err)
+	require.Equal(t, 2, count("counter_history"))
+}
+
+func TestSQLiteStorage_LoadRange(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1)))
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(1)))
+	now := time.Now()
+
+	res := storage.LoadRangeContext(ctx, "gauge", "Alloc", now.Add(-time.Minute), now.Add(time.Minute), 0)
+	require.NoError(t, res.Err)
+	require.Len(t, res.Value, 1)
+
+	// A series without samples in the range is told from an unknown series, like by MyStorage.
+	res = storage.LoadRangeContext(ctx, "counter", "PollCount", now.Add(-time.Hour), now.Add(-time.Minute), 0)
+	require.NoError(t, res.Err)
+	require.Empty(t, res.Value)
+	res = storage.LoadRangeContext(ctx, "counter", "Alloc", now.Add(-time.Minute), now.Add(time.Minute), 0)
+	require.ErrorIs(t, res.Err, ErrNoSuchMetric)
+	res = storage.LoadRangeContext(ctx, "histogram", "Alloc", now.Add(-time.Minute), now.Add(time.Minute), 0)
+	require.ErrorIs(t, res.Err, ErrNoSuchMetric)
+}
+
+func TestSQLiteStorage_Migrate(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+
+	// The migrations have been applied by CreateTables.
+	applied, err := storage.Migrate(ctx)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+
+	migrations, err := storage.Migrations()
+	require.NoError(t, err)
+	statuses, err := storage.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, len(migrations))
+	for _, status := range statuses {
+		require.NotNil(t, status.Applied, status.Name)
+	}
+
+	// A failed migration is not recorded and is applied again.
+	_, err = storage.DB.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migrations[len(migrations)-1].Version)
+	require.NoError(t, err)
+	statuses, err = storage.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.Nil(t, statuses[len(statuses)-1].Applied)
+	applied, err = storage.Migrate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, migrations[len(migrations)-1:], applied)
+}
+
+func TestSQLiteStorage_MigrateConcurrently(t *testing.T) {
+	sqlitePath := path.Join(t.TempDir(), "metrics.db")
+	ctx := context.Background()
+
+	// The storages have their own databases on the same file, as the servers started together.
+	storages := make([]*SQLStorage, 4)
+	for i := range storages {
+		db, err := sql.Open("sqlite", sqlitePath)
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		storages[i] = NewSQLiteStorage(db)
+	}
+
+	var wg sync.WaitGroup
+	applied := make([][]Migration, len(storages))
+	errs := make([]error, len(storages))
+	for i, storage := range storages {
+		wg.Add(1)
+		go func(i int, storage *SQLStorage) {
+			defer wg.Done()
+			applied[i], errs[i] = storage.Migrate(ctx)
+		}(i, storage)
+	}
+	wg.Wait()
+
+	migrations, err := storages[0].Migrations()
+	require.NoError(t, err)
+	total := 0
+	for i := range storages {
+		require.NoError(t, errs[i])
+		total += len(applied[i])
+	}
+	require.Equal(t, len(migrations), total)
+}
+
+func TestSQLiteStorage_Metadata(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	ctx := context.Background()
+
+	alloc := metrics.Metadata{Name: "Alloc", MType: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects."}
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{alloc, {Name: "PollCount", MType: "counter"}}))
+	err := storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "Frees", MType: "counter"}, {Name: "Alloc", MType: "counter"}})
+	require.ErrorIs(t, err, ErrTypeConflict)
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "PollCount", MType: "counter", Help: "Number of polls."}}))
+
+	res := storage.LoadMetadataContext(ctx)
+	require.NoError(t, res.Err)
+	require.Equal(t, map[string]metrics.Metadata{
+		"Alloc":     alloc,
+		"PollCount": {Name: "PollCount", MType: "counter", Help: "Number of polls."},
+	}, res.Value)
+
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1)))
+	require.ErrorIs(t, storage.StoreContext(ctx, "Alloc", metrics.Counter(1)), ErrTypeConflict)
+	require.ErrorIs(t, storage.StoreContext(ctx, "PollCount", metrics.NewHistogram([]float64{1})), ErrTypeConflict)
+	_, applied, err := storage.StoreBatchContext(ctx, "batch-1", []MetricValue{
+		{Metric: "Frees", Value: metrics.Counter(1)},
+		{Metric: metrics.SeriesKey("Alloc", "host1", nil), Value: metrics.Counter(1)},
+	})
+	// Only the conflicting value is dropped and the batch is remembered.
+	require.ErrorIs(t, err, ErrTypeConflict)
+	require.True(t, applied)
+	res = storage.LoadContext(ctx, "counter", "Frees")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Counter(1), res.Value)
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-1", []MetricValue{{Metric: "Frees", Value: metrics.Counter(1)}})
+	require.NoError(t, err)
+	require.False(t, applied)
+
+	// A deleted declaration can be declared again with another type.
+	require.NoError(t, storage.DeleteMetadataContext(ctx, []string{"Alloc"}))
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "Alloc", MType: "counter"}}))
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Counter(1)))
+}
+
+func TestSortedByMetric(t *testing.T) {
+	batch := []MetricValue{
+		{Metric: "b", Value: metrics.CounterTotal(10)},
+		{Metric: "a", Value: metrics.Gauge(1)},
+		{Metric: "b", Value: metrics.CounterTotal(15)},
+		{Metric: "a", Value: metrics.Gauge(2)},
+	}
+	require.Equal(t, []MetricValue{
+		{Metric: "a", Value: metrics.Gauge(1)},
+		{Metric: "a", Value: metrics.Gauge(2)},
+		{Metric: "b", Value: metrics.CounterTotal(10)},
+		{Metric: "b", Value: metrics.CounterTotal(15)},
+	}, sortedByMetric(batch))
+	require.Equal(t, metrics.Metric("b"), batch[0].Metric)
+}
@@ -1,12 +1,15 @@
 // Package storage provides functionalities for keeping data on server
-// this package have two types of storage:
+// this package have three types of storage:
 // - MyStorage that keeps data in map and periodically saves it to file
 // - SQLStorage that keeps data as SQL database
+// - WALStorage that keeps data in map and writes every update to a write-ahead log with periodic snapshots
 package storage
 
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/luckyseadog/go-dev/internal/metrics"
@@ -16,10 +19,28 @@ import (
 var (
 	ErrNotMyStorage    = errors.New("database is not of the type MyStorage")
 	ErrNotSQLStorage   = errors.New("database is not of the type SQLStorage")
+	ErrTypeConflict    = errors.New("metric is declared with another type")
+	ErrInvalidBatchKey = errors.New("idempotency key is too long")
+	ErrNoSuchMetric    = errors.New("no such metric")
 	errNotExpectedType = errors.New("not expected type")
-	errNoSuchMetric    = errors.New("no such metric")
+	errInvalidRange    = errors.New("invalid time range")
+	errNoSuchRollup    = errors.New("no rollups for the window")
 )
 
+// historyRetention is how long MyStorage keeps samples of every metric.
+const historyRetention = 24 * time.Hour
+
+// batchKeyRetention is how long the idempotency keys of the applied batches are remembered.
+// It covers the default maximum age of the spool of the agent, so a batch replayed from the spool is recognized.
+const batchKeyRetention = 24 * time.Hour
+
+// maxBatchKeyLength is the maximum length in bytes of the idempotency key of a batch.
+const maxBatchKeyLength = 128
+
+// maxBatchKeys is how many idempotency keys are remembered at most. When there are more keys within
+// batchKeyRetention, the oldest ones are forgotten first.
+const maxBatchKeys = 100000
+
 // AutoSavingParams is a structure that holds parameters related to auto-saving data in the storage.
 type AutoSavingParams struct {
 	storageChan   chan struct{}
@@ -38,4 +59,194 @@ type Storage interface {
 	LoadContext(ctx context.Context, metricType string, metric metrics.Metric) Result
 	LoadDataGaugeContext(ctx context.Context) Result
 	LoadDataCounterContext(ctx context.Context) Result
+	LoadDataHistogramContext(ctx context.Context) Result
+	LoadRangeContext(ctx context.Context, metricType string, metric metrics.Metric, from, to time.Time, step time.Duration) Result
+	LoadRollupContext(ctx context.Context, metric metrics.Metric, window time.Duration) Result
+	Subscribe(observer Observer)
+
+	// StoreBatchContext stores the values of the batch atomically. A non-empty key is the idempotency key
+	// of the batch, it is remembered with the values; if the key is already remembered, the batch is a replay,
+	// it is not applied again and false is returned. The values of another type than the declared one are dropped,
+	// the other values are stored and the conflicts are reported by an error wrapping ErrTypeConflict.
+	// A key longer than 128 bytes is rejected with ErrInvalidBatchKey. The stored values of the metrics of the batch
+	// are returned as read with the batch applied, the current ones for a replay, so they need not be loaded again.
+	StoreBatchContext(ctx context.Context, key string, batch []MetricValue) (BatchValues, bool, error)
+
+	// RegisterMetadataContext declares the metadata of metrics by name. The type of a declared name can not be changed,
+	// such a declaration fails with ErrTypeConflict; the unit and the help are replaced. A value of another type
+	// than the declared one is rejected by StoreContext with ErrTypeConflict.
+	RegisterMetadataContext(ctx context.Context, metadata []metrics.Metadata) error
+	// DeleteMetadataContext removes the declarations of the names, so a name can be declared again with another type.
+	// Undeclared names are ignored.
+	DeleteMetadataContext(ctx context.Context, names []string) error
+	// LoadMetadataContext retrieves the declared metadata as map[string]metrics.Metadata by name.
+	LoadMetadataContext(ctx context.Context) Result
+}
+
+// MetricValue is a value of a batch stored by StoreBatchContext, the value has one of the types accepted by StoreContext.
+type MetricValue struct {
+	Metric metrics.Metric
+	Value  any
+}
+
+// BatchValues are the stored values of the metrics of a batch returned by StoreBatchContext, by metric key.
+// The values of every type of metric are those of the table of the type, a counter has its accumulated value.
+type BatchValues struct {
+	Gauges     map[metrics.Metric]metrics.Gauge
+	Counters   map[metrics.Metric]metrics.Counter
+	Histograms map[metrics.Metric]metrics.Histogram
+}
+
+// newBatchValues returns empty BatchValues to be filled by a storage.
+func newBatchValues() BatchValues {
+	return BatchValues{
+		Gauges:     map[metrics.Metric]metrics.Gauge{},
+		Counters:   map[metrics.Metric]metrics.Counter{},
+		Histograms: map[metrics.Metric]metrics.Histogram{},
+	}
+}
+
+// Load retrieves the stored value of a metric of the batch like Storage.LoadContext.
+//
+// Parameters:
+//   - metricType: The type of metric to load ("gauge", "counter" or "histogram").
+//   - metric: The metric key associated with the value to be retrieved.
+//
+// Returns:
+//   - A Result containing the value, ErrNoSuchMetric if the batch has no stored value of the metric.
+func (bv BatchValues) Load(metricType string, metric metrics.Metric) Result {
+	var value any
+	var ok bool
+	switch metricType {
+	case "gauge":
+		value, ok = bv.Gauges[metric]
+	case "counter":
+		value, ok = bv.Counters[metric]
+	case "histogram":
+		value, ok = bv.Histograms[metric]
+	}
+	if !ok {
+		return Result{Value: nil, Err: ErrNoSuchMetric}
+	}
+	return Result{Value: value, Err: nil}
+}
+
+// valueType returns the type of metric of a value accepted by StoreContext: "gauge", "counter" or "histogram".
+func valueType(value any) string {
+	switch value.(type) {
+	case metrics.Gauge, float64:
+		return "gauge"
+	case metrics.Counter, int64, metrics.CounterTotal:
+		return "counter"
+	case metrics.Histogram:
+		return "histogram"
+	default:
+		return ""
+	}
+}
+
+// filterDeclared returns the values of the batch whose type is the type declared for their name by the metadata,
+// undeclared names included, and an error wrapping ErrTypeConflict which lists the other values, nil if there are none.
+// declared returns the declared type of a name, an empty string for an undeclared name.
+func filterDeclared(batch []MetricValue, declared func(name string) string) ([]MetricValue, error) {
+	kept := batch[:0:0]
+	var conflicts []string
+	for _, value := range batch {
+		name := metrics.SeriesName(value.Metric)
+		if mType := declared(name); mType != "" && mType != valueType(value.Value) {
+			conflicts = append(conflicts, fmt.Sprintf("%s is declared %s, got %s", name, mType, valueType(value.Value)))
+			continue
+		}
+		kept = append(kept, value)
+	}
+	if len(conflicts) > 0 {
+		return kept, fmt.Errorf("%w: %s", ErrTypeConflict, strings.Join(conflicts, "; "))
+	}
+	return kept, nil
+}
+
+// validateMetadata checks the metadata and returns ErrTypeConflict if a name is already declared with another type,
+// see filterDeclared, or is declared with different types by the metadata itself.
+func validateMetadata(metadata []metrics.Metadata, declared func(name string) string) error {
+	requested := map[string]string{}
+	for _, m := range metadata {
+		err := m.Validate()
+		if err != nil {
+			return err
+		}
+		mType, ok := requested[m.Name]
+		if !ok {
+			mType = declared(m.Name)
+		}
+		if mType != "" && mType != m.MType {
+			return fmt.Errorf("%w: %s is declared %s, got %s", ErrTypeConflict, m.Name, mType, m.MType)
+		}
+		requested[m.Name] = m.MType
+	}
+	return nil
+}
+
+// defaultRollupWindows returns the windows of the gauge rollups kept by a new storage.
+func defaultRollupWindows() []time.Duration {
+	windows, _ := metrics.ParseRollupWindows(metrics.DefaultRollupWindows)
+	return windows
+}
+
+// hasWindow reports whether the window is one of the windows.
+func hasWindow(windows []time.Duration, window time.Duration) bool {
+	for _, w := range windows {
+		if w == window {
+			return true
+		}
+	}
+	return false
+}
+
+// validateValue checks that the value can be stored: it is a gauge, a counter or a valid histogram.
+func validateValue(value any) error {
+	switch value := value.(type) {
+	case metrics.Gauge, float64, metrics.Counter, int64, metrics.CounterTotal:
+		return nil
+	case metrics.Histogram:
+		return value.Validate()
+	default:
+		return errNotExpectedType
+	}
+}
+
+// validateBatch validates the idempotency key and the values of a batch before it is stored.
+func validateBatch(key string, batch []MetricValue) error {
+	if len(key) > maxBatchKeyLength {
+		return ErrInvalidBatchKey
+	}
+	for _, value := range batch {
+		err := validateValue(value.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downsample reduces samples to at most one per step-wide bucket counted from the moment from,
+// keeping the latest sample of every bucket. Samples have to be sorted by time.
+// If step is not positive, samples are returned as is.
+func downsample[T any](samples []T, timestamp func(T) time.Time, from time.Time, step time.Duration) []T {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	result := make([]T, 0)
+	lastBucket := int64(-1)
+	for _, sample := range samples {
+		bucket := int64(timestamp(sample).Sub(from) / step)
+		if bucket == lastBucket {
+			result[len(result)-1] = sample
+			continue
+		}
+		result = append(result, sample)
+		lastBucket = bucket
+	}
+
+	return result
 }
@@ -2,8 +2,12 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"os"
 	"path"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -158,6 +162,432 @@ func TestStorage_File(t *testing.T) {
 	res = storage.LoadContext(context.Background(), "counter", "Metric4")
 	require.Error(t, res.Err)
 
+	res = storage.LoadRangeContext(context.Background(), "gauge", "Metric4", time.Now().Add(-time.Hour), time.Now(), 0)
+	require.NoError(t, res.Err)
+	require.Len(t, res.Value, 1)
+
+}
+
+func TestStorage_Histogram(t *testing.T) {
+	storage := NewStorage(nil, time.Millisecond)
+	ctx := context.Background()
+
+	h := metrics.NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	err := storage.StoreContext(ctx, "latency", h)
+	require.NoError(t, err)
+
+	h = metrics.NewHistogram([]float64{0.1, 1})
+	h.Observe(5)
+	err = storage.StoreContext(ctx, "latency", h)
+	require.NoError(t, err)
+
+	res := storage.LoadContext(ctx, "histogram", "latency")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Histogram{Bounds: []float64{0.1, 1}, Counts: []uint64{1, 1, 1}, Sum: 5.55, Count: 3}, res.Value)
+
+	err = storage.StoreContext(ctx, "latency", metrics.Histogram{Bounds: []float64{1, 0.1}, Counts: []uint64{0, 0, 0}})
+	require.Error(t, err)
+
+	tmpDir := t.TempDir()
+	err = storage.SaveToFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+	storage = NewStorage(nil, time.Millisecond)
+	err = storage.LoadFromFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+
+	res = storage.LoadDataHistogramContext(ctx)
+	require.NoError(t, res.Err)
+	require.Equal(t, map[metrics.Metric]metrics.Histogram{
+		"latency": {Bounds: []float64{0.1, 1}, Counts: []uint64{1, 1, 1}, Sum: 5.55, Count: 3},
+	}, res.Value)
+
+	// Histograms with other buckets replace the stored one.
+	h = metrics.NewHistogram([]float64{10})
+	h.Observe(1)
+	err = storage.StoreContext(ctx, "latency", h)
+	require.NoError(t, err)
+	res = storage.LoadContext(ctx, "histogram", "latency")
+	require.NoError(t, res.Err)
+	require.Equal(t, h, res.Value)
+}
+
+func TestStorage_CounterTotal(t *testing.T) {
+	storage := NewStorage(nil, time.Millisecond)
+	ctx := context.Background()
+
+	// Totals are turned into increases, a repeated total adds nothing and a total going down is a reset.
+	for _, total := range []metrics.CounterTotal{10, 15, 15, 4} {
+		err := storage.StoreContext(ctx, "requests", total)
+		require.NoError(t, err)
+	}
+	err := storage.StoreContext(ctx, "requests", metrics.Counter(1))
+	require.NoError(t, err)
+
+	res := storage.LoadContext(ctx, "counter", "requests")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Counter(20), res.Value)
+
+	tmpDir := t.TempDir()
+	err = storage.SaveToFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+	storage = NewStorage(nil, time.Millisecond)
+	err = storage.LoadFromFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+
+	// The last total is restored, so the total sent again after the restart of the server is not counted twice.
+	err = storage.StoreContext(ctx, "requests", metrics.CounterTotal(6))
+	require.NoError(t, err)
+	res = storage.LoadContext(ctx, "counter", "requests")
+	require.NoError(t, res.Err)
+	require.Equal(t, metrics.Counter(22), res.Value)
+}
+
+func TestStorage_StoreBatch(t *testing.T) {
+	storage := NewStorage(nil, time.Millisecond)
+	ctx := context.Background()
+
+	batch := []MetricValue{
+		{Metric: "Alloc", Value: metrics.Gauge(1)},
+		{Metric: "PollCount", Value: metrics.Counter(2)},
+		{Metric: "Alloc", Value: metrics.Gauge(3)},
+		{Metric: "PollCount", Value: metrics.Counter(5)},
+	}
+	values, applied, err := storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.True(t, applied)
+	require.Equal(t, metrics.Gauge(3), storage.DataGauge["Alloc"])
+	require.Equal(t, metrics.Counter(7), storage.DataCounter["PollCount"])
+	require.Equal(t, map[metrics.Metric]metrics.Gauge{"Alloc": 3}, values.Gauges)
+	require.Equal(t, map[metrics.Metric]metrics.Counter{"PollCount": 7}, values.Counters)
+
+	// The replay of the batch is not applied, the current values are returned.
+	storage.DataGauge["Alloc"] = 4
+	values, applied, err = storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.False(t, applied)
+	require.Equal(t, metrics.Counter(7), storage.DataCounter["PollCount"])
+	require.Equal(t, metrics.Gauge(4), values.Load("gauge", "Alloc").Value)
+	require.Equal(t, metrics.Counter(7), values.Load("counter", "PollCount").Value)
+	require.ErrorIs(t, values.Load("histogram", "PollCount").Err, ErrNoSuchMetric)
+
+	// A batch with an invalid value is not applied at all and its key is not remembered.
+	invalid := []MetricValue{{Metric: "PollCount", Value: metrics.Counter(1)}, {Metric: "Alloc", Value: "text"}}
+	_, _, err = storage.StoreBatchContext(ctx, "batch-2", invalid)
+	require.Error(t, err)
+	require.Equal(t, metrics.Counter(7), storage.DataCounter["PollCount"])
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-2", batch[:2])
+	require.NoError(t, err)
+	require.True(t, applied)
+	require.Equal(t, metrics.Counter(9), storage.DataCounter["PollCount"])
+
+	// An expired key is applied again, and a batch without a key is always applied.
+	storage.BatchKeys["batch-3"] = time.Now().Add(-batchKeyRetention - time.Minute)
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-3", batch[1:2])
+	require.NoError(t, err)
+	require.True(t, applied)
+	_, applied, err = storage.StoreBatchContext(ctx, "", batch[1:2])
+	require.NoError(t, err)
+	require.True(t, applied)
+	require.Equal(t, metrics.Counter(13), storage.DataCounter["PollCount"])
+
+	tmpDir := t.TempDir()
+	err = storage.SaveToFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+	storage = NewStorage(nil, time.Millisecond)
+	err = storage.LoadFromFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.False(t, applied)
+}
+
+func TestStorage_StoreBatchKeys(t *testing.T) {
+	storage := NewStorage(nil, time.Millisecond)
+	ctx := context.Background()
+	batch := []MetricValue{{Metric: "PollCount", Value: metrics.Counter(1)}}
+
+	_, _, err := storage.StoreBatchContext(ctx, strings.Repeat("k", maxBatchKeyLength+1), batch)
+	require.ErrorIs(t, err, ErrInvalidBatchKey)
+	require.Empty(t, storage.DataCounter)
+	_, applied, err := storage.StoreBatchContext(ctx, strings.Repeat("k", maxBatchKeyLength), batch)
+	require.NoError(t, err)
+	require.True(t, applied)
+
+	// When the keys are full, the oldest ones are forgotten first.
+	now := time.Now()
+	storage.BatchKeys = map[string]time.Time{}
+	for i := 0; i < maxBatchKeys; i++ {
+		storage.BatchKeys[strconv.Itoa(i)] = now.Add(time.Duration(i-maxBatchKeys) * time.Millisecond)
+	}
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-1", batch)
+	require.NoError(t, err)
+	require.True(t, applied)
+	require.Len(t, storage.BatchKeys, maxBatchKeys-maxBatchKeys/10+1)
+	require.NotContains(t, storage.BatchKeys, strconv.Itoa(maxBatchKeys/10-1))
+	require.Contains(t, storage.BatchKeys, strconv.Itoa(maxBatchKeys/10))
+	_, applied, err = storage.StoreBatchContext(ctx, strconv.Itoa(maxBatchKeys-1), batch)
+	require.NoError(t, err)
+	require.False(t, applied)
+}
+
+func TestStorage_Rollup(t *testing.T) {
+	storage := NewStorage(nil, time.Millisecond)
+	storage.SetRollupWindows([]time.Duration{time.Hour})
+	ctx := context.Background()
+
+	for _, value := range []metrics.Gauge{5, 40, 3} {
+		require.NoError(t, storage.StoreContext(ctx, "HeapAlloc", value))
+	}
+	_, _, err := storage.StoreBatchContext(ctx, "", []MetricValue{{Metric: "HeapAlloc", Value: 12.0}})
+	require.NoError(t, err)
+
+	// The spike is kept by the rollup while the gauge holds the last value.
+	res := storage.LoadRollupContext(ctx, "HeapAlloc", time.Hour)
+	require.NoError(t, res.Err)
+	rollup := res.Value.(metrics.Rollup)
+	require.Equal(t, metrics.Gauge(3), rollup.Min)
+	require.Equal(t, metrics.Gauge(40), rollup.Max)
+	require.Equal(t, int64(4), rollup.Count)
+	require.Equal(t, metrics.Gauge(12), rollup.Last)
+	require.Equal(t, metrics.Gauge(12), storage.DataGauge["HeapAlloc"])
+
+	res = storage.LoadRollupContext(ctx, "HeapAlloc", time.Minute)
+	require.Error(t, res.Err)
+	res = storage.LoadRollupContext(ctx, "Alloc", time.Hour)
+	require.Error(t, res.Err)
+
+	tmpDir := t.TempDir()
+	err = storage.SaveToFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+	restored := NewStorage(nil, time.Millisecond)
+	restored.SetRollupWindows([]time.Duration{time.Hour})
+	err = restored.LoadFromFile(path.Join(tmpDir, "metrics.json"))
+	require.NoError(t, err)
+	res = restored.LoadRollupContext(ctx, "HeapAlloc", time.Hour)
+	require.NoError(t, res.Err)
+	require.True(t, rollup.Start.Equal(res.Value.(metrics.Rollup).Start))
+	rollup.Start = res.Value.(metrics.Rollup).Start
+	require.Equal(t, rollup, res.Value)
+}
+
+func TestStorage_Metadata(t *testing.T) {
+	storage := NewStorage(nil, time.Millisecond)
+	ctx := context.Background()
+
+	alloc := metrics.Metadata{Name: "Alloc", MType: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects."}
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{alloc, {Name: "PollCount", MType: "counter"}}))
+	require.Error(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "", MType: "gauge"}}))
+	err := storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "Frees", MType: "counter"}, {Name: "Alloc", MType: "counter"}})
+	require.ErrorIs(t, err, ErrTypeConflict)
+	err = storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "Frees", MType: "counter"}, {Name: "Frees", MType: "gauge"}})
+	require.ErrorIs(t, err, ErrTypeConflict)
+	// The unit and the help of a declared name are replaced.
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "PollCount", MType: "counter", Help: "Number of polls."}}))
+
+	res := storage.LoadMetadataContext(ctx)
+	require.NoError(t, res.Err)
+	require.Equal(t, map[string]metrics.Metadata{
+		"Alloc":     alloc,
+		"PollCount": {Name: "PollCount", MType: "counter", Help: "Number of polls."},
+	}, res.Value)
+
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1)))
+	require.NoError(t, storage.StoreContext(ctx, "Frees", metrics.Counter(1)))
+	require.ErrorIs(t, storage.StoreContext(ctx, "Alloc", metrics.Counter(1)), ErrTypeConflict)
+	require.ErrorIs(t, storage.StoreContext(ctx, metrics.SeriesKey("PollCount", "host1", nil), metrics.Gauge(1)), ErrTypeConflict)
+	_, applied, err := storage.StoreBatchContext(ctx, "batch-1", []MetricValue{
+		{Metric: "Frees", Value: metrics.Counter(1)},
+		{Metric: "Alloc", Value: metrics.NewHistogram([]float64{1})},
+	})
+	// Only the conflicting value is dropped and the batch is remembered.
+	require.ErrorIs(t, err, ErrTypeConflict)
+	require.True(t, applied)
+	require.Equal(t, metrics.Counter(2), storage.DataCounter["Frees"])
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-1", []MetricValue{{Metric: "Frees", Value: metrics.Counter(1)}})
+	require.NoError(t, err)
+	require.False(t, applied)
+
+	// A deleted declaration can be declared again with another type.
+	require.NoError(t, storage.DeleteMetadataContext(ctx, []string{"PollCount", "Unknown"}))
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Gauge(1)))
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "PollCount", MType: "gauge"}}))
+
+	tmpDir := t.TempDir()
+	require.NoError(t, storage.SaveToFile(path.Join(tmpDir, "metrics.json")))
+	storage = NewStorage(nil, time.Millisecond)
+	require.NoError(t, storage.LoadFromFile(path.Join(tmpDir, "metrics.json")))
+	require.Equal(t, alloc, storage.Metadata["Alloc"])
+	require.ErrorIs(t, storage.StoreContext(ctx, "Alloc", metrics.Counter(1)), ErrTypeConflict)
+}
+
+func TestWALStorage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	storage, err := OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1.5)))
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(2)))
+	_, applied, err := storage.StoreBatchContext(ctx, "batch-1", []MetricValue{
+		{Metric: "PollCount", Value: metrics.Counter(3)},
+		{Metric: "Total", Value: metrics.CounterTotal(10)},
+	})
+	require.NoError(t, err)
+	require.True(t, applied)
+	require.Error(t, storage.StoreContext(ctx, "Alloc", "text"))
+
+	// Crash: the storage is not closed, the data is recovered from the log only.
+	require.NoError(t, storage.log.Close())
+	storage, err = OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.Equal(t, metrics.Gauge(1.5), storage.DataGauge["Alloc"])
+	require.Equal(t, metrics.Counter(5), storage.DataCounter["PollCount"])
+	require.Equal(t, metrics.CounterTotal(10), storage.CounterTotals["Total"])
+	require.Len(t, storage.HistoryCounter["PollCount"], 2)
+	_, applied, err = storage.StoreBatchContext(ctx, "batch-1", []MetricValue{{Metric: "PollCount", Value: metrics.Counter(3)}})
+	require.NoError(t, err)
+	require.False(t, applied)
+
+	// Close compacts the log into the snapshot.
+	require.NoError(t, storage.StoreContext(ctx, "Total", metrics.CounterTotal(12)))
+	require.NoError(t, storage.Close())
+	require.Error(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(2)))
+	info, err := os.Stat(path.Join(dir, walLogFile))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	storage, err = OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.Equal(t, metrics.Counter(12), storage.DataCounter["Total"])
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(2.5)))
+	require.NoError(t, storage.log.Close())
+
+	// A crash in the middle of a write leaves a torn record, it is dropped on recovery.
+	file, err := os.OpenFile(path.Join(dir, walLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{42, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	storage, err = OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.Equal(t, metrics.Gauge(2.5), storage.DataGauge["Alloc"])
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(3.5)))
+	require.NoError(t, storage.Close())
+
+	storage, err = OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.Equal(t, metrics.Gauge(3.5), storage.DataGauge["Alloc"])
+	require.NoError(t, storage.Close())
+
+	_, err = OpenWALStorage(dir, WALOptions{Fsync: "sometimes"})
+	require.Error(t, err)
+}
+
+func TestWALStorage_Metadata(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	storage, err := OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	alloc := metrics.Metadata{Name: "Alloc", MType: "gauge", Unit: "bytes"}
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{alloc}))
+	require.ErrorIs(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{{Name: "Alloc", MType: "counter"}}), ErrTypeConflict)
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1)))
+	require.ErrorIs(t, storage.StoreContext(ctx, "Alloc", metrics.Counter(1)), ErrTypeConflict)
+	size := storage.logSize
+
+	// A rejected value is not written to the log, the other values of the batch are.
+	_, _, err = storage.StoreBatchContext(ctx, "", []MetricValue{{Metric: "Alloc", Value: metrics.Counter(1)}})
+	require.ErrorIs(t, err, ErrTypeConflict)
+	require.Equal(t, size, storage.logSize)
+	_, _, err = storage.StoreBatchContext(ctx, "", []MetricValue{
+		{Metric: "Alloc", Value: metrics.Counter(1)},
+		{Metric: "Frees", Value: metrics.Counter(1)},
+	})
+	require.ErrorIs(t, err, ErrTypeConflict)
+	require.NoError(t, storage.DeleteMetadataContext(ctx, []string{"Alloc"}))
+
+	// Crash: the metadata is recovered from the log.
+	require.NoError(t, storage.log.Close())
+	storage, err = OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, storage.Metadata, "Alloc")
+	require.Equal(t, metrics.Gauge(1), storage.DataGauge["Alloc"])
+	require.Equal(t, metrics.Counter(1), storage.DataCounter["Frees"])
+	require.NoError(t, storage.RegisterMetadataContext(ctx, []metrics.Metadata{alloc}))
+	require.NoError(t, storage.Close())
+
+	// Close compacts the metadata into the snapshot.
+	storage, err = OpenWALStorage(dir, WALOptions{})
+	require.NoError(t, err)
+	require.Equal(t, alloc, storage.Metadata["Alloc"])
+	require.ErrorIs(t, storage.StoreContext(ctx, "Alloc", metrics.Counter(1)), ErrTypeConflict)
+	require.NoError(t, storage.Close())
+}
+
+func TestWALStorage_SnapshotBeforeTruncate(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// The log is compacted after every write.
+	storage, err := OpenWALStorage(dir, WALOptions{Fsync: FsyncNever, MaxLogSize: 1})
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(2)))
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(3)))
+	log, err := os.ReadFile(path.Join(dir, walLogFile))
+	require.NoError(t, err)
+	require.Empty(t, log)
+	require.NoError(t, storage.Close())
+
+	// Crash between writing the snapshot and truncating the log: the records in the snapshot are skipped.
+	storage, err = OpenWALStorage(dir, WALOptions{Fsync: FsyncNever})
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreContext(ctx, "PollCount", metrics.Counter(4)))
+	storage.walMu.Lock()
+	storage.MyStorage.mu.RLock()
+	snapshot, err := json.Marshal(walSnapshot{LSN: storage.lsn, Data: storage.fileData(true)})
+	storage.MyStorage.mu.RUnlock()
+	storage.walMu.Unlock()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, walSnapshotFile), snapshot, 0644))
+	require.NoError(t, storage.log.Close())
+
+	storage, err = OpenWALStorage(dir, WALOptions{Fsync: FsyncNever})
+	require.NoError(t, err)
+	require.Equal(t, metrics.Counter(9), storage.DataCounter["PollCount"])
+	require.NoError(t, storage.Close())
+}
+
+func TestMigrations(t *testing.T) {
+	postgres, err := NewSQLStorage(nil).Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, postgres)
+	for i, migration := range postgres {
+		require.Equal(t, int64(i+1), migration.Version, migration.Name)
+		require.NotEmpty(t, migrationStatements(migration.SQL), migration.Name)
+	}
+
+	// Every database has the same versions, so a schema version means the same tables.
+	sqlite, err := (&SQLStorage{sqlite: true}).Migrations()
+	require.NoError(t, err)
+	require.Len(t, sqlite, len(postgres))
+	for i, migration := range sqlite {
+		require.Equal(t, postgres[i].Version, migration.Version)
+		require.Equal(t, postgres[i].Name, migration.Name)
+	}
+
+	require.Equal(t, []string{"CREATE TABLE a (x TEXT)", "CREATE INDEX b ON a (x)"},
+		migrationStatements("-- Comment.\nCREATE TABLE a (x TEXT);\n\n  -- Another comment.\nCREATE INDEX b ON a (x);\n"))
+}
+
+func TestMultiRow(t *testing.T) {
+	statement, args := multiRow(`INSERT INTO gauge (metric, val) VALUES %s`, [][]any{{"Alloc", 1.0}, {"Sys", 2.0}})
+	require.Equal(t, `INSERT INTO gauge (metric, val) VALUES ($1, $2), ($3, $4)`, statement)
+	require.Equal(t, []any{"Alloc", 1.0, "Sys", 2.0}, args)
 }
 
 func TestStorage_LoadAllData(t *testing.T) {
@@ -179,6 +609,88 @@ func TestStorage_LoadAllData(t *testing.T) {
 	require.True(t, reflect.DeepEqual(res.Value, dataCounter))
 }
 
+func TestStorage_SaveToFileHistory(t *testing.T) {
+	storage := NewStorage(nil, time.Second)
+	ctx := context.Background()
+	for _, value := range []metrics.Gauge{1, 2, 3} {
+		require.NoError(t, storage.StoreContext(ctx, "Alloc", value))
+	}
+
+	// The history is not written to the file, only the restored value is a sample then.
+	filepath := path.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, storage.SaveToFile(filepath))
+	data, err := os.ReadFile(filepath)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "history_gauge")
+	storage = NewStorage(nil, time.Second)
+	require.NoError(t, storage.LoadFromFile(filepath))
+	require.Len(t, storage.HistoryGauge["Alloc"], 1)
+	require.Equal(t, metrics.Gauge(3), storage.HistoryGauge["Alloc"][0].Value)
+}
+
+func TestStorage_PruneHistory(t *testing.T) {
+	storage := NewStorage(nil, time.Second)
+	ctx := context.Background()
+	expired := time.Now().Add(-historyRetention - time.Minute)
+	storage.HistoryGauge["Idle"] = []metrics.GaugeSample{{Timestamp: expired, Value: 1}}
+	storage.HistoryCounter["Polls"] = []metrics.CounterSample{{Timestamp: expired, Value: 1}, {Timestamp: time.Now(), Value: 2}}
+
+	// The series which are not stored any more are pruned too.
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(1)))
+	require.NotContains(t, storage.HistoryGauge, metrics.Metric("Idle"))
+	require.Len(t, storage.HistoryCounter["Polls"], 1)
+	require.Len(t, storage.HistoryGauge["Alloc"], 1)
+
+	// The history is pruned at most once a minute.
+	storage.HistoryGauge["Idle"] = []metrics.GaugeSample{{Timestamp: expired, Value: 1}}
+	require.NoError(t, storage.StoreContext(ctx, "Alloc", metrics.Gauge(2)))
+	require.Contains(t, storage.HistoryGauge, metrics.Metric("Idle"))
+}
+
+func TestStorage_LoadRange(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	storage := NewStorage(nil, time.Second)
+	storage.HistoryGauge["Alloc"] = []metrics.GaugeSample{
+		{Timestamp: start, Value: 1},
+		{Timestamp: start.Add(20 * time.Second), Value: 2},
+		{Timestamp: start.Add(40 * time.Second), Value: 3},
+		{Timestamp: start.Add(70 * time.Second), Value: 4},
+	}
+
+	res := storage.LoadRangeContext(context.Background(), "gauge", "Alloc", start, start.Add(time.Minute), 0)
+	require.NoError(t, res.Err)
+	require.Equal(t, []metrics.GaugeSample{
+		{Timestamp: start, Value: 1},
+		{Timestamp: start.Add(20 * time.Second), Value: 2},
+		{Timestamp: start.Add(40 * time.Second), Value: 3},
+	}, res.Value)
+
+	res = storage.LoadRangeContext(context.Background(), "gauge", "Alloc", start, start.Add(2*time.Minute), time.Minute)
+	require.NoError(t, res.Err)
+	require.Equal(t, []metrics.GaugeSample{
+		{Timestamp: start.Add(40 * time.Second), Value: 3},
+		{Timestamp: start.Add(70 * time.Second), Value: 4},
+	}, res.Value)
+
+	res = storage.LoadRangeContext(context.Background(), "gauge", "Alloc", start.Add(time.Minute), start, 0)
+	require.Error(t, res.Err)
+
+	res = storage.LoadRangeContext(context.Background(), "counter", "Alloc", start, start.Add(time.Minute), 0)
+	require.Error(t, res.Err)
+
+	err := storage.StoreContext(context.Background(), "Poll", metrics.Counter(2))
+	require.NoError(t, err)
+	err = storage.StoreContext(context.Background(), "Poll", metrics.Counter(3))
+	require.NoError(t, err)
+	res = storage.LoadRangeContext(context.Background(), "counter", "Poll", time.Now().Add(-time.Minute), time.Now(), 0)
+	require.NoError(t, res.Err)
+	samples, ok := res.Value.([]metrics.CounterSample)
+	require.True(t, ok)
+	require.Len(t, samples, 2)
+	require.Equal(t, metrics.Counter(2), samples[0].Value)
+	require.Equal(t, metrics.Counter(5), samples[1].Value)
+}
+
 func BenchmarkMyStorage(b *testing.B) {
 	storage := NewStorage(nil, time.Second)
 
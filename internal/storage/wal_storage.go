@@ -0,0 +1,738 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+// The fsync modes of WALStorage.
+const (
+	// FsyncAlways syncs the log before a write is acknowledged, an acknowledged write survives a crash.
+	FsyncAlways = "always"
+	// FsyncInterval syncs the log once a second, a crash of the machine loses at most the last second of writes.
+	FsyncInterval = "interval"
+	// FsyncNever leaves syncing of the log to the operating system.
+	FsyncNever = "never"
+)
+
+const (
+	walLogFile      = "wal.log"
+	walSnapshotFile = "snapshot.json"
+
+	// walHeaderSize is the size of the header of a record: the length and the CRC-32 of the payload.
+	walHeaderSize = 8
+	// walMaxRecordSize limits the length read from a header, a larger length means the header is corrupted.
+	walMaxRecordSize = 64 << 20
+	// walMaxLogSize is the default size of the log after which it is compacted into a snapshot.
+	walMaxLogSize    = 64 << 20
+	walSyncInterval  = time.Second
+	walDirPermission = 0755
+)
+
+var (
+	errInvalidFsync = errors.New("invalid fsync mode, expected always, interval or never")
+	errWALClosed    = errors.New("WAL storage is closed")
+	errTornRecord   = errors.New("torn or corrupted WAL record")
+)
+
+// WALOptions are the options of WALStorage.
+type WALOptions struct {
+	// Fsync is the fsync mode of the log, FsyncAlways if empty.
+	Fsync string
+	// SnapshotInterval is the time between compactions of the log into a snapshot.
+	// If it is 0, the log is compacted only when it exceeds MaxLogSize and on Close.
+	SnapshotInterval time.Duration
+	// MaxLogSize is the size of the log in bytes after which it is compacted, 64 MiB if 0.
+	MaxLogSize int64
+	// RollupWindows are the windows of the gauge rollups, the default windows if nil.
+	RollupWindows []time.Duration
+}
+
+// WALStorage keeps metrics in memory as MyStorage and makes every write durable in a write-ahead log,
+// so a write costs one appended record instead of rewriting all the metrics.
+// The log is periodically compacted: the data is written to a snapshot file, which atomically replaces
+// the previous one, and the log is truncated. On opening the storage the snapshot is loaded and the records
+// of the log written after it are replayed; a torn record at the end of the log, left by a crash in the middle
+// of a write, is dropped.
+//
+// Every record has a sequence number and the snapshot has the number of the last record it contains,
+// so the records are not applied twice if the storage crashes between writing the snapshot and truncating the log.
+type WALStorage struct {
+	*MyStorage
+
+	dir     string
+	options WALOptions
+
+	// walMu serializes the writes, so the records are in the log in the order they are applied.
+	walMu    sync.Mutex
+	log      *os.File
+	logSize  int64
+	lsn      uint64
+	unsynced bool
+	closed   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// walRecord is a record of the log: a batch of values stored at the moment Time, the declared metadata
+// or the names whose declarations are removed.
+type walRecord struct {
+	LSN      uint64             `json:"lsn"`
+	Time     time.Time          `json:"time"`
+	Key      string             `json:"key,omitempty"`
+	Values   []walValue         `json:"values"`
+	Metadata []metrics.Metadata `json:"metadata,omitempty"`
+	// Undeclared holds the names whose declarations are removed by DeleteMetadata.
+	Undeclared []string `json:"undeclared,omitempty"`
+}
+
+// walValue is a value of a record, Type is "gauge", "counter", "counter_total" or "histogram".
+type walValue struct {
+	Metric    metrics.Metric     `json:"metric"`
+	Type      string             `json:"type"`
+	Value     float64            `json:"value,omitempty"`
+	Delta     int64              `json:"delta,omitempty"`
+	Histogram *metrics.Histogram `json:"histogram,omitempty"`
+}
+
+// walSnapshot is the content of the snapshot file, LSN is the sequence number of the last record it contains.
+type walSnapshot struct {
+	LSN  uint64           `json:"lsn"`
+	Data metrics.FileData `json:"data"`
+}
+
+// OpenWALStorage opens the storage in the directory, it is created if it does not exist.
+// The data is recovered from the snapshot and the log of the directory.
+//
+// Parameters:
+//   - dir: The directory of the snapshot and the log.
+//   - options: The options of the storage.
+//
+// Returns:
+//   - A pointer to the opened WALStorage, it must be closed by Close.
+//   - An error if the options are invalid or the data can not be recovered.
+func OpenWALStorage(dir string, options WALOptions) (*WALStorage, error) {
+	switch options.Fsync {
+	case "":
+		options.Fsync = FsyncAlways
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("%w: %q", errInvalidFsync, options.Fsync)
+	}
+	if options.MaxLogSize <= 0 {
+		options.MaxLogSize = walMaxLogSize
+	}
+
+	err := os.MkdirAll(dir, walDirPermission)
+	if err != nil {
+		return nil, err
+	}
+
+	// The storage saves the data itself, so the memory storage must not send signals for saving to file.
+	memory := NewStorage(nil, -1)
+	if options.RollupWindows != nil {
+		memory.SetRollupWindows(options.RollupWindows)
+	}
+	ws := &WALStorage{
+		MyStorage: memory,
+		dir:       dir,
+		options:   options,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err = ws.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	err = ws.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	go ws.run()
+	return ws, nil
+}
+
+// loadSnapshot restores the data from the snapshot file if it exists.
+func (ws *WALStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(ws.dir, walSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot walSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return fmt.Errorf("snapshot %s: %w", walSnapshotFile, err)
+	}
+
+	ws.MyStorage.mu.Lock()
+	ws.MyStorage.restore(snapshot.Data)
+	ws.MyStorage.mu.Unlock()
+	ws.lsn = snapshot.LSN
+	return nil
+}
+
+// replay opens the log and applies its records written after the snapshot.
+// The log is truncated after the last intact record.
+func (ws *WALStorage) replay() error {
+	file, err := os.OpenFile(filepath.Join(ws.dir, walLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		record, size, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Printf("WAL storage: %v at offset %d, the rest of the log is dropped", err, offset)
+			break
+		}
+		offset += size
+
+		if record.LSN <= ws.lsn {
+			continue
+		}
+		if record.Metadata != nil || record.Undeclared != nil {
+			ws.MyStorage.mu.Lock()
+			ws.MyStorage.declare(record.Metadata)
+			ws.MyStorage.undeclare(record.Undeclared)
+			ws.MyStorage.mu.Unlock()
+			ws.lsn = record.LSN
+			continue
+		}
+		batch := make([]MetricValue, 0, len(record.Values))
+		for _, value := range record.Values {
+			metricValue, err := value.metricValue()
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("record %d: %w", record.LSN, err)
+			}
+			batch = append(batch, metricValue)
+		}
+		_, _, err = ws.MyStorage.storeBatchAt(record.Key, batch, record.Time)
+		if err != nil && !errors.Is(err, ErrTypeConflict) {
+			file.Close()
+			return fmt.Errorf("record %d: %w", record.LSN, err)
+		}
+		ws.lsn = record.LSN
+	}
+
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	ws.log = file
+	ws.logSize = offset
+	return nil
+}
+
+// readRecord reads a record from the log and returns it with its size in the log.
+// It returns io.EOF at the end of the log and errTornRecord if the record is incomplete or corrupted.
+func readRecord(reader io.Reader) (walRecord, int64, error) {
+	var record walRecord
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return record, 0, io.EOF
+	}
+	if err != nil {
+		return record, 0, fmt.Errorf("%w: %d bytes of header", errTornRecord, n)
+	}
+
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length > walMaxRecordSize {
+		return record, 0, fmt.Errorf("%w: length %d", errTornRecord, length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return record, 0, fmt.Errorf("%w: %v", errTornRecord, err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return record, 0, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+	}
+
+	err = json.Unmarshal(payload, &record)
+	if err != nil {
+		return record, 0, fmt.Errorf("%w: %v", errTornRecord, err)
+	}
+	return record, walHeaderSize + int64(length), nil
+}
+
+// newWALValue converts a validated value of a batch to the value of a record.
+func newWALValue(value MetricValue) walValue {
+	switch metricValue := value.Value.(type) {
+	case metrics.Gauge:
+		return walValue{Metric: value.Metric, Type: "gauge", Value: float64(metricValue)}
+	case float64:
+		return walValue{Metric: value.Metric, Type: "gauge", Value: metricValue}
+	case metrics.Counter:
+		return walValue{Metric: value.Metric, Type: "counter", Delta: int64(metricValue)}
+	case int64:
+		return walValue{Metric: value.Metric, Type: "counter", Delta: metricValue}
+	case metrics.CounterTotal:
+		return walValue{Metric: value.Metric, Type: "counter_total", Delta: int64(metricValue)}
+	case metrics.Histogram:
+		histogram := metricValue.Copy()
+		return walValue{Metric: value.Metric, Type: "histogram", Histogram: &histogram}
+	default:
+		// The values are validated, so it does not happen.
+		return walValue{Metric: value.Metric}
+	}
+}
+
+// metricValue converts the value of a record back to the value of a batch.
+func (v walValue) metricValue() (MetricValue, error) {
+	switch v.Type {
+	case "gauge":
+		return MetricValue{Metric: v.Metric, Value: metrics.Gauge(v.Value)}, nil
+	case "counter":
+		return MetricValue{Metric: v.Metric, Value: metrics.Counter(v.Delta)}, nil
+	case "counter_total":
+		return MetricValue{Metric: v.Metric, Value: metrics.CounterTotal(v.Delta)}, nil
+	case "histogram":
+		if v.Histogram == nil {
+			return MetricValue{}, errNotExpectedType
+		}
+		return MetricValue{Metric: v.Metric, Value: *v.Histogram}, nil
+	default:
+		return MetricValue{}, errNotExpectedType
+	}
+}
+
+// StoreContext stores a metric value associated with the given metric key in the storage.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metric: The metric key associated with the value to be stored.
+//   - metricValue: The value to be stored for the specified metric key.
+//
+// Returns:
+//   - An error if the value can not be stored or written to the log, or if the context is canceled.
+func (ws *WALStorage) StoreContext(ctx context.Context, metric metrics.Metric, metricValue any) error {
+	_, _, err := ws.StoreBatchContext(ctx, "", []MetricValue{{Metric: metric, Value: metricValue}})
+	return err
+}
+
+// Store stores a metric value associated with the given metric key in the storage.
+//
+// Parameters:
+//   - metric: The metric key associated with the value to be stored.
+//   - metricValue: The value to be stored for the specified metric key.
+//
+// Returns:
+//   - An error if the value can not be stored or written to the log.
+func (ws *WALStorage) Store(metric metrics.Metric, metricValue any) error {
+	_, _, err := ws.StoreBatch("", []MetricValue{{Metric: metric, Value: metricValue}})
+	return err
+}
+
+// StoreBatchContext stores the values of the batch atomically, see StoreBatch.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - key: The idempotency key of the batch of at most maxBatchKeyLength bytes, an empty key means the batch
+//     is always applied.
+//   - batch: The metric keys and the values to be stored.
+//
+// Returns:
+//   - The stored values of the metrics of the batch, see StoreBatch.
+//   - false if the key is already remembered and the batch is not applied again.
+//   - An error if a value of the batch can not be stored, the batch can not be written to the log,
+//     or if the context is canceled.
+func (ws *WALStorage) StoreBatchContext(ctx context.Context, key string, batch []MetricValue) (BatchValues, bool, error) {
+	type result struct {
+		values  BatchValues
+		applied bool
+		err     error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		values, applied, err := ws.StoreBatch(key, batch)
+		ch <- result{values: values, applied: applied, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.values, res.applied, res.err
+	case <-ctx.Done():
+		return BatchValues{}, false, ctx.Err()
+	}
+}
+
+// StoreBatch writes the batch to the log as one record and then applies it in memory, so the batch is recovered
+// either entirely or not at all. With FsyncAlways the record is synced before the batch is applied.
+//
+// Parameters:
+//   - key: The idempotency key of the batch of at most maxBatchKeyLength bytes, an empty key means the batch
+//     is always applied.
+//   - batch: The metric keys and the values to be stored.
+//
+// Returns:
+//   - The values of the metrics of the batch read with the batch applied, the current ones for a replay.
+//     The dropped values have none.
+//   - false if the key is already remembered and the batch is not applied again.
+//   - An error if a value of the batch can not be stored or the batch can not be written to the log,
+//     nothing is stored then.
+//     An error wrapping ErrTypeConflict if values have another type than the declared one, the other values are stored.
+func (ws *WALStorage) StoreBatch(key string, batch []MetricValue) (BatchValues, bool, error) {
+	err := validateBatch(key, batch)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+
+	ws.walMu.Lock()
+	defer ws.walMu.Unlock()
+	if ws.closed {
+		return BatchValues{}, false, errWALClosed
+	}
+	if key != "" && ws.batchRemembered(key) {
+		ws.MyStorage.mu.RLock()
+		defer ws.MyStorage.mu.RUnlock()
+		return ws.MyStorage.batchValues(batch), false, nil
+	}
+	// The metadata is changed under walMu only, so the conflicting values are dropped before the batch is written
+	// to the log.
+	ws.MyStorage.mu.RLock()
+	batch, conflictErr := filterDeclared(batch, ws.MyStorage.declaredType)
+	ws.MyStorage.mu.RUnlock()
+	if len(batch) == 0 && key == "" {
+		return newBatchValues(), true, conflictErr
+	}
+	values := make([]walValue, 0, len(batch))
+	for _, value := range batch {
+		values = append(values, newWALValue(value))
+	}
+
+	now := time.Now()
+	err = ws.append(walRecord{LSN: ws.lsn + 1, Time: now, Key: key, Values: values})
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+	ws.lsn++
+
+	stored, applied, err := ws.MyStorage.storeBatchAt(key, batch, now)
+	if err != nil {
+		return BatchValues{}, false, err
+	}
+
+	if ws.logSize > ws.options.MaxLogSize {
+		err = ws.snapshot()
+		if err != nil {
+			// The batch is in the log, the compaction is retried with the next write.
+			log.Printf("WAL storage: snapshot: %v", err)
+		}
+	}
+	return stored, applied, conflictErr
+}
+
+// RegisterMetadataContext declares the metadata of metrics by name, see RegisterMetadata.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - metadata: The metadata to declare.
+//
+// Returns:
+//   - An error if the metadata is invalid, conflicts with the declared types or can not be written to the log,
+//     or if the context is canceled.
+func (ws *WALStorage) RegisterMetadataContext(ctx context.Context, metadata []metrics.Metadata) error {
+	ch := make(chan error, 1)
+
+	go func() {
+		ch <- ws.RegisterMetadata(metadata)
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RegisterMetadata writes the metadata to the log as one record and then declares it in memory.
+//
+// Parameters:
+//   - metadata: The metadata to declare.
+//
+// Returns:
+//   - An error if the metadata is invalid, ErrTypeConflict if it conflicts with the declared types,
+//     or an error if it can not be written to the log.
+func (ws *WALStorage) RegisterMetadata(metadata []metrics.Metadata) error {
+	ws.walMu.Lock()
+	defer ws.walMu.Unlock()
+	if ws.closed {
+		return errWALClosed
+	}
+
+	ws.MyStorage.mu.RLock()
+	err := validateMetadata(metadata, ws.MyStorage.declaredType)
+	ws.MyStorage.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	err = ws.append(walRecord{LSN: ws.lsn + 1, Time: time.Now(), Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	ws.lsn++
+
+	ws.MyStorage.mu.Lock()
+	ws.MyStorage.declare(metadata)
+	ws.MyStorage.mu.Unlock()
+	return nil
+}
+
+// DeleteMetadataContext removes the declarations of the names, see DeleteMetadata.
+// It operates within the provided context, allowing for cancellation and timeout management.
+//
+// Parameters:
+//   - ctx: The context in which the operation should be performed.
+//   - names: The names whose declarations are removed.
+//
+// Returns:
+//   - An error if the record can not be written to the log or if the context is canceled.
+func (ws *WALStorage) DeleteMetadataContext(ctx context.Context, names []string) error {
+	ch := make(chan error, 1)
+
+	go func() {
+		ch <- ws.DeleteMetadata(names)
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeleteMetadata writes the names to the log as one record and then removes their declarations in memory.
+//
+// Parameters:
+//   - names: The names whose declarations are removed.
+//
+// Returns:
+//   - An error if the record can not be written to the log, nothing is removed then.
+func (ws *WALStorage) DeleteMetadata(names []string) error {
+	ws.walMu.Lock()
+	defer ws.walMu.Unlock()
+	if ws.closed {
+		return errWALClosed
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	err := ws.append(walRecord{LSN: ws.lsn + 1, Time: time.Now(), Undeclared: names})
+	if err != nil {
+		return err
+	}
+	ws.lsn++
+
+	ws.MyStorage.mu.Lock()
+	ws.MyStorage.undeclare(names)
+	ws.MyStorage.mu.Unlock()
+	return nil
+}
+
+// batchRemembered reports whether the idempotency key is remembered by the memory storage.
+func (ws *WALStorage) batchRemembered(key string) bool {
+	ws.MyStorage.mu.RLock()
+	defer ws.MyStorage.mu.RUnlock()
+	remembered, ok := ws.MyStorage.BatchKeys[key]
+	return ok && time.Since(remembered) <= batchKeyRetention
+}
+
+// append writes the record to the end of the log. If the write fails, the log is truncated back,
+// so a partial record does not precede the next ones. The caller must hold walMu.
+func (ws *WALStorage) append(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:walHeaderSize], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeaderSize:], payload)
+
+	_, err = ws.log.Write(frame)
+	if err == nil && ws.options.Fsync == FsyncAlways {
+		err = ws.log.Sync()
+	}
+	if err != nil {
+		if truncateErr := ws.log.Truncate(ws.logSize); truncateErr == nil {
+			_, _ = ws.log.Seek(ws.logSize, io.SeekStart)
+		}
+		return err
+	}
+
+	ws.logSize += int64(len(frame))
+	ws.unsynced = ws.options.Fsync == FsyncInterval
+	return nil
+}
+
+// snapshot writes the data to a temporary file, syncs it and renames it to the snapshot file,
+// then the log is truncated. The caller must hold walMu, so no record is written meanwhile.
+// Unlike the file of SaveToFile, the snapshot keeps the history, it is written once the log exceeds MaxLogSize.
+func (ws *WALStorage) snapshot() error {
+	ws.MyStorage.mu.RLock()
+	fileData := ws.MyStorage.fileData(true)
+	ws.MyStorage.mu.RUnlock()
+
+	data, err := json.Marshal(walSnapshot{LSN: ws.lsn, Data: fileData})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ws.dir, walSnapshotFile)
+	tmp, err := os.CreateTemp(ws.dir, walSnapshotFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = syncDir(ws.dir)
+	if err != nil {
+		return err
+	}
+
+	// The records up to ws.lsn are in the snapshot now, if the truncation fails they are skipped on recovery.
+	err = ws.log.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = ws.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	ws.logSize = 0
+	ws.unsynced = false
+	return ws.log.Sync()
+}
+
+// syncDir syncs the directory, so a renamed file survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// run syncs the log in FsyncInterval mode and compacts it every SnapshotInterval until the storage is closed.
+func (ws *WALStorage) run() {
+	defer close(ws.done)
+
+	var syncTick, snapshotTick <-chan time.Time
+	if ws.options.Fsync == FsyncInterval {
+		syncTicker := time.NewTicker(walSyncInterval)
+		defer syncTicker.Stop()
+		syncTick = syncTicker.C
+	}
+	if ws.options.SnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(ws.options.SnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotTick = snapshotTicker.C
+	}
+
+	for {
+		select {
+		case <-syncTick:
+			ws.walMu.Lock()
+			if ws.unsynced {
+				err := ws.log.Sync()
+				if err != nil {
+					log.Printf("WAL storage: sync: %v", err)
+				} else {
+					ws.unsynced = false
+				}
+			}
+			ws.walMu.Unlock()
+		case <-snapshotTick:
+			ws.walMu.Lock()
+			if ws.logSize > 0 {
+				err := ws.snapshot()
+				if err != nil {
+					log.Printf("WAL storage: snapshot: %v", err)
+				}
+			}
+			ws.walMu.Unlock()
+		case <-ws.stop:
+			return
+		}
+	}
+}
+
+// Close compacts the log into a snapshot and closes the storage, the following writes fail.
+//
+// Returns:
+//   - An error if the snapshot can not be written or the log can not be closed,
+//     the data is recovered from the log on the next opening then.
+func (ws *WALStorage) Close() error {
+	ws.walMu.Lock()
+	if ws.closed {
+		ws.walMu.Unlock()
+		return nil
+	}
+	ws.closed = true
+	ws.walMu.Unlock()
+
+	close(ws.stop)
+	<-ws.done
+
+	ws.walMu.Lock()
+	defer ws.walMu.Unlock()
+	err := ws.snapshot()
+	if err != nil {
+		ws.log.Sync()
+		ws.log.Close()
+		return err
+	}
+	return ws.log.Close()
+}
@@ -0,0 +1,415 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// MyLog is the logger used for webhook logs. It is initialized with log.Default() by default.
+var MyLog = log.Default()
+
+// ErrNoSuchSubscription is returned when the subscription with the given ID does not exist.
+var ErrNoSuchSubscription = errors.New("no such subscription")
+
+// Default parameters of the Dispatcher used for zero fields of Config.
+const (
+	DefaultBatchInterval  = time.Second
+	DefaultMaxBatch       = 100
+	DefaultMaxRetries     = 5
+	DefaultRetryBackoff   = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultMaxDeadLetters = 100
+)
+
+// Config holds the parameters of the Dispatcher.
+type Config struct {
+	BatchInterval  time.Duration // how often batches are sent.
+	MaxBatch       int           // the maximum number of events in a single payload.
+	MaxRetries     int           // how many times a failed delivery is repeated.
+	RetryBackoff   time.Duration // the delay before the first retry, doubled for every next one.
+	MaxBackoff     time.Duration // the maximum delay between retries.
+	MaxDeadLetters int           // how many failed deliveries are kept.
+	// AllowPrivate allows the URLs of loopback, private and link-local addresses. The subscriptions are added
+	// over the API of the server, so by default they can not make it send requests into the internal network.
+	AllowPrivate bool
+	// Client sends the payloads. The default client refuses to connect to the addresses denied by AllowPrivate,
+	// including the ones a public host name resolves to; a custom client is used as is.
+	Client *http.Client
+}
+
+// Event is a value of a metric sent to a subscription.
+// For a histogram Value is the number of its observations, the threshold of a subscription is compared with it.
+type Event struct {
+	Metric    metrics.Metric     `json:"metric"`
+	Name      string             `json:"name"`
+	Labels    map[string]string  `json:"labels,omitempty"`
+	MType     string             `json:"type"`
+	Value     float64            `json:"value"`
+	Histogram *metrics.Histogram `json:"histogram,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// Payload is the body of the request sent to the URL of a subscription.
+// ID identifies the delivery, it does not change between retries, so receivers can drop duplicates.
+type Payload struct {
+	ID           string  `json:"id"`
+	Subscription string  `json:"subscription"`
+	Events       []Event `json:"events"`
+}
+
+// DeadLetter is a payload which could not be delivered after all the retries.
+type DeadLetter struct {
+	Subscription string    `json:"subscription"`
+	URL          string    `json:"url"`
+	Payload      Payload   `json:"payload"`
+	Attempts     int       `json:"attempts"`
+	Error        string    `json:"error"`
+	FailedAt     time.Time `json:"failed_at"`
+}
+
+// subscriptionState is a subscription with its pending events.
+// Pending events are de-duplicated by series: a newer value of the series replaces the older one.
+// While the payloads of a subscription are being delivered, its new events stay pending until the next Flush.
+type subscriptionState struct {
+	Subscription
+	pending    map[metrics.Metric]Event
+	condition  map[metrics.Metric]bool
+	delivering bool
+}
+
+// Dispatcher sends the values written to the storage to the webhook subscriptions.
+// It implements storage.Observer and has to be subscribed to the storage.
+type Dispatcher struct {
+	cfg Config
+
+	mu            sync.Mutex
+	subscriptions map[string]*subscriptionState
+	deadLetters   []DeadLetter
+
+	deliveries sync.WaitGroup
+}
+
+// NewDispatcher creates a Dispatcher without subscriptions.
+//
+// Parameters:
+//   - cfg: The parameters of the Dispatcher, zero fields are replaced by the defaults.
+//
+// Returns:
+//   - A pointer to the Dispatcher.
+func NewDispatcher(cfg Config) *Dispatcher {
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = DefaultBatchInterval
+	}
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = DefaultMaxBatch
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if cfg.MaxDeadLetters <= 0 {
+		cfg.MaxDeadLetters = DefaultMaxDeadLetters
+	}
+	if cfg.Client == nil {
+		cfg.Client = newClient(cfg.AllowPrivate)
+	}
+
+	return &Dispatcher{
+		cfg:           cfg,
+		subscriptions: map[string]*subscriptionState{},
+	}
+}
+
+// Add validates and registers the subscription. The ID is always generated, the secret is generated if it is empty.
+// Unless AllowPrivate is set, the URL may not be localhost or a loopback, private or link-local IP address.
+//
+// Parameters:
+//   - sub: The subscription to add.
+//
+// Returns:
+//   - The registered subscription including its secret and an error if the subscription is invalid.
+func (d *Dispatcher) Add(sub Subscription) (Subscription, error) {
+	err := sub.validate(d.cfg.AllowPrivate)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub.ID = randomID(8)
+	if sub.Secret == "" {
+		sub.Secret = randomID(16)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscriptions[sub.ID] = &subscriptionState{
+		Subscription: sub,
+		pending:      map[metrics.Metric]Event{},
+		condition:    map[metrics.Metric]bool{},
+	}
+
+	return sub, nil
+}
+
+// Remove deletes the subscription with its pending events.
+func (d *Dispatcher) Remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.subscriptions[id]; !ok {
+		return ErrNoSuchSubscription
+	}
+	delete(d.subscriptions, id)
+	return nil
+}
+
+// Subscriptions returns the registered subscriptions sorted by ID. Secrets are not returned.
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subs := make([]Subscription, 0, len(d.subscriptions))
+	for _, state := range d.subscriptions {
+		sub := state.Subscription
+		sub.Secret = ""
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+
+	return subs
+}
+
+// DeadLetters returns the payloads which could not be delivered, the oldest first.
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter(nil), d.deadLetters...)
+}
+
+// OnStore implements storage.Observer. It adds the update to the pending events of the matching subscriptions.
+func (d *Dispatcher) OnStore(update storage.Update) {
+	name, labels, err := metrics.ParseSeriesKey(update.Metric)
+	if err != nil {
+		return
+	}
+	event := Event{
+		Metric:    update.Metric,
+		Name:      name,
+		Labels:    labels,
+		MType:     update.MType,
+		Value:     update.Value,
+		Histogram: update.Histogram,
+		Timestamp: update.Timestamp,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, state := range d.subscriptions {
+		if !state.matches(update.MType, name, labels) {
+			continue
+		}
+		if state.Threshold != nil {
+			holds, _ := metrics.Compare(update.Value, state.Op, *state.Threshold)
+			crossed := holds && !state.condition[update.Metric]
+			state.condition[update.Metric] = holds
+			if !crossed {
+				continue
+			}
+		}
+		state.pending[update.Metric] = event
+	}
+}
+
+// Flush starts sending the pending events, every subscription gets its payloads in a goroutine of its own,
+// so an endpoint which is slow or retries does not delay the others. The events of a subscription
+// whose previous payloads are still being delivered stay pending. Payloads which are not delivered
+// after all the retries are added to the dead letters. Wait waits until the started deliveries finish.
+func (d *Dispatcher) Flush(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, state := range d.subscriptions {
+		if len(state.pending) == 0 || state.delivering {
+			continue
+		}
+		events := make([]Event, 0, len(state.pending))
+		for _, event := range state.pending {
+			events = append(events, event)
+		}
+		state.pending = map[metrics.Metric]Event{}
+		sort.Slice(events, func(i, j int) bool {
+			if !events[i].Timestamp.Equal(events[j].Timestamp) {
+				return events[i].Timestamp.Before(events[j].Timestamp)
+			}
+			return events[i].Metric < events[j].Metric
+		})
+
+		var payloads []Payload
+		for start := 0; start < len(events); start += d.cfg.MaxBatch {
+			end := start + d.cfg.MaxBatch
+			if end > len(events) {
+				end = len(events)
+			}
+			payloads = append(payloads, Payload{ID: randomID(8), Subscription: state.ID, Events: events[start:end]})
+		}
+
+		state.delivering = true
+		d.deliveries.Add(1)
+		go d.deliverAll(ctx, state, payloads)
+	}
+}
+
+// Wait waits until the deliveries started by Flush finish.
+func (d *Dispatcher) Wait() {
+	d.deliveries.Wait()
+}
+
+// Run sends the pending events every BatchInterval until ctx is done, then it waits for the started deliveries.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.BatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.Wait()
+			return
+		case <-ticker.C:
+			d.Flush(ctx)
+		}
+	}
+}
+
+// deliverAll delivers the payloads of the subscription in order and marks the subscription as free.
+func (d *Dispatcher) deliverAll(ctx context.Context, state *subscriptionState, payloads []Payload) {
+	defer d.deliveries.Done()
+	defer func() {
+		d.mu.Lock()
+		state.delivering = false
+		d.mu.Unlock()
+	}()
+
+	sub := state.Subscription
+	for _, payload := range payloads {
+		attempts, err := d.deliver(ctx, sub, payload)
+		if err != nil {
+			MyLog.Printf("webhook %s: payload %s is not delivered: %v", sub.ID, payload.ID, err)
+			d.addDeadLetter(DeadLetter{
+				Subscription: sub.ID,
+				URL:          sub.URL,
+				Payload:      payload,
+				Attempts:     attempts,
+				Error:        err.Error(),
+				FailedAt:     time.Now(),
+			})
+		}
+	}
+}
+
+// deliver POSTs the payload to the subscription, retrying with exponential backoff on network errors,
+// 5xx and 429 responses. It returns the number of attempts and the last error.
+func (d *Dispatcher) deliver(ctx context.Context, sub Subscription, payload Payload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	signature := security.Hash(string(body), []byte(sub.Secret))
+
+	backoff := d.cfg.RetryBackoff
+	attempt := 0
+	for {
+		attempt++
+		retry, err := d.post(ctx, sub.URL, body, signature, payload.ID)
+		if err == nil {
+			return attempt, nil
+		}
+		if !retry || attempt > d.cfg.MaxRetries {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > d.cfg.MaxBackoff {
+			backoff = d.cfg.MaxBackoff
+		}
+	}
+}
+
+// post makes a single delivery attempt. It reports whether the failed attempt can be retried.
+func (d *Dispatcher) post(ctx context.Context, url string, body []byte, signature string, id string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("HashSHA256", signature)
+	req.Header.Set("X-Webhook-Delivery", id)
+
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// newClient returns the default client of the Dispatcher. Unless allowPrivate is set, it checks the address
+// every connection is made to after the host name is resolved, so a public name of a private address is refused too,
+// including on redirects.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || deniedIP(ip) {
+				return fmt.Errorf("%w: %s", errDeniedAddress, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// addDeadLetter keeps the failed delivery, dropping the oldest ones above MaxDeadLetters.
+func (d *Dispatcher) addDeadLetter(deadLetter DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetters = append(d.deadLetters, deadLetter)
+	if len(d.deadLetters) > d.cfg.MaxDeadLetters {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-d.cfg.MaxDeadLetters:]
+	}
+}
@@ -0,0 +1,263 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+	"github.com/luckyseadog/go-dev/internal/security"
+	"github.com/luckyseadog/go-dev/internal/storage"
+)
+
+// receiver is a webhook receiver which checks signatures and keeps the received payloads.
+type receiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	payloads []Payload
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(rc.t, err)
+	assert.Equal(rc.t, security.Hash(string(body), []byte(rc.secret)), r.Header.Get("HashSHA256"))
+
+	var payload Payload
+	assert.NoError(rc.t, json.Unmarshal(body, &payload))
+	assert.Equal(rc.t, payload.ID, r.Header.Get("X-Webhook-Delivery"))
+
+	rc.mu.Lock()
+	rc.payloads = append(rc.payloads, payload)
+	rc.mu.Unlock()
+}
+
+func (rc *receiver) received() []Payload {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Payload(nil), rc.payloads...)
+}
+
+func TestDispatcher_Batching(t *testing.T) {
+	rc := &receiver{t: t, secret: "secret"}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	s := storage.NewStorage(nil, time.Second)
+	dispatcher := NewDispatcher(Config{MaxBatch: 2, AllowPrivate: true})
+	s.Subscribe(dispatcher)
+	sub, err := dispatcher.Add(Subscription{URL: srv.URL, Secret: "secret", Metric: "Free*", Labels: map[string]string{"env": "prod"}})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	host1 := metrics.SeriesKey("FreeMemory", "host1", map[string]string{"env": "prod"})
+	host2 := metrics.SeriesKey("FreeMemory", "host2", map[string]string{"env": "prod"})
+	host3 := metrics.SeriesKey("FreeDisk", "host3", map[string]string{"env": "prod"})
+	require.NoError(t, s.StoreContext(ctx, host1, metrics.Gauge(1)))
+	require.NoError(t, s.StoreContext(ctx, host1, metrics.Gauge(2)))
+	require.NoError(t, s.StoreContext(ctx, host2, metrics.Gauge(3)))
+	require.NoError(t, s.StoreContext(ctx, host3, metrics.Gauge(4)))
+	require.NoError(t, s.StoreContext(ctx, metrics.SeriesKey("FreeMemory", "host4", map[string]string{"env": "dev"}), metrics.Gauge(5)))
+	require.NoError(t, s.StoreContext(ctx, metrics.Alloc, metrics.Gauge(6)))
+
+	dispatcher.Flush(ctx)
+	dispatcher.Wait()
+
+	values := map[metrics.Metric]float64{}
+	payloads := rc.received()
+	require.Len(t, payloads, 2)
+	for _, payload := range payloads {
+		require.Equal(t, sub.ID, payload.Subscription)
+		require.LessOrEqual(t, len(payload.Events), 2)
+		for _, event := range payload.Events {
+			values[event.Metric] = event.Value
+		}
+	}
+	require.Equal(t, map[metrics.Metric]float64{host1: 2, host2: 3, host3: 4}, values)
+
+	dispatcher.Flush(ctx)
+	dispatcher.Wait()
+	require.Len(t, rc.received(), 2)
+}
+
+func TestDispatcher_Threshold(t *testing.T) {
+	rc := &receiver{t: t, secret: "secret"}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	dispatcher := NewDispatcher(Config{AllowPrivate: true})
+	threshold := 10.0
+	_, err := dispatcher.Add(Subscription{URL: srv.URL, Secret: "secret", Metric: "PollCount", MType: "counter", Op: ">", Threshold: &threshold})
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i, value := range []float64{5, 11, 12, 3, 15} {
+		dispatcher.OnStore(storage.Update{Metric: metrics.PollCount, MType: "counter", Value: value, Timestamp: now.Add(time.Duration(i) * time.Second)})
+		dispatcher.Flush(context.Background())
+		dispatcher.Wait()
+	}
+
+	payloads := rc.received()
+	require.Len(t, payloads, 2)
+	require.Equal(t, 11.0, payloads[0].Events[0].Value)
+	require.Equal(t, 15.0, payloads[1].Events[0].Value)
+}
+
+func TestDispatcher_Retries(t *testing.T) {
+	rc := &receiver{t: t, secret: "secret"}
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rc.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	dispatcher := NewDispatcher(Config{MaxRetries: 3, RetryBackoff: time.Millisecond, AllowPrivate: true})
+	_, err := dispatcher.Add(Subscription{URL: srv.URL, Secret: "secret", Metric: "Alloc"})
+	require.NoError(t, err)
+
+	dispatcher.OnStore(storage.Update{Metric: metrics.Alloc, MType: "gauge", Value: 1, Timestamp: time.Now()})
+	dispatcher.Flush(context.Background())
+	dispatcher.Wait()
+
+	require.Equal(t, int32(3), calls.Load())
+	require.Len(t, rc.received(), 1)
+	require.Empty(t, dispatcher.DeadLetters())
+}
+
+func TestDispatcher_DeadLetters(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	dispatcher := NewDispatcher(Config{MaxRetries: 2, RetryBackoff: time.Millisecond, AllowPrivate: true})
+	failing, err := dispatcher.Add(Subscription{URL: srv.URL, Metric: "Alloc"})
+	require.NoError(t, err)
+	_, err = dispatcher.Add(Subscription{URL: rejecting.URL, Metric: "Alloc"})
+	require.NoError(t, err)
+
+	dispatcher.OnStore(storage.Update{Metric: metrics.Alloc, MType: "gauge", Value: 1, Timestamp: time.Now()})
+	dispatcher.Flush(context.Background())
+	dispatcher.Wait()
+
+	require.Equal(t, int32(3), calls.Load())
+	deadLetters := dispatcher.DeadLetters()
+	require.Len(t, deadLetters, 2)
+	attempts := map[string]int{}
+	for _, deadLetter := range deadLetters {
+		attempts[deadLetter.Subscription] = deadLetter.Attempts
+		require.Len(t, deadLetter.Payload.Events, 1)
+	}
+	require.Equal(t, 3, attempts[failing.ID])
+}
+
+func TestDispatcher_Subscriptions(t *testing.T) {
+	dispatcher := NewDispatcher(Config{})
+
+	_, err := dispatcher.Add(Subscription{URL: "ftp://example.com", Metric: "Alloc"})
+	require.Error(t, err)
+	_, err = dispatcher.Add(Subscription{URL: "http://example.com", Metric: "Alloc", Op: ">"})
+	require.Error(t, err)
+	_, err = dispatcher.Add(Subscription{URL: "http://example.com", Metric: "["})
+	require.Error(t, err)
+
+	sub, err := dispatcher.Add(Subscription{URL: "http://example.com", Metric: "Alloc"})
+	require.NoError(t, err)
+	require.NotEmpty(t, sub.ID)
+	require.NotEmpty(t, sub.Secret)
+
+	subs := dispatcher.Subscriptions()
+	require.Len(t, subs, 1)
+	require.Empty(t, subs[0].Secret)
+
+	require.NoError(t, dispatcher.Remove(sub.ID))
+	require.ErrorIs(t, dispatcher.Remove(sub.ID), ErrNoSuchSubscription)
+	require.Empty(t, dispatcher.Subscriptions())
+}
+
+func TestDispatcher_PrivateAddresses(t *testing.T) {
+	dispatcher := NewDispatcher(Config{})
+	for _, url := range []string{
+		"http://localhost:8080/hook",
+		"http://api.localhost/hook",
+		"http://127.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+	} {
+		_, err := dispatcher.Add(Subscription{URL: url, Metric: "Alloc"})
+		require.ErrorIs(t, err, errDeniedAddress, url)
+	}
+	_, err := dispatcher.Add(Subscription{URL: "https://93.184.216.34/hook", Metric: "Alloc"})
+	require.NoError(t, err)
+
+	_, err = NewDispatcher(Config{AllowPrivate: true}).Add(Subscription{URL: "http://127.0.0.1/hook", Metric: "Alloc"})
+	require.NoError(t, err)
+
+	// The default client checks the address it connects to, whatever the name of the host is.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, err = newClient(false).Post(srv.URL, "application/json", nil)
+	require.ErrorIs(t, err, errDeniedAddress)
+	resp, err := newClient(true).Post(srv.URL, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestDispatcher_SlowSubscription(t *testing.T) {
+	release := make(chan struct{})
+	var slowCalls atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowCalls.Add(1)
+		<-release
+	}))
+	defer slow.Close()
+	rc := &receiver{t: t, secret: "secret"}
+	fast := httptest.NewServer(rc)
+	defer fast.Close()
+
+	dispatcher := NewDispatcher(Config{AllowPrivate: true})
+	_, err := dispatcher.Add(Subscription{URL: slow.URL, Metric: "Alloc"})
+	require.NoError(t, err)
+	_, err = dispatcher.Add(Subscription{URL: fast.URL, Secret: "secret", Metric: "Alloc"})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// The fast subscription gets its payloads while the slow one is being delivered.
+	for _, value := range []float64{1, 2} {
+		dispatcher.OnStore(storage.Update{Metric: metrics.Alloc, MType: "gauge", Value: value, Timestamp: time.Now()})
+		dispatcher.Flush(ctx)
+		require.Eventually(t, func() bool { return len(rc.received()) == int(value) }, time.Second, 10*time.Millisecond)
+	}
+	require.Equal(t, int32(1), slowCalls.Load())
+
+	// The events of the slow subscription wait for its delivery and are sent with the next Flush.
+	close(release)
+	dispatcher.Wait()
+	dispatcher.Flush(ctx)
+	dispatcher.Wait()
+	require.Equal(t, int32(2), slowCalls.Load())
+	require.Empty(t, dispatcher.DeadLetters())
+}
@@ -0,0 +1,108 @@
+// Package webhooks provides outbound webhook subscriptions of the server.
+// A Dispatcher observes the writes to storage.Storage, collects the values of the subscribed metrics
+// into batches and POSTs them as signed JSON payloads to the URLs of the subscriptions.
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/luckyseadog/go-dev/internal/metrics"
+)
+
+var (
+	errInvalidSubscription = errors.New("invalid subscription")
+	errDeniedAddress       = errors.New("webhooks to loopback, private and link-local addresses are not allowed")
+)
+
+// Subscription describes which metrics are sent to the URL.
+// Metric is the name of the metric or a pattern in the syntax of path.Match, e.g. "Free*".
+// The stored series has to have all the Labels of the subscription.
+// If Threshold is set, an event is sent only when the value crosses it, i.e. when the condition
+// "value Op Threshold" becomes true for the series; otherwise every stored value is sent.
+//
+// The payload is signed with Secret by HMAC-SHA256, the signature is sent in the header HashSHA256.
+type Subscription struct {
+	ID        string            `json:"id"`
+	URL       string            `json:"url"`
+	Secret    string            `json:"secret,omitempty"`
+	Metric    string            `json:"metric"`
+	MType     string            `json:"type,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Op        string            `json:"op,omitempty"`
+	Threshold *float64          `json:"threshold,omitempty"`
+}
+
+// validate checks the subscription. Unless allowPrivate is set, the host of the URL may not be localhost
+// or a denied IP address, see deniedIP.
+func (s *Subscription) validate(allowPrivate bool) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("%w: invalid url", errInvalidSubscription)
+	}
+	if !allowPrivate {
+		host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+		if ip := net.ParseIP(host); host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && deniedIP(ip)) {
+			return fmt.Errorf("%w: %s", errDeniedAddress, u.Hostname())
+		}
+	}
+	if s.Metric == "" {
+		return fmt.Errorf("%w: metric is required", errInvalidSubscription)
+	}
+	if _, err := path.Match(s.Metric, ""); err != nil {
+		return fmt.Errorf("%w: invalid metric pattern", errInvalidSubscription)
+	}
+	if s.MType != "" && s.MType != "gauge" && s.MType != "counter" && s.MType != "histogram" {
+		return fmt.Errorf("%w: not allowed type %q", errInvalidSubscription, s.MType)
+	}
+	if err := metrics.ValidateLabels(s.Labels); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidSubscription, err)
+	}
+	if s.Threshold != nil {
+		if _, err := metrics.Compare(0, s.Op, *s.Threshold); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidSubscription, err)
+		}
+	} else if s.Op != "" {
+		return fmt.Errorf("%w: op without threshold", errInvalidSubscription)
+	}
+	return nil
+}
+
+// deniedIP reports whether the webhooks to the IP address are denied unless private addresses are allowed:
+// loopback, private, link-local, multicast and unspecified addresses are.
+func deniedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// matches reports whether the series of the given type, name and labels is sent to the subscription.
+func (s *Subscription) matches(mType string, name string, labels map[string]string) bool {
+	if s.MType != "" && s.MType != mType {
+		return false
+	}
+	if ok, _ := path.Match(s.Metric, name); !ok {
+		return false
+	}
+	for label, value := range s.Labels {
+		if labels[label] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// randomID returns a random hex string of n bytes.
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
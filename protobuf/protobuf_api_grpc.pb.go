@@ -20,7 +20,10 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	MetricsCollect_AddMetrics_FullMethodName = "/protobuf_api.MetricsCollect/AddMetrics"
+	MetricsCollect_AddMetrics_FullMethodName       = "/protobuf_api.MetricsCollect/AddMetrics"
+	MetricsCollect_StreamMetrics_FullMethodName    = "/protobuf_api.MetricsCollect/StreamMetrics"
+	MetricsCollect_ListAgents_FullMethodName       = "/protobuf_api.MetricsCollect/ListAgents"
+	MetricsCollect_RegisterMetadata_FullMethodName = "/protobuf_api.MetricsCollect/RegisterMetadata"
 )
 
 // MetricsCollectClient is the client API for MetricsCollect service.
@@ -28,6 +31,9 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MetricsCollectClient interface {
 	AddMetrics(ctx context.Context, in *AddMetricsRequest, opts ...grpc.CallOption) (*AddMetricsResponse, error)
+	StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (MetricsCollect_StreamMetricsClient, error)
+	ListAgents(ctx context.Context, in *ListAgentsRequest, opts ...grpc.CallOption) (*ListAgentsResponse, error)
+	RegisterMetadata(ctx context.Context, in *RegisterMetadataRequest, opts ...grpc.CallOption) (*RegisterMetadataResponse, error)
 }
 
 type metricsCollectClient struct {
@@ -47,11 +53,63 @@ func (c *metricsCollectClient) AddMetrics(ctx context.Context, in *AddMetricsReq
 	return out, nil
 }
 
+func (c *metricsCollectClient) StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (MetricsCollect_StreamMetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetricsCollect_ServiceDesc.Streams[0], MetricsCollect_StreamMetrics_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsCollectStreamMetricsClient{stream}
+	return x, nil
+}
+
+type MetricsCollect_StreamMetricsClient interface {
+	Send(*AddMetricsRequest) error
+	Recv() (*StreamMetricsAck, error)
+	grpc.ClientStream
+}
+
+type metricsCollectStreamMetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsCollectStreamMetricsClient) Send(m *AddMetricsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *metricsCollectStreamMetricsClient) Recv() (*StreamMetricsAck, error) {
+	m := new(StreamMetricsAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metricsCollectClient) ListAgents(ctx context.Context, in *ListAgentsRequest, opts ...grpc.CallOption) (*ListAgentsResponse, error) {
+	out := new(ListAgentsResponse)
+	err := c.cc.Invoke(ctx, MetricsCollect_ListAgents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsCollectClient) RegisterMetadata(ctx context.Context, in *RegisterMetadataRequest, opts ...grpc.CallOption) (*RegisterMetadataResponse, error) {
+	out := new(RegisterMetadataResponse)
+	err := c.cc.Invoke(ctx, MetricsCollect_RegisterMetadata_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetricsCollectServer is the server API for MetricsCollect service.
 // All implementations must embed UnimplementedMetricsCollectServer
 // for forward compatibility
 type MetricsCollectServer interface {
 	AddMetrics(context.Context, *AddMetricsRequest) (*AddMetricsResponse, error)
+	StreamMetrics(MetricsCollect_StreamMetricsServer) error
+	ListAgents(context.Context, *ListAgentsRequest) (*ListAgentsResponse, error)
+	RegisterMetadata(context.Context, *RegisterMetadataRequest) (*RegisterMetadataResponse, error)
 	mustEmbedUnimplementedMetricsCollectServer()
 }
 
@@ -62,6 +120,15 @@ type UnimplementedMetricsCollectServer struct {
 func (UnimplementedMetricsCollectServer) AddMetrics(context.Context, *AddMetricsRequest) (*AddMetricsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method AddMetrics not implemented")
 }
+func (UnimplementedMetricsCollectServer) StreamMetrics(MetricsCollect_StreamMetricsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamMetrics not implemented")
+}
+func (UnimplementedMetricsCollectServer) ListAgents(context.Context, *ListAgentsRequest) (*ListAgentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAgents not implemented")
+}
+func (UnimplementedMetricsCollectServer) RegisterMetadata(context.Context, *RegisterMetadataRequest) (*RegisterMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterMetadata not implemented")
+}
 func (UnimplementedMetricsCollectServer) mustEmbedUnimplementedMetricsCollectServer() {}
 
 // UnsafeMetricsCollectServer may be embedded to opt out of forward compatibility for this service.
@@ -93,6 +160,68 @@ func _MetricsCollect_AddMetrics_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetricsCollect_StreamMetrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MetricsCollectServer).StreamMetrics(&metricsCollectStreamMetricsServer{stream})
+}
+
+type MetricsCollect_StreamMetricsServer interface {
+	Send(*StreamMetricsAck) error
+	Recv() (*AddMetricsRequest, error)
+	grpc.ServerStream
+}
+
+type metricsCollectStreamMetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsCollectStreamMetricsServer) Send(m *StreamMetricsAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *metricsCollectStreamMetricsServer) Recv() (*AddMetricsRequest, error) {
+	m := new(AddMetricsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _MetricsCollect_ListAgents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAgentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsCollectServer).ListAgents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricsCollect_ListAgents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsCollectServer).ListAgents(ctx, req.(*ListAgentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsCollect_RegisterMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsCollectServer).RegisterMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricsCollect_RegisterMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsCollectServer).RegisterMetadata(ctx, req.(*RegisterMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetricsCollect_ServiceDesc is the grpc.ServiceDesc for MetricsCollect service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -104,7 +233,341 @@ var MetricsCollect_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "AddMetrics",
 			Handler:    _MetricsCollect_AddMetrics_Handler,
 		},
+		{
+			MethodName: "ListAgents",
+			Handler:    _MetricsCollect_ListAgents_Handler,
+		},
+		{
+			MethodName: "RegisterMetadata",
+			Handler:    _MetricsCollect_RegisterMetadata_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamMetrics",
+			Handler:       _MetricsCollect_StreamMetrics_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "protobuf/protobuf_api.proto",
+}
+
+const (
+	Alerts_ListAlerts_FullMethodName = "/protobuf_api.Alerts/ListAlerts"
+)
+
+// AlertsClient is the client API for Alerts service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AlertsClient interface {
+	ListAlerts(ctx context.Context, in *ListAlertsRequest, opts ...grpc.CallOption) (*ListAlertsResponse, error)
+}
+
+type alertsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAlertsClient(cc grpc.ClientConnInterface) AlertsClient {
+	return &alertsClient{cc}
+}
+
+func (c *alertsClient) ListAlerts(ctx context.Context, in *ListAlertsRequest, opts ...grpc.CallOption) (*ListAlertsResponse, error) {
+	out := new(ListAlertsResponse)
+	err := c.cc.Invoke(ctx, Alerts_ListAlerts_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AlertsServer is the server API for Alerts service.
+// All implementations must embed UnimplementedAlertsServer
+// for forward compatibility
+type AlertsServer interface {
+	ListAlerts(context.Context, *ListAlertsRequest) (*ListAlertsResponse, error)
+	mustEmbedUnimplementedAlertsServer()
+}
+
+// UnimplementedAlertsServer must be embedded to have forward compatible implementations.
+type UnimplementedAlertsServer struct {
+}
+
+func (UnimplementedAlertsServer) ListAlerts(context.Context, *ListAlertsRequest) (*ListAlertsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAlerts not implemented")
+}
+func (UnimplementedAlertsServer) mustEmbedUnimplementedAlertsServer() {}
+
+// UnsafeAlertsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AlertsServer will
+// result in compilation errors.
+type UnsafeAlertsServer interface {
+	mustEmbedUnimplementedAlertsServer()
+}
+
+func RegisterAlertsServer(s grpc.ServiceRegistrar, srv AlertsServer) {
+	s.RegisterService(&Alerts_ServiceDesc, srv)
+}
+
+func _Alerts_ListAlerts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAlertsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AlertsServer).ListAlerts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Alerts_ListAlerts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AlertsServer).ListAlerts(ctx, req.(*ListAlertsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Alerts_ServiceDesc is the grpc.ServiceDesc for Alerts service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Alerts_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "protobuf_api.Alerts",
+	HandlerType: (*AlertsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListAlerts",
+			Handler:    _Alerts_ListAlerts_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "protobuf/protobuf_api.proto",
 }
+
+const (
+	MetricsQuery_GetMetric_FullMethodName    = "/protobuf_api.MetricsQuery/GetMetric"
+	MetricsQuery_ListMetrics_FullMethodName  = "/protobuf_api.MetricsQuery/ListMetrics"
+	MetricsQuery_WatchMetrics_FullMethodName = "/protobuf_api.MetricsQuery/WatchMetrics"
+	MetricsQuery_ListMetadata_FullMethodName = "/protobuf_api.MetricsQuery/ListMetadata"
+)
+
+// MetricsQueryClient is the client API for MetricsQuery service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MetricsQueryClient interface {
+	GetMetric(ctx context.Context, in *GetMetricRequest, opts ...grpc.CallOption) (*GetMetricResponse, error)
+	ListMetrics(ctx context.Context, in *ListMetricsRequest, opts ...grpc.CallOption) (*ListMetricsResponse, error)
+	WatchMetrics(ctx context.Context, in *WatchMetricsRequest, opts ...grpc.CallOption) (MetricsQuery_WatchMetricsClient, error)
+	ListMetadata(ctx context.Context, in *ListMetadataRequest, opts ...grpc.CallOption) (*ListMetadataResponse, error)
+}
+
+type metricsQueryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMetricsQueryClient(cc grpc.ClientConnInterface) MetricsQueryClient {
+	return &metricsQueryClient{cc}
+}
+
+func (c *metricsQueryClient) GetMetric(ctx context.Context, in *GetMetricRequest, opts ...grpc.CallOption) (*GetMetricResponse, error) {
+	out := new(GetMetricResponse)
+	err := c.cc.Invoke(ctx, MetricsQuery_GetMetric_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsQueryClient) ListMetrics(ctx context.Context, in *ListMetricsRequest, opts ...grpc.CallOption) (*ListMetricsResponse, error) {
+	out := new(ListMetricsResponse)
+	err := c.cc.Invoke(ctx, MetricsQuery_ListMetrics_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsQueryClient) WatchMetrics(ctx context.Context, in *WatchMetricsRequest, opts ...grpc.CallOption) (MetricsQuery_WatchMetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetricsQuery_ServiceDesc.Streams[0], MetricsQuery_WatchMetrics_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsQueryWatchMetricsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetricsQuery_WatchMetricsClient interface {
+	Recv() (*Metric, error)
+	grpc.ClientStream
+}
+
+type metricsQueryWatchMetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsQueryWatchMetricsClient) Recv() (*Metric, error) {
+	m := new(Metric)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metricsQueryClient) ListMetadata(ctx context.Context, in *ListMetadataRequest, opts ...grpc.CallOption) (*ListMetadataResponse, error) {
+	out := new(ListMetadataResponse)
+	err := c.cc.Invoke(ctx, MetricsQuery_ListMetadata_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MetricsQueryServer is the server API for MetricsQuery service.
+// All implementations must embed UnimplementedMetricsQueryServer
+// for forward compatibility
+type MetricsQueryServer interface {
+	GetMetric(context.Context, *GetMetricRequest) (*GetMetricResponse, error)
+	ListMetrics(context.Context, *ListMetricsRequest) (*ListMetricsResponse, error)
+	WatchMetrics(*WatchMetricsRequest, MetricsQuery_WatchMetricsServer) error
+	ListMetadata(context.Context, *ListMetadataRequest) (*ListMetadataResponse, error)
+	mustEmbedUnimplementedMetricsQueryServer()
+}
+
+// UnimplementedMetricsQueryServer must be embedded to have forward compatible implementations.
+type UnimplementedMetricsQueryServer struct {
+}
+
+func (UnimplementedMetricsQueryServer) GetMetric(context.Context, *GetMetricRequest) (*GetMetricResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMetric not implemented")
+}
+func (UnimplementedMetricsQueryServer) ListMetrics(context.Context, *ListMetricsRequest) (*ListMetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMetrics not implemented")
+}
+func (UnimplementedMetricsQueryServer) WatchMetrics(*WatchMetricsRequest, MetricsQuery_WatchMetricsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchMetrics not implemented")
+}
+func (UnimplementedMetricsQueryServer) ListMetadata(context.Context, *ListMetadataRequest) (*ListMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMetadata not implemented")
+}
+func (UnimplementedMetricsQueryServer) mustEmbedUnimplementedMetricsQueryServer() {}
+
+// UnsafeMetricsQueryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MetricsQueryServer will
+// result in compilation errors.
+type UnsafeMetricsQueryServer interface {
+	mustEmbedUnimplementedMetricsQueryServer()
+}
+
+func RegisterMetricsQueryServer(s grpc.ServiceRegistrar, srv MetricsQueryServer) {
+	s.RegisterService(&MetricsQuery_ServiceDesc, srv)
+}
+
+func _MetricsQuery_GetMetric_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMetricRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsQueryServer).GetMetric(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricsQuery_GetMetric_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsQueryServer).GetMetric(ctx, req.(*GetMetricRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsQuery_ListMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsQueryServer).ListMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricsQuery_ListMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsQueryServer).ListMetrics(ctx, req.(*ListMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsQuery_WatchMetrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchMetricsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricsQueryServer).WatchMetrics(m, &metricsQueryWatchMetricsServer{stream})
+}
+
+type MetricsQuery_WatchMetricsServer interface {
+	Send(*Metric) error
+	grpc.ServerStream
+}
+
+type metricsQueryWatchMetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsQueryWatchMetricsServer) Send(m *Metric) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MetricsQuery_ListMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsQueryServer).ListMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricsQuery_ListMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsQueryServer).ListMetadata(ctx, req.(*ListMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MetricsQuery_ServiceDesc is the grpc.ServiceDesc for MetricsQuery service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MetricsQuery_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "protobuf_api.MetricsQuery",
+	HandlerType: (*MetricsQueryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetMetric",
+			Handler:    _MetricsQuery_GetMetric_Handler,
+		},
+		{
+			MethodName: "ListMetrics",
+			Handler:    _MetricsQuery_ListMetrics_Handler,
+		},
+		{
+			MethodName: "ListMetadata",
+			Handler:    _MetricsQuery_ListMetadata_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchMetrics",
+			Handler:       _MetricsQuery_WatchMetrics_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "protobuf/protobuf_api.proto",
+}